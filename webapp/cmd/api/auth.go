@@ -1,25 +1,59 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/securetoken"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
 
 var jwtTokenExpiry time.Duration = time.Minute * 15
 var refreshTokenExpiry time.Duration = time.Hour * 24
+var mfaTokenExpiry time.Duration = time.Minute * 5
+
+// mfaPurpose marks the tokens handed out by authenticate to users who still have
+// to give a two-factor code. They can't be used for anything else.
+const mfaPurpose = "mfa"
+
+// oauthRefreshPurpose marks the refresh tokens issued to OAuth clients, so they
+// can only be used at /oauth/token and not at the browser's refresh endpoints.
+const oauthRefreshPurpose = "oauth_refresh"
 
 type TokenPairs struct {
 	Token        string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
 }
 
+// MFAChallenge is returned by authenticate instead of TokenPairs when the user
+// has two-factor authentication enabled.
+type MFAChallenge struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+}
+
 type Claims struct {
 	UserName string `json:"name"`
+
+	// Purpose is empty for access and refresh tokens, mfaPurpose for the tokens
+	// that stand in for them until a two-factor code is given, and
+	// oauthRefreshPurpose for refresh tokens issued to OAuth clients.
+	Purpose string `json:"purpose,omitempty"`
+
+	// ClientID and Scope are set on tokens issued to OAuth clients, which may
+	// only do what the space separated scopes allow.
+	ClientID string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+
+	// SessionID is the session a user's own login belongs to; logging the
+	// session out invalidates its tokens. Tokens issued before sessions were
+	// recorded have none.
+	SessionID int `json:"sid,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -51,6 +85,19 @@ func (app *application) getTokenFromHeaderAndVerify(w http.ResponseWriter, r *ht
 
 	token := headerParts[1]
 
+	claims, err := app.parseAccessToken(token)
+	if err != nil {
+		return "", nil, err
+	}
+
+	//valid token
+	return token, claims, nil
+}
+
+// parseAccessToken checks the signature, expiry, issuer and purpose of an access
+// token we issued, and returns its claims. It doesn't check whether the token has
+// been revoked since.
+func (app *application) parseAccessToken(token string) (*Claims, error) {
 	// declare an empty Claims variable
 	claims := &Claims{}
 
@@ -67,21 +114,42 @@ func (app *application) getTokenFromHeaderAndVerify(w http.ResponseWriter, r *ht
 	// check for an error; note that this catches expired tokens as well.
 	if err != nil {
 		if strings.HasPrefix(err.Error(), "token is expired by") {
-			return "", nil, errors.New("expired token")
+			return nil, errors.New("expired token")
 		}
-		return "", nil, err
+		return nil, err
 	}
 
 	// make sure that we issued this token
 	if claims.Issuer != app.Domain {
-		return "", nil, errors.New("incorrect issuer")
+		return nil, errors.New("incorrect issuer")
 	}
 
-	//valid token
-	return token, claims, nil
+	// a token waiting for a two-factor code is not an access token
+	if claims.Purpose != "" {
+		return nil, errors.New("not an access token")
+	}
+
+	return claims, nil
+}
+
+// tokenGrant limits the tokens made by generateGrantedTokenPair to what an OAuth
+// client was granted. Without a ClientID it is a user's own, unlimited login,
+// which belongs to the session SessionID.
+type tokenGrant struct {
+	ClientID  string
+	Scopes    []string
+	SessionID int
 }
 
 func (app *application) generateTokenPair(user *data.User) (TokenPairs, error) {
+	return app.generateGrantedTokenPair(user, tokenGrant{})
+}
+
+// generateGrantedTokenPair makes the tokens for user, limited by grant when it
+// names a client.
+func (app *application) generateGrantedTokenPair(user *data.User, grant tokenGrant) (TokenPairs, error) {
+	var err error
+
 	// Create the token.
 	token := jwt.New(jwt.SigningMethodHS256)
 
@@ -96,8 +164,22 @@ func (app *application) generateTokenPair(user *data.User) (TokenPairs, error) {
 	} else {
 		claims["admin"] = false
 	}
+	if grant.ClientID != "" {
+		claims["client_id"] = grant.ClientID
+		claims["scope"] = strings.Join(grant.Scopes, " ")
+	}
+	if grant.SessionID != 0 {
+		claims["sid"] = grant.SessionID
+	}
 
-	// set the expiry
+	// give the token an id, so it can be revoked on its own
+	claims["jti"], err = newTokenID()
+	if err != nil {
+		return TokenPairs{}, err
+	}
+
+	// set the issue time, so tokens can be revoked, and the expiry
+	claims["iat"] = time.Now().Unix()
 	claims["exp"] = time.Now().Add(jwtTokenExpiry).Unix()
 
 	// create the signed token
@@ -110,8 +192,22 @@ func (app *application) generateTokenPair(user *data.User) (TokenPairs, error) {
 	refreshToken := jwt.New(jwt.SigningMethodHS256)
 	refreshTokenClaims := refreshToken.Claims.(jwt.MapClaims)
 	refreshTokenClaims["sub"] = fmt.Sprint(user.ID)
+	refreshTokenClaims["jti"], err = newTokenID()
+	if err != nil {
+		return TokenPairs{}, err
+	}
+	refreshTokenClaims["iat"] = time.Now().Unix()
 	// set the expiry; must be longer than jwt expiry
 	refreshTokenClaims["exp"] = time.Now().Add(refreshTokenExpiry).Unix()
+	if grant.ClientID != "" {
+		refreshTokenClaims["iss"] = app.Domain
+		refreshTokenClaims["purpose"] = oauthRefreshPurpose
+		refreshTokenClaims["client_id"] = grant.ClientID
+		refreshTokenClaims["scope"] = strings.Join(grant.Scopes, " ")
+	}
+	if grant.SessionID != 0 {
+		refreshTokenClaims["sid"] = grant.SessionID
+	}
 
 	// create signed refresh token
 	signedRefreshToken, err := refreshToken.SignedString([]byte(app.JWTSecret))
@@ -124,3 +220,146 @@ func (app *application) generateTokenPair(user *data.User) (TokenPairs, error) {
 		RefreshToken: signedRefreshToken,
 	}, nil
 }
+
+// generateMFAToken returns a short-lived token that proves the user gave the
+// right password, for authenticateMFA.
+func (app *application) generateMFAToken(user *data.User) (string, error) {
+	token := jwt.New(jwt.SigningMethodHS256)
+
+	claims := token.Claims.(jwt.MapClaims)
+	claims["sub"] = fmt.Sprint(user.ID)
+	claims["aud"] = app.Domain
+	claims["iss"] = app.Domain
+	claims["purpose"] = mfaPurpose
+	claims["iat"] = time.Now().Unix()
+	claims["exp"] = time.Now().Add(mfaTokenExpiry).Unix()
+
+	return token.SignedString([]byte(app.JWTSecret))
+}
+
+// verifyMFAToken checks a token from generateMFAToken and returns the user it was
+// issued to.
+func (app *application) verifyMFAToken(ctx context.Context, token string) (*data.User, error) {
+	claims, err := app.parsePurposeToken(token, mfaPurpose)
+	if err != nil {
+		return nil, err
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := app.DB.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if tokenRevoked(claims, user) {
+		return nil, errors.New("two-factor token has been revoked")
+	}
+
+	return user, nil
+}
+
+// parsePurposeToken checks a token we issued for purpose, and returns its claims.
+func (app *application) parsePurposeToken(token, purpose string) (*Claims, error) {
+	claims := &Claims{}
+
+	_, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (any, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		return []byte(app.JWTSecret), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Issuer != app.Domain || claims.Purpose != purpose {
+		return nil, fmt.Errorf("not a %s token", purpose)
+	}
+
+	return claims, nil
+}
+
+// errNotRefreshToken is returned by parseRefreshToken for tokens we signed that
+// are meant for something else.
+var errNotRefreshToken = errors.New("not a refresh token")
+
+// parseRefreshToken checks the signature and expiry of a refresh token from a
+// user's own login, and returns its claims. Access, MFA and OAuth tokens are
+// refused with errNotRefreshToken; OAuth clients refresh theirs at /oauth/token,
+// keeping their scopes. It doesn't check whether the token has been revoked.
+func (app *application) parseRefreshToken(token string) (*Claims, error) {
+	claims := &Claims{}
+
+	_, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (any, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		return []byte(app.JWTSecret), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// every refresh token we issue expires
+	if claims.ExpiresAt == nil {
+		return nil, errors.New("refresh token has no expiry")
+	}
+
+	// only the other tokens carry a purpose, client, issuer or audience
+	if claims.Purpose != "" || claims.ClientID != "" || claims.Issuer != "" || len(claims.Audience) > 0 {
+		return nil, errNotRefreshToken
+	}
+
+	return claims, nil
+}
+
+// setRefreshCookie stores the refresh token in a secure, HTTP only cookie, for
+// the browser client.
+func (app *application) setRefreshCookie(w http.ResponseWriter, refreshToken string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "_Host-refresh_token",
+		Path:     "/",
+		Value:    refreshToken,
+		Domain:   "localhost",
+		Expires:  time.Now().Add(refreshTokenExpiry),
+		MaxAge:   int(refreshTokenExpiry.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// newTokenID returns a random id for the jti claim, by which a token can be
+// revoked on its own.
+func newTokenID() (string, error) {
+	id, _, err := securetoken.New()
+	return id, err
+}
+
+// tokenIDRevoked reports whether the token itself was revoked, e.g. at
+// /oauth/revoke. Tokens without an id predate revocation and can't have been.
+func (app *application) tokenIDRevoked(ctx context.Context, claims *Claims) (bool, error) {
+	if claims.ID == "" {
+		return false, nil
+	}
+
+	return app.DB.TokenIDRevoked(ctx, claims.ID)
+}
+
+// tokenRevoked reports whether a token was issued before the user's sessions were
+// revoked, e.g. by a password reset. JWT times only have second precision, so the
+// revocation time is rounded down to the second.
+func tokenRevoked(claims *Claims, user *data.User) bool {
+	var issuedAt time.Time
+	if claims.IssuedAt != nil {
+		issuedAt = claims.IssuedAt.Time
+	}
+
+	return issuedAt.Before(user.SessionsRevokedAt.Truncate(time.Second))
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/imaging"
+	"github.com/spacesedan/testing-course/webapp/pkg/storage"
+	"github.com/spacesedan/testing-course/webapp/pkg/upload"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// multipartOverhead is how much larger than the picture a multipart upload may
+// be, for its headers and boundaries.
+const multipartOverhead = 64 << 10
+
+// avatarURL returns where the user's profile picture is served, or an empty
+// string if they have none.
+func avatarURL(user *data.User) string {
+	if user.ProfilePic.FileName == "" {
+		return ""
+	}
+	return fmt.Sprintf("/users/%d/avatar", user.ID)
+}
+
+// withAvatarURLs sets the AvatarURL of users, for writing them as JSON.
+func withAvatarURLs(users ...*data.User) {
+	for _, u := range users {
+		u.AvatarURL = avatarURL(u)
+	}
+}
+
+// avatarUser returns the user whose profile picture the request is for. If
+// ownerOnly, the logged in user must be that user or an administrator. It writes
+// the error response and returns nil if the request can't go ahead.
+func (app *application) avatarUser(w http.ResponseWriter, r *http.Request, ownerOnly bool) *data.User {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return nil
+	}
+
+	if ownerOnly {
+		current := app.userFromContext(r)
+		if current.ID != userID && current.IsAdmin != 1 {
+			app.errorJSON(w, errors.New("you may only manage your own profile pictures"), http.StatusForbidden)
+			return nil
+		}
+	}
+
+	user, err := app.DB.GetUser(r.Context(), userID)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return nil
+	}
+
+	return user
+}
+
+// getAvatar serves a user's profile picture, at the size given by the size query
+// parameter, or the largest. Browsers may keep it, but must check it is still
+// current before using it, since a new picture has the same URL.
+func (app *application) getAvatar(w http.ResponseWriter, r *http.Request) {
+	user := app.avatarUser(w, r, false)
+	if user == nil {
+		return
+	}
+
+	if user.ProfilePic.FileName == "" {
+		app.errorJSON(w, errors.New("user has no profile picture"), http.StatusNotFound)
+		return
+	}
+
+	app.serveAvatar(w, r, user.ProfilePic)
+}
+
+// serveAvatar serves image at the size given by the size query parameter, or
+// the largest.
+func (app *application) serveAvatar(w http.ResponseWriter, r *http.Request, image data.UserImage) {
+	size := data.ImageSizes[len(data.ImageSizes)-1]
+	if s := r.URL.Query().Get("size"); s != "" {
+		var err error
+		size, err = strconv.Atoi(s)
+		if err != nil || !validAvatarSize(size) {
+			app.errorJSON(w, fmt.Errorf("size must be one of %v", data.ImageSizes), http.StatusBadRequest)
+			return
+		}
+	}
+
+	blob, err := app.Blobs.Get(r.Context(), image.Variant(size))
+	if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrInvalidKey) {
+		// pictures from before they were resized only come in one size
+		blob, err = app.Blobs.Get(r.Context(), image.FileName)
+	}
+	if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrInvalidKey) {
+		app.errorJSON(w, errors.New("profile picture is missing"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	storage.ServeBlob(w, r, blob)
+}
+
+// validAvatarSize reports whether profile pictures are made in size.
+func validAvatarSize(size int) bool {
+	for _, s := range data.ImageSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// putAvatar sets a user's profile picture, replacing the one they had. The
+// picture is either the body of the request, or the image field of a multipart
+// form. It must be a JPEG, PNG, GIF or WebP image of at most 5 MB, and is
+// stored cropped to a square in each of data.ImageSizes.
+func (app *application) putAvatar(w http.ResponseWriter, r *http.Request) {
+	user := app.avatarUser(w, r, true)
+	if user == nil {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, upload.DefaultMaxFileSize+multipartOverhead)
+
+	var body io.Reader = r.Body
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		file, _, err := r.FormFile("image")
+		if err != nil {
+			app.errorJSON(w, fmt.Errorf("reading the image field: %w", err), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+
+	// read it all first, so that a broken upload isn't mistaken for a failure to
+	// store it
+	image, err := io.ReadAll(io.LimitReader(body, upload.DefaultMaxFileSize+1))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	file, err := upload.Save(r.Context(), app.Blobs, bytes.NewReader(image), upload.DefaultMaxFileSize)
+	switch {
+	case errors.Is(err, upload.ErrEmpty):
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	case errors.Is(err, upload.ErrFileTooLarge):
+		app.errorJSON(w, err, http.StatusRequestEntityTooLarge)
+		return
+	case errors.Is(err, upload.ErrNotImage):
+		app.errorJSON(w, err, http.StatusUnsupportedMediaType)
+		return
+	case err != nil:
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	fileName, err := imaging.Store(r.Context(), app.Blobs, file.Key)
+	switch {
+	case errors.Is(err, imaging.ErrUnsupported), errors.Is(err, imaging.ErrTooManyPixels):
+		app.errorJSON(w, err, http.StatusUnsupportedMediaType)
+		return
+	case err != nil:
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	_, err = app.DB.InsertUserImage(r.Context(), data.UserImage{UserID: user.ID, FileName: fileName})
+	if err != nil {
+		imaging.Remove(r.Context(), app.Blobs, fileName)
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	user.ProfilePic.FileName = fileName
+	withAvatarURLs(user)
+	_ = app.writeJSON(w, http.StatusOK, user)
+}
+
+// deleteAvatar leaves a user without a profile picture. The picture stays in
+// their history, so they can choose it again.
+func (app *application) deleteAvatar(w http.ResponseWriter, r *http.Request) {
+	user := app.avatarUser(w, r, true)
+	if user == nil {
+		return
+	}
+
+	err := app.DB.ClearCurrentUserImage(r.Context(), user.ID)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// avatarHistoryURL returns where the API serves one of the user's profile
+// pictures, current or not.
+func avatarHistoryURL(image *data.UserImage) string {
+	return fmt.Sprintf("/users/%d/avatars/%d", image.UserID, image.ID)
+}
+
+// allAvatars lists every profile picture a user has had and not deleted, newest
+// first, and which one is current.
+func (app *application) allAvatars(w http.ResponseWriter, r *http.Request) {
+	user := app.avatarUser(w, r, true)
+	if user == nil {
+		return
+	}
+
+	images, err := app.DB.AllUserImages(r.Context(), user.ID)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	for _, i := range images {
+		i.URL = avatarHistoryURL(i)
+	}
+	if images == nil {
+		images = []*data.UserImage{}
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, images)
+}
+
+// avatarImage returns the profile picture from the user's history that the
+// request is for. It writes the error response and returns nil if there is no
+// such picture.
+func (app *application) avatarImage(w http.ResponseWriter, r *http.Request, user *data.User) *data.UserImage {
+	imageID, err := strconv.Atoi(chi.URLParam(r, "imageID"))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return nil
+	}
+
+	images, err := app.DB.AllUserImages(r.Context(), user.ID)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return nil
+	}
+
+	for _, i := range images {
+		if i.ID == imageID {
+			return i
+		}
+	}
+
+	app.errorJSON(w, errors.New("profile picture not found"), http.StatusNotFound)
+	return nil
+}
+
+// getPastAvatar serves one of the profile pictures in a user's history, like
+// getAvatar serves the current one.
+func (app *application) getPastAvatar(w http.ResponseWriter, r *http.Request) {
+	user := app.avatarUser(w, r, true)
+	if user == nil {
+		return
+	}
+
+	image := app.avatarImage(w, r, user)
+	if image == nil {
+		return
+	}
+
+	app.serveAvatar(w, r, *image)
+}
+
+// chooseAvatar makes a picture from a user's history their profile picture
+// again.
+func (app *application) chooseAvatar(w http.ResponseWriter, r *http.Request) {
+	user := app.avatarUser(w, r, true)
+	if user == nil {
+		return
+	}
+
+	imageID, err := strconv.Atoi(chi.URLParam(r, "imageID"))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	err = app.DB.SetCurrentUserImage(r.Context(), user.ID, imageID)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	user, err = app.DB.GetUser(r.Context(), user.ID)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	withAvatarURLs(user)
+	_ = app.writeJSON(w, http.StatusOK, user)
+}
+
+// deletePastAvatar deletes a picture from a user's history; if it is their
+// profile picture, they are left without one. Its blobs are removed by the
+// image garbage collector.
+func (app *application) deletePastAvatar(w http.ResponseWriter, r *http.Request) {
+	user := app.avatarUser(w, r, true)
+	if user == nil {
+		return
+	}
+
+	imageID, err := strconv.Atoi(chi.URLParam(r, "imageID"))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	err = app.DB.DeleteUserImage(r.Context(), user.ID, imageID)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
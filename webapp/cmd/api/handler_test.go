@@ -1,13 +1,34 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/spacesedan/testing-course/webapp/pkg/accesstoken"
 	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/mailer"
+	"github.com/spacesedan/testing-course/webapp/pkg/oauth"
+	"github.com/spacesedan/testing-course/webapp/pkg/oidc"
+	"github.com/spacesedan/testing-course/webapp/pkg/sessions"
+	"github.com/spacesedan/testing-course/webapp/pkg/storage"
+	"github.com/spacesedan/testing-course/webapp/pkg/totp"
+	"github.com/spacesedan/testing-course/webapp/pkg/twofactor"
+	"github.com/spacesedan/testing-course/webapp/pkg/upload"
+	"image"
+	"image/png"
 	"io"
+	"math/big"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -20,6 +41,7 @@ func TestApplication_authenticate(t *testing.T) {
 		expectedStatusCode int
 	}{
 		{"valid user", `{"email": "admin@example.com", "password": "secret"}`, http.StatusOK},
+		{"valid user mixed case email", `{"email": "Admin@Example.COM", "password": "secret"}`, http.StatusOK},
 		{"empty email", `{"email": "", "password": "secret"}`, http.StatusUnauthorized},
 		{"empty password", `{"email": "admin@example.com", "password": ""}`, http.StatusUnauthorized},
 		{"not JSON", `I'm not JSON'`, http.StatusUnauthorized},
@@ -43,6 +65,32 @@ func TestApplication_authenticate(t *testing.T) {
 }
 
 func TestApplication_refresh(t *testing.T) {
+	testUser := data.User{
+		ID:        1,
+		FirstName: "Admin",
+		LastName:  "User",
+		Email:     "admin@example.com",
+	}
+
+	sign := func(claims jwt.MapClaims, secret string) string {
+		t.Helper()
+
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	soon := time.Now().Add(10 * time.Second).Unix()
+	issued, _ := app.generateTokenPair(&testUser)
+
+	// a token whose payload was swapped for one naming another user keeps the
+	// original signature
+	parts := strings.Split(sign(jwt.MapClaims{"sub": "1", "exp": soon}, app.JWTSecret), ".")
+	parts[1] = strings.Split(sign(jwt.MapClaims{"sub": "2", "exp": soon}, app.JWTSecret), ".")[1]
+	tampered := strings.Join(parts, ".")
+
 	tests := []struct {
 		name               string
 		token              string
@@ -52,13 +100,10 @@ func TestApplication_refresh(t *testing.T) {
 		{"valid", "", http.StatusOK, true},
 		{"valid but not yet ready to expire", "", http.StatusTooEarly, false},
 		{"expired token", expiredToken, http.StatusBadRequest, false},
-	}
-
-	testUser := data.User{
-		ID:        1,
-		FirstName: "Admin",
-		LastName:  "User",
-		Email:     "admin@example.com",
+		{"tampered token", tampered, http.StatusBadRequest, false},
+		{"wrong secret", sign(jwt.MapClaims{"sub": "1", "exp": soon}, "not the secret"), http.StatusBadRequest, false},
+		{"no expiry", sign(jwt.MapClaims{"sub": "1"}, app.JWTSecret), http.StatusBadRequest, false},
+		{"access token", issued.Token, http.StatusUnauthorized, false},
 	}
 
 	oldRefreshTime := refreshTokenExpiry
@@ -96,6 +141,9 @@ func TestApplication_refresh(t *testing.T) {
 }
 
 func TestApplication_userHandlers(t *testing.T) {
+	// the cases run in order against one repository, so user 1 is deleted last
+	memApp, _ := newMemApp(t)
+
 	tests := []struct {
 		name           string
 		method         string
@@ -104,18 +152,18 @@ func TestApplication_userHandlers(t *testing.T) {
 		handler        http.HandlerFunc
 		expectedStatus int
 	}{
-		{"allUsers", http.MethodGet, "", "", app.allUsers, http.StatusOK},
-		{"deleteUser", http.MethodDelete, "", "1", app.deleteUser, http.StatusNoContent},
-		{"deleteUser invalid param", http.MethodDelete, "", "one", app.deleteUser, http.StatusBadRequest},
-		{"getUser valid", http.MethodGet, "", "1", app.getUser, http.StatusOK},
-		{"getUser invalid", http.MethodGet, "", "2", app.getUser, http.StatusBadRequest},
-		{"getUser invalid param", http.MethodGet, "", "one", app.getUser, http.StatusBadRequest},
+		{"allUsers", http.MethodGet, "", "", memApp.allUsers, http.StatusOK},
+		{"deleteUser invalid param", http.MethodDelete, "", "one", memApp.deleteUser, http.StatusBadRequest},
+		{"deleteUser not found", http.MethodDelete, "", "2", memApp.deleteUser, http.StatusNotFound},
+		{"getUser valid", http.MethodGet, "", "1", memApp.getUser, http.StatusOK},
+		{"getUser invalid", http.MethodGet, "", "2", memApp.getUser, http.StatusNotFound},
+		{"getUser invalid param", http.MethodGet, "", "one", memApp.getUser, http.StatusBadRequest},
 		{
 			"updateUser valid",
 			http.MethodPatch,
 			`{"id": 1, "first_name": "Admin", "last_name": "User", "email": "admin@example.com"}`,
 			"",
-			app.updateUser,
+			memApp.updateUser,
 			http.StatusNoContent,
 		},
 		{
@@ -123,31 +171,55 @@ func TestApplication_userHandlers(t *testing.T) {
 			http.MethodPatch,
 			`{"id": 2, "first_name": "INVALID", "last_name": "USER", "email": "INVALID@USER.com"}`,
 			"",
-			app.updateUser,
-			http.StatusBadRequest,
+			memApp.updateUser,
+			http.StatusNotFound,
 		},
 		{
 			"updateUser invalid json",
 			http.MethodPatch,
 			`{"id": 2, first_name: "INVALID", "last_name": "USER", "email": "INVALID@USER.com"}`,
 			"",
-			app.updateUser,
+			memApp.updateUser,
 			http.StatusBadRequest,
 		},
 		{
 			"insertUser valid",
 			http.MethodPut,
-			`{"first_name": "jack", "last_name": "smith", "email": "jack@example.com"}`,
+			`{"first_name": "jack", "last_name": "smith", "email": "jack@example.com", "password": "correct horse 42"}`,
 			"",
-			app.insertUser,
+			memApp.insertUser,
 			http.StatusNoContent,
 		},
+		{
+			"insertUser weak password",
+			http.MethodPut,
+			`{"first_name": "jack", "last_name": "smith", "email": "jack@example.com", "password": "secret"}`,
+			"",
+			memApp.insertUser,
+			http.StatusBadRequest,
+		},
+		{
+			"insertUser missing password",
+			http.MethodPut,
+			`{"first_name": "jack", "last_name": "smith", "email": "jack@example.com"}`,
+			"",
+			memApp.insertUser,
+			http.StatusBadRequest,
+		},
+		{
+			"insertUser duplicate email",
+			http.MethodPut,
+			`{"first_name": "Admin", "last_name": "User", "email": "ADMIN@example.com", "password": "correct horse 42"}`,
+			"",
+			memApp.insertUser,
+			http.StatusConflict,
+		},
 		{
 			"insertUser invalid",
 			http.MethodPut,
 			`{"foo": "bar", "first_name": "jack", "last_name": "smith", "email": "jack@example.com"}`,
 			"",
-			app.insertUser,
+			memApp.insertUser,
 			http.StatusBadRequest,
 		},
 		{
@@ -155,9 +227,10 @@ func TestApplication_userHandlers(t *testing.T) {
 			http.MethodPut,
 			`{"first_name: "jack", "last_name": "smith", "email": "jack@example.com"}`,
 			"",
-			app.insertUser,
+			memApp.insertUser,
 			http.StatusBadRequest,
 		},
+		{"deleteUser", http.MethodDelete, "", "1", memApp.deleteUser, http.StatusNoContent},
 	}
 
 	for _, e := range tests {
@@ -219,6 +292,10 @@ func TestApplication_refreshUsingCookie(t *testing.T) {
 		Secure:   true,
 	}
 
+	noExpiry, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "1"}).SignedString([]byte(app.JWTSecret))
+	noExpiryCookie := &http.Cookie{Name: "_Host-refresh_token", Value: noExpiry}
+	accessCookie := &http.Cookie{Name: "_Host-refresh_token", Value: tokens.Token}
+
 	tests := []struct {
 		name           string
 		addCookie      bool
@@ -227,6 +304,8 @@ func TestApplication_refreshUsingCookie(t *testing.T) {
 	}{
 		{"valid cookie", true, testCookie, http.StatusOK},
 		{"invalid cookie", true, badCookie, http.StatusBadRequest},
+		{"no expiry", true, noExpiryCookie, http.StatusBadRequest},
+		{"access token", true, accessCookie, http.StatusUnauthorized},
 		{"no cookie", false, nil, http.StatusUnauthorized},
 	}
 
@@ -247,6 +326,35 @@ func TestApplication_refreshUsingCookie(t *testing.T) {
 	}
 }
 
+func TestApplication_refreshRevokedToken(t *testing.T) {
+	memApp, repo := newMemApp(t)
+
+	user, err := repo.GetUser(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, _ := memApp.generateTokenPair(user)
+	claims, err := memApp.parseRefreshToken(tokens.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo.RevokeTokenID(context.Background(), claims.ID, claims.ExpiresAt.Time)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: "_Host-refresh_token", Value: tokens.RefreshToken})
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(memApp.refreshUsingCookie).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected a revoked refresh token to be refused, but got %d", rr.Code)
+	}
+}
+
 func TestApplication_deleteRefreshCookie(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/logout", nil)
 	rr := httptest.NewRecorder()
@@ -271,3 +379,1381 @@ func TestApplication_deleteRefreshCookie(t *testing.T) {
 		t.Errorf("_Host-refresh_token cookie not found")
 	}
 }
+
+func TestApplication_userHandlersChangeState(t *testing.T) {
+	memApp, repo := newMemApp(t)
+
+	req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(`{"first_name": "jack", "last_name": "smith", "email": "Jack@Example.com", "password": "correct horse 42"}`))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(memApp.insertUser).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("insertUser: wrong status returned; expected %d, but got %d", http.StatusNoContent, rr.Code)
+	}
+
+	user, err := repo.GetUserByEmail(context.Background(), "jack@example.com")
+	if err != nil {
+		t.Fatalf("insertUser did not store the user: %s", err)
+	}
+
+	if matches, _ := user.PasswordMatches("correct horse 42"); !matches {
+		t.Error("insertUser did not store the password from the request")
+	}
+
+	chiCtx := chi.NewRouteContext()
+	chiCtx.URLParams.Add("userID", strconv.Itoa(user.ID))
+	req = httptest.NewRequest(http.MethodDelete, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(memApp.deleteUser).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("deleteUser: wrong status returned; expected %d, but got %d", http.StatusNoContent, rr.Code)
+	}
+
+	users, _ := repo.AllUsers(context.Background())
+	if len(users) != 1 {
+		t.Errorf("expected only the admin user to remain, but got %d users", len(users))
+	}
+}
+
+func TestApplication_authenticateRehashesPassword(t *testing.T) {
+	memApp, repo := newMemApp(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader(`{"email": "admin@example.com", "password": "secret"}`))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(memApp.authenticate).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status returned; expected %d, but got %d", http.StatusOK, rr.Code)
+	}
+
+	user, _ := repo.GetUserByEmail(context.Background(), "admin@example.com")
+	if !strings.HasPrefix(user.Password, "$argon2id$") {
+		t.Errorf("expected the seeded bcrypt hash to be replaced with argon2id, but got %s", user.Password)
+	}
+
+	if matches, _ := user.PasswordMatches("secret"); !matches {
+		t.Error("rehashed password should still match 'secret' but does not")
+	}
+
+	// the password is the same, so it doesn't take up a place in the history
+	if hashes, _ := repo.PasswordHistory(context.Background(), user.ID, 5); len(hashes) != 0 {
+		t.Errorf("expected the password history to be left alone, but it has %d entries", len(hashes))
+	}
+}
+
+func TestApplication_passwordReset(t *testing.T) {
+	memApp, repo := newMemApp(t)
+	mail := memApp.Mailer.(*mailer.MemoryMailer)
+
+	admin, _ := repo.GetUser(context.Background(), 1)
+	oldTokens, _ := memApp.generateTokenPair(admin)
+
+	forgotTests := []struct {
+		name           string
+		json           string
+		expectedStatus int
+	}{
+		{"unknown email", `{"email": "nobody@example.com"}`, http.StatusAccepted},
+		{"missing email", `{}`, http.StatusBadRequest},
+		{"valid", `{"email": "admin@example.com"}`, http.StatusAccepted},
+	}
+
+	for _, e := range forgotTests {
+		req := httptest.NewRequest(http.MethodPost, "/password/forgot", strings.NewReader(e.json))
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(memApp.forgotPassword).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("forgotPassword %s: wrong status returned; expected %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+
+	if len(mail.Messages()) != 1 {
+		t.Fatalf("expected exactly one reset email, but got %d", len(mail.Messages()))
+	}
+
+	msg, _ := mail.Last()
+	link, _, _ := strings.Cut(msg.Body[strings.Index(msg.Body, "http"):], "\n")
+	resetURL, _ := url.Parse(link)
+	token := resetURL.Query().Get("token")
+
+	// make sure the old tokens were issued in an earlier second than the reset
+	time.Sleep(time.Second)
+
+	resetTests := []struct {
+		name           string
+		json           string
+		expectedStatus int
+	}{
+		{"bad token", `{"token": "made up", "password": "correct horse 42"}`, http.StatusBadRequest},
+		{"weak password", `{"token": "` + token + `", "password": "secret"}`, http.StatusBadRequest},
+		{"valid", `{"token": "` + token + `", "password": "correct horse 42"}`, http.StatusNoContent},
+		{"token used twice", `{"token": "` + token + `", "password": "correct horse 43"}`, http.StatusBadRequest},
+	}
+
+	for _, e := range resetTests {
+		req := httptest.NewRequest(http.MethodPost, "/password/reset", strings.NewReader(e.json))
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(memApp.resetPassword).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("resetPassword %s: wrong status returned; expected %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+
+	admin, _ = repo.GetUser(context.Background(), 1)
+	if matches, _ := admin.PasswordMatches("correct horse 42"); !matches {
+		t.Error("expected the password to have been reset")
+	}
+
+	// tokens issued before the reset are revoked
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+oldTokens.Token)
+	rr := httptest.NewRecorder()
+	memApp.authRequired(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected an access token issued before the reset to be rejected, but got %d", rr.Code)
+	}
+
+	newTokens, _ := memApp.generateTokenPair(admin)
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+newTokens.Token)
+	rr = httptest.NewRecorder()
+	memApp.authRequired(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected an access token issued after the reset to be accepted, but got %d", rr.Code)
+	}
+}
+
+func TestApplication_registration(t *testing.T) {
+	memApp, repo := newMemApp(t)
+	repo.Hasher = data.BcryptHasher{Cost: 4}
+	memApp.Hasher = repo.Hasher
+	mail := memApp.Mailer.(*mailer.MemoryMailer)
+
+	// post sends body to handler and returns the status code
+	post := func(handler http.HandlerFunc, body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	registerTests := []struct {
+		name           string
+		json           string
+		expectedStatus int
+	}{
+		{"valid", `{"first_name": "Jack", "last_name": "Smith", "email": "jack@smith.com", "password": "correct horse 42"}`, http.StatusCreated},
+		{"duplicate email", `{"first_name": "Jack", "last_name": "Smith", "email": "JACK@smith.com", "password": "correct horse 42"}`, http.StatusConflict},
+		{"weak password", `{"first_name": "Jane", "last_name": "Smith", "email": "jane@smith.com", "password": "secret"}`, http.StatusBadRequest},
+		{"missing name", `{"email": "jane@smith.com", "password": "correct horse 42"}`, http.StatusBadRequest},
+		{"cannot make themselves admin", `{"first_name": "Jane", "last_name": "Smith", "email": "jane@smith.com", "password": "correct horse 42", "is_admin": 1}`, http.StatusBadRequest},
+	}
+
+	for _, e := range registerTests {
+		if status := post(memApp.register, e.json); status != e.expectedStatus {
+			t.Errorf("register %s: wrong status returned; expected %d, but got %d", e.name, e.expectedStatus, status)
+		}
+	}
+
+	login := `{"email": "jack@smith.com", "password": "correct horse 42"}`
+	if status := post(memApp.authenticate, login); status != http.StatusForbidden {
+		t.Errorf("expected an unverified user to be refused with 403, but got %d", status)
+	}
+
+	resendTests := []struct {
+		name           string
+		json           string
+		expectedStatus int
+	}{
+		{"unknown email", `{"email": "nobody@example.com"}`, http.StatusAccepted},
+		{"missing email", `{}`, http.StatusBadRequest},
+		{"valid", `{"email": "jack@smith.com"}`, http.StatusAccepted},
+	}
+
+	for _, e := range resendTests {
+		if status := post(memApp.resendVerification, e.json); status != e.expectedStatus {
+			t.Errorf("resendVerification %s: wrong status returned; expected %d, but got %d", e.name, e.expectedStatus, status)
+		}
+	}
+
+	if len(mail.Messages()) != 2 {
+		t.Fatalf("expected a verification email and a resent one, but got %d", len(mail.Messages()))
+	}
+
+	msg, _ := mail.Last()
+	link, _, _ := strings.Cut(msg.Body[strings.Index(msg.Body, "http"):], "\n")
+	verifyURL, _ := url.Parse(link)
+	token := verifyURL.Query().Get("token")
+
+	verifyTests := []struct {
+		name           string
+		json           string
+		expectedStatus int
+	}{
+		{"bad token", `{"token": "made up"}`, http.StatusBadRequest},
+		{"valid", `{"token": "` + token + `"}`, http.StatusNoContent},
+		{"token used twice", `{"token": "` + token + `"}`, http.StatusBadRequest},
+	}
+
+	for _, e := range verifyTests {
+		if status := post(memApp.verifyEmail, e.json); status != e.expectedStatus {
+			t.Errorf("verifyEmail %s: wrong status returned; expected %d, but got %d", e.name, e.expectedStatus, status)
+		}
+	}
+
+	if status := post(memApp.authenticate, login); status != http.StatusOK {
+		t.Errorf("expected a verified user to log in, but got %d", status)
+	}
+}
+
+func TestApplication_twoFactor(t *testing.T) {
+	memApp, repo := newMemApp(t)
+	repo.Hasher = data.BcryptHasher{Cost: 4}
+	memApp.Hasher = repo.Hasher
+	mux := memApp.routes()
+
+	id, err := repo.InsertUser(context.Background(), data.User{FirstName: "Jack", LastName: "Smith", Email: "jack@smith.com", Password: "correct horse 42", EmailVerifiedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// do sends a request through the router and decodes any JSON response into v
+	do := func(method, target, token, contentType, body string, v any) int {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if v != nil {
+			_ = json.NewDecoder(rr.Body).Decode(v)
+		}
+		return rr.Code
+	}
+
+	login := `{"email": "jack@smith.com", "password": "correct horse 42"}`
+
+	var tokens TokenPairs
+	if status := do(http.MethodPost, "/auth", "", "application/json", login, &tokens); status != http.StatusOK || tokens.Token == "" {
+		t.Fatalf("expected a token pair before two-factor authentication is on, but got %d", status)
+	}
+
+	var enrollment twofactor.Enrollment
+	if status := do(http.MethodPost, "/mfa/totp/", tokens.Token, "application/json", "", &enrollment); status != http.StatusOK || enrollment.Secret == "" {
+		t.Fatalf("expected enrollment to return a secret, but got %d", status)
+	}
+
+	if status := do(http.MethodPost, "/mfa/totp/confirm", tokens.Token, "application/json", `{"code": "not a code"}`, nil); status != http.StatusBadRequest {
+		t.Errorf("expected a bad confirmation code to give 400, but got %d", status)
+	}
+
+	code, _ := totp.Code(enrollment.Secret, totp.Step(time.Now()))
+	var confirmed struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if status := do(http.MethodPost, "/mfa/totp/confirm", tokens.Token, "application/json", `{"code": "`+code+`"}`, &confirmed); status != http.StatusOK || len(confirmed.RecoveryCodes) == 0 {
+		t.Fatalf("expected confirmation to return recovery codes, but got %d", status)
+	}
+
+	var challenge MFAChallenge
+	if status := do(http.MethodPost, "/auth", "", "application/json", login, &challenge); status != http.StatusOK || !challenge.MFARequired || challenge.MFAToken == "" {
+		t.Fatalf("expected an MFA challenge once two-factor authentication is on, but got %d", status)
+	}
+
+	// the challenge token must not work as an access or refresh token
+	if status := do(http.MethodGet, "/users/", challenge.MFAToken, "application/json", "", nil); status != http.StatusUnauthorized {
+		t.Errorf("expected the MFA token to be refused by protected routes, but got %d", status)
+	}
+
+	refresh := url.Values{"refresh_token": {challenge.MFAToken}}.Encode()
+	if status := do(http.MethodPost, "/refresh-token", "", "application/x-www-form-urlencoded", refresh, nil); status != http.StatusUnauthorized {
+		t.Errorf("expected the MFA token to be refused as a refresh token, but got %d", status)
+	}
+
+	mfaTests := []struct {
+		name           string
+		json           string
+		expectedStatus int
+	}{
+		{"wrong code", `{"mfa_token": "` + challenge.MFAToken + `", "code": "000000"}`, http.StatusUnauthorized},
+		{"bad token", `{"mfa_token": "` + tokens.Token + `", "code": "` + confirmed.RecoveryCodes[0] + `"}`, http.StatusUnauthorized},
+		{"recovery code", `{"mfa_token": "` + challenge.MFAToken + `", "code": "` + confirmed.RecoveryCodes[0] + `"}`, http.StatusOK},
+		{"recovery code used twice", `{"mfa_token": "` + challenge.MFAToken + `", "code": "` + confirmed.RecoveryCodes[0] + `"}`, http.StatusUnauthorized},
+	}
+
+	for _, e := range mfaTests {
+		if status := do(http.MethodPost, "/auth/mfa", "", "application/json", e.json, nil); status != e.expectedStatus {
+			t.Errorf("authenticateMFA %s: wrong status returned; expected %d, but got %d", e.name, e.expectedStatus, status)
+		}
+	}
+
+	if status := do(http.MethodDelete, "/mfa/totp/", tokens.Token, "application/json", `{"code": "`+confirmed.RecoveryCodes[1]+`"}`, nil); status != http.StatusNoContent {
+		t.Errorf("expected two-factor authentication to be turned off, but got %d", status)
+	}
+
+	if user, _ := repo.GetUser(context.Background(), id); user.TOTPEnabled() {
+		t.Error("expected two-factor authentication to be off")
+	}
+}
+
+func TestApplication_accessTokens(t *testing.T) {
+	memApp, repo := newMemApp(t)
+	mux := memApp.routes()
+
+	admin, _ := repo.GetUser(context.Background(), 1)
+	tokens, _ := memApp.generateTokenPair(admin)
+
+	// do sends a request through the router with the given bearer token and
+	// decodes any JSON response into v
+	do := func(method, target, bearer, body string, v any) int {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+bearer)
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if v != nil {
+			_ = json.NewDecoder(rr.Body).Decode(v)
+		}
+		return rr.Code
+	}
+
+	createTests := []struct {
+		name           string
+		json           string
+		expectedStatus int
+	}{
+		{"no scopes", `{"name": "ci"}`, http.StatusBadRequest},
+		{"unknown scope", `{"name": "ci", "scopes": ["everything"]}`, http.StatusBadRequest},
+		{"missing name", `{"scopes": ["users:read"]}`, http.StatusBadRequest},
+		{"negative lifetime", `{"name": "ci", "scopes": ["users:read"], "expires_in": -1}`, http.StatusBadRequest},
+	}
+
+	for _, e := range createTests {
+		if status := do(http.MethodPost, "/tokens/", tokens.Token, e.json, nil); status != e.expectedStatus {
+			t.Errorf("createAccessToken %s: wrong status returned; expected %d, but got %d", e.name, e.expectedStatus, status)
+		}
+	}
+
+	var readOnly, readWrite NewAccessToken
+	if status := do(http.MethodPost, "/tokens/", tokens.Token, `{"name": "reports", "scopes": ["users:read"], "expires_in": 3600}`, &readOnly); status != http.StatusCreated || readOnly.Token == "" {
+		t.Fatalf("expected a read-only token to be created, but got %d", status)
+	}
+
+	if status := do(http.MethodPost, "/tokens/", tokens.Token, `{"name": "sync", "scopes": ["users:read", "users:write"]}`, &readWrite); status != http.StatusCreated || readWrite.Token == "" {
+		t.Fatalf("expected a read-write token to be created, but got %d", status)
+	}
+
+	useTests := []struct {
+		name           string
+		method         string
+		target         string
+		token          string
+		expectedStatus int
+	}{
+		{"read with read scope", http.MethodGet, "/users/", readOnly.Token, http.StatusOK},
+		{"write without write scope", http.MethodDelete, "/users/1", readOnly.Token, http.StatusForbidden},
+		{"write with write scope", http.MethodPatch, "/users/", readWrite.Token, http.StatusBadRequest},
+		{"unknown token", http.MethodGet, "/users/", accesstoken.Prefix + "made-up", http.StatusUnauthorized},
+		{"list tokens with a token", http.MethodGet, "/tokens/", readWrite.Token, http.StatusForbidden},
+		{"create tokens with a token", http.MethodPost, "/tokens/", readWrite.Token, http.StatusForbidden},
+		{"two-factor with a token", http.MethodPost, "/mfa/totp/", readWrite.Token, http.StatusForbidden},
+	}
+
+	for _, e := range useTests {
+		if status := do(e.method, e.target, e.token, "", nil); status != e.expectedStatus {
+			t.Errorf("%s: wrong status returned; expected %d, but got %d", e.name, e.expectedStatus, status)
+		}
+	}
+
+	var listed []data.AccessToken
+	if status := do(http.MethodGet, "/tokens/", tokens.Token, "", &listed); status != http.StatusOK || len(listed) != 2 {
+		t.Fatalf("expected two tokens to be listed, but got %d and %d tokens", status, len(listed))
+	}
+
+	if listed[0].LastUsedAt == nil || listed[0].ExpiresAt == nil || listed[1].ExpiresAt != nil {
+		t.Errorf("expected the read-only token to be used and expire, and the other never to, but got %+v", listed)
+	}
+
+	revokeTests := []struct {
+		name           string
+		target         string
+		expectedStatus int
+	}{
+		{"bad id", "/tokens/abc", http.StatusBadRequest},
+		{"unknown id", "/tokens/100", http.StatusNotFound},
+		{"valid", "/tokens/" + strconv.Itoa(readOnly.ID), http.StatusNoContent},
+		{"already revoked", "/tokens/" + strconv.Itoa(readOnly.ID), http.StatusNotFound},
+	}
+
+	for _, e := range revokeTests {
+		if status := do(http.MethodDelete, e.target, tokens.Token, "", nil); status != e.expectedStatus {
+			t.Errorf("revokeAccessToken %s: wrong status returned; expected %d, but got %d", e.name, e.expectedStatus, status)
+		}
+	}
+
+	if status := do(http.MethodGet, "/users/", readOnly.Token, "", nil); status != http.StatusUnauthorized {
+		t.Errorf("expected a revoked token to be refused, but got %d", status)
+	}
+}
+
+func TestApplication_oauth(t *testing.T) {
+	memApp, repo := newMemApp(t)
+	memApp.OAuth = &oauth.Service{DB: repo, Scopes: accesstoken.Scopes}
+	mux := memApp.routes()
+
+	admin, _ := repo.GetUser(context.Background(), 1)
+	tokens, _ := memApp.generateTokenPair(admin)
+
+	userID, _ := repo.InsertUser(context.Background(), data.User{FirstName: "Jane", LastName: "Doe", Email: "jane@example.com", Password: "secret"})
+	jane, _ := repo.GetUser(context.Background(), userID)
+	janeTokens, _ := memApp.generateTokenPair(jane)
+
+	// do sends a JSON request through the router with the given bearer token and
+	// decodes any JSON response into v
+	do := func(method, target, bearer, body string, v any) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if v != nil {
+			_ = json.NewDecoder(rr.Body).Decode(v)
+		}
+		return rr
+	}
+
+	// token posts a form to the token endpoint, authenticating the client with
+	// HTTP Basic auth when a secret is given
+	token := func(clientID, secret string, form url.Values, v any) int {
+		if secret == "" {
+			form.Set("client_id", clientID)
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if secret != "" {
+			req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(secret))
+		}
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Header().Get("Cache-Control") != "no-store" {
+			t.Error("expected the token response not to be cached")
+		}
+
+		if v != nil {
+			_ = json.NewDecoder(rr.Body).Decode(v)
+		}
+		return rr.Code
+	}
+
+	spaJSON := `{"name": "SPA", "redirect_uris": ["http://localhost:8090/callback"], "grant_types": ["authorization_code", "refresh_token"], "scopes": ["users:read", "users:write"]}`
+	serviceJSON := `{"name": "Sync", "grant_types": ["client_credentials"], "scopes": ["users:read"], "confidential": true}`
+
+	if rr := do(http.MethodPost, "/oauth/clients/", janeTokens.Token, spaJSON, nil); rr.Code != http.StatusForbidden {
+		t.Errorf("expected only admins to register clients, but got %d", rr.Code)
+	}
+
+	if rr := do(http.MethodPost, "/oauth/clients/", tokens.Token, `{"name": "Bad", "grant_types": ["password"]}`, nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected an unsupported grant to be refused, but got %d", rr.Code)
+	}
+
+	var spa, service NewOAuthClient
+	if rr := do(http.MethodPost, "/oauth/clients/", tokens.Token, spaJSON, &spa); rr.Code != http.StatusCreated || spa.ClientSecret != "" {
+		t.Fatalf("expected a public client to be registered, but got %d", rr.Code)
+	}
+
+	if rr := do(http.MethodPost, "/oauth/clients/", tokens.Token, serviceJSON, &service); rr.Code != http.StatusCreated || service.ClientSecret == "" {
+		t.Fatalf("expected a confidential client to be registered with a secret, but got %d", rr.Code)
+	}
+
+	// the authorization code flow, with an S256 challenge for the verifier
+	verifier := strings.Repeat("v", 43)
+	sum := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {spa.ClientID},
+		"redirect_uri":          {"http://localhost:8090/callback"},
+		"scope":                 {"users:read"},
+		"state":                 {"xyz"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	authorizeTests := []struct {
+		name             string
+		change           func(q url.Values)
+		expectedStatus   int
+		expectedLocation string
+	}{
+		{"valid", func(q url.Values) {}, http.StatusFound, "/consent.html?"},
+		{"unregistered redirect", func(q url.Values) { q.Set("redirect_uri", "https://evil.example.com/") }, http.StatusBadRequest, ""},
+		{"unknown client", func(q url.Values) { q.Set("client_id", "nobody") }, http.StatusBadRequest, ""},
+		{"no challenge", func(q url.Values) { q.Del("code_challenge") }, http.StatusFound, "http://localhost:8090/callback?error=invalid_request"},
+	}
+
+	for _, e := range authorizeTests {
+		q := url.Values{}
+		for key, values := range query {
+			q[key] = values
+		}
+		e.change(q)
+
+		rr := do(http.MethodGet, "/oauth/authorize?"+q.Encode(), "", "", nil)
+		if rr.Code != e.expectedStatus || !strings.HasPrefix(rr.Header().Get("Location"), e.expectedLocation) {
+			t.Errorf("authorize %s: expected %d to %q, but got %d to %q", e.name, e.expectedStatus, e.expectedLocation, rr.Code, rr.Header().Get("Location"))
+		}
+	}
+
+	request := `{"response_type": "code", "client_id": "` + spa.ClientID + `", "redirect_uri": "http://localhost:8090/callback", "scope": "users:read", "state": "xyz", "code_challenge": "` + query.Get("code_challenge") + `", "code_challenge_method": "S256"`
+
+	if rr := do(http.MethodPost, "/oauth/authorize", "", request+"}", nil); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected approval to need a logged in user, but got %d", rr.Code)
+	}
+
+	var consent AuthorizeResponse
+	if rr := do(http.MethodPost, "/oauth/authorize", tokens.Token, request+"}", &consent); rr.Code != http.StatusOK || !consent.ConsentRequired || consent.ClientName != "SPA" {
+		t.Fatalf("expected the user to be asked for consent, but got %d and %+v", rr.Code, consent)
+	}
+
+	var denied AuthorizeResponse
+	do(http.MethodPost, "/oauth/authorize", tokens.Token, request+`, "approve": false}`, &denied)
+	if !strings.Contains(denied.RedirectTo, "error=access_denied") {
+		t.Errorf("expected a denial to be sent to the client, but got %q", denied.RedirectTo)
+	}
+
+	var approved AuthorizeResponse
+	do(http.MethodPost, "/oauth/authorize", tokens.Token, request+`, "approve": true}`, &approved)
+	redirectTo, _ := url.Parse(approved.RedirectTo)
+	code := redirectTo.Query().Get("code")
+	if code == "" || redirectTo.Query().Get("state") != "xyz" {
+		t.Fatalf("expected a code to be sent to the client, but got %q", approved.RedirectTo)
+	}
+
+	// once consented, the same request is approved without asking
+	var again AuthorizeResponse
+	do(http.MethodPost, "/oauth/authorize", tokens.Token, request+"}", &again)
+	if again.ConsentRequired || !strings.Contains(again.RedirectTo, "code=") {
+		t.Errorf("expected the request to be approved without asking again, but got %+v", again)
+	}
+
+	exchange := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {"http://localhost:8090/callback"},
+		"code_verifier": {verifier},
+	}
+
+	var issued OAuthToken
+	if status := token(spa.ClientID, "", exchange, &issued); status != http.StatusOK || issued.RefreshToken == "" || issued.Scope != "users:read" || issued.TokenType != "Bearer" {
+		t.Fatalf("expected the code to be exchanged for tokens, but got %d and %+v", status, issued)
+	}
+
+	var reused oauth.Error
+	if status := token(spa.ClientID, "", exchange, &reused); status != http.StatusBadRequest || reused.Code != "invalid_grant" {
+		t.Errorf("expected a used code to be refused, but got %d and %+v", status, reused)
+	}
+
+	var refreshed OAuthToken
+	refresh := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {issued.RefreshToken}}
+	if status := token(spa.ClientID, "", refresh, &refreshed); status != http.StatusOK || refreshed.Scope != "users:read" {
+		t.Errorf("expected the refresh token to be exchanged, but got %d and %+v", status, refreshed)
+	}
+
+	widen := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {issued.RefreshToken}, "scope": {"users:write"}}
+	if status := token(spa.ClientID, "", widen, nil); status != http.StatusBadRequest {
+		t.Errorf("expected a refresh not to widen the scopes, but got %d", status)
+	}
+
+	// client credentials
+	credentials := url.Values{"grant_type": {"client_credentials"}}
+	if status := token(service.ClientID, "wrong", credentials, nil); status != http.StatusUnauthorized {
+		t.Errorf("expected a wrong client secret to be refused, but got %d", status)
+	}
+
+	if status := token(spa.ClientID, "", credentials, nil); status != http.StatusBadRequest {
+		t.Errorf("expected a public client to be refused client credentials, but got %d", status)
+	}
+
+	var serviceToken OAuthToken
+	if status := token(service.ClientID, service.ClientSecret, credentials, &serviceToken); status != http.StatusOK || serviceToken.RefreshToken != "" {
+		t.Fatalf("expected an access token without a refresh token, but got %d and %+v", status, serviceToken)
+	}
+
+	useTests := []struct {
+		name           string
+		method         string
+		target         string
+		token          string
+		expectedStatus int
+	}{
+		{"read with read scope", http.MethodGet, "/users/", issued.AccessToken, http.StatusOK},
+		{"write without write scope", http.MethodDelete, "/users/1", issued.AccessToken, http.StatusForbidden},
+		{"service read", http.MethodGet, "/users/1", serviceToken.AccessToken, http.StatusOK},
+		{"service write", http.MethodPatch, "/users/", serviceToken.AccessToken, http.StatusForbidden},
+		{"create access tokens", http.MethodPost, "/tokens/", issued.AccessToken, http.StatusForbidden},
+		{"approve other clients", http.MethodPost, "/oauth/authorize", issued.AccessToken, http.StatusForbidden},
+		{"register clients", http.MethodPost, "/oauth/clients/", serviceToken.AccessToken, http.StatusForbidden},
+	}
+
+	for _, e := range useTests {
+		if rr := do(e.method, e.target, e.token, "", nil); rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned; expected %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+
+	// the browser refresh endpoint must not turn a client's token into a full login
+	req := httptest.NewRequest(http.MethodPost, "/refresh-token", strings.NewReader(url.Values{"refresh_token": {issued.RefreshToken}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected /refresh-token to refuse a client's refresh token, but got %d", rr.Code)
+	}
+
+	if rr := do(http.MethodDelete, "/oauth/clients/"+spa.ClientID, tokens.Token, "", nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected the client to be deleted, but got %d", rr.Code)
+	}
+
+	if status := token(spa.ClientID, "", refresh, nil); status != http.StatusUnauthorized {
+		t.Errorf("expected a deleted client's refresh to be refused, but got %d", status)
+	}
+
+	var clients []data.OAuthClient
+	if rr := do(http.MethodGet, "/oauth/clients/", tokens.Token, "", &clients); rr.Code != http.StatusOK || len(clients) != 1 {
+		t.Errorf("expected one client left, but got %d and %d clients", rr.Code, len(clients))
+	}
+}
+
+func TestApplication_openIDConnect(t *testing.T) {
+	memApp, repo := newMemApp(t)
+	mux := memApp.routes()
+
+	admin, _ := repo.GetUser(context.Background(), 1)
+	tokens, _ := memApp.generateTokenPair(admin)
+
+	get := func(target, bearer string, v any) int {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if v != nil {
+			_ = json.NewDecoder(rr.Body).Decode(v)
+		}
+		return rr.Code
+	}
+
+	var config oidc.Configuration
+	if status := get("/.well-known/openid-configuration", "", &config); status != http.StatusOK {
+		t.Fatalf("expected the discovery document, but got %d", status)
+	}
+
+	if config.Issuer != "http://localhost:8090" || config.JWKSURI != "http://localhost:8090/.well-known/jwks.json" || config.TokenEndpoint != "http://localhost:8090/oauth/token" {
+		t.Errorf("unexpected discovery document %+v", config)
+	}
+
+	var keySet oidc.JWKS
+	if status := get("/.well-known/jwks.json", "", &keySet); status != http.StatusOK || len(keySet.Keys) != 1 {
+		t.Fatalf("expected one published key, but got %d and %+v", status, keySet)
+	}
+
+	_, client, _ := memApp.OAuth.RegisterClient(context.Background(), data.OAuthClient{
+		Name:         "SPA",
+		RedirectURIs: []string{"http://localhost:8090/callback"},
+		GrantTypes:   []string{oauth.GrantAuthorizationCode},
+		Scopes:       []string{"openid", "email", "users:read"},
+		OwnerID:      1,
+	}, false)
+
+	// issue tokens through the authorization code flow with the given scopes
+	issue := func(scope string) OAuthToken {
+		verifier := strings.Repeat("v", 43)
+		sum := sha256.Sum256([]byte(verifier))
+
+		redirectTo, err := memApp.OAuth.Approve(context.Background(), 1, oauth.AuthorizeRequest{
+			ResponseType:        "code",
+			ClientID:            client.ClientID,
+			RedirectURI:         "http://localhost:8090/callback",
+			Scope:               scope,
+			CodeChallenge:       base64.RawURLEncoding.EncodeToString(sum[:]),
+			CodeChallengeMethod: "S256",
+			Nonce:               "n-0S6_WzA2Mj",
+		})
+		if err != nil {
+			t.Fatalf("Approve() returned an error: %s", err)
+		}
+		u, _ := url.Parse(redirectTo)
+
+		form := url.Values{
+			"grant_type":    {"authorization_code"},
+			"client_id":     {client.ClientID},
+			"code":          {u.Query().Get("code")},
+			"redirect_uri":  {"http://localhost:8090/callback"},
+			"code_verifier": {verifier},
+		}
+		req := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		var issued OAuthToken
+		_ = json.NewDecoder(rr.Body).Decode(&issued)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected tokens for %q, but got %d", scope, rr.Code)
+		}
+		return issued
+	}
+
+	withoutOpenID := issue("users:read")
+	if withoutOpenID.IDToken != "" {
+		t.Error("expected no ID token without the openid scope")
+	}
+
+	issued := issue("openid email")
+	if issued.IDToken == "" {
+		t.Fatal("expected an ID token with the openid scope")
+	}
+
+	// check the ID token the way a client library would, with the published key
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(issued.IDToken, claims, func(token *jwt.Token) (any, error) {
+		n, _ := base64.RawURLEncoding.DecodeString(keySet.Keys[0].Modulus)
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537}, nil
+	})
+	if err != nil {
+		t.Fatalf("the ID token does not verify with the published key: %s", err)
+	}
+
+	if claims["iss"] != config.Issuer || claims["aud"] != client.ClientID || claims["sub"] != "1" || claims["nonce"] != "n-0S6_WzA2Mj" || claims["email"] != "admin@example.com" {
+		t.Errorf("unexpected ID token claims %v", claims)
+	}
+
+	userInfoTests := []struct {
+		name           string
+		token          string
+		expectedStatus int
+		expectedEmail  bool
+		expectedName   bool
+	}{
+		{"client with email scope", issued.AccessToken, http.StatusOK, true, false},
+		{"client without openid scope", withoutOpenID.AccessToken, http.StatusForbidden, false, false},
+		{"own login", tokens.Token, http.StatusOK, true, true},
+		{"no token", "", http.StatusUnauthorized, false, false},
+	}
+
+	for _, e := range userInfoTests {
+		info := map[string]any{}
+		status := get("/userinfo", e.token, &info)
+		if status != e.expectedStatus {
+			t.Errorf("userinfo %s: expected %d, but got %d", e.name, e.expectedStatus, status)
+			continue
+		}
+
+		if status != http.StatusOK {
+			continue
+		}
+
+		_, hasEmail := info["email"]
+		_, hasName := info["name"]
+		if info["sub"] != "1" || hasEmail != e.expectedEmail || hasName != e.expectedName {
+			t.Errorf("userinfo %s: unexpected claims %v", e.name, info)
+		}
+	}
+}
+
+func TestApplication_introspectAndRevoke(t *testing.T) {
+	memApp, repo := newMemApp(t)
+	mux := memApp.routes()
+	ctx := context.Background()
+
+	admin, _ := repo.GetUser(ctx, 1)
+	login, _ := memApp.generateTokenPair(admin)
+	pat, _, _ := memApp.AccessTokens.Create(ctx, 1, "ci", []string{accesstoken.ScopeUsersRead}, 0)
+
+	secret, service, _ := memApp.OAuth.RegisterClient(ctx, data.OAuthClient{Name: "Sync", GrantTypes: []string{oauth.GrantClientCredentials}, Scopes: []string{"users:read"}, OwnerID: 1}, true)
+	_, spa, _ := memApp.OAuth.RegisterClient(ctx, data.OAuthClient{
+		Name:         "SPA",
+		RedirectURIs: []string{"http://localhost:8090/callback"},
+		GrantTypes:   []string{oauth.GrantAuthorizationCode, oauth.GrantRefreshToken},
+		Scopes:       []string{"users:read"},
+		OwnerID:      1,
+	}, false)
+
+	// post sends a form to one of the OAuth endpoints, as the service client when
+	// asService is set and as the public SPA otherwise, and decodes any JSON
+	// response into v
+	post := func(target string, asService bool, form url.Values, v any) int {
+		if !asService {
+			form.Set("client_id", spa.ClientID)
+		}
+
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if asService {
+			req.SetBasicAuth(service.ClientID, secret)
+		}
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if v != nil {
+			_ = json.NewDecoder(rr.Body).Decode(v)
+		}
+		return rr.Code
+	}
+
+	var serviceToken OAuthToken
+	post("/oauth/token", true, url.Values{"grant_type": {"client_credentials"}}, &serviceToken)
+
+	spaTokens, _ := memApp.generateGrantedTokenPair(admin, tokenGrant{ClientID: spa.ClientID, Scopes: []string{"users:read"}})
+
+	if status := post("/oauth/introspect", false, url.Values{"token": {serviceToken.AccessToken}}, nil); status != http.StatusUnauthorized {
+		t.Errorf("expected a public client to be refused introspection, but got %d", status)
+	}
+
+	if status := post("/oauth/introspect", true, url.Values{}, nil); status != http.StatusBadRequest {
+		t.Errorf("expected introspection without a token to be refused, but got %d", status)
+	}
+
+	introspectTests := []struct {
+		name              string
+		token             string
+		expectedActive    bool
+		expectedClientID  string
+		expectedTokenType string
+		expectedScope     string
+	}{
+		{"client credentials", serviceToken.AccessToken, true, service.ClientID, "Bearer", "users:read"},
+		{"client refresh token", spaTokens.RefreshToken, true, spa.ClientID, "refresh_token", "users:read"},
+		{"own login", login.Token, true, "", "Bearer", strings.Join(app.OAuth.Scopes, " ")},
+		{"personal access token", pat, true, "", "Bearer", "users:read"},
+		{"browser refresh token", login.RefreshToken, false, "", "", ""},
+		{"garbage", "not-a-token", false, "", "", ""},
+		{"expired", expiredToken, false, "", "", ""},
+	}
+
+	for _, e := range introspectTests {
+		var got Introspection
+		if status := post("/oauth/introspect", true, url.Values{"token": {e.token}}, &got); status != http.StatusOK {
+			t.Errorf("introspect %s: expected 200, but got %d", e.name, status)
+			continue
+		}
+
+		if got.Active != e.expectedActive || got.ClientID != e.expectedClientID || got.TokenType != e.expectedTokenType || got.Scope != e.expectedScope {
+			t.Errorf("introspect %s: unexpected response %+v", e.name, got)
+		}
+
+		if got.Active && (got.Subject != "1" || got.Username != "admin@example.com" || got.ExpiresAt == 0 && e.name != "personal access token") {
+			t.Errorf("introspect %s: expected the admin's details, but got %+v", e.name, got)
+		}
+	}
+
+	revokeTests := []struct {
+		name           string
+		token          string
+		expectedStatus int
+	}{
+		{"another client's token", serviceToken.AccessToken, http.StatusBadRequest},
+		{"own login", login.Token, http.StatusBadRequest},
+		{"personal access token", pat, http.StatusBadRequest},
+		{"garbage", "not-a-token", http.StatusOK},
+		{"access token", spaTokens.Token, http.StatusOK},
+		{"refresh token", spaTokens.RefreshToken, http.StatusOK},
+		{"already revoked", spaTokens.Token, http.StatusOK},
+	}
+
+	for _, e := range revokeTests {
+		if status := post("/oauth/revoke", false, url.Values{"token": {e.token}}, nil); status != e.expectedStatus {
+			t.Errorf("revoke %s: expected %d, but got %d", e.name, e.expectedStatus, status)
+		}
+	}
+
+	for _, token := range []string{spaTokens.Token, spaTokens.RefreshToken} {
+		var got Introspection
+		post("/oauth/introspect", true, url.Values{"token": {token}}, &got)
+		if got.Active {
+			t.Errorf("expected a revoked token to be inactive, but got %+v", got)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/users/", nil)
+	req.Header.Set("Authorization", "Bearer "+spaTokens.Token)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected a revoked access token to be refused, but got %d", rr.Code)
+	}
+
+	var refused oauth.Error
+	if status := post("/oauth/token", false, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {spaTokens.RefreshToken}}, &refused); status != http.StatusBadRequest || refused.Code != "invalid_grant" {
+		t.Errorf("expected a revoked refresh token to be refused, but got %d and %+v", status, refused)
+	}
+
+	// a login on a device the user has since logged out
+	device, _ := memApp.startSessionTokenPair(httptest.NewRequest(http.MethodPost, "/auth", nil), admin)
+
+	var live Introspection
+	post("/oauth/introspect", true, url.Values{"token": {device.Token}}, &live)
+	if !live.Active {
+		t.Errorf("expected the token of a live session to be active, but got %+v", live)
+	}
+
+	list, _ := repo.AllSessions(ctx, 1)
+	for _, session := range list {
+		_ = memApp.Sessions.End(ctx, 1, session.ID)
+	}
+
+	var ended Introspection
+	post("/oauth/introspect", true, url.Values{"token": {device.Token}}, &ended)
+	if ended.Active {
+		t.Errorf("expected the token of a logged out session to be inactive, but got %+v", ended)
+	}
+}
+
+func TestApplication_sessions(t *testing.T) {
+	memApp, repo := newMemApp(t)
+	mux := memApp.routes()
+
+	const firefox = "Mozilla/5.0 (X11; Linux x86_64; rv:105.0) Gecko/20100101 Firefox/105.0"
+
+	// send sends a request through the router from the given device, and decodes
+	// any JSON response into v
+	send := func(req *http.Request, userAgent string, v any) *httptest.ResponseRecorder {
+		req.RemoteAddr = "192.0.2.1:50000"
+		req.Header.Set("User-Agent", userAgent)
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if v != nil {
+			_ = json.NewDecoder(rr.Body).Decode(v)
+		}
+		return rr
+	}
+
+	logIn := func(userAgent string) TokenPairs {
+		t.Helper()
+
+		var tokens TokenPairs
+		req := httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader(`{"email": "admin@example.com", "password": "secret"}`))
+		if rr := send(req, userAgent, &tokens); rr.Code != http.StatusOK {
+			t.Fatalf("expected to log in, but got %d", rr.Code)
+		}
+		return tokens
+	}
+
+	do := func(method, target, bearer string, v any) int {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		return send(req, firefox, v).Code
+	}
+
+	refresh := func(refreshToken string) int {
+		req := httptest.NewRequest(http.MethodGet, "/web/refresh-token", nil)
+		req.AddCookie(&http.Cookie{Name: "_Host-refresh_token", Value: refreshToken})
+		return send(req, firefox, nil).Code
+	}
+
+	laptop := logIn(firefox)
+	script := logIn("curl/7.85.0")
+
+	var listed []UserSession
+	if status := do(http.MethodGet, "/me/sessions", laptop.Token, &listed); status != http.StatusOK || len(listed) != 2 {
+		t.Fatalf("expected two sessions to be listed, but got %d and %d sessions", status, len(listed))
+	}
+
+	if !listed[0].Current || listed[1].Current {
+		t.Errorf("expected only the first session to be current, but got %+v", listed)
+	}
+
+	if listed[0].Device != "Firefox on Linux" || listed[1].Device != "curl" || listed[0].IP != "192.0.2.1" || listed[0].Kind != data.SessionAPI {
+		t.Errorf("expected the devices and address to be recorded, but got %+v", listed)
+	}
+
+	// a refresh keeps the session, and so do the tokens it returns
+	if status := refresh(laptop.RefreshToken); status != http.StatusOK {
+		t.Errorf("expected the laptop to refresh its tokens, but got %d", status)
+	}
+
+	endTests := []struct {
+		name           string
+		target         string
+		expectedStatus int
+	}{
+		{"bad id", "/me/sessions/abc", http.StatusBadRequest},
+		{"unknown id", "/me/sessions/100", http.StatusNotFound},
+		{"valid", "/me/sessions/" + strconv.Itoa(listed[1].ID), http.StatusNoContent},
+		{"already ended", "/me/sessions/" + strconv.Itoa(listed[1].ID), http.StatusNotFound},
+	}
+
+	for _, e := range endTests {
+		if status := do(http.MethodDelete, e.target, laptop.Token, nil); status != e.expectedStatus {
+			t.Errorf("endSession %s: wrong status returned; expected %d, but got %d", e.name, e.expectedStatus, status)
+		}
+	}
+
+	if status := do(http.MethodGet, "/me/sessions", script.Token, nil); status != http.StatusUnauthorized {
+		t.Errorf("expected the access token of an ended session to be refused, but got %d", status)
+	}
+
+	if status := refresh(script.RefreshToken); status != http.StatusUnauthorized {
+		t.Errorf("expected the refresh token of an ended session to be refused, but got %d", status)
+	}
+
+	// ending the others keeps the one making the request
+	phone := logIn("Mozilla/5.0 (Linux; Android 13; Pixel 7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/106.0.0.0 Mobile Safari/537.36")
+	if status := do(http.MethodDelete, "/me/sessions", phone.Token, nil); status != http.StatusNoContent {
+		t.Fatalf("expected the other sessions to be ended, but got %d", status)
+	}
+
+	if status := do(http.MethodGet, "/me/sessions", laptop.Token, nil); status != http.StatusUnauthorized {
+		t.Errorf("expected the laptop to be logged out, but got %d", status)
+	}
+
+	if status := do(http.MethodGet, "/me/sessions", phone.Token, &listed); status != http.StatusOK || len(listed) != 1 || !listed[0].Current {
+		t.Errorf("expected only the phone's session to be left, but got %d and %+v", status, listed)
+	}
+
+	// logging out ends the session too
+	req := httptest.NewRequest(http.MethodGet, "/web/logout", nil)
+	req.AddCookie(&http.Cookie{Name: "_Host-refresh_token", Value: phone.RefreshToken})
+	send(req, firefox, nil)
+
+	if remaining, _ := repo.AllSessions(context.Background(), 1); len(remaining) != 0 {
+		t.Errorf("expected logging out to end the session, but %d are left", len(remaining))
+	}
+}
+
+func TestApplication_me(t *testing.T) {
+	memApp, repo := newMemApp(t)
+	repo.Hasher = data.BcryptHasher{Cost: 4}
+	mux := memApp.routes()
+
+	ctx := context.Background()
+	id, _ := repo.InsertUser(ctx, data.User{FirstName: "Jack", LastName: "Smith", Email: "jack@smith.com", Password: "correct horse 42", EmailVerifiedAt: time.Now()})
+	jack, _ := repo.GetUser(ctx, id)
+	tokens, _ := memApp.generateTokenPair(jack)
+	readOnly, _, _ := memApp.AccessTokens.Create(ctx, id, "reports", []string{accesstoken.ScopeUsersRead}, 0)
+
+	do := func(method, target, bearer, body string, v any) int {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+bearer)
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if v != nil {
+			_ = json.NewDecoder(rr.Body).Decode(v)
+		}
+		return rr.Code
+	}
+
+	var me data.User
+	if status := do(http.MethodGet, "/me", tokens.Token, "", &me); status != http.StatusOK || me.ID != id || me.Email != "jack@smith.com" {
+		t.Errorf("expected /me to return jack, but got %d and %+v", status, me)
+	}
+
+	updateTests := []struct {
+		name              string
+		token             string
+		json              string
+		expectedStatus    int
+		expectedFirstName string
+	}{
+		{"raise is_admin", tokens.Token, `{"is_admin": 1}`, http.StatusBadRequest, "Jack"},
+		{"change email", tokens.Token, `{"email": "admin@example.com"}`, http.StatusBadRequest, "Jack"},
+		{"empty name", tokens.Token, `{"first_name": " "}`, http.StatusBadRequest, "Jack"},
+		{"without write scope", readOnly, `{"first_name": "Jake"}`, http.StatusForbidden, "Jack"},
+		{"valid", tokens.Token, `{"first_name": "Jackie"}`, http.StatusOK, "Jackie"},
+	}
+
+	for _, e := range updateTests {
+		if status := do(http.MethodPatch, "/me", e.token, e.json, nil); status != e.expectedStatus {
+			t.Errorf("updateMe %s: wrong status returned; expected %d, but got %d", e.name, e.expectedStatus, status)
+		}
+
+		user, _ := repo.GetUser(ctx, id)
+		if user.FirstName != e.expectedFirstName || user.LastName != "Smith" || user.IsAdmin != 0 || user.Email != "jack@smith.com" {
+			t.Errorf("updateMe %s: unexpected user %+v", e.name, user)
+		}
+	}
+
+	// nor through the administrators' routes
+	escalate := fmt.Sprintf(`{"id": %d, "first_name": "Jackie", "last_name": "Smith", "email": "jack@smith.com", "is_admin": 1}`, id)
+	adminTests := []struct {
+		name   string
+		method string
+		target string
+		json   string
+	}{
+		{"updateUser", http.MethodPatch, "/users/", escalate},
+		{"insertUser", http.MethodPut, "/users/", `{"first_name": "Eve", "last_name": "Smith", "email": "eve@smith.com", "password": "correct horse 42", "is_admin": 1}`},
+		{"deleteUser", http.MethodDelete, "/users/1", ""},
+	}
+
+	for _, e := range adminTests {
+		if status := do(e.method, e.target, tokens.Token, e.json, nil); status != http.StatusForbidden {
+			t.Errorf("%s by a user who isn't an administrator: expected 403, but got %d", e.name, status)
+		}
+	}
+
+	if user, _ := repo.GetUser(ctx, id); user.IsAdmin != 0 {
+		t.Error("expected a user not to be able to make themselves an administrator")
+	}
+
+	// a session that knew the old password
+	laptop, _ := memApp.Sessions.Start(ctx, id, data.SessionWeb, sessions.Client{}, time.Now().Add(time.Hour))
+
+	passwordTests := []struct {
+		name           string
+		token          string
+		json           string
+		expectedStatus int
+	}{
+		{"wrong current password", tokens.Token, `{"current_password": "wrong", "new_password": "battery staple 43"}`, http.StatusForbidden},
+		{"weak new password", tokens.Token, `{"current_password": "correct horse 42", "new_password": "secret"}`, http.StatusBadRequest},
+		{"same password", tokens.Token, `{"current_password": "correct horse 42", "new_password": "correct horse 42"}`, http.StatusBadRequest},
+		{"with an access token", readOnly, `{"current_password": "correct horse 42", "new_password": "battery staple 43"}`, http.StatusForbidden},
+		{"valid", tokens.Token, `{"current_password": "correct horse 42", "new_password": "battery staple 43"}`, http.StatusNoContent},
+	}
+
+	for _, e := range passwordTests {
+		if status := do(http.MethodPost, "/me/password", e.token, e.json, nil); status != e.expectedStatus {
+			t.Errorf("changePassword %s: wrong status returned; expected %d, but got %d", e.name, e.expectedStatus, status)
+		}
+	}
+
+	user, _ := repo.GetUser(ctx, id)
+	if valid, _ := user.PasswordMatches("battery staple 43"); !valid {
+		t.Error("expected the new password to be set")
+	}
+
+	if _, err := repo.GetSession(ctx, laptop.ID); err == nil {
+		t.Error("expected other sessions to be logged out after a password change")
+	}
+}
+
+func TestApplication_avatar(t *testing.T) {
+	memApp, repo := newMemApp(t)
+	repo.Hasher = data.BcryptHasher{Cost: 4}
+	memApp.Blobs = &storage.MemoryStore{}
+	mux := memApp.routes()
+
+	ctx := context.Background()
+	id, _ := repo.InsertUser(ctx, data.User{FirstName: "Jack", LastName: "Smith", Email: "jack@smith.com", Password: "correct horse 42", EmailVerifiedAt: time.Now()})
+	jack, _ := repo.GetUser(ctx, id)
+	admin, _ := repo.GetUser(ctx, 1)
+	jackTokens, _ := memApp.generateTokenPair(jack)
+	adminTokens, _ := memApp.generateTokenPair(admin)
+	readOnly, _, _ := memApp.AccessTokens.Create(ctx, id, "reports", []string{accesstoken.ScopeUsersRead}, 0)
+
+	var picture bytes.Buffer
+	_ = png.Encode(&picture, image.NewRGBA(image.Rect(0, 0, 2, 2)))
+
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	part, _ := writer.CreateFormFile("image", "../../me.png")
+	_, _ = part.Write(picture.Bytes())
+	_ = writer.Close()
+
+	do := func(method, target, bearer, contentType string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, bytes.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	jackAvatar := fmt.Sprintf("/users/%d/avatar", id)
+
+	putTests := []struct {
+		name           string
+		target         string
+		token          string
+		contentType    string
+		body           []byte
+		expectedStatus int
+	}{
+		{"not logged in", jackAvatar, "", "image/png", picture.Bytes(), http.StatusUnauthorized},
+		{"without write scope", jackAvatar, readOnly, "image/png", picture.Bytes(), http.StatusForbidden},
+		{"another user's", "/users/1/avatar", jackTokens.Token, "image/png", picture.Bytes(), http.StatusForbidden},
+		{"missing user", "/users/100/avatar", adminTokens.Token, "image/png", picture.Bytes(), http.StatusNotFound},
+		{"empty", jackAvatar, jackTokens.Token, "image/png", nil, http.StatusBadRequest},
+		{"not an image", jackAvatar, jackTokens.Token, "image/png", []byte("<script>alert(1)</script>"), http.StatusUnsupportedMediaType},
+		{"broken image", jackAvatar, jackTokens.Token, "image/png", picture.Bytes()[:40], http.StatusUnsupportedMediaType},
+		{"too large", jackAvatar, jackTokens.Token, "image/png", append(picture.Bytes(), make([]byte, upload.DefaultMaxFileSize)...), http.StatusRequestEntityTooLarge},
+		{"multipart without image", jackAvatar, jackTokens.Token, writer.FormDataContentType(), []byte("--" + writer.Boundary() + "--"), http.StatusBadRequest},
+		{"multipart", jackAvatar, jackTokens.Token, writer.FormDataContentType(), form.Bytes(), http.StatusOK},
+		{"raw", jackAvatar, jackTokens.Token, "image/png", picture.Bytes(), http.StatusOK},
+		{"by an admin", jackAvatar, adminTokens.Token, "application/octet-stream", picture.Bytes(), http.StatusOK},
+	}
+
+	for _, e := range putTests {
+		rr := do(http.MethodPut, e.target, e.token, e.contentType, e.body)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("putAvatar %s: wrong status returned; expected %d, but got %d: %s", e.name, e.expectedStatus, rr.Code, rr.Body)
+		}
+
+		if rr.Code == http.StatusOK {
+			var user data.User
+			_ = json.NewDecoder(rr.Body).Decode(&user)
+			if user.AvatarURL != jackAvatar {
+				t.Errorf("putAvatar %s: expected avatar_url %s, but got %q", e.name, jackAvatar, user.AvatarURL)
+			}
+		}
+	}
+
+	stored, _ := repo.GetUser(ctx, id)
+	if strings.Contains(stored.ProfilePic.FileName, "me.png") || !strings.HasSuffix(stored.ProfilePic.FileName, ".png") {
+		t.Errorf("expected a server chosen file name, but got %s", stored.ProfilePic.FileName)
+	}
+
+	var listed data.User
+	_ = json.NewDecoder(do(http.MethodGet, fmt.Sprintf("/users/%d", id), adminTokens.Token, "", nil).Body).Decode(&listed)
+	if listed.AvatarURL != jackAvatar {
+		t.Errorf("expected getUser to include avatar_url %s, but got %q", jackAvatar, listed.AvatarURL)
+	}
+
+	// anyone may see a profile picture
+	rr := do(http.MethodGet, jackAvatar, "", "", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("getAvatar: expected the picture, but got %d", rr.Code)
+	}
+
+	if served, err := png.DecodeConfig(bytes.NewReader(rr.Body.Bytes())); err != nil || served.Width != 512 || served.Height != 512 {
+		t.Errorf("getAvatar: expected the largest size by default, but got %+v and %v", served, err)
+	}
+
+	small := do(http.MethodGet, jackAvatar+"?size=64", "", "", nil)
+	if served, err := png.DecodeConfig(small.Body); err != nil || served.Width != 64 {
+		t.Errorf("getAvatar: expected the 64 pixel version, but got %+v and %v", served, err)
+	}
+
+	if status := do(http.MethodGet, jackAvatar+"?size=100", "", "", nil).Code; status != http.StatusBadRequest {
+		t.Errorf("getAvatar: expected 400 for a size that isn't made, but got %d", status)
+	}
+
+	if rr.Header().Get("Content-Type") != "image/png" || rr.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("getAvatar: unexpected headers %v", rr.Header())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, jackAvatar, nil)
+	req.Header.Set("If-None-Match", rr.Header().Get("ETag"))
+	revalidated := httptest.NewRecorder()
+	mux.ServeHTTP(revalidated, req)
+	if revalidated.Code != http.StatusNotModified {
+		t.Errorf("getAvatar: expected 304 for a current ETag, but got %d", revalidated.Code)
+	}
+
+	if status := do(http.MethodDelete, "/users/1/avatar", jackTokens.Token, "", nil).Code; status != http.StatusForbidden {
+		t.Errorf("deleteAvatar another user's: expected 403, but got %d", status)
+	}
+
+	if status := do(http.MethodDelete, jackAvatar, jackTokens.Token, "", nil).Code; status != http.StatusNoContent {
+		t.Errorf("deleteAvatar: expected 204, but got %d", status)
+	}
+
+	if status := do(http.MethodGet, jackAvatar, "", "", nil).Code; status != http.StatusNotFound {
+		t.Errorf("getAvatar after delete: expected 404, but got %d", status)
+	}
+
+	if status := do(http.MethodDelete, jackAvatar, jackTokens.Token, "", nil).Code; status != http.StatusNotFound {
+		t.Errorf("deleteAvatar twice: expected 404, but got %d", status)
+	}
+
+	// every upload is kept in the history
+	jackAvatars := fmt.Sprintf("/users/%d/avatars", id)
+	if status := do(http.MethodGet, "/users/1/avatars", jackTokens.Token, "", nil).Code; status != http.StatusForbidden {
+		t.Errorf("allAvatars another user's: expected 403, but got %d", status)
+	}
+
+	var history []data.UserImage
+	rr = do(http.MethodGet, jackAvatars, readOnly, "", nil)
+	_ = json.NewDecoder(rr.Body).Decode(&history)
+	if rr.Code != http.StatusOK || len(history) != 3 || history[0].IsCurrent {
+		t.Fatalf("allAvatars: expected 3 pictures, none current, but got %d and %+v", rr.Code, history)
+	}
+
+	oldest := history[2]
+	if expected := fmt.Sprintf("%s/%d", jackAvatars, oldest.ID); oldest.URL != expected {
+		t.Errorf("allAvatars: expected url %s, but got %q", expected, oldest.URL)
+	}
+
+	if served, err := png.DecodeConfig(do(http.MethodGet, oldest.URL+"?size=64", readOnly, "", nil).Body); err != nil || served.Width != 64 {
+		t.Errorf("getPastAvatar: expected the 64 pixel version, but got %+v and %v", served, err)
+	}
+
+	if status := do(http.MethodPut, oldest.URL+"/current", readOnly, "", nil).Code; status != http.StatusForbidden {
+		t.Errorf("chooseAvatar without write scope: expected 403, but got %d", status)
+	}
+
+	var chosen data.User
+	rr = do(http.MethodPut, oldest.URL+"/current", jackTokens.Token, "", nil)
+	_ = json.NewDecoder(rr.Body).Decode(&chosen)
+	if rr.Code != http.StatusOK || chosen.AvatarURL != jackAvatar {
+		t.Errorf("chooseAvatar: expected the user with avatar_url %s, but got %d and %q", jackAvatar, rr.Code, chosen.AvatarURL)
+	}
+	if stored, _ := repo.GetUser(ctx, id); stored.ProfilePic.FileName != oldest.FileName {
+		t.Errorf("chooseAvatar: expected the oldest picture to be current, but got %s", stored.ProfilePic.FileName)
+	}
+
+	if status := do(http.MethodGet, jackAvatar, "", "", nil).Code; status != http.StatusOK {
+		t.Errorf("getAvatar after choosing a past picture: expected 200, but got %d", status)
+	}
+
+	deleteTests := []struct {
+		name           string
+		target         string
+		token          string
+		expectedStatus int
+	}{
+		{"another user's", fmt.Sprintf("/users/1/avatars/%d", history[0].ID), jackTokens.Token, http.StatusForbidden},
+		{"bad id", jackAvatars + "/one", jackTokens.Token, http.StatusBadRequest},
+		{"missing", jackAvatars + "/100", jackTokens.Token, http.StatusNotFound},
+		{"past", history[0].URL, jackTokens.Token, http.StatusNoContent},
+		{"past again", history[0].URL, jackTokens.Token, http.StatusNotFound},
+		{"current", oldest.URL, adminTokens.Token, http.StatusNoContent},
+	}
+
+	for _, e := range deleteTests {
+		if status := do(http.MethodDelete, e.target, e.token, "", nil).Code; status != e.expectedStatus {
+			t.Errorf("deletePastAvatar %s: expected %d, but got %d", e.name, e.expectedStatus, status)
+		}
+	}
+
+	if status := do(http.MethodGet, jackAvatar, "", "", nil).Code; status != http.StatusNotFound {
+		t.Errorf("getAvatar after deleting the current picture: expected 404, but got %d", status)
+	}
+
+	if status := do(http.MethodPut, oldest.URL+"/current", jackTokens.Token, "", nil).Code; status != http.StatusNotFound {
+		t.Errorf("chooseAvatar of a deleted picture: expected 404, but got %d", status)
+	}
+}
@@ -4,8 +4,14 @@ import (
 	"errors"
 	"github.com/go-chi/chi/v5"
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/spacesedan/testing-course/webapp/pkg/accesstoken"
 	"github.com/spacesedan/testing-course/webapp/pkg/data"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/spacesedan/testing-course/webapp/pkg/passwordpolicy"
+	"github.com/spacesedan/testing-course/webapp/pkg/passwordreset"
+	"github.com/spacesedan/testing-course/webapp/pkg/registration"
+	"github.com/spacesedan/testing-course/webapp/pkg/sessions"
+	"github.com/spacesedan/testing-course/webapp/pkg/twofactor"
+	"log"
 	"net/http"
 	"strconv"
 	"time"
@@ -26,37 +32,53 @@ func (app *application) authenticate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// look up the user by email address
-	user, err := app.DB.GetUserByEmail(creds.Username)
+	user, err := app.DB.GetUserByEmail(r.Context(), creds.Username)
 	if err != nil {
 		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
 		return
 	}
 
 	// check password
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(creds.Password))
-	if err != nil {
+	if valid, err := user.PasswordMatches(creds.Password); err != nil || !valid {
 		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
 		return
 	}
 
-	// generate tokens
-	tokenPairs, err := app.generateTokenPair(user)
+	// self-registered users must confirm their email address first
+	if !user.EmailVerified() {
+		app.errorJSON(w, registration.ErrUnverified, http.StatusForbidden)
+		return
+	}
+
+	// users with two-factor authentication get a short-lived token instead, to
+	// exchange for real ones along with a code at /auth/mfa
+	if user.TOTPEnabled() {
+		mfaToken, err := app.generateMFAToken(user)
+		if err != nil {
+			app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+			return
+		}
+
+		_ = app.writeJSON(w, http.StatusOK, MFAChallenge{MFARequired: true, MFAToken: mfaToken})
+		return
+	}
+
+	// upgrade an outdated hash while we have the plain text password
+	if user.PasswordNeedsRehash(app.Hasher) {
+		if err := app.DB.UpdatePasswordHash(r.Context(), user.ID, creds.Password); err != nil {
+			log.Printf("could not rehash password for user %d: %s\n", user.ID, err)
+		}
+	}
+
+	// generate tokens, for a new session on this device
+	tokenPairs, err := app.startSessionTokenPair(r, user)
 	if err != nil {
+		log.Printf("could not start a session for user %d: %s\n", user.ID, err)
 		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "_Host-refresh_token",
-		Path:     "/",
-		Value:    tokenPairs.RefreshToken,
-		Domain:   "localhost",
-		Expires:  time.Now().Add(refreshTokenExpiry),
-		MaxAge:   int(refreshTokenExpiry.Seconds()),
-		Secure:   true,
-		HttpOnly: true,
-		SameSite: http.SameSiteStrictMode,
-	})
+	app.setRefreshCookie(w, tokenPairs.RefreshToken)
 
 	//	send token to user
 	_ = app.writeJSON(w, http.StatusOK, tokenPairs)
@@ -70,18 +92,18 @@ func (app *application) refresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	refreshToken := r.Form.Get("refresh_token")
-	claims := &Claims{}
-
-	_, err = jwt.ParseWithClaims(refreshToken, claims, func(token *jwt.Token) (any, error) {
-		return []byte(app.JWTSecret), nil
-	})
-	if err != nil {
+	claims, err := app.parseRefreshToken(r.Form.Get("refresh_token"))
+	if errors.Is(err, errNotRefreshToken) {
+		app.errorJSON(w, err, http.StatusUnauthorized)
+		return
+	} else if err != nil {
 		app.errorJSON(w, err, http.StatusBadRequest)
+		return
 	}
 
 	if time.Unix(claims.ExpiresAt.Unix(), 0).Sub(time.Now()) > 30*time.Second {
 		app.errorJSON(w, errors.New("refresh token does not need to be renewed yet"), http.StatusTooEarly)
+		return
 	}
 
 	// get the user id from the claims
@@ -91,29 +113,36 @@ func (app *application) refresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := app.DB.GetUser(userID)
+	user, err := app.DB.GetUser(r.Context(), userID)
 	if err != nil {
 		app.errorJSON(w, errors.New("unknown user"), http.StatusBadRequest)
 		return
 	}
 
-	tokenPairs, err := app.generateTokenPair(user)
+	if tokenRevoked(claims, user) {
+		app.errorJSON(w, errors.New("refresh token has been revoked"), http.StatusUnauthorized)
+		return
+	}
+
+	revoked, err := app.tokenIDRevoked(r.Context(), claims)
 	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	} else if revoked {
+		app.errorJSON(w, errors.New("refresh token has been revoked"), http.StatusUnauthorized)
+		return
+	}
+
+	tokenPairs, err := app.refreshSessionTokenPair(r, user, claims)
+	if errors.Is(err, sessions.ErrEnded) {
+		app.errorJSON(w, err, http.StatusUnauthorized)
+		return
+	} else if err != nil {
 		app.errorJSON(w, err, http.StatusBadRequest)
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "_Host-refresh_token",
-		Path:     "/",
-		Value:    tokenPairs.RefreshToken,
-		Domain:   "localhost",
-		Expires:  time.Now().Add(refreshTokenExpiry),
-		MaxAge:   int(refreshTokenExpiry.Seconds()),
-		Secure:   true,
-		HttpOnly: true,
-		SameSite: http.SameSiteStrictMode,
-	})
+	app.setRefreshCookie(w, tokenPairs.RefreshToken)
 
 	_ = app.writeJSON(w, http.StatusOK, tokenPairs)
 
@@ -122,13 +151,11 @@ func (app *application) refresh(w http.ResponseWriter, r *http.Request) {
 func (app *application) refreshUsingCookie(w http.ResponseWriter, r *http.Request) {
 	for _, cookie := range r.Cookies() {
 		if cookie.Name == "_Host-refresh_token" {
-			claims := &Claims{}
-			refreshToken := cookie.Value
-
-			_, err := jwt.ParseWithClaims(refreshToken, claims, func(token *jwt.Token) (any, error) {
-				return []byte(app.JWTSecret), nil
-			})
-			if err != nil {
+			claims, err := app.parseRefreshToken(cookie.Value)
+			if errors.Is(err, errNotRefreshToken) {
+				app.errorJSON(w, err, http.StatusUnauthorized)
+				return
+			} else if err != nil {
 				app.errorJSON(w, err, http.StatusBadRequest)
 				return
 			}
@@ -144,29 +171,36 @@ func (app *application) refreshUsingCookie(w http.ResponseWriter, r *http.Reques
 				return
 			}
 
-			user, err := app.DB.GetUser(userID)
+			user, err := app.DB.GetUser(r.Context(), userID)
 			if err != nil {
 				app.errorJSON(w, errors.New("unknown user"), http.StatusBadRequest)
 				return
 			}
 
-			tokenPairs, err := app.generateTokenPair(user)
+			if tokenRevoked(claims, user) {
+				app.errorJSON(w, errors.New("refresh token has been revoked"), http.StatusUnauthorized)
+				return
+			}
+
+			revoked, err := app.tokenIDRevoked(r.Context(), claims)
 			if err != nil {
+				app.errorJSON(w, err, http.StatusInternalServerError)
+				return
+			} else if revoked {
+				app.errorJSON(w, errors.New("refresh token has been revoked"), http.StatusUnauthorized)
+				return
+			}
+
+			tokenPairs, err := app.refreshSessionTokenPair(r, user, claims)
+			if errors.Is(err, sessions.ErrEnded) {
+				app.errorJSON(w, err, http.StatusUnauthorized)
+				return
+			} else if err != nil {
 				app.errorJSON(w, err, http.StatusBadRequest)
 				return
 			}
 
-			http.SetCookie(w, &http.Cookie{
-				Name:     "_Host-refresh_token",
-				Path:     "/",
-				Value:    tokenPairs.RefreshToken,
-				Domain:   "localhost",
-				Expires:  time.Now().Add(refreshTokenExpiry),
-				MaxAge:   int(refreshTokenExpiry.Seconds()),
-				Secure:   true,
-				HttpOnly: true,
-				SameSite: http.SameSiteStrictMode,
-			})
+			app.setRefreshCookie(w, tokenPairs.RefreshToken)
 
 			_ = app.writeJSON(w, http.StatusOK, tokenPairs)
 			return
@@ -177,12 +211,13 @@ func (app *application) refreshUsingCookie(w http.ResponseWriter, r *http.Reques
 }
 
 func (app *application) allUsers(w http.ResponseWriter, r *http.Request) {
-	users, err := app.DB.AllUsers()
+	users, err := app.DB.AllUsers(r.Context())
 	if err != nil {
-		app.errorJSON(w, err, http.StatusBadRequest)
+		app.repoErrorJSON(w, err)
 		return
 	}
 
+	withAvatarURLs(users...)
 	_ = app.writeJSON(w, http.StatusOK, users)
 }
 
@@ -193,12 +228,13 @@ func (app *application) getUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := app.DB.GetUser(userId)
+	user, err := app.DB.GetUser(r.Context(), userId)
 	if err != nil {
-		app.errorJSON(w, err, http.StatusBadRequest)
+		app.repoErrorJSON(w, err)
 		return
 	}
 
+	withAvatarURLs(user)
 	_ = app.writeJSON(w, http.StatusOK, user)
 }
 
@@ -211,9 +247,9 @@ func (app *application) updateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.DB.UpdateUser(user)
+	err = app.DB.UpdateUser(r.Context(), user)
 	if err != nil {
-		app.errorJSON(w, err, http.StatusBadRequest)
+		app.repoErrorJSON(w, err)
 		return
 	}
 
@@ -227,9 +263,9 @@ func (app *application) deleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.DB.DeleteUser(userId)
+	err = app.DB.DeleteUser(r.Context(), userId)
 	if err != nil {
-		app.errorJSON(w, err, http.StatusBadRequest)
+		app.repoErrorJSON(w, err)
 		return
 	}
 
@@ -237,24 +273,51 @@ func (app *application) deleteUser(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *application) insertUser(w http.ResponseWriter, r *http.Request) {
-	var user data.User
+	// data.User never serializes its password, so accept it alongside
+	var payload struct {
+		data.User
+		Password string `json:"password"`
+	}
 
-	err := app.readJSON(w, r, &user)
+	err := app.readJSON(w, r, &payload)
 	if err != nil {
 		app.errorJSON(w, err, http.StatusBadRequest)
 		return
 	}
 
-	_, err = app.DB.InsertUser(user)
+	err = app.Policy.Validate(payload.Password)
 	if err != nil {
 		app.errorJSON(w, err, http.StatusBadRequest)
 		return
 	}
 
+	user := payload.User
+	user.Password = payload.Password
+
+	// an admin vouches for the address of a user they create
+	user.EmailVerifiedAt = time.Now()
+
+	_, err = app.DB.InsertUser(r.Context(), user)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func (app *application) deleteRefreshCookies(w http.ResponseWriter, r *http.Request) {
+	// logging out ends the session the refresh cookie belongs to
+	if cookie, err := r.Cookie("_Host-refresh_token"); err == nil {
+		claims := &Claims{}
+		_, err := jwt.ParseWithClaims(cookie.Value, claims, func(token *jwt.Token) (any, error) {
+			return []byte(app.JWTSecret), nil
+		})
+		if userID, convErr := strconv.Atoi(claims.Subject); err == nil && convErr == nil && claims.SessionID != 0 {
+			_ = app.Sessions.End(r.Context(), userID, claims.SessionID)
+		}
+	}
+
 	delCookie := http.Cookie{
 		Name:     "_Host-refresh_token",
 		Path:     "/",
@@ -271,3 +334,317 @@ func (app *application) deleteRefreshCookies(w http.ResponseWriter, r *http.Requ
 
 	w.WriteHeader(http.StatusAccepted)
 }
+
+// forgotPassword emails a password reset link. It answers 202 Accepted whether or
+// not the address belongs to a user, so it can't be used to find accounts.
+func (app *application) forgotPassword(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil || payload.Email == "" {
+		app.errorJSON(w, errors.New("an email address is required"), http.StatusBadRequest)
+		return
+	}
+
+	err = app.Resets.Request(r.Context(), payload.Email)
+	if err != nil {
+		log.Println("could not send password reset:", err)
+		app.errorJSON(w, errors.New("could not send password reset"), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// resetPassword sets a new password using a token from a reset link.
+func (app *application) resetPassword(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	err = app.Resets.Reset(r.Context(), payload.Token, payload.Password)
+	switch {
+	case errors.Is(err, passwordreset.ErrInvalidToken), errors.Is(err, passwordpolicy.ErrRejected):
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	case err != nil:
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// register creates an account for a new user, who can log in once they have
+// followed the verification link emailed to them.
+func (app *application) register(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+		Email     string `json:"email"`
+		Password  string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	user := data.User{
+		FirstName: payload.FirstName,
+		LastName:  payload.LastName,
+		Email:     payload.Email,
+	}
+
+	id, err := app.Registrations.Register(r.Context(), user, payload.Password)
+	switch {
+	case errors.Is(err, registration.ErrMissingFields), errors.Is(err, passwordpolicy.ErrRejected):
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	case err != nil:
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusCreated, map[string]int{"id": id})
+}
+
+// resendVerification emails a new verification link. Like forgotPassword, it
+// answers 202 Accepted whatever the address.
+func (app *application) resendVerification(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil || payload.Email == "" {
+		app.errorJSON(w, errors.New("an email address is required"), http.StatusBadRequest)
+		return
+	}
+
+	err = app.Registrations.Resend(r.Context(), payload.Email)
+	if err != nil {
+		log.Println("could not resend verification:", err)
+		app.errorJSON(w, errors.New("could not send verification email"), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// verifyEmail confirms an email address using a token from a verification link.
+func (app *application) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Token string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	err = app.Registrations.Verify(r.Context(), payload.Token)
+	switch {
+	case errors.Is(err, registration.ErrInvalidToken):
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	case err != nil:
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authenticateMFA finishes logging in a user with two-factor authentication: it
+// exchanges the token from authenticate and a code from their authenticator app,
+// or a recovery code, for a token pair.
+func (app *application) authenticateMFA(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.verifyMFAToken(r.Context(), payload.MFAToken)
+	if err != nil {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+
+	err = app.TwoFactor.Verify(r.Context(), user, payload.Code)
+	if err != nil {
+		if !errors.Is(err, twofactor.ErrInvalidCode) {
+			log.Printf("could not check two-factor code for user %d: %s\n", user.ID, err)
+		}
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+
+	tokenPairs, err := app.startSessionTokenPair(r, user)
+	if err != nil {
+		log.Printf("could not start a session for user %d: %s\n", user.ID, err)
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+
+	app.setRefreshCookie(w, tokenPairs.RefreshToken)
+
+	_ = app.writeJSON(w, http.StatusOK, tokenPairs)
+}
+
+// enrollTOTP starts two-factor enrollment for the logged in user, returning the
+// secret and provisioning URI for their authenticator app.
+func (app *application) enrollTOTP(w http.ResponseWriter, r *http.Request) {
+	enrollment, err := app.TwoFactor.Enroll(r.Context(), app.userFromContext(r))
+	switch {
+	case errors.Is(err, twofactor.ErrAlreadyEnabled):
+		app.errorJSON(w, err, http.StatusConflict)
+		return
+	case err != nil:
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, enrollment)
+}
+
+// confirmTOTP turns on two-factor authentication for the logged in user, given a
+// code from their app, and returns their recovery codes.
+func (app *application) confirmTOTP(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	codes, err := app.TwoFactor.Confirm(r.Context(), app.userFromContext(r).ID, payload.Code)
+	switch {
+	case errors.Is(err, twofactor.ErrInvalidCode), errors.Is(err, twofactor.ErrNotEnrolled):
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	case errors.Is(err, twofactor.ErrAlreadyEnabled):
+		app.errorJSON(w, err, http.StatusConflict)
+		return
+	case err != nil:
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, map[string][]string{"recovery_codes": codes})
+}
+
+// disableTOTP turns off two-factor authentication for the logged in user, given a
+// valid code.
+func (app *application) disableTOTP(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	err = app.TwoFactor.Disable(r.Context(), app.userFromContext(r), payload.Code)
+	switch {
+	case errors.Is(err, twofactor.ErrInvalidCode), errors.Is(err, twofactor.ErrNotEnrolled):
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	case err != nil:
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// NewAccessToken is returned once, when a personal access token is created; the
+// token itself can't be retrieved again.
+type NewAccessToken struct {
+	Token string `json:"token"`
+	*data.AccessToken
+}
+
+// createAccessToken creates a personal access token for the logged in user.
+// expires_in is the lifetime in seconds; zero or missing means the longest
+// allowed.
+func (app *application) createAccessToken(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Name      string   `json:"name"`
+		Scopes    []string `json:"scopes"`
+		ExpiresIn int64    `json:"expires_in"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	user := app.userFromContext(r)
+	token, stored, err := app.AccessTokens.Create(r.Context(), user.ID, payload.Name, payload.Scopes, time.Duration(payload.ExpiresIn)*time.Second)
+	switch {
+	case errors.Is(err, accesstoken.ErrInvalidRequest):
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	case err != nil:
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusCreated, NewAccessToken{Token: token, AccessToken: stored})
+}
+
+// allAccessTokens lists the logged in user's personal access tokens.
+func (app *application) allAccessTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := app.AccessTokens.List(r.Context(), app.userFromContext(r).ID)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	if tokens == nil {
+		tokens = []*data.AccessToken{}
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, tokens)
+}
+
+// revokeAccessToken deletes one of the logged in user's personal access tokens.
+func (app *application) revokeAccessToken(w http.ResponseWriter, r *http.Request) {
+	tokenID, err := strconv.Atoi(chi.URLParam(r, "tokenID"))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	err = app.AccessTokens.Revoke(r.Context(), app.userFromContext(r).ID, tokenID)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/spacesedan/testing-course/webapp/pkg/accesstoken"
+	"github.com/spacesedan/testing-course/webapp/pkg/oauth"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Introspection describes a token to a resource server (RFC 7662 section 2.2).
+// An inactive token is described by Active alone.
+type Introspection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	Audience  string `json:"aud,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+	TokenID   string `json:"jti,omitempty"`
+}
+
+// introspect tells a resource server whether a token is active, and if so whom
+// it belongs to and what it may do. Only confidential clients may ask, so tokens
+// can't be probed by anyone who knows a public client's id.
+func (app *application) introspect(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	err := r.ParseForm()
+	if err != nil {
+		app.oauthErrorJSON(w, &oauth.Error{Code: "invalid_request", Description: "the request body can't be parsed"})
+		return
+	}
+
+	client, err := app.authenticateClient(r)
+	if err != nil {
+		app.oauthErrorJSON(w, err)
+		return
+	}
+
+	if !client.Confidential() {
+		app.oauthErrorJSON(w, &oauth.Error{Code: "invalid_client", Description: "only confidential clients may introspect tokens"})
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		app.oauthErrorJSON(w, &oauth.Error{Code: "invalid_request", Description: "token is required"})
+		return
+	}
+
+	introspection, err := app.introspectToken(r.Context(), token)
+	if err != nil {
+		app.oauthErrorJSON(w, err)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, introspection)
+}
+
+// introspectToken describes an access token, an OAuth client's refresh token or
+// a personal access token. Anything else, and tokens that have expired or been
+// revoked, are inactive.
+func (app *application) introspectToken(ctx context.Context, token string) (Introspection, error) {
+	if accesstoken.IsAccessToken(token) {
+		user, t, err := app.AccessTokens.Authenticate(ctx, token)
+		if errors.Is(err, accesstoken.ErrInvalidToken) {
+			return Introspection{}, nil
+		} else if err != nil {
+			return Introspection{}, err
+		}
+
+		introspection := Introspection{
+			Active:    true,
+			Scope:     strings.Join(t.Scopes, " "),
+			Username:  user.Email,
+			TokenType: "Bearer",
+			IssuedAt:  t.CreatedAt.Unix(),
+			Subject:   strconv.Itoa(user.ID),
+		}
+		if t.ExpiresAt != nil {
+			introspection.ExpiresAt = t.ExpiresAt.Unix()
+		}
+
+		return introspection, nil
+	}
+
+	tokenType := "Bearer"
+	claims, err := app.parseAccessToken(token)
+	if err != nil {
+		tokenType = "refresh_token"
+		claims, err = app.parsePurposeToken(token, oauthRefreshPurpose)
+		if err != nil {
+			return Introspection{}, nil
+		}
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return Introspection{}, nil
+	}
+
+	user, err := app.DB.GetUser(ctx, userID)
+	if errors.Is(err, repository.ErrNotFound) {
+		return Introspection{}, nil
+	} else if err != nil {
+		return Introspection{}, err
+	}
+
+	if tokenRevoked(claims, user) {
+		return Introspection{}, nil
+	}
+
+	revoked, err := app.tokenIDRevoked(ctx, claims)
+	if err != nil {
+		return Introspection{}, err
+	} else if revoked {
+		return Introspection{}, nil
+	}
+
+	// tokens of a session that was logged out are refused by authRequired, so
+	// they aren't active here either; checking doesn't count as the session
+	// being seen, as a resource server isn't where the user is
+	if claims.SessionID != 0 {
+		session, err := app.DB.GetSession(ctx, claims.SessionID)
+		if errors.Is(err, repository.ErrNotFound) {
+			return Introspection{}, nil
+		} else if err != nil {
+			return Introspection{}, err
+		}
+
+		if session.UserID != user.ID || session.Expired(time.Now()) {
+			return Introspection{}, nil
+		}
+	}
+
+	// a user's own login carries every scope
+	scope := claims.Scope
+	if claims.ClientID == "" {
+		scope = strings.Join(app.OAuth.Scopes, " ")
+	}
+
+	introspection := Introspection{
+		Active:    true,
+		Scope:     scope,
+		ClientID:  claims.ClientID,
+		Username:  user.Email,
+		TokenType: tokenType,
+		Subject:   claims.Subject,
+		Issuer:    claims.Issuer,
+		TokenID:   claims.ID,
+	}
+	if claims.ExpiresAt != nil {
+		introspection.ExpiresAt = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		introspection.IssuedAt = claims.IssuedAt.Unix()
+	}
+	if len(claims.Audience) > 0 {
+		introspection.Audience = claims.Audience[0]
+	}
+
+	return introspection, nil
+}
+
+// revoke lets a client revoke an access or refresh token it was issued (RFC
+// 7009). Tokens that are already invalid need no revoking, so they succeed too.
+// Personal access tokens are revoked by their owner at /tokens instead.
+func (app *application) revoke(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.oauthErrorJSON(w, &oauth.Error{Code: "invalid_request", Description: "the request body can't be parsed"})
+		return
+	}
+
+	client, err := app.authenticateClient(r)
+	if err != nil {
+		app.oauthErrorJSON(w, err)
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	switch {
+	case token == "":
+		app.oauthErrorJSON(w, &oauth.Error{Code: "invalid_request", Description: "token is required"})
+		return
+	case accesstoken.IsAccessToken(token):
+		app.oauthErrorJSON(w, &oauth.Error{Code: "unsupported_token_type", Description: "personal access tokens are revoked by their owner"})
+		return
+	}
+
+	claims, err := app.parseAccessToken(token)
+	if err != nil {
+		claims, err = app.parsePurposeToken(token, oauthRefreshPurpose)
+		if err != nil {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+
+	switch {
+	case claims.ClientID != client.ClientID:
+		app.oauthErrorJSON(w, &oauth.Error{Code: "unauthorized_client", Description: "the token was not issued to this client"})
+		return
+	case claims.ID == "" || claims.ExpiresAt == nil:
+		app.oauthErrorJSON(w, &oauth.Error{Code: "unsupported_token_type", Description: "the token can't be revoked; it will expire on its own"})
+		return
+	}
+
+	err = app.DB.RevokeTokenID(r.Context(), claims.ID, claims.ExpiresAt.Time)
+	if err != nil {
+		app.oauthErrorJSON(w, fmt.Errorf("could not revoke token: %w", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
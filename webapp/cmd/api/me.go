@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"github.com/spacesedan/testing-course/webapp/pkg/passwordpolicy"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+	"net/http"
+	"strings"
+)
+
+// errWrongPassword is returned by changePassword when the current password
+// doesn't match.
+var errWrongPassword = errors.New("the current password is incorrect")
+
+// getMe returns the logged in user, so clients don't need to know their id.
+func (app *application) getMe(w http.ResponseWriter, r *http.Request) {
+	user := *app.userFromContext(r)
+	withAvatarURLs(&user)
+	_ = app.writeJSON(w, http.StatusOK, user)
+}
+
+// updateMe changes the logged in user's name. Only the fields of the payload can
+// be changed; anything else, like is_admin, is refused as an unknown field.
+// Leaving a field out keeps it as it is.
+func (app *application) updateMe(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		FirstName *string `json:"first_name"`
+		LastName  *string `json:"last_name"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	user := *app.userFromContext(r)
+	if payload.FirstName != nil {
+		user.FirstName = strings.TrimSpace(*payload.FirstName)
+	}
+	if payload.LastName != nil {
+		user.LastName = strings.TrimSpace(*payload.LastName)
+	}
+
+	if user.FirstName == "" || user.LastName == "" {
+		app.errorJSON(w, errors.New("first and last name must not be empty"), http.StatusBadRequest)
+		return
+	}
+
+	err = app.DB.UpdateUser(r.Context(), user)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	withAvatarURLs(&user)
+	_ = app.writeJSON(w, http.StatusOK, user)
+}
+
+// changePassword sets a new password for the logged in user, who must give their
+// current one. The new password must satisfy the password policy, like any
+// other, and every other session of the user is logged out.
+func (app *application) changePassword(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	user := app.userFromContext(r)
+	err = app.DB.WithTx(r.Context(), func(repo repository.DataBaseRepo) error {
+		if valid, err := user.PasswordMatches(payload.CurrentPassword); err != nil || !valid {
+			return errWrongPassword
+		}
+
+		err := app.Policy.Check(r.Context(), repo, user.ID, payload.NewPassword)
+		if err != nil {
+			return err
+		}
+
+		return repo.ResetPassword(r.Context(), user.ID, payload.NewPassword)
+	})
+	switch {
+	case errors.Is(err, errWrongPassword):
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	case errors.Is(err, passwordpolicy.ErrRejected):
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	case err != nil:
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	// whoever else knew the old password is logged out
+	err = app.Sessions.EndOthers(r.Context(), user.ID, app.sessionFromContext(r))
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
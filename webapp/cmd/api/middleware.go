@@ -1,6 +1,84 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/spacesedan/testing-course/webapp/pkg/accesstoken"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/sessions"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type contextKey string
+
+const (
+	// contextUserKey holds the *data.User that authRequired authenticated.
+	contextUserKey contextKey = "user"
+
+	// contextScopesKey holds the []string of scopes the request is limited to,
+	// if it was authenticated with a personal access token or a token issued to
+	// an OAuth client.
+	contextScopesKey contextKey = "scopes"
+
+	// contextSessionKey holds the id of the session the request's token belongs
+	// to, if it is a user's own login.
+	contextSessionKey contextKey = "session"
+
+	// contextIPKey holds the client's IP address, as found by addIPtoContext.
+	contextIPKey contextKey = "user_ip"
+)
+
+// ipFromContext returns the client's IP address, or "unknown" for requests that
+// didn't pass through addIPtoContext.
+func (app *application) ipFromContext(ctx context.Context) string {
+	ip, ok := ctx.Value(contextIPKey).(string)
+	if !ok {
+		return "unknown"
+	}
+	return ip
+}
+
+// addIPtoContext records the client's IP address, as the web application does,
+// so sessions can show where they were used from.
+func (app *application) addIPtoContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// get the ip (as accurately as possible)
+		ip, err := getIp(r)
+		if err != nil {
+			ip, _, _ = net.SplitHostPort(r.RemoteAddr)
+			if len(ip) == 0 {
+				ip = "unknown"
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), contextIPKey, ip)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func getIp(r *http.Request) (string, error) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "unknown", err
+	}
+
+	userIP := net.ParseIP(ip)
+	if userIP == nil {
+		return "", fmt.Errorf("userip: %q is not IP:port", r.RemoteAddr)
+	}
+
+	forward := r.Header.Get("X-Forwarded-For")
+	if len(forward) > 0 {
+		ip = forward
+	}
+
+	return ip, nil
+}
 
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -18,12 +96,139 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 
 func (app *application) authRequired(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, _, err := app.getTokenFromHeaderAndVerify(w, r)
+		// personal access tokens are bearer tokens too, told apart from JWTs by
+		// their prefix
+		if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); accesstoken.IsAccessToken(token) {
+			w.Header().Add("Vary", "Authorization")
+
+			user, accessToken, err := app.AccessTokens.Authenticate(r.Context(), token)
+			if err != nil {
+				if !errors.Is(err, accesstoken.ErrInvalidToken) {
+					log.Println("could not check access token:", err)
+				}
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), contextUserKey, user)
+			ctx = context.WithValue(ctx, contextScopesKey, accessToken.Scopes)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		_, claims, err := app.getTokenFromHeaderAndVerify(w, r)
 		if err != nil {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
+		// reject tokens issued before the user's sessions were revoked
+		userID, err := strconv.Atoi(claims.Subject)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		user, err := app.DB.GetUser(r.Context(), userID)
+		if err != nil || tokenRevoked(claims, user) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if revoked, err := app.tokenIDRevoked(r.Context(), claims); err != nil || revoked {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// reject tokens of a session that was logged out
+		if claims.SessionID != 0 {
+			_, err := app.Sessions.Check(r.Context(), user.ID, claims.SessionID, app.clientFromRequest(r))
+			if err != nil {
+				if !errors.Is(err, sessions.ErrEnded) {
+					log.Println("could not check session:", err)
+				}
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), contextUserKey, user)
+		ctx = context.WithValue(ctx, contextSessionKey, claims.SessionID)
+		if claims.ClientID != "" {
+			ctx = context.WithValue(ctx, contextScopesKey, strings.Fields(claims.Scope))
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// userFromContext returns the user authenticated by authRequired.
+func (app *application) userFromContext(r *http.Request) *data.User {
+	return r.Context().Value(contextUserKey).(*data.User)
+}
+
+// sessionFromContext returns the id of the session the request's token belongs
+// to, or zero if it doesn't belong to one.
+func (app *application) sessionFromContext(r *http.Request) int {
+	id, _ := r.Context().Value(contextSessionKey).(int)
+	return id
+}
+
+// scopesFromContext returns the scopes the request is limited to, and whether it
+// is limited at all; a user's own login is not.
+func (app *application) scopesFromContext(r *http.Request) ([]string, bool) {
+	scopes, limited := r.Context().Value(contextScopesKey).([]string)
+	return scopes, limited
+}
+
+// requireScope refuses requests authenticated with a personal access token or an
+// OAuth client's token that lacks scope. A user's own login carries every scope.
+// It must come after authRequired.
+func (app *application) requireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if scopes, limited := app.scopesFromContext(r); limited && !hasScope(scopes, scope) {
+				app.errorJSON(w, fmt.Errorf("token lacks the %s scope", scope), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// denyScopedTokens refuses requests authenticated with a personal access token or
+// an OAuth client's token, for routes that manage the account's own credentials,
+// so a leaked token can't be used to mint more or to lock the owner out. It must
+// come after authRequired.
+func (app *application) denyScopedTokens(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, limited := app.scopesFromContext(r); limited {
+			app.errorJSON(w, errors.New("log in to manage your credentials; tokens for scripts and apps can't"), http.StatusForbidden)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
+
+// adminRequired refuses requests from users who aren't administrators. It must
+// come after authRequired.
+func (app *application) adminRequired(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.userFromContext(r).IsAdmin != 1 {
+			app.errorJSON(w, errors.New("only administrators can do this"), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/oauth"
+	"github.com/spacesedan/testing-course/webapp/pkg/oidc"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// consentPage is the page of the SPA that asks the user to approve an OAuth
+// client; it is given the query of the authorization request.
+const consentPage = "/consent.html"
+
+// OAuthToken is the successful response of the token endpoint (RFC 6749 section
+// 5.1).
+type OAuthToken struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope"`
+
+	// IDToken is the OpenID Connect ID token, issued when the openid scope was
+	// granted for a user.
+	IDToken string `json:"id_token,omitempty"`
+}
+
+// AuthorizeResponse tells the consent page either where to send the user, or
+// that it has to ask them first.
+type AuthorizeResponse struct {
+	RedirectTo      string   `json:"redirect_to,omitempty"`
+	ConsentRequired bool     `json:"consent_required,omitempty"`
+	ClientName      string   `json:"client_name,omitempty"`
+	Scopes          []string `json:"scopes,omitempty"`
+}
+
+// NewOAuthClient is returned once, when a client is registered; a confidential
+// client's secret can't be retrieved again.
+type NewOAuthClient struct {
+	ClientSecret string `json:"client_secret,omitempty"`
+	*data.OAuthClient
+}
+
+// oauthErrorJSON writes err as an OAuth2 error response. Errors that aren't
+// *oauth.Error mean something is broken, and are logged rather than shown.
+func (app *application) oauthErrorJSON(w http.ResponseWriter, err error) {
+	var oauthErr *oauth.Error
+	if !errors.As(err, &oauthErr) {
+		log.Println("oauth:", err)
+		_ = app.writeJSON(w, http.StatusInternalServerError, oauth.Error{Code: "server_error"})
+		return
+	}
+
+	status := http.StatusBadRequest
+	if oauthErr.Code == "invalid_client" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		status = http.StatusUnauthorized
+	}
+
+	_ = app.writeJSON(w, status, oauthErr)
+}
+
+// authorize starts the authorization code flow. A valid request is handed to the
+// consent page; an invalid one is sent back to the client, unless the client or
+// its redirect URI can't be trusted.
+func (app *application) authorize(w http.ResponseWriter, r *http.Request) {
+	req := oauth.AuthorizeRequestFromQuery(r.URL.Query())
+
+	client, _, err := app.OAuth.ValidateAuthorize(r.Context(), req)
+	var oauthErr *oauth.Error
+	switch {
+	case err != nil && (client == nil || !errors.As(err, &oauthErr)):
+		app.oauthErrorJSON(w, err)
+		return
+	case err != nil:
+		http.Redirect(w, r, oauth.ErrorRedirect(req, oauthErr), http.StatusFound)
+		return
+	}
+
+	http.Redirect(w, r, consentPage+"?"+r.URL.RawQuery, http.StatusFound)
+}
+
+// approveAuthorization is called by the consent page for the logged in user.
+// Without approve it reports whether the user has to be asked, or approves
+// straight away if they already agreed to every scope; with it, it records their
+// answer. Either way the page is told where to send the user next.
+func (app *application) approveAuthorization(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		oauth.AuthorizeRequest
+		Approve *bool `json:"approve"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	req := payload.AuthorizeRequest
+	user := app.userFromContext(r)
+
+	client, scopes, err := app.OAuth.ValidateAuthorize(r.Context(), req)
+	var oauthErr *oauth.Error
+	switch {
+	case err != nil && (client == nil || !errors.As(err, &oauthErr)):
+		app.oauthErrorJSON(w, err)
+		return
+	case err != nil:
+		_ = app.writeJSON(w, http.StatusOK, AuthorizeResponse{RedirectTo: oauth.ErrorRedirect(req, oauthErr)})
+		return
+	}
+
+	if payload.Approve == nil {
+		needed, err := app.OAuth.ConsentNeeded(r.Context(), user.ID, client.ClientID, scopes)
+		if err != nil {
+			app.oauthErrorJSON(w, err)
+			return
+		}
+
+		if needed {
+			_ = app.writeJSON(w, http.StatusOK, AuthorizeResponse{ConsentRequired: true, ClientName: client.Name, Scopes: scopes})
+			return
+		}
+	} else if !*payload.Approve {
+		denied := &oauth.Error{Code: "access_denied", Description: "the user denied the request"}
+		_ = app.writeJSON(w, http.StatusOK, AuthorizeResponse{RedirectTo: oauth.ErrorRedirect(req, denied)})
+		return
+	}
+
+	redirectTo, err := app.OAuth.Approve(r.Context(), user.ID, req)
+	if err != nil {
+		app.oauthErrorJSON(w, err)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, AuthorizeResponse{RedirectTo: redirectTo})
+}
+
+// token is the OAuth2 token endpoint. Clients authenticate with HTTP Basic auth
+// or with client_id and client_secret form parameters; public clients send just
+// their client_id.
+func (app *application) token(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	err := r.ParseForm()
+	if err != nil {
+		app.oauthErrorJSON(w, &oauth.Error{Code: "invalid_request", Description: "the request body can't be parsed"})
+		return
+	}
+
+	client, err := app.authenticateClient(r)
+	if err != nil {
+		app.oauthErrorJSON(w, err)
+		return
+	}
+
+	var user *data.User
+	var scopes []string
+	var nonce string
+	withRefresh := false
+	withIDToken := false
+
+	switch r.PostForm.Get("grant_type") {
+	case oauth.GrantAuthorizationCode:
+		code, err := app.OAuth.Exchange(r.Context(), client, r.PostForm.Get("code"), r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier"))
+		if err != nil {
+			app.oauthErrorJSON(w, err)
+			return
+		}
+
+		user, err = app.DB.GetUser(r.Context(), code.UserID)
+		if err != nil {
+			app.oauthErrorJSON(w, err)
+			return
+		}
+		scopes = code.Scopes
+		nonce = code.Nonce
+		withRefresh = client.AllowsGrant(oauth.GrantRefreshToken)
+		withIDToken = hasScope(scopes, oidc.ScopeOpenID)
+
+	case oauth.GrantRefreshToken:
+		if !client.AllowsGrant(oauth.GrantRefreshToken) {
+			app.oauthErrorJSON(w, &oauth.Error{Code: "unauthorized_client", Description: "the client may not use the refresh token grant"})
+			return
+		}
+
+		user, scopes, err = app.oauthRefresh(r, client)
+		if err != nil {
+			app.oauthErrorJSON(w, err)
+			return
+		}
+		withRefresh = true
+		withIDToken = hasScope(scopes, oidc.ScopeOpenID)
+
+	case oauth.GrantClientCredentials:
+		scopes, err = app.OAuth.ClientCredentials(client, r.PostForm.Get("scope"))
+		if err != nil {
+			app.oauthErrorJSON(w, err)
+			return
+		}
+
+		// the client acts as the user who registered it
+		user, err = app.DB.GetUser(r.Context(), client.OwnerID)
+		if err != nil {
+			app.oauthErrorJSON(w, err)
+			return
+		}
+
+	case "":
+		app.oauthErrorJSON(w, &oauth.Error{Code: "invalid_request", Description: "grant_type is required"})
+		return
+
+	default:
+		app.oauthErrorJSON(w, &oauth.Error{Code: "unsupported_grant_type"})
+		return
+	}
+
+	tokenPairs, err := app.generateGrantedTokenPair(user, tokenGrant{ClientID: client.ClientID, Scopes: scopes})
+	if err != nil {
+		app.oauthErrorJSON(w, err)
+		return
+	}
+
+	response := OAuthToken{
+		AccessToken: tokenPairs.Token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(jwtTokenExpiry.Seconds()),
+		Scope:       strings.Join(scopes, " "),
+	}
+	if withRefresh {
+		response.RefreshToken = tokenPairs.RefreshToken
+	}
+
+	// the client credentials grant has no end user to identify
+	if withIDToken {
+		response.IDToken, err = app.OIDC.IDToken(user, client.ClientID, scopes, nonce, tokenPairs.Token)
+		if err != nil {
+			app.oauthErrorJSON(w, err)
+			return
+		}
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, response)
+}
+
+// oauthRefresh checks the refresh token in a refresh_token grant, which must
+// have been issued to client, and returns the user to issue new tokens to and
+// their scopes.
+func (app *application) oauthRefresh(r *http.Request, client *data.OAuthClient) (*data.User, []string, error) {
+	invalid := &oauth.Error{Code: "invalid_grant", Description: "the refresh token is invalid, expired or revoked"}
+
+	claims, err := app.parsePurposeToken(r.PostForm.Get("refresh_token"), oauthRefreshPurpose)
+	if err != nil || claims.ClientID != client.ClientID {
+		return nil, nil, invalid
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return nil, nil, invalid
+	}
+
+	user, err := app.DB.GetUser(r.Context(), userID)
+	if err != nil || tokenRevoked(claims, user) {
+		return nil, nil, invalid
+	}
+
+	if revoked, err := app.tokenIDRevoked(r.Context(), claims); err != nil || revoked {
+		return nil, nil, invalid
+	}
+
+	scopes, err := oauth.RefreshScopes(strings.Fields(claims.Scope), r.PostForm.Get("scope"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return user, scopes, nil
+}
+
+// authenticateClient returns the client making a request to one of the token
+// endpoints, whose form must already be parsed.
+func (app *application) authenticateClient(r *http.Request) (*data.OAuthClient, error) {
+	clientID, secret, err := clientCredentials(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return app.OAuth.AuthenticateClient(r.Context(), clientID, secret)
+}
+
+// clientCredentials returns the client id and secret of a token request, from
+// the Authorization header or the form. The values in the header are form
+// encoded (RFC 6749 section 2.3.1).
+func clientCredentials(r *http.Request) (string, string, error) {
+	invalid := &oauth.Error{Code: "invalid_client", Description: "the client credentials can't be read"}
+
+	if r.Header.Get("Authorization") == "" {
+		return r.PostForm.Get("client_id"), r.PostForm.Get("client_secret"), nil
+	}
+
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		return "", "", invalid
+	}
+
+	var err error
+	id, err = url.QueryUnescape(id)
+	if err != nil {
+		return "", "", invalid
+	}
+
+	secret, err = url.QueryUnescape(secret)
+	if err != nil {
+		return "", "", invalid
+	}
+
+	return id, secret, nil
+}
+
+// allOAuthClients lists the registered OAuth clients.
+func (app *application) allOAuthClients(w http.ResponseWriter, r *http.Request) {
+	clients, err := app.OAuth.Clients(r.Context())
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	if clients == nil {
+		clients = []*data.OAuthClient{}
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, clients)
+}
+
+// registerOAuthClient registers an OAuth client owned by the logged in user.
+func (app *application) registerOAuthClient(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		GrantTypes   []string `json:"grant_types"`
+		Scopes       []string `json:"scopes"`
+		Confidential bool     `json:"confidential"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	secret, client, err := app.OAuth.RegisterClient(r.Context(), data.OAuthClient{
+		Name:         payload.Name,
+		RedirectURIs: payload.RedirectURIs,
+		GrantTypes:   payload.GrantTypes,
+		Scopes:       payload.Scopes,
+		OwnerID:      app.userFromContext(r).ID,
+	}, payload.Confidential)
+
+	var oauthErr *oauth.Error
+	switch {
+	case errors.As(err, &oauthErr):
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	case err != nil:
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusCreated, NewOAuthClient{ClientSecret: secret, OAuthClient: client})
+}
+
+// deleteOAuthClient deletes an OAuth client, with its codes and consents.
+func (app *application) deleteOAuthClient(w http.ResponseWriter, r *http.Request) {
+	err := app.OAuth.DeleteClient(r.Context(), chi.URLParam(r, "clientID"))
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
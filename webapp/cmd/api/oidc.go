@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/spacesedan/testing-course/webapp/pkg/oauth"
+	"github.com/spacesedan/testing-course/webapp/pkg/oidc"
+	"net/http"
+)
+
+// openIDConfiguration serves the OpenID Connect discovery document, which tells
+// client libraries where our endpoints are and what they support.
+func (app *application) openIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	issuer := app.OIDC.Issuer
+
+	_ = app.writeJSON(w, http.StatusOK, oidc.Configuration{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             issuer + "/oauth/authorize",
+		TokenEndpoint:                     issuer + "/oauth/token",
+		UserInfoEndpoint:                  issuer + "/userinfo",
+		JWKSURI:                           issuer + "/.well-known/jwks.json",
+		IntrospectionEndpoint:             issuer + "/oauth/introspect",
+		RevocationEndpoint:                issuer + "/oauth/revoke",
+		ScopesSupported:                   app.OAuth.Scopes,
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{oauth.GrantAuthorizationCode, oauth.GrantRefreshToken, oauth.GrantClientCredentials},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{"RS256"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported:                   oidc.Claims,
+	})
+}
+
+// jwks serves the public keys ID tokens are signed with.
+func (app *application) jwks(w http.ResponseWriter, r *http.Request) {
+	_ = app.writeJSON(w, http.StatusOK, app.OIDC.KeySet())
+}
+
+// userInfo returns the claims about the logged in user that their token's scopes
+// allow. A user's own login sees all of them.
+func (app *application) userInfo(w http.ResponseWriter, r *http.Request) {
+	scopes, limited := app.scopesFromContext(r)
+	if !limited {
+		scopes = oidc.Scopes
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	_ = app.writeJSON(w, http.StatusOK, oidc.UserClaims(app.userFromContext(r), scopes))
+}
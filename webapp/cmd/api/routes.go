@@ -3,6 +3,8 @@ package main
 import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/spacesedan/testing-course/webapp/pkg/accesstoken"
+	"github.com/spacesedan/testing-course/webapp/pkg/oidc"
 	"net/http"
 )
 
@@ -13,27 +15,115 @@ func (app *application) routes() http.Handler {
 
 	// register middleware
 	mux.Use(middleware.Recoverer)
+	mux.Use(app.addIPtoContext)
 	mux.Use(app.enableCORS)
 	mux.Handle("/", http.StripPrefix("/", http.FileServer(http.Dir(HTMLDir))))
 
 	mux.Route("/web", func(r chi.Router) {
 		r.Post("/auth", app.authenticate)
+		r.Post("/auth/mfa", app.authenticateMFA)
 		r.Get("/refresh-token", app.refreshUsingCookie)
 		r.Get("/logout", app.deleteRefreshCookies)
 	})
 
 	// authentication routes - auth handler, refresh
 	mux.Post("/auth", app.authenticate)
+	mux.Post("/auth/mfa", app.authenticateMFA)
 	mux.Post("/refresh-token", app.refresh)
 
-	// protected routes
-	mux.Route("/users", func(r chi.Router) {
+	// password reset routes
+	mux.Post("/password/forgot", app.forgotPassword)
+	mux.Post("/password/reset", app.resetPassword)
+
+	// self-registration routes
+	mux.Post("/register", app.register)
+	mux.Post("/register/resend", app.resendVerification)
+	mux.Post("/register/verify", app.verifyEmail)
+
+	// two-factor enrollment for the logged in user
+	mux.Route("/mfa/totp", func(r chi.Router) {
+		r.Use(app.authRequired)
+		r.Use(app.denyScopedTokens)
+		r.Post("/", app.enrollTOTP)
+		r.Post("/confirm", app.confirmTOTP)
+		r.Delete("/", app.disableTOTP)
+	})
+
+	// personal access tokens of the logged in user
+	mux.Route("/tokens", func(r chi.Router) {
+		r.Use(app.authRequired)
+		r.Use(app.denyScopedTokens)
+		r.Get("/", app.allAccessTokens)
+		r.Post("/", app.createAccessToken)
+		r.Delete("/{tokenID}", app.revokeAccessToken)
+	})
+
+	// the logged in user's own account; their password and sessions can only be
+	// managed by the user themselves
+	mux.Route("/me", func(r chi.Router) {
+		r.Use(app.authRequired)
+		r.With(app.requireScope(accesstoken.ScopeUsersRead)).Get("/", app.getMe)
+		r.With(app.requireScope(accesstoken.ScopeUsersWrite)).Patch("/", app.updateMe)
+
+		r.Group(func(r chi.Router) {
+			r.Use(app.denyScopedTokens)
+			r.Post("/password", app.changePassword)
+			r.Get("/sessions", app.allSessions)
+			r.Delete("/sessions", app.endOtherSessions)
+			r.Delete("/sessions/{sessionID}", app.endSession)
+		})
+	})
+
+	// OAuth2 authorization server; the consent page approves requests for the
+	// logged in user
+	mux.Route("/oauth", func(r chi.Router) {
+		r.Get("/authorize", app.authorize)
+		r.With(app.authRequired, app.denyScopedTokens).Post("/authorize", app.approveAuthorization)
+		r.Post("/token", app.token)
+		r.Post("/introspect", app.introspect)
+		r.Post("/revoke", app.revoke)
+
+		r.Route("/clients", func(r chi.Router) {
+			r.Use(app.authRequired)
+			r.Use(app.denyScopedTokens)
+			r.Use(app.adminRequired)
+			r.Get("/", app.allOAuthClients)
+			r.Post("/", app.registerOAuthClient)
+			r.Delete("/{clientID}", app.deleteOAuthClient)
+		})
+	})
+
+	// OpenID Connect discovery, keys and claims
+	mux.Get("/.well-known/openid-configuration", app.openIDConfiguration)
+	mux.Get("/.well-known/jwks.json", app.jwks)
+	mux.Group(func(r chi.Router) {
 		r.Use(app.authRequired)
-		r.Get("/", app.allUsers)
-		r.Get("/{userID}", app.getUser)
-		r.Delete("/{userID}", app.deleteUser)
-		r.Put("/", app.insertUser)
-		r.Patch("/", app.updateUser)
+		r.Use(app.requireScope(oidc.ScopeOpenID))
+		r.Get("/userinfo", app.userInfo)
+		r.Post("/userinfo", app.userInfo)
+	})
+
+	mux.Route("/users", func(r chi.Router) {
+		// profile pictures are public, so pages can show them with a plain img tag
+		r.Get("/{userID}/avatar", app.getAvatar)
+
+		// protected routes; personal access tokens and OAuth clients need the matching scope
+		r.Group(func(r chi.Router) {
+			r.Use(app.authRequired)
+			r.With(app.requireScope(accesstoken.ScopeUsersRead)).Get("/", app.allUsers)
+			r.With(app.requireScope(accesstoken.ScopeUsersRead)).Get("/{userID}", app.getUser)
+			// only administrators may create, change or delete other users; users
+			// change themselves through /me
+			r.With(app.requireScope(accesstoken.ScopeUsersWrite), app.adminRequired).Delete("/{userID}", app.deleteUser)
+			r.With(app.requireScope(accesstoken.ScopeUsersWrite), app.adminRequired).Put("/", app.insertUser)
+			r.With(app.requireScope(accesstoken.ScopeUsersWrite), app.adminRequired).Patch("/", app.updateUser)
+			r.With(app.requireScope(accesstoken.ScopeUsersWrite)).Put("/{userID}/avatar", app.putAvatar)
+			r.With(app.requireScope(accesstoken.ScopeUsersWrite)).Delete("/{userID}/avatar", app.deleteAvatar)
+			r.With(app.requireScope(accesstoken.ScopeUsersRead)).Get("/{userID}/avatars", app.allAvatars)
+			r.With(app.requireScope(accesstoken.ScopeUsersRead)).Get("/{userID}/avatars/{imageID}", app.getPastAvatar)
+			r.With(app.requireScope(accesstoken.ScopeUsersWrite)).Put("/{userID}/avatars/{imageID}/current", app.chooseAvatar)
+			r.With(app.requireScope(accesstoken.ScopeUsersWrite)).Delete("/{userID}/avatars/{imageID}", app.deletePastAvatar)
+		})
 	})
 
 	return mux
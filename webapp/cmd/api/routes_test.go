@@ -13,12 +13,50 @@ func Test_application_routes(t *testing.T) {
 		method string
 	}{
 		{"/auth", "POST"},
+		{"/auth/mfa", "POST"},
+		{"/web/auth/mfa", "POST"},
 		{"/refresh-token", "POST"},
+		{"/password/forgot", "POST"},
+		{"/password/reset", "POST"},
+		{"/register", "POST"},
+		{"/register/resend", "POST"},
+		{"/register/verify", "POST"},
+		{"/mfa/totp/", "POST"},
+		{"/mfa/totp/confirm", "POST"},
+		{"/mfa/totp/", "DELETE"},
+		{"/tokens/", "GET"},
+		{"/tokens/", "POST"},
+		{"/tokens/{tokenID}", "DELETE"},
+		{"/me/", "GET"},
+		{"/me/", "PATCH"},
+		{"/me/password", "POST"},
+		{"/me/sessions", "GET"},
+		{"/me/sessions", "DELETE"},
+		{"/me/sessions/{sessionID}", "DELETE"},
+		{"/oauth/authorize", "GET"},
+		{"/oauth/authorize", "POST"},
+		{"/oauth/token", "POST"},
+		{"/oauth/introspect", "POST"},
+		{"/oauth/revoke", "POST"},
+		{"/oauth/clients/", "GET"},
+		{"/oauth/clients/", "POST"},
+		{"/oauth/clients/{clientID}", "DELETE"},
+		{"/.well-known/openid-configuration", "GET"},
+		{"/.well-known/jwks.json", "GET"},
+		{"/userinfo", "GET"},
+		{"/userinfo", "POST"},
 		{"/users/", "GET"},
 		{"/users/{userID}", "GET"},
 		{"/users/{userID}", "DELETE"},
 		{"/users/", "PATCH"},
 		{"/users/", "PUT"},
+		{"/users/{userID}/avatar", "GET"},
+		{"/users/{userID}/avatar", "PUT"},
+		{"/users/{userID}/avatar", "DELETE"},
+		{"/users/{userID}/avatars", "GET"},
+		{"/users/{userID}/avatars/{imageID}", "GET"},
+		{"/users/{userID}/avatars/{imageID}/current", "PUT"},
+		{"/users/{userID}/avatars/{imageID}", "DELETE"},
 	}
 
 	mux := app.routes()
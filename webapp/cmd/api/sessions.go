@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/sessions"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// UserSession is one place the logged in user is logged in, as listed at
+// /me/sessions. Current marks the session making the request.
+type UserSession struct {
+	*data.Session
+	Current bool `json:"current"`
+}
+
+// clientFromRequest describes where a request comes from, for its session.
+func (app *application) clientFromRequest(r *http.Request) sessions.Client {
+	return sessions.Client{
+		IP:        app.ipFromContext(r.Context()),
+		UserAgent: r.UserAgent(),
+	}
+}
+
+// startSessionTokenPair logs user in on the device making the request: it starts
+// a session for them and makes the tokens that belong to it.
+func (app *application) startSessionTokenPair(r *http.Request, user *data.User) (TokenPairs, error) {
+	session, err := app.Sessions.Start(r.Context(), user.ID, data.SessionAPI, app.clientFromRequest(r), time.Now().Add(refreshTokenExpiry))
+	if err != nil {
+		return TokenPairs{}, err
+	}
+
+	return app.generateGrantedTokenPair(user, tokenGrant{SessionID: session.ID})
+}
+
+// refreshSessionTokenPair makes new tokens for the session a refresh token
+// belongs to, keeping it alive as long as the new refresh token. It returns
+// sessions.ErrEnded if the session was logged out. Refresh tokens from before
+// sessions were recorded start a new one.
+func (app *application) refreshSessionTokenPair(r *http.Request, user *data.User, claims *Claims) (TokenPairs, error) {
+	if claims.SessionID == 0 {
+		return app.startSessionTokenPair(r, user)
+	}
+
+	client := app.clientFromRequest(r)
+	session, err := app.Sessions.Check(r.Context(), user.ID, claims.SessionID, client)
+	if err != nil {
+		return TokenPairs{}, err
+	}
+
+	err = app.Sessions.Extend(r.Context(), session, client, time.Now().Add(refreshTokenExpiry))
+	if err != nil {
+		return TokenPairs{}, err
+	}
+
+	return app.generateGrantedTokenPair(user, tokenGrant{SessionID: session.ID})
+}
+
+// allSessions lists the places the logged in user is logged in, to the API and
+// to the web application.
+func (app *application) allSessions(w http.ResponseWriter, r *http.Request) {
+	list, err := app.Sessions.List(r.Context(), app.userFromContext(r).ID)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	current := app.sessionFromContext(r)
+	userSessions := make([]UserSession, 0, len(list))
+	for _, s := range list {
+		userSessions = append(userSessions, UserSession{Session: s, Current: s.ID == current})
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, userSessions)
+}
+
+// endSession logs out one of the logged in user's sessions, which may be the one
+// making the request.
+func (app *application) endSession(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := strconv.Atoi(chi.URLParam(r, "sessionID"))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	err = app.Sessions.End(r.Context(), app.userFromContext(r).ID, sessionID)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// endOtherSessions logs out every session of the logged in user but the one
+// making the request.
+func (app *application) endOtherSessions(w http.ResponseWriter, r *http.Request) {
+	current := app.sessionFromContext(r)
+	if current == 0 {
+		app.errorJSON(w, errors.New("the request does not belong to a session"), http.StatusBadRequest)
+		return
+	}
+
+	err := app.Sessions.EndOthers(r.Context(), app.userFromContext(r).ID, current)
+	if err != nil {
+		app.repoErrorJSON(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
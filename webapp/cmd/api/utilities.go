@@ -3,7 +3,9 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
 	"io"
+	"log"
 	"net/http"
 )
 
@@ -59,6 +61,23 @@ func (app *application) errorJSON(w http.ResponseWriter, err error, status ...in
 	_ = app.writeJSON(w, statusCode, theError, "error")
 }
 
+// repoErrorJSON writes an error returned by the repository, picking the status
+// code from the typed repository errors; anything else means the database is broken.
+// Conflicts and failures may carry details of the database, such as constraint
+// names, so the client gets a fixed message and the error is logged.
+func (app *application) repoErrorJSON(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		app.errorJSON(w, err, http.StatusNotFound)
+	case errors.Is(err, repository.ErrDuplicate), errors.Is(err, repository.ErrConflict):
+		log.Println("repository conflict:", err)
+		app.errorJSON(w, errors.New("the request conflicts with existing data"), http.StatusConflict)
+	default:
+		log.Println("repository error:", err)
+		app.errorJSON(w, errors.New("internal server error"), http.StatusInternalServerError)
+	}
+}
+
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, data any) error {
 	maxBytes := 1024 * 1024 // one megabyte
 	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
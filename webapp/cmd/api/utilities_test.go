@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestApplication_repoErrorJSON(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		expectedStatus int
+		hidden         bool
+	}{
+		{"not found", fmt.Errorf("user 2: %w", repository.ErrNotFound), http.StatusNotFound, false},
+		{"duplicate", fmt.Errorf("%w: users_email_lower_idx", repository.ErrDuplicate), http.StatusConflict, true},
+		{"conflict", fmt.Errorf("%w: user_images_user_id_fkey", repository.ErrConflict), http.StatusConflict, true},
+		{"broken", errors.New("dial tcp 10.0.0.5:5432: connection refused"), http.StatusInternalServerError, true},
+	}
+
+	for _, e := range tests {
+		rr := httptest.NewRecorder()
+		app.repoErrorJSON(rr, e.err)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned; expected %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		var payload struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&payload); err != nil {
+			t.Fatalf("%s: %s", e.name, err)
+		}
+
+		// only a missing row is described to the client
+		if shown := strings.Contains(payload.Error.Message, e.err.Error()); shown == e.hidden {
+			t.Errorf("%s: unexpected message %q for %q", e.name, payload.Error.Message, e.err)
+		}
+	}
+}
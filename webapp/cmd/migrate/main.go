@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	_ "github.com/jackc/pgconn"
+	_ "github.com/jackc/pgx/v4"
+	_ "github.com/jackc/pgx/v4/stdlib"
+	"github.com/spacesedan/testing-course/webapp/pkg/migrations"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository/dbrepo"
+	"log"
+	_ "modernc.org/sqlite"
+	"os"
+	"strconv"
+)
+
+type application struct {
+	DSN      string
+	DBDriver string
+	SeedFile string
+}
+
+// Applies the embedded schema migrations to a database. Run it with go run ./cmd/migrate:
+// go run ./cmd/migrate up         // apply every pending migration
+// go run ./cmd/migrate down       // revert the most recent migration
+// go run ./cmd/migrate status     // list migrations and whether they have been applied
+// go run ./cmd/migrate goto 1     // migrate up or down to version 1 (0 reverts everything)
+// go run ./cmd/migrate baseline   // record a database created from the old pg_dump schema as being at version 1
+// go run ./cmd/migrate seed       // load the development data in sql/seed.sql
+// go run ./cmd/migrate -db-driver sqlite -dsn users.db up
+//
+// A database created from sql/users.sql, before there were migrations, has the
+// tables of version 1 but no version, so up refuses it. Run baseline once, then
+// up as usual:
+// go run ./cmd/migrate baseline && go run ./cmd/migrate up
+
+func main() {
+	var app application
+	flag.StringVar(&app.DSN, "dsn", "", "Database connection; defaults to the docker-compose Postgres, or users.db for sqlite")
+	flag.StringVar(&app.DBDriver, "db-driver", "postgres", "Database driver: postgres|sqlite")
+	flag.StringVar(&app.SeedFile, "seed-file", "./sql/seed.sql", "SQL file loaded by the seed command")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] up|down|status|goto <version>|baseline [version]|seed\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if app.DSN == "" && app.DBDriver == "sqlite" {
+		app.DSN = "users.db"
+	} else if app.DSN == "" {
+		app.DSN = "host=localhost port=5431 user=postgres password=postgres dbname=users sslmode=disable timezone=UTC connect_timeout=5"
+	}
+
+	var db *sql.DB
+	var err error
+	if app.DBDriver == "sqlite" {
+		db, err = sql.Open("sqlite", dbrepo.SQLiteDSN(app.DSN))
+	} else {
+		db, err = sql.Open("pgx", app.DSN)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	migrator, err := migrations.New(db, app.DBDriver)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := app.run(context.Background(), migrator, flag.Args()); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (app *application) run(ctx context.Context, migrator *migrations.Migrator, args []string) error {
+	switch args[0] {
+	case "up":
+		if err := migrator.Up(ctx); err != nil {
+			return err
+		}
+	case "down":
+		if err := migrator.Down(ctx); err != nil {
+			return err
+		}
+	case "goto":
+		if len(args) != 2 {
+			return fmt.Errorf("goto needs a version")
+		}
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		if err := migrator.Goto(ctx, version); err != nil {
+			return err
+		}
+	case "baseline":
+		version := migrations.BaselineVersion
+		if len(args) == 2 {
+			var err error
+			version, err = strconv.Atoi(args[1])
+			if err != nil {
+				return fmt.Errorf("invalid version %q", args[1])
+			}
+		}
+		if err := migrator.Baseline(ctx, version); err != nil {
+			return err
+		}
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			if s.Applied {
+				fmt.Printf("%04d_%s\tapplied %s\n", s.Version, s.Name, s.AppliedAt.Format("2006-01-02 15:04:05"))
+			} else {
+				fmt.Printf("%04d_%s\tpending\n", s.Version, s.Name)
+			}
+		}
+		return nil
+	case "seed":
+		seed, err := os.ReadFile(app.SeedFile)
+		if err != nil {
+			return err
+		}
+		if _, err := migrator.DB.ExecContext(ctx, string(seed)); err != nil {
+			return err
+		}
+		log.Printf("Loaded %s\n", app.SeedFile)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q; expected up, down, status, goto, baseline or seed", args[0])
+	}
+
+	version, err := migrator.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Database is at version %d (latest is %d)\n", version, migrator.Latest())
+	return nil
+}
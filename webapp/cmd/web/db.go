@@ -1,15 +1,37 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	stderrors "errors"
+	"fmt"
 	_ "github.com/jackc/pgconn"
 	_ "github.com/jackc/pgx/v4"
 	_ "github.com/jackc/pgx/v4/stdlib"
+	"github.com/spacesedan/testing-course/webapp/pkg/migrations"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository/dbrepo"
 	"log"
+	_ "modernc.org/sqlite"
 )
 
-func openDB(dsn string) (*sql.DB, error) {
-	db, err := sql.Open("pgx", dsn)
+const (
+	defaultPostgresDSN = "host=localhost port=5431 user=postgres password=postgres dbname=users sslmode=disable timezone=UTC connect_timeout=5"
+	defaultSQLiteDSN   = "users.db"
+)
+
+func openDB(driver, dsn string) (*sql.DB, error) {
+	var db *sql.DB
+	var err error
+
+	switch driver {
+	case "postgres":
+		db, err = sql.Open("pgx", dsn)
+	case "sqlite":
+		db, err = sql.Open("sqlite", dbrepo.SQLiteDSN(dsn))
+	default:
+		return nil, fmt.Errorf("unknown database driver %q; expected postgres or sqlite", driver)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -23,11 +45,45 @@ func openDB(dsn string) (*sql.DB, error) {
 }
 
 func (app *application) connectToDB() (*sql.DB, error) {
-	connection, err := openDB(app.DSN)
+	dsn := app.DSN
+	if dsn == "" && app.DBDriver == "sqlite" {
+		dsn = defaultSQLiteDSN
+	} else if dsn == "" {
+		dsn = defaultPostgresDSN
+	}
+
+	connection, err := openDB(app.DBDriver, dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	log.Println("Connected to Postgres")
+	log.Printf("Connected to %s\n", app.DBDriver)
 	return connection, nil
 }
+
+// newRepo returns the repository for the configured database driver.
+func (app *application) newRepo(conn *sql.DB, timeouts dbrepo.Timeouts) repository.DataBaseRepo {
+	if app.DBDriver == "sqlite" {
+		return &dbrepo.SQLiteDBRepo{DB: conn, Timeouts: timeouts, Hasher: app.Hasher, HistoryLimit: app.Policy.History - 1}
+	}
+
+	return &dbrepo.PostgresDBRepo{DB: conn, Timeouts: timeouts, Hasher: app.Hasher, HistoryLimit: app.Policy.History - 1}
+}
+
+// checkSchema makes sure every migration has been applied, so that we never run
+// against a schema we don't understand.
+func (app *application) checkSchema(conn *sql.DB) error {
+	migrator, err := migrations.New(conn, app.DBDriver)
+	if err != nil {
+		return err
+	}
+
+	err = migrator.Check(context.Background())
+	if stderrors.Is(err, migrations.ErrNeedsBaseline) {
+		return fmt.Errorf("%w; run: go run ./cmd/migrate -db-driver %s -dsn ... baseline, then the same with up", err, app.DBDriver)
+	} else if err != nil {
+		return fmt.Errorf("%w; run: go run ./cmd/migrate -db-driver %s -dsn ... up", err, app.DBDriver)
+	}
+
+	return nil
+}
@@ -1,20 +1,27 @@
 package main
 
 import (
-	"fmt"
+	stderrors "errors"
 	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/imaging"
+	"github.com/spacesedan/testing-course/webapp/pkg/passwordpolicy"
+	"github.com/spacesedan/testing-course/webapp/pkg/passwordreset"
+	"github.com/spacesedan/testing-course/webapp/pkg/registration"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+	"github.com/spacesedan/testing-course/webapp/pkg/storage"
+	"github.com/spacesedan/testing-course/webapp/pkg/totp"
+	"github.com/spacesedan/testing-course/webapp/pkg/twofactor"
+	"github.com/spacesedan/testing-course/webapp/pkg/upload"
 	"html/template"
-	"io"
 	"log"
 	"net/http"
-	"os"
+	"net/url"
 	"path"
-	"path/filepath"
+	"strconv"
 	"time"
 )
 
 var pathToTemplates string = "./templates/"
-var pathToStatic string = "./static/img/"
 
 func (app *application) Home(w http.ResponseWriter, r *http.Request) {
 
@@ -35,6 +42,189 @@ func (app *application) Profile(w http.ResponseWriter, r *http.Request) {
 	_ = app.render(w, r, "profile.page.gohtml", &TemplateData{})
 }
 
+func (app *application) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	_ = app.render(w, r, "forgot-password.page.gohtml", &TemplateData{})
+}
+
+func (app *application) PostForgotPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required("email")
+
+	if !form.Valid() {
+		app.Session.Put(r.Context(), "error", "Enter your email address")
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	// the same message is shown whether or not the address has an account
+	err = app.Resets.Request(r.Context(), r.Form.Get("email"))
+	if err != nil {
+		log.Println("could not send password reset:", err)
+		app.Session.Put(r.Context(), "error", "Could not send a reset link; please try again later")
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "If that address has an account, a link to reset its password is on its way")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	td := make(map[string]any)
+	td["token"] = r.URL.Query().Get("token")
+
+	_ = app.render(w, r, "reset-password.page.gohtml", &TemplateData{Data: td})
+}
+
+func (app *application) PostResetPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	token := r.Form.Get("token")
+	retry := "/reset-password?" + url.Values{"token": {token}}.Encode()
+
+	form := NewForm(r.PostForm)
+	form.Required("token", "password", "confirm_password")
+	form.Check(r.Form.Get("password") == r.Form.Get("confirm_password"), "confirm_password", "Passwords do not match")
+
+	if !form.Valid() {
+		app.Session.Put(r.Context(), "error", "Enter the same new password twice")
+		http.Redirect(w, r, retry, http.StatusSeeOther)
+		return
+	}
+
+	err = app.Resets.Reset(r.Context(), token, r.Form.Get("password"))
+	switch {
+	case stderrors.Is(err, passwordreset.ErrInvalidToken):
+		app.Session.Put(r.Context(), "error", "That reset link is invalid or has expired; please ask for a new one")
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	case stderrors.Is(err, passwordpolicy.ErrRejected):
+		app.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, retry, http.StatusSeeOther)
+		return
+	case err != nil:
+		log.Println("could not reset password:", err)
+		app.Session.Put(r.Context(), "error", "Could not reset your password; please try again later")
+		http.Redirect(w, r, retry, http.StatusSeeOther)
+		return
+	}
+
+	// every existing session, including this one, now belongs to the old password
+	_ = app.Session.Destroy(r.Context())
+	app.Session.Put(r.Context(), "flash", "Your password has been reset; please log in")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (app *application) Register(w http.ResponseWriter, r *http.Request) {
+	_ = app.render(w, r, "register.page.gohtml", &TemplateData{})
+}
+
+func (app *application) PostRegister(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required("first_name", "last_name", "email", "password", "confirm_password")
+	form.Check(r.Form.Get("password") == r.Form.Get("confirm_password"), "confirm_password", "Passwords do not match")
+
+	if !form.Valid() {
+		app.Session.Put(r.Context(), "error", "Fill in every field, and enter the same password twice")
+		http.Redirect(w, r, "/register", http.StatusSeeOther)
+		return
+	}
+
+	user := data.User{
+		FirstName: r.Form.Get("first_name"),
+		LastName:  r.Form.Get("last_name"),
+		Email:     r.Form.Get("email"),
+	}
+
+	_, err = app.Registrations.Register(r.Context(), user, r.Form.Get("password"))
+	switch {
+	case stderrors.Is(err, passwordpolicy.ErrRejected), stderrors.Is(err, registration.ErrMissingFields):
+		app.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, "/register", http.StatusSeeOther)
+		return
+	case stderrors.Is(err, repository.ErrDuplicate):
+		app.Session.Put(r.Context(), "error", "An account with that email address already exists")
+		http.Redirect(w, r, "/register", http.StatusSeeOther)
+		return
+	case err != nil:
+		log.Println("could not register user:", err)
+		app.Session.Put(r.Context(), "error", "Could not create your account; please try again later")
+		http.Redirect(w, r, "/register", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "Your account has been created; follow the link we emailed you to confirm your address, then log in")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (app *application) PostResendVerification(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required("email")
+
+	if !form.Valid() {
+		app.Session.Put(r.Context(), "error", "Enter your email address")
+		http.Redirect(w, r, "/register", http.StatusSeeOther)
+		return
+	}
+
+	// the same message is shown whether or not the address needs verifying
+	err = app.Registrations.Resend(r.Context(), r.Form.Get("email"))
+	if err != nil {
+		log.Println("could not resend verification:", err)
+		app.Session.Put(r.Context(), "error", "Could not send a verification link; please try again later")
+		http.Redirect(w, r, "/register", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "If that address is waiting to be confirmed, a new link is on its way")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// VerifyEmail confirms an email address from the link in a verification email.
+func (app *application) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	err := app.Registrations.Verify(r.Context(), r.URL.Query().Get("token"))
+	switch {
+	case stderrors.Is(err, registration.ErrInvalidToken):
+		app.Session.Put(r.Context(), "error", "That verification link is invalid or has expired; please ask for a new one")
+		http.Redirect(w, r, "/register", http.StatusSeeOther)
+		return
+	case err != nil:
+		log.Println("could not verify email:", err)
+		app.Session.Put(r.Context(), "error", "Could not confirm your email address; please try again later")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "Your email address has been confirmed; please log in")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
 type TemplateData struct {
 	IP    string
 	Data  map[string]any
@@ -91,7 +281,7 @@ func (app *application) Login(w http.ResponseWriter, r *http.Request) {
 	email := r.Form.Get("email")
 	password := r.Form.Get("password")
 
-	user, err := app.DB.GetUserByEmail(email)
+	user, err := app.DB.GetUserByEmail(r.Context(), email)
 	if err != nil {
 		app.Session.Put(r.Context(), "error", "Invalid login")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -106,16 +296,289 @@ func (app *application) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// self-registered users must confirm their email address first
+	if !user.EmailVerified() {
+		app.Session.Put(r.Context(), "error", "Please confirm your email address before logging in")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	// users with two-factor authentication must give a code before they are
+	// logged in; until then the session only remembers who they said they were
+	if user.TOTPEnabled() {
+		app.Session.Put(r.Context(), "mfa_user_id", user.ID)
+		app.Session.Put(r.Context(), "mfa_expires", time.Now().Add(mfaLoginTimeout))
+		http.Redirect(w, r, "/login/mfa", http.StatusSeeOther)
+		return
+	}
+
+	if !app.logIn(w, r, user) {
+		return
+	}
+
+	// redirect to some other page
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
+
+// logIn puts the user in the session, with a new session token, and records the
+// session so it shows on their devices page. If it can't, it sends the user back
+// to the login page and returns false.
+func (app *application) logIn(w http.ResponseWriter, r *http.Request, user *data.User) bool {
+	session, err := app.Sessions.Start(r.Context(), user.ID, data.SessionWeb, app.clientFromRequest(r), time.Now().Add(app.Session.Lifetime))
+	if err != nil {
+		log.Printf("could not start a session for user %d: %s\n", user.ID, err)
+		app.Session.Put(r.Context(), "error", "Could not log you in; please try again later")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return false
+	}
+
+	// put user information in the session; it is stored by value, which is
+	// how every handler reads it back
+	app.Session.Put(r.Context(), "user", *user)
+	app.Session.Put(r.Context(), "session_id", session.ID)
+
 	// prevent fixation attack
 	_ = app.Session.RenewToken(r.Context())
 
 	// store success message in the session
 	app.Session.Put(r.Context(), "flash", "Successful login")
 
-	// redirect to some other page
+	return true
+}
+
+// mfaLoginTimeout is how long a user has to give their two-factor code after
+// their password.
+const mfaLoginTimeout = 5 * time.Minute
+
+// pendingMFAUser returns the user waiting to give a two-factor code, or nil if
+// there is none or they took too long.
+func (app *application) pendingMFAUser(r *http.Request) *data.User {
+	id := app.Session.GetInt(r.Context(), "mfa_user_id")
+	if id == 0 || time.Now().After(app.Session.GetTime(r.Context(), "mfa_expires")) {
+		return nil
+	}
+
+	user, err := app.DB.GetUser(r.Context(), id)
+	if err != nil {
+		return nil
+	}
+
+	return user
+}
+
+func (app *application) LoginMFA(w http.ResponseWriter, r *http.Request) {
+	if app.pendingMFAUser(r) == nil {
+		app.Session.Put(r.Context(), "error", "Log in first")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	_ = app.render(w, r, "login-mfa.page.gohtml", &TemplateData{})
+}
+
+func (app *application) PostLoginMFA(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	user := app.pendingMFAUser(r)
+	if user == nil {
+		app.Session.Remove(r.Context(), "mfa_user_id")
+		app.Session.Remove(r.Context(), "mfa_expires")
+		app.Session.Put(r.Context(), "error", "Your login has expired; please log in again")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	err = app.TwoFactor.Verify(r.Context(), user, r.Form.Get("code"))
+	if err != nil {
+		if !stderrors.Is(err, twofactor.ErrInvalidCode) {
+			log.Printf("could not check two-factor code for user %d: %s\n", user.ID, err)
+		}
+		app.Session.Put(r.Context(), "error", "Invalid code")
+		http.Redirect(w, r, "/login/mfa", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Remove(r.Context(), "mfa_user_id")
+	app.Session.Remove(r.Context(), "mfa_expires")
+	if !app.logIn(w, r, user) {
+		return
+	}
+
 	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
 }
 
+// TwoFactorSettings shows the logged in user's two-factor authentication settings.
+func (app *application) TwoFactorSettings(w http.ResponseWriter, r *http.Request) {
+	app.renderTwoFactor(w, r, nil)
+}
+
+// renderTwoFactor renders the two-factor settings page; recoveryCodes are shown
+// right after enrollment is confirmed, and never again.
+func (app *application) renderTwoFactor(w http.ResponseWriter, r *http.Request, recoveryCodes []string) {
+	sessionUser := app.Session.Get(r.Context(), "user").(data.User)
+	user, err := app.DB.GetUser(r.Context(), sessionUser.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "could not load user", http.StatusInternalServerError)
+		return
+	}
+
+	td := make(map[string]any)
+	td["enabled"] = user.TOTPEnabled()
+	td["recovery_codes"] = recoveryCodes
+	if !user.TOTPEnabled() && user.TOTPSecret != "" {
+		td["secret"] = user.TOTPSecret
+		td["uri"] = totp.ProvisioningURI(app.TwoFactor.Issuer, user.Email, user.TOTPSecret)
+	}
+
+	_ = app.render(w, r, "two-factor.page.gohtml", &TemplateData{Data: td})
+}
+
+func (app *application) PostEnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	sessionUser := app.Session.Get(r.Context(), "user").(data.User)
+	user, err := app.DB.GetUser(r.Context(), sessionUser.ID)
+	if err == nil {
+		_, err = app.TwoFactor.Enroll(r.Context(), user)
+	}
+
+	switch {
+	case stderrors.Is(err, twofactor.ErrAlreadyEnabled):
+		app.Session.Put(r.Context(), "error", "Two-factor authentication is already on")
+	case err != nil:
+		log.Println("could not start two-factor enrollment:", err)
+		app.Session.Put(r.Context(), "error", "Could not set up two-factor authentication; please try again later")
+	}
+
+	http.Redirect(w, r, "/user/two-factor", http.StatusSeeOther)
+}
+
+func (app *application) PostConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	sessionUser := app.Session.Get(r.Context(), "user").(data.User)
+	codes, err := app.TwoFactor.Confirm(r.Context(), sessionUser.ID, r.Form.Get("code"))
+	switch {
+	case stderrors.Is(err, twofactor.ErrInvalidCode), stderrors.Is(err, twofactor.ErrNotEnrolled), stderrors.Is(err, twofactor.ErrAlreadyEnabled):
+		app.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, "/user/two-factor", http.StatusSeeOther)
+		return
+	case err != nil:
+		log.Println("could not confirm two-factor enrollment:", err)
+		app.Session.Put(r.Context(), "error", "Could not set up two-factor authentication; please try again later")
+		http.Redirect(w, r, "/user/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "Two-factor authentication is on")
+	app.renderTwoFactor(w, r, codes)
+}
+
+func (app *application) PostDisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	sessionUser := app.Session.Get(r.Context(), "user").(data.User)
+	user, err := app.DB.GetUser(r.Context(), sessionUser.ID)
+	if err == nil {
+		err = app.TwoFactor.Disable(r.Context(), user, r.Form.Get("code"))
+	}
+
+	switch {
+	case stderrors.Is(err, twofactor.ErrInvalidCode), stderrors.Is(err, twofactor.ErrNotEnrolled):
+		app.Session.Put(r.Context(), "error", err.Error())
+	case err != nil:
+		log.Println("could not disable two-factor authentication:", err)
+		app.Session.Put(r.Context(), "error", "Could not turn off two-factor authentication; please try again later")
+	default:
+		app.Session.Put(r.Context(), "flash", "Two-factor authentication is off")
+	}
+
+	http.Redirect(w, r, "/user/two-factor", http.StatusSeeOther)
+}
+
+// Devices lists the places the logged in user is logged in, to this application
+// and to the API, so they can log any of them out.
+func (app *application) Devices(w http.ResponseWriter, r *http.Request) {
+	sessionUser := app.Session.Get(r.Context(), "user").(data.User)
+	list, err := app.Sessions.List(r.Context(), sessionUser.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "could not load devices", http.StatusInternalServerError)
+		return
+	}
+
+	td := make(map[string]any)
+	td["sessions"] = list
+	td["current"] = app.Session.GetInt(r.Context(), "session_id")
+
+	_ = app.render(w, r, "devices.page.gohtml", &TemplateData{Data: td})
+}
+
+// PostLogOutDevice logs out one of the logged in user's sessions; logging out the
+// current one logs them out here.
+func (app *application) PostLogOutDevice(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(r.Form.Get("id"))
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	sessionUser := app.Session.Get(r.Context(), "user").(data.User)
+	err = app.Sessions.End(r.Context(), sessionUser.ID, id)
+	switch {
+	case stderrors.Is(err, repository.ErrNotFound):
+		app.Session.Put(r.Context(), "error", "That device is already logged out")
+	case err != nil:
+		log.Println("could not end session:", err)
+		app.Session.Put(r.Context(), "error", "Could not log the device out; please try again later")
+	case id == app.Session.GetInt(r.Context(), "session_id"):
+		_ = app.Session.Destroy(r.Context())
+		app.Session.Put(r.Context(), "flash", "You have been logged out")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	default:
+		app.Session.Put(r.Context(), "flash", "The device has been logged out")
+	}
+
+	http.Redirect(w, r, "/user/devices", http.StatusSeeOther)
+}
+
+// PostLogOutOtherDevices logs out every session of the logged in user but this
+// one.
+func (app *application) PostLogOutOtherDevices(w http.ResponseWriter, r *http.Request) {
+	sessionUser := app.Session.Get(r.Context(), "user").(data.User)
+	err := app.Sessions.EndOthers(r.Context(), sessionUser.ID, app.Session.GetInt(r.Context(), "session_id"))
+	if err != nil {
+		log.Println("could not end sessions:", err)
+		app.Session.Put(r.Context(), "error", "Could not log the other devices out; please try again later")
+	} else {
+		app.Session.Put(r.Context(), "flash", "Every other device has been logged out")
+	}
+
+	http.Redirect(w, r, "/user/devices", http.StatusSeeOther)
+}
+
 func (app *application) authenticate(r *http.Request, user *data.User, password string) bool {
 	// check to see if the input password matches the one stored in db
 	// if it doesn't return false
@@ -123,17 +586,34 @@ func (app *application) authenticate(r *http.Request, user *data.User, password
 		return false
 	}
 
-	// put user information in the session
-	app.Session.Put(r.Context(), "user", user)
+	// upgrade an outdated hash while we have the plain text password
+	if user.PasswordNeedsRehash(app.Hasher) {
+		if err := app.DB.UpdatePasswordHash(r.Context(), user.ID, password); err != nil {
+			log.Printf("could not rehash password for user %d: %s\n", user.ID, err)
+		}
+	}
+
 	return true
 
 }
 
 func (app *application) UploadProfilePic(w http.ResponseWriter, r *http.Request) {
 	// call a function that extracts a file from an upload (request)
-	files, err := app.UploadFiles(r, pathToStatic)
+	files, err := app.UploadFiles(r, app.Blobs)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), uploadErrorStatus(err))
+		return
+	}
+
+	// only the first file is the profile picture
+	for _, f := range files[1:] {
+		_ = app.Blobs.Delete(r.Context(), f.FileName)
+	}
+
+	// resize it, and strip the metadata
+	fileName, err := imaging.Store(r.Context(), app.Blobs, files[0].FileName)
+	if err != nil {
+		http.Error(w, err.Error(), uploadErrorStatus(err))
 		return
 	}
 
@@ -143,84 +623,164 @@ func (app *application) UploadProfilePic(w http.ResponseWriter, r *http.Request)
 	// create a variable of type data.UserImage
 	userImg := data.UserImage{
 		UserID:    user.ID,
-		FileName:  files[0].OriginalFileName,
+		FileName:  fileName,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
 
 	// insert the user image into user_images
-	_, err = app.DB.InsertUserImage(userImg)
+	_, err = app.DB.InsertUserImage(r.Context(), userImg)
 	if err != nil {
+		imaging.Remove(r.Context(), app.Blobs, userImg.FileName)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	// refresh the sessional variable "user"
-	updatedUser, err := app.DB.GetUser(user.ID)
+	updatedUser, err := app.DB.GetUser(r.Context(), user.ID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	app.Session.Put(r.Context(), "user", updatedUser)
+	app.Session.Put(r.Context(), "user", *updatedUser)
 
 	// redirect back to profile page
 	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
 
 }
 
-type UploadedFile struct {
-	OriginalFileName string
-	FileSize         int64
+// Pictures lists every profile picture the logged in user has uploaded and not
+// deleted, so they can go back to one of them.
+func (app *application) Pictures(w http.ResponseWriter, r *http.Request) {
+	sessionUser := app.Session.Get(r.Context(), "user").(data.User)
+	images, err := app.DB.AllUserImages(r.Context(), sessionUser.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "could not load profile pictures", http.StatusInternalServerError)
+		return
+	}
+
+	td := make(map[string]any)
+	td["images"] = images
+
+	_ = app.render(w, r, "pictures.page.gohtml", &TemplateData{Data: td})
 }
 
-func (app *application) UploadFiles(r *http.Request, uploadDir string) ([]*UploadedFile, error) {
-	var uploadedFiles []*UploadedFile
+// PostUsePicture makes one of the logged in user's past pictures their profile
+// picture again.
+func (app *application) PostUsePicture(w http.ResponseWriter, r *http.Request) {
+	id, ok := pictureID(w, r)
+	if !ok {
+		return
+	}
 
-	err := r.ParseMultipartForm(int64(1024 * 1024 * 5))
-	if err != nil {
-		return nil, fmt.Errorf("the uploaded file is too big and less than %d bytes", 1024*1024*5)
+	sessionUser := app.Session.Get(r.Context(), "user").(data.User)
+	err := app.DB.SetCurrentUserImage(r.Context(), sessionUser.ID, id)
+	switch {
+	case stderrors.Is(err, repository.ErrNotFound):
+		app.Session.Put(r.Context(), "error", "That picture has been deleted")
+	case err != nil:
+		log.Println("could not change profile picture:", err)
+		app.Session.Put(r.Context(), "error", "Could not change your profile picture; please try again later")
+	default:
+		app.refreshSessionUser(r, sessionUser.ID)
+		app.Session.Put(r.Context(), "flash", "Your profile picture has been changed")
 	}
 
-	for _, fHeaders := range r.MultipartForm.File {
-		for _, hdr := range fHeaders {
-			uploadedFiles, err = func(uploadedFiles []*UploadedFile) ([]*UploadedFile, error) {
-				var uploadedFile UploadedFile
+	http.Redirect(w, r, "/user/pictures", http.StatusSeeOther)
+}
 
-				// Get the file from the request
-				infile, err := hdr.Open()
-				if err != nil {
-					return nil, err
-				}
-				defer infile.Close()
+// PostDeletePicture deletes one of the logged in user's pictures; its files are
+// removed later by the image garbage collector.
+func (app *application) PostDeletePicture(w http.ResponseWriter, r *http.Request) {
+	id, ok := pictureID(w, r)
+	if !ok {
+		return
+	}
 
-				uploadedFile.OriginalFileName = hdr.Filename
+	sessionUser := app.Session.Get(r.Context(), "user").(data.User)
+	err := app.DB.DeleteUserImage(r.Context(), sessionUser.ID, id)
+	switch {
+	case stderrors.Is(err, repository.ErrNotFound):
+		app.Session.Put(r.Context(), "error", "That picture has already been deleted")
+	case err != nil:
+		log.Println("could not delete profile picture:", err)
+		app.Session.Put(r.Context(), "error", "Could not delete the picture; please try again later")
+	default:
+		app.refreshSessionUser(r, sessionUser.ID)
+		app.Session.Put(r.Context(), "flash", "The picture has been deleted")
+	}
 
-				var outfile *os.File
+	http.Redirect(w, r, "/user/pictures", http.StatusSeeOther)
+}
 
-				defer outfile.Close()
+// pictureID reads the id of a picture from the posted form. It writes the error
+// response if there isn't one.
+func pictureID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return 0, false
+	}
 
-				// create a new file that will hold the incoming file information and store it within our file system
-				// if err return nil and the error
-				// else copy the content of the incoming file to the newly create file
-				if outfile, err = os.Create(filepath.Join(uploadDir, uploadedFile.OriginalFileName)); err != nil {
-					return nil, err
-				} else {
-					fileSize, err := io.Copy(outfile, infile)
-					if err != nil {
-						return nil, err
-					}
-					uploadedFile.FileSize = fileSize
-				}
+	id, err := strconv.Atoi(r.Form.Get("id"))
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return 0, false
+	}
 
-				uploadedFiles = append(uploadedFiles, &uploadedFile)
+	return id, true
+}
 
-				return uploadedFiles, nil
-			}(uploadedFiles)
-			if err != nil {
-				return uploadedFiles, err
-			}
-		}
+// refreshSessionUser reloads the user kept in the session, so pages show their
+// current profile picture.
+func (app *application) refreshSessionUser(r *http.Request, userID int) {
+	user, err := app.DB.GetUser(r.Context(), userID)
+	if err != nil {
+		log.Println("could not reload user:", err)
+		return
+	}
+	app.Session.Put(r.Context(), "user", *user)
+}
+
+type UploadedFile struct {
+	// FileName is the name the server stored the file under.
+	FileName         string
+	OriginalFileName string
+	ContentType      string
+	FileSize         int64
+}
+
+// UploadFiles stores the images uploaded with the request in store, each under a
+// new name; see package upload for what is refused.
+func (app *application) UploadFiles(r *http.Request, store storage.BlobStore) ([]*UploadedFile, error) {
+	files, err := upload.SaveForm(r, store, upload.Limits{})
+	if err != nil {
+		return nil, err
+	}
+
+	uploadedFiles := make([]*UploadedFile, 0, len(files))
+	for _, f := range files {
+		uploadedFiles = append(uploadedFiles, &UploadedFile{
+			FileName:         f.Key,
+			OriginalFileName: f.OriginalName,
+			ContentType:      f.ContentType,
+			FileSize:         f.Size,
+		})
 	}
 
 	return uploadedFiles, nil
 }
+
+// uploadErrorStatus returns the status code for an error returned by UploadFiles
+// or imaging.Store.
+func uploadErrorStatus(err error) int {
+	switch {
+	case stderrors.Is(err, upload.ErrFileTooLarge), stderrors.Is(err, upload.ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case stderrors.Is(err, upload.ErrNotImage), stderrors.Is(err, imaging.ErrUnsupported), stderrors.Is(err, imaging.ErrTooManyPixels):
+		return http.StatusUnsupportedMediaType
+	}
+	return http.StatusBadRequest
+}
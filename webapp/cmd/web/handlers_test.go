@@ -4,8 +4,14 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	stderrors "errors"
 	"fmt"
 	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/mailer"
+	"github.com/spacesedan/testing-course/webapp/pkg/sessions"
+	"github.com/spacesedan/testing-course/webapp/pkg/storage"
+	"github.com/spacesedan/testing-course/webapp/pkg/totp"
+	"github.com/spacesedan/testing-course/webapp/pkg/upload"
 	"image"
 	"image/jpeg"
 	"io"
@@ -15,9 +21,11 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func Test_application_handlers(t *testing.T) {
@@ -162,6 +170,14 @@ func TestApplication_Login(t *testing.T) {
 			},
 			expectedStatusCode: http.StatusSeeOther,
 			expectedLoc:        "/user/profile",
+		}, {
+			name: "valid login with mixed case email",
+			postedData: url.Values{
+				"email":    {" Admin@Example.com "},
+				"password": {"secret"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			expectedLoc:        "/user/profile",
 		}, {
 			name: "missing form data",
 			postedData: url.Values{
@@ -217,6 +233,28 @@ func TestApplication_Login(t *testing.T) {
 	}
 }
 
+func TestApplication_authenticateRehashesPassword(t *testing.T) {
+	memApp, repo := newMemApp(t)
+
+	ctx := context.Background()
+	user, _ := repo.GetUserByEmail(ctx, "admin@example.com")
+	req := httptest.NewRequest(http.MethodPost, "/login", nil)
+
+	if !memApp.authenticate(req, user, "secret") {
+		t.Fatal("expected the seeded password to authenticate")
+	}
+
+	rehashed, _ := repo.GetUser(ctx, user.ID)
+	if !strings.HasPrefix(rehashed.Password, "$argon2id$") {
+		t.Errorf("expected the seeded bcrypt hash to be replaced with argon2id, but got %s", rehashed.Password)
+	}
+
+	// the password is the same, so it doesn't take up a place in the history
+	if hashes, _ := repo.PasswordHistory(ctx, user.ID, 5); len(hashes) != 0 {
+		t.Errorf("expected the password history to be left alone, but it has %d entries", len(hashes))
+	}
+}
+
 func TestApplication_UploadFiles(t *testing.T) {
 	// set up pipes
 	pr, pw := io.Pipe()
@@ -236,18 +274,26 @@ func TestApplication_UploadFiles(t *testing.T) {
 	request.Header.Add("Content-Type", writer.FormDataContentType())
 
 	// call app.UploadFiles
-	uploadedFiles, err := app.UploadFiles(request, "./testdata/uploads/")
+	uploadedFiles, err := app.UploadFiles(request, &storage.LocalStore{Dir: "./testdata/uploads/"})
 	if err != nil {
 		t.Error(err)
 	}
 
 	//preform our tests
-	if _, err := os.Stat(fmt.Sprintf("./testdata/uploads/%s", uploadedFiles[0].OriginalFileName)); os.IsNotExist(err) {
+	if len(uploadedFiles) != 1 {
+		t.Fatalf("expected one uploaded file, but got %d", len(uploadedFiles))
+	}
+
+	if uploadedFiles[0].FileName == uploadedFiles[0].OriginalFileName || uploadedFiles[0].OriginalFileName != "img.JPG" {
+		t.Errorf("expected the file to be stored under a new name, but got %+v", uploadedFiles[0])
+	}
+
+	if _, err := os.Stat(fmt.Sprintf("./testdata/uploads/%s", uploadedFiles[0].FileName)); os.IsNotExist(err) {
 		t.Errorf("expected file to exist :%s", err.Error())
 
 	}
 	// clean up
-	_ = os.Remove(fmt.Sprintf("./testdata/uploads/%s", uploadedFiles[0].OriginalFileName))
+	_ = os.Remove(fmt.Sprintf("./testdata/uploads/%s", uploadedFiles[0].FileName))
 
 	wg.Wait()
 }
@@ -282,8 +328,95 @@ func simulateJPGUpload(fileToUpload string, writer *multipart.Writer, t *testing
 	}
 }
 
+func TestApplication_UploadFiles_refused(t *testing.T) {
+	jpg, err := os.ReadFile("./testdata/img.JPG")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type file struct {
+		name     string
+		contents []byte
+	}
+
+	tests := []struct {
+		name           string
+		files          []file
+		expectedErr    error
+		expectedStatus int
+	}{
+		{"no file", nil, upload.ErrNoFile, http.StatusBadRequest},
+		{"not an image", []file{{"img.jpg", []byte("<?php system($_GET['c']); ?>")}}, upload.ErrNotImage, http.StatusUnsupportedMediaType},
+		{"empty", []file{{"img.jpg", nil}}, upload.ErrEmpty, http.StatusBadRequest},
+		{"too large", []file{{"img.jpg", append(jpg, make([]byte, upload.DefaultMaxFileSize)...)}}, upload.ErrFileTooLarge, http.StatusRequestEntityTooLarge},
+		{"too large together", []file{{"a.jpg", jpg}, {"b.jpg", append(jpg, make([]byte, upload.DefaultMaxFileSize-len(jpg))...)}, {"c.jpg", append(jpg, make([]byte, upload.DefaultMaxFileSize-len(jpg))...)}}, upload.ErrTooLarge, http.StatusRequestEntityTooLarge},
+		{"one image and one script", []file{{"a.jpg", jpg}, {"b.jpg", []byte("#!/bin/sh")}}, upload.ErrNotImage, http.StatusUnsupportedMediaType},
+	}
+
+	for _, e := range tests {
+		store := &storage.MemoryStore{}
+
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		for _, f := range e.files {
+			part, _ := mw.CreateFormFile("file", f.name)
+			_, _ = part.Write(f.contents)
+		}
+		_ = mw.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/", body)
+		req.Header.Add("Content-Type", mw.FormDataContentType())
+
+		_, err := app.UploadFiles(req, store)
+		if !stderrors.Is(err, e.expectedErr) {
+			t.Errorf("%s: expected %v, but got %v", e.name, e.expectedErr, err)
+		}
+
+		if status := uploadErrorStatus(err); status != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, status)
+		}
+
+		if stored, _ := store.List(req.Context(), ""); len(stored) != 0 {
+			t.Errorf("%s: expected nothing to be stored, but found %d blobs", e.name, len(stored))
+		}
+	}
+}
+
+func TestApplication_UploadFiles_traversal(t *testing.T) {
+	dir := t.TempDir()
+	uploads := filepath.Join(dir, "uploads")
+	_ = os.Mkdir(uploads, 0755)
+
+	jpg, _ := os.ReadFile("./testdata/img.JPG")
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	part, _ := mw.CreateFormFile("file", "../escaped.jpg")
+	_, _ = part.Write(jpg)
+	_ = mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/", body)
+	req.Header.Add("Content-Type", mw.FormDataContentType())
+
+	files, err := app.UploadFiles(req, &storage.LocalStore{Dir: uploads})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "escaped.jpg")); err == nil {
+		t.Error("expected the file name to be ignored, but the file escaped the upload directory")
+	}
+
+	if files[0].OriginalFileName != "escaped.jpg" || files[0].ContentType != "image/jpeg" || !strings.HasSuffix(files[0].FileName, ".jpg") {
+		t.Errorf("unexpected file %+v", files[0])
+	}
+}
+
 func TestApplication_UploadProfilePic(t *testing.T) {
-	pathToStatic = "./testdata/uploads/"
+	store := &storage.MemoryStore{}
+	memApp, _ := newMemApp(t)
+	memApp.Blobs = store
+
 	filepath := "./testdata/img.JPG"
 
 	// specify a field name for the form
@@ -318,7 +451,7 @@ func TestApplication_UploadProfilePic(t *testing.T) {
 
 	rr := httptest.NewRecorder()
 
-	handler := http.HandlerFunc(app.UploadProfilePic)
+	handler := http.HandlerFunc(memApp.UploadProfilePic)
 
 	handler.ServeHTTP(rr, req)
 
@@ -326,5 +459,308 @@ func TestApplication_UploadProfilePic(t *testing.T) {
 		t.Errorf("wrong status code")
 	}
 
-	_ = os.Remove("./testdata/uploads/img.JPG")
+	// only the resized versions are kept, not the upload with its metadata
+	stored, _ := store.List(req.Context(), "")
+	if len(stored) != len(data.ImageSizes) {
+		t.Errorf("expected %d sizes of the picture to be stored, but found %d blobs", len(data.ImageSizes), len(stored))
+	}
+
+	// pages read the user back from the session as a data.User
+	user, ok := memApp.Session.Get(req.Context(), "user").(data.User)
+	if !ok || user.ProfilePic.FileName == "" {
+		t.Errorf("expected the session to hold the user with their new picture, but got %#v", memApp.Session.Get(req.Context(), "user"))
+	}
+}
+
+func TestApplication_registration(t *testing.T) {
+	memApp, repo := newMemApp(t)
+	repo.Hasher = data.BcryptHasher{Cost: 4}
+	memApp.Hasher = repo.Hasher
+	mail := memApp.Mailer.(*mailer.MemoryMailer)
+
+	// do sends a request to handler and returns where it redirected to, and the
+	// error or flash message it left in the session
+	do := func(handler http.HandlerFunc, method, target string, form url.Values) (string, string) {
+		req, _ := http.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req = addContextAndSessionToRequest(req, memApp)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		msg := memApp.Session.PopString(req.Context(), "error") + memApp.Session.PopString(req.Context(), "flash")
+		return rr.Header().Get("Location"), msg
+	}
+
+	registerTests := []struct {
+		name        string
+		postedData  url.Values
+		expectedLoc string
+	}{
+		{"valid", url.Values{"first_name": {"Jack"}, "last_name": {"Smith"}, "email": {"jack@smith.com"}, "password": {"correct horse 42"}, "confirm_password": {"correct horse 42"}}, "/"},
+		{"duplicate email", url.Values{"first_name": {"Jack"}, "last_name": {"Smith"}, "email": {"jack@smith.com"}, "password": {"correct horse 42"}, "confirm_password": {"correct horse 42"}}, "/register"},
+		{"passwords differ", url.Values{"first_name": {"Jane"}, "last_name": {"Smith"}, "email": {"jane@smith.com"}, "password": {"correct horse 42"}, "confirm_password": {"correct horse 43"}}, "/register"},
+		{"weak password", url.Values{"first_name": {"Jane"}, "last_name": {"Smith"}, "email": {"jane@smith.com"}, "password": {"secret"}, "confirm_password": {"secret"}}, "/register"},
+	}
+
+	for _, e := range registerTests {
+		if loc, _ := do(memApp.PostRegister, http.MethodPost, "/register", e.postedData); loc != e.expectedLoc {
+			t.Errorf("register %s: expected a redirect to %s, but got %s", e.name, e.expectedLoc, loc)
+		}
+	}
+
+	login := url.Values{"email": {"jack@smith.com"}, "password": {"correct horse 42"}}
+	req, _ := http.NewRequest(http.MethodPost, "/login", strings.NewReader(login.Encode()))
+	req = addContextAndSessionToRequest(req, memApp)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(memApp.Login).ServeHTTP(rr, req)
+
+	if loc := rr.Header().Get("Location"); loc != "/" || !strings.Contains(memApp.Session.GetString(req.Context(), "error"), "confirm your email") {
+		t.Errorf("expected an unverified user to be sent back with an error, but got a redirect to %s", loc)
+	}
+
+	if memApp.Session.Exists(req.Context(), "user") {
+		t.Error("an unverified user should not be logged in")
+	}
+
+	msg, ok := mail.Last()
+	if !ok {
+		t.Fatal("expected a verification email")
+	}
+
+	link, _ := url.Parse(strings.Fields(msg.Body[strings.Index(msg.Body, "http"):])[0])
+
+	if loc, _ := do(memApp.VerifyEmail, http.MethodGet, "/verify-email?token=made+up", nil); loc != "/register" {
+		t.Errorf("expected a bad verification link to redirect to /register, but got %s", loc)
+	}
+
+	if loc, _ := do(memApp.VerifyEmail, http.MethodGet, link.RequestURI(), nil); loc != "/" {
+		t.Errorf("expected verification to redirect to /, but got %s", loc)
+	}
+
+	if loc, _ := do(memApp.Login, http.MethodPost, "/login", login); loc != "/user/profile" {
+		t.Errorf("expected a verified user to log in, but got a redirect to %s", loc)
+	}
+}
+
+func TestApplication_twoFactorLogin(t *testing.T) {
+	memApp, repo := newMemApp(t)
+	repo.Hasher = data.BcryptHasher{Cost: 4}
+	memApp.Hasher = repo.Hasher
+
+	ctx := context.Background()
+	id, err := repo.InsertUser(ctx, data.User{FirstName: "Jack", LastName: "Smith", Email: "jack@smith.com", Password: "correct horse 42", EmailVerifiedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, _ := repo.GetUser(ctx, id)
+
+	enrollment, err := memApp.TwoFactor.Enroll(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := totp.Code(enrollment.Secret, totp.Step(time.Now()))
+	recoveryCodes, err := memApp.TwoFactor.Confirm(ctx, id, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each request carries on the session of the one before it
+	sessionCtx := getCtx(httptest.NewRequest(http.MethodGet, "/", nil))
+	sessionCtx, _ = memApp.Session.Load(sessionCtx, "")
+
+	do := func(handler http.HandlerFunc, method, target string, form url.Values) string {
+		req, _ := http.NewRequestWithContext(sessionCtx, method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		return rr.Header().Get("Location")
+	}
+
+	if loc := do(memApp.LoginMFA, http.MethodGet, "/login/mfa", nil); loc != "/" {
+		t.Errorf("expected the code page to redirect to / before a password is given, but got %s", loc)
+	}
+
+	if loc := do(memApp.Login, http.MethodPost, "/login", url.Values{"email": {"jack@smith.com"}, "password": {"correct horse 42"}}); loc != "/login/mfa" {
+		t.Errorf("expected the password to redirect to /login/mfa, but got %s", loc)
+	}
+
+	if memApp.Session.Exists(sessionCtx, "user") {
+		t.Error("a user should not be logged in before giving their code")
+	}
+
+	if loc := do(memApp.PostLoginMFA, http.MethodPost, "/login/mfa", url.Values{"code": {"000000"}}); loc != "/login/mfa" {
+		t.Errorf("expected a wrong code to redirect to /login/mfa, but got %s", loc)
+	}
+
+	if loc := do(memApp.PostLoginMFA, http.MethodPost, "/login/mfa", url.Values{"code": {recoveryCodes[0]}}); loc != "/user/profile" {
+		t.Errorf("expected a recovery code to log in, but got a redirect to %s", loc)
+	}
+
+	if !memApp.Session.Exists(sessionCtx, "user") {
+		t.Error("expected the user to be logged in after giving their code")
+	}
+
+	if memApp.Session.Exists(sessionCtx, "mfa_user_id") {
+		t.Error("expected the pending login to be cleared")
+	}
+
+	req, _ := http.NewRequestWithContext(sessionCtx, http.MethodGet, "/user/two-factor", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(memApp.TwoFactorSettings).ServeHTTP(rr, req)
+
+	if !strings.Contains(rr.Body.String(), "Two-factor authentication is on") {
+		t.Error("expected the settings page to show two-factor authentication as on")
+	}
+}
+
+func TestApplication_devices(t *testing.T) {
+	memApp, repo := newMemApp(t)
+	repo.Hasher = data.BcryptHasher{Cost: 4}
+	memApp.Hasher = repo.Hasher
+
+	ctx := context.Background()
+	id, err := repo.InsertUser(ctx, data.User{FirstName: "Jack", LastName: "Smith", Email: "jack@smith.com", Password: "correct horse 42", EmailVerifiedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each request carries on the session of the one before it
+	sessionCtx := getCtx(httptest.NewRequest(http.MethodGet, "/", nil))
+	sessionCtx, _ = memApp.Session.Load(sessionCtx, "")
+
+	do := func(handler http.Handler, method, target string, form url.Values) *httptest.ResponseRecorder {
+		req, _ := http.NewRequestWithContext(sessionCtx, method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:105.0) Gecko/20100101 Firefox/105.0")
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		return rr
+	}
+
+	rr := do(http.HandlerFunc(memApp.Login), http.MethodPost, "/login", url.Values{"email": {"jack@smith.com"}, "password": {"correct horse 42"}})
+	if loc := rr.Header().Get("Location"); loc != "/user/profile" {
+		t.Fatalf("expected to log in, but got a redirect to %s", loc)
+	}
+
+	// the same user, logged in to the API from a script
+	script, _ := memApp.Sessions.Start(ctx, id, data.SessionAPI, sessions.Client{IP: "198.51.100.7", UserAgent: "curl/7.85.0"}, time.Now().Add(time.Hour))
+
+	rr = do(memApp.auth(http.HandlerFunc(memApp.Devices)), http.MethodGet, "/user/devices", nil)
+	for _, expected := range []string{"Firefox on Linux", "curl", "198.51.100.7", "This device"} {
+		if !strings.Contains(rr.Body.String(), expected) {
+			t.Errorf("expected the devices page to show %q", expected)
+		}
+	}
+
+	rr = do(memApp.auth(http.HandlerFunc(memApp.PostLogOutDevice)), http.MethodPost, "/user/devices/log-out", url.Values{"id": {fmt.Sprint(script.ID)}})
+	if loc := rr.Header().Get("Location"); loc != "/user/devices" {
+		t.Errorf("expected logging out a device to redirect to /user/devices, but got %s", loc)
+	}
+
+	if list, _ := repo.AllSessions(ctx, id); len(list) != 1 || list[0].Kind != data.SessionWeb {
+		t.Fatalf("expected only the web session to be left, but got %d", len(list))
+	}
+
+	// logged out from elsewhere, the next request here is refused
+	list, _ := repo.AllSessions(ctx, id)
+	_ = repo.DeleteSession(ctx, id, list[0].ID)
+
+	rr = do(memApp.auth(http.HandlerFunc(memApp.Devices)), http.MethodGet, "/user/devices", nil)
+	if rr.Code != http.StatusTemporaryRedirect {
+		t.Errorf("expected an ended session to be sent to the login page, but got %d", rr.Code)
+	}
+
+	if memApp.Session.Exists(sessionCtx, "user") {
+		t.Error("expected the user to be logged out once their session ended")
+	}
+}
+
+func TestApplication_images(t *testing.T) {
+	store := &storage.MemoryStore{}
+	_ = store.Put(context.Background(), "face_64.jpg", strings.NewReader("face"), "image/jpeg")
+
+	memApp := app
+	memApp.Blobs = store
+	routes := memApp.routes()
+
+	tests := []struct {
+		name           string
+		url            string
+		expectedStatus int
+	}{
+		{"stored image", "/static/img/face_64.jpg", http.StatusOK},
+		{"missing image", "/static/img/face_512.jpg", http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		req := httptest.NewRequest(http.MethodGet, e.url, nil)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
+
+func TestApplication_pictures(t *testing.T) {
+	memApp, repo := newMemApp(t)
+
+	ctx := context.Background()
+	id, err := repo.InsertUser(ctx, data.User{FirstName: "Jack", LastName: "Smith", Email: "jack@smith.com", Password: "correct horse 42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := repo.InsertUserImage(ctx, data.UserImage{UserID: id, FileName: "0123456789abcdef0123456789abcdef.jpg"})
+	second, _ := repo.InsertUserImage(ctx, data.UserImage{UserID: id, FileName: "fedcba9876543210fedcba9876543210.jpg"})
+
+	sessionCtx := getCtx(httptest.NewRequest(http.MethodGet, "/", nil))
+	sessionCtx, _ = memApp.Session.Load(sessionCtx, "")
+	memApp.Session.Put(sessionCtx, "user", data.User{ID: id})
+
+	do := func(handler http.HandlerFunc, method, target string, form url.Values) *httptest.ResponseRecorder {
+		req, _ := http.NewRequestWithContext(sessionCtx, method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		return rr
+	}
+
+	rr := do(memApp.Pictures, http.MethodGet, "/user/pictures", nil)
+	for _, expected := range []string{"0123456789abcdef0123456789abcdef_64.jpg", "fedcba9876543210fedcba9876543210_64.jpg", "Current"} {
+		if !strings.Contains(rr.Body.String(), expected) {
+			t.Errorf("expected the pictures page to show %q", expected)
+		}
+	}
+
+	rr = do(memApp.PostUsePicture, http.MethodPost, "/user/pictures/use", url.Values{"id": {fmt.Sprint(first)}})
+	if loc := rr.Header().Get("Location"); loc != "/user/pictures" {
+		t.Errorf("expected choosing a picture to redirect to /user/pictures, but got %s", loc)
+	}
+	if user := memApp.Session.Get(sessionCtx, "user").(data.User); user.ProfilePic.FileName != "0123456789abcdef0123456789abcdef.jpg" {
+		t.Errorf("expected the session user to have the first picture, but got %+v", user.ProfilePic)
+	}
+
+	_ = do(memApp.PostDeletePicture, http.MethodPost, "/user/pictures/delete", url.Values{"id": {fmt.Sprint(second)}})
+	if images, _ := repo.AllUserImages(ctx, id); len(images) != 1 || images[0].ID != first {
+		t.Errorf("expected only picture %d to be left, but got %+v", first, images)
+	}
+
+	_ = do(memApp.PostDeletePicture, http.MethodPost, "/user/pictures/delete", url.Values{"id": {fmt.Sprint(second)}})
+	if msg := memApp.Session.PopString(sessionCtx, "error"); msg == "" {
+		t.Error("expected deleting a deleted picture to show an error")
+	}
+
+	rr = do(memApp.PostUsePicture, http.MethodPost, "/user/pictures/use", url.Values{"id": {"nope"}})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected a bad id to be refused, but got %d", rr.Code)
+	}
 }
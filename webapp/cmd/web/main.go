@@ -1,22 +1,42 @@
 package main
 
 import (
+	"context"
 	"encoding/gob"
 	"flag"
 	"github.com/alexedwards/scs/v2"
 	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/imagegc"
+	"github.com/spacesedan/testing-course/webapp/pkg/mailer"
+	"github.com/spacesedan/testing-course/webapp/pkg/passwordpolicy"
+	"github.com/spacesedan/testing-course/webapp/pkg/passwordreset"
+	"github.com/spacesedan/testing-course/webapp/pkg/registration"
 	"github.com/spacesedan/testing-course/webapp/pkg/repository"
 	"github.com/spacesedan/testing-course/webapp/pkg/repository/dbrepo"
+	"github.com/spacesedan/testing-course/webapp/pkg/sessions"
+	"github.com/spacesedan/testing-course/webapp/pkg/storage"
+	"github.com/spacesedan/testing-course/webapp/pkg/twofactor"
 	"log"
 	"net/http"
+	"time"
 )
 
 const webPort string = "8080"
 
 type application struct {
-	DSN     string
-	Session *scs.SessionManager
-	DB      repository.DataBaseRepo
+	DSN           string
+	DBDriver      string
+	Session       *scs.SessionManager
+	DB            repository.DataBaseRepo
+	Hasher        data.PasswordHasher
+	Policy        *passwordpolicy.Policy
+	Resets        *passwordreset.Service
+	Registrations *registration.Service
+	TwoFactor     *twofactor.Service
+	Sessions      *sessions.Service
+	Blobs         storage.BlobStore
+	Mailer        mailer.Mailer
+	Emails        *mailer.Templates
 }
 
 func main() {
@@ -24,23 +44,160 @@ func main() {
 	// set up an application
 	app := application{
 		Session: getSession(),
+		Policy:  &passwordpolicy.Policy{},
 	}
 
+	var timeouts dbrepo.Timeouts
+	var perOperation string
+	var checkSchema bool
+	var demo bool
+	var passwordHash string
+	var breachList string
+	var mailConfig mailer.Config
+	var mailTemplates string
+	var resetURL string
+	var resetTTL time.Duration
+	var verifyURL string
+	var verifyTTL time.Duration
+	var totpIssuer string
+	var storageConfig storage.Config
+	var imageURLSecret string
+	var imageGCInterval time.Duration
+
 	flag.StringVar(
 		&app.DSN,
 		"dsn",
-		"host=localhost port=5431 user=postgres password=postgres dbname=users sslmode=disable timezone=UTC connect_timeout=5",
-		"Postgres connection",
+		"",
+		"Database connection; defaults to the docker-compose Postgres, or "+defaultSQLiteDSN+" for sqlite",
 	)
+	flag.StringVar(&app.DBDriver, "db-driver", "postgres", "Database driver: postgres|sqlite")
+	flag.DurationVar(&timeouts.Default, "db-timeout", 3*time.Second, "Default timeout for database operations")
+	flag.StringVar(&perOperation, "db-timeouts", "", "Per-operation database timeouts, e.g. AllUsers=5s,InsertUser=1s")
+	flag.BoolVar(&checkSchema, "check-schema", true, "Refuse to start unless the database schema is at the latest migration")
+	flag.StringVar(&passwordHash, "password-hash", "argon2id", "Algorithm for new password hashes: argon2id|bcrypt; outdated hashes are replaced at login")
+	flag.IntVar(&app.Policy.MinLength, "password-min-length", 10, "Minimum password length")
+	flag.IntVar(&app.Policy.MinClasses, "password-min-classes", 2, "Minimum number of character classes (lower, upper, digit, symbol) in a password")
+	flag.IntVar(&app.Policy.History, "password-history", 5, "Number of recent passwords, including the current one, that may not be reused")
+	flag.StringVar(&breachList, "breached-passwords", "", "File of breached passwords, one per line, that may not be used")
+	flag.StringVar(&mailConfig.Kind, "mailer", "log", "How to send email: log|file|memory|smtp; file writes a dev mailbox of .eml files to -mail-dir")
+	flag.StringVar(&mailTemplates, "mail-templates", "./templates/email/", "Directory of email templates")
+	flag.StringVar(&mailConfig.From, "mail-from", "no-reply@example.com", "Sender address for outgoing email")
+	flag.StringVar(&mailConfig.Dir, "mail-dir", "./tmp/mail", "Directory the file mailer writes messages to")
+	flag.StringVar(&mailConfig.SMTPAddr, "smtp-addr", "localhost:25", "SMTP server, as host:port")
+	flag.StringVar(&mailConfig.Username, "smtp-user", "", "SMTP username, if the server needs authentication")
+	flag.StringVar(&mailConfig.Password, "smtp-password", "", "SMTP password")
+	flag.StringVar(&resetURL, "reset-url", "http://localhost:8080/reset-password", "Page that password reset links point to")
+	flag.DurationVar(&resetTTL, "reset-ttl", passwordreset.DefaultTTL, "How long password reset links stay valid")
+	flag.StringVar(&verifyURL, "verify-url", "http://localhost:8080/verify-email", "Page that email verification links point to")
+	flag.DurationVar(&verifyTTL, "verify-ttl", registration.DefaultTTL, "How long email verification links stay valid")
+	flag.StringVar(&totpIssuer, "totp-issuer", "Webapp", "Name shown for accounts in authenticator apps")
+	flag.StringVar(&storageConfig.Kind, "storage", "local", "Where uploaded images are kept: local|memory|s3; use s3 when running more than one instance")
+	flag.StringVar(&storageConfig.Dir, "storage-dir", "./static/img/", "Directory the local store keeps images in")
+	flag.StringVar(&storageConfig.S3.Endpoint, "s3-endpoint", "http://localhost:9000", "URL of the S3 compatible service, e.g. MinIO")
+	flag.StringVar(&storageConfig.S3.Bucket, "s3-bucket", "images", "Bucket images are kept in")
+	flag.StringVar(&storageConfig.S3.Region, "s3-region", "us-east-1", "Region of the bucket")
+	flag.StringVar(&storageConfig.S3.AccessKey, "s3-access-key", "", "S3 access key")
+	flag.StringVar(&storageConfig.S3.SecretKey, "s3-secret-key", "", "S3 secret key")
+	flag.StringVar(&imageURLSecret, "image-url-secret", "", "Secret signed image URLs are made with; signed URLs are unavailable if empty")
+	flag.DurationVar(&imageGCInterval, "image-gc-interval", time.Hour, "How often to remove image files no profile picture refers to; 0 turns it off, e.g. when another instance does it")
+	flag.BoolVar(&demo, "demo", false, "Run against an in-memory database seeded with the admin user; nothing is saved")
 	flag.Parse()
 
-	conn, err := app.connectToDB()
+	var err error
+	timeouts.PerOperation, err = dbrepo.ParseTimeouts(perOperation)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app.Hasher, err = data.NewPasswordHasher(passwordHash)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if breachList != "" {
+		app.Policy.Breached, err = passwordpolicy.LoadBreachList(breachList)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Loaded %d breached passwords\n", len(app.Policy.Breached))
+	}
+
+	if demo {
+		repo := dbrepo.NewMemoryDBRepo()
+		repo.Hasher = app.Hasher
+		repo.HistoryLimit = app.Policy.History - 1
+		err = repo.Seed(dbrepo.DefaultFixtures())
+		if err != nil {
+			log.Fatal(err)
+		}
+		app.DB = repo
+		log.Println("Running in demo mode; data is kept in memory")
+	} else {
+		conn, err := app.connectToDB()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer conn.Close()
+
+		if checkSchema {
+			err = app.checkSchema(conn)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		app.DB = app.newRepo(conn, timeouts)
+	}
+
+	if imageURLSecret != "" {
+		storageConfig.URLs = &storage.URLSigner{BaseURL: "/static/img", Secret: []byte(imageURLSecret)}
+	}
+
+	app.Blobs, err = storage.New(storageConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// remove the files of deleted profile pictures in the background
+	if imageGCInterval > 0 {
+		gc := &imagegc.Collector{DB: app.DB, Blobs: app.Blobs}
+		go gc.Run(context.Background(), imageGCInterval)
+	}
+
+	mail, err := mailer.New(mailConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer conn.Close()
 
-	app.DB = &dbrepo.PostgresDBRepo{DB: conn}
+	// deliver mail in the background, retrying failures
+	app.Mailer = mailer.NewQueue(mail, mailer.QueueOptions{})
+	app.Emails = &mailer.Templates{Dir: mailTemplates}
+
+	app.Resets = &passwordreset.Service{
+		DB:        app.DB,
+		Mailer:    app.Mailer,
+		Templates: app.Emails,
+		Policy:    app.Policy,
+		ResetURL:  resetURL,
+		TTL:       resetTTL,
+	}
+
+	app.Registrations = &registration.Service{
+		DB:        app.DB,
+		Mailer:    app.Mailer,
+		Templates: app.Emails,
+		Policy:    app.Policy,
+		VerifyURL: verifyURL,
+		TTL:       verifyTTL,
+	}
+
+	app.TwoFactor = &twofactor.Service{
+		DB:     app.DB,
+		Issuer: totpIssuer,
+		Skew:   1,
+	}
+
+	app.Sessions = &sessions.Service{DB: app.DB}
 
 	// print out a message
 	log.Println("Starting server on port: ", webPort)
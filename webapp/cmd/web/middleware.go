@@ -2,7 +2,11 @@ package main
 
 import (
 	"context"
+	stderrors "errors"
 	"fmt"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/sessions"
+	"log"
 	"net"
 	"net/http"
 )
@@ -66,6 +70,43 @@ func (app *application) auth(next http.Handler) http.Handler {
 			return
 		}
 
+		// end the session if the user's sessions were revoked since logging in,
+		// e.g. by a password reset
+		sessionUser := app.Session.Get(r.Context(), "user").(data.User)
+		user, err := app.DB.GetUser(r.Context(), sessionUser.ID)
+		if err != nil || !user.SessionsRevokedAt.Equal(sessionUser.SessionsRevokedAt) {
+			app.endSession(w, r)
+			return
+		}
+
+		// and if it was logged out from the devices page, here or elsewhere
+		if id := app.Session.GetInt(r.Context(), "session_id"); id != 0 {
+			_, err := app.Sessions.Check(r.Context(), user.ID, id, app.clientFromRequest(r))
+			if err != nil {
+				if !stderrors.Is(err, sessions.ErrEnded) {
+					log.Println("could not check session:", err)
+				}
+				app.endSession(w, r)
+				return
+			}
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
+
+// endSession logs the user out of a session that has ended, and sends them to
+// the login page.
+func (app *application) endSession(w http.ResponseWriter, r *http.Request) {
+	_ = app.Session.Destroy(r.Context())
+	app.Session.Put(r.Context(), "error", "your session has ended; please log in again")
+	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+}
+
+// clientFromRequest describes where a request comes from, for its session.
+func (app *application) clientFromRequest(r *http.Request) sessions.Client {
+	return sessions.Client{
+		IP:        app.ipFromContext(r.Context()),
+		UserAgent: r.UserAgent(),
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
+	"github.com/spacesedan/testing-course/webapp/pkg/storage"
 	"net/http"
 )
 
@@ -20,14 +21,37 @@ func (app *application) routes() http.Handler {
 	// register routes
 	mux.Get("/", app.Home)
 	mux.Post("/login", app.Login)
+	mux.Get("/login/mfa", app.LoginMFA)
+	mux.Post("/login/mfa", app.PostLoginMFA)
+	mux.Get("/forgot-password", app.ForgotPassword)
+	mux.Post("/forgot-password", app.PostForgotPassword)
+	mux.Get("/reset-password", app.ResetPassword)
+	mux.Post("/reset-password", app.PostResetPassword)
+	mux.Get("/register", app.Register)
+	mux.Post("/register", app.PostRegister)
+	mux.Post("/resend-verification", app.PostResendVerification)
+	mux.Get("/verify-email", app.VerifyEmail)
 
 	// protect the "/user/profile" page with auth middleware
 	mux.Route("/user", func(mux chi.Router) {
 		mux.Use(app.auth)
 		mux.Get("/profile", app.Profile)
 		mux.Post("/upload-profile-pic", app.UploadProfilePic)
+		mux.Get("/pictures", app.Pictures)
+		mux.Post("/pictures/use", app.PostUsePicture)
+		mux.Post("/pictures/delete", app.PostDeletePicture)
+		mux.Get("/two-factor", app.TwoFactorSettings)
+		mux.Post("/two-factor/enroll", app.PostEnrollTwoFactor)
+		mux.Post("/two-factor/confirm", app.PostConfirmTwoFactor)
+		mux.Post("/two-factor/disable", app.PostDisableTwoFactor)
+		mux.Get("/devices", app.Devices)
+		mux.Post("/devices/log-out", app.PostLogOutDevice)
+		mux.Post("/devices/log-out-others", app.PostLogOutOtherDevices)
 	})
 
+	// uploaded images, from whichever store keeps them
+	mux.Handle("/static/img/*", http.StripPrefix("/static/img", &storage.Handler{Store: app.Blobs, Public: true}))
+
 	// static assets
 	fileServer := http.FileServer(http.Dir("./static/"))
 	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
@@ -14,7 +14,28 @@ func Test_application_routes(t *testing.T) {
 	}{
 		{"/", "GET"},
 		{"/login", "POST"},
+		{"/login/mfa", "GET"},
+		{"/login/mfa", "POST"},
+		{"/forgot-password", "GET"},
+		{"/forgot-password", "POST"},
+		{"/reset-password", "GET"},
+		{"/reset-password", "POST"},
+		{"/register", "GET"},
+		{"/register", "POST"},
+		{"/resend-verification", "POST"},
+		{"/verify-email", "GET"},
 		{"/user/profile", "GET"},
+		{"/user/two-factor", "GET"},
+		{"/user/two-factor/enroll", "POST"},
+		{"/user/two-factor/confirm", "POST"},
+		{"/user/two-factor/disable", "POST"},
+		{"/user/pictures", "GET"},
+		{"/user/pictures/use", "POST"},
+		{"/user/pictures/delete", "POST"},
+		{"/user/devices", "GET"},
+		{"/user/devices/log-out", "POST"},
+		{"/user/devices/log-out-others", "POST"},
+		{"/static/img/*", "GET"},
 		{"/static/*", "GET"},
 	}
 
@@ -1,7 +1,15 @@
 package main
 
 import (
+	"github.com/spacesedan/testing-course/webapp/pkg/mailer"
+	"github.com/spacesedan/testing-course/webapp/pkg/passwordpolicy"
+	"github.com/spacesedan/testing-course/webapp/pkg/passwordreset"
+	"github.com/spacesedan/testing-course/webapp/pkg/registration"
 	"github.com/spacesedan/testing-course/webapp/pkg/repository/dbrepo"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository/dbrepo/dbrepotest"
+	"github.com/spacesedan/testing-course/webapp/pkg/sessions"
+	"github.com/spacesedan/testing-course/webapp/pkg/twofactor"
+	"log"
 	"os"
 	"testing"
 )
@@ -12,7 +20,51 @@ func TestMain(m *testing.M) {
 	pathToTemplates = "./../../templates/"
 
 	app.Session = getSession()
-	app.DB = &dbrepo.TestDBRepo{}
+	repo := dbrepo.NewMemoryDBRepo()
+	if err := repo.Seed(dbrepo.DefaultFixtures()); err != nil {
+		log.Fatalf("seeding the memory repository: %s", err)
+	}
+	app.DB = repo
+	app.Policy = passwordpolicy.Default()
+	app.Mailer = &mailer.MemoryMailer{}
+	app.Emails = &mailer.Templates{Dir: "./../../templates/email/"}
+	app.Resets = &passwordreset.Service{
+		DB:        app.DB,
+		Mailer:    app.Mailer,
+		Templates: app.Emails,
+		Policy:    app.Policy,
+		ResetURL:  "http://localhost:8080/reset-password",
+	}
+	app.Registrations = &registration.Service{
+		DB:        app.DB,
+		Mailer:    app.Mailer,
+		Templates: app.Emails,
+		Policy:    app.Policy,
+		VerifyURL: "http://localhost:8080/verify-email",
+	}
+	app.TwoFactor = &twofactor.Service{DB: app.DB, Issuer: "Webapp", Skew: 1}
+	app.Sessions = &sessions.Service{DB: app.DB}
 
 	os.Exit(m.Run())
 }
+
+// newMemApp returns a copy of app backed by a memory repository of its own,
+// holding the default fixtures, with every service using that repository and a
+// MemoryMailer of its own. Tests that change data use it rather than app, which
+// every test shares.
+func newMemApp(t *testing.T) (application, *dbrepo.MemoryDBRepo) {
+	t.Helper()
+
+	repo := dbrepotest.NewSeeded(t)
+	mail := &mailer.MemoryMailer{}
+
+	memApp := app
+	memApp.DB = repo
+	memApp.Mailer = mail
+	memApp.Resets = &passwordreset.Service{DB: repo, Mailer: mail, Templates: app.Emails, Policy: app.Policy, ResetURL: app.Resets.ResetURL}
+	memApp.Registrations = &registration.Service{DB: repo, Mailer: mail, Templates: app.Emails, Policy: app.Policy, VerifyURL: app.Registrations.VerifyURL}
+	memApp.TwoFactor = &twofactor.Service{DB: repo, Issuer: app.TwoFactor.Issuer, Skew: app.TwoFactor.Skew}
+	memApp.Sessions = &sessions.Service{DB: repo}
+
+	return memApp, repo
+}
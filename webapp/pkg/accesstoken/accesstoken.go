@@ -0,0 +1,196 @@
+// Package accesstoken implements personal access tokens: long-lived, revocable
+// credentials that users create so that scripts and other services can call the
+// API as them without logging in. Each token is limited to a set of scopes and
+// may expire. Only a SHA-256 hash of each token is stored.
+package accesstoken
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+	"github.com/spacesedan/testing-course/webapp/pkg/securetoken"
+	"strings"
+	"time"
+)
+
+// Prefix starts every personal access token, so they are easy to tell apart from
+// JWTs and to spot when leaked.
+const Prefix = "wat_"
+
+// The scopes a token can be given.
+const (
+	ScopeUsersRead  = "users:read"
+	ScopeUsersWrite = "users:write"
+)
+
+// Scopes lists every scope, in the order they are documented.
+var Scopes = []string{ScopeUsersRead, ScopeUsersWrite}
+
+// DefaultUsageInterval is how often the last used time of a token is updated
+// when Service.UsageInterval is zero.
+const DefaultUsageInterval = time.Minute
+
+var (
+	// ErrInvalidToken is returned by Authenticate for tokens that are malformed,
+	// unknown, revoked or expired.
+	ErrInvalidToken = errors.New("invalid access token")
+
+	// ErrInvalidRequest is returned by Create for a missing name, an unknown
+	// scope or a negative lifetime.
+	ErrInvalidRequest = errors.New("invalid access token request")
+)
+
+// Service creates, lists, revokes and checks personal access tokens.
+type Service struct {
+	DB repository.DataBaseRepo
+
+	// MaxTTL caps the lifetime of new tokens; zero allows tokens that never
+	// expire.
+	MaxTTL time.Duration
+
+	// UsageInterval is how stale a token's last used time may get before
+	// Authenticate updates it, to save a write on every request; zero means
+	// DefaultUsageInterval.
+	UsageInterval time.Duration
+}
+
+// Create makes a new token for the user, and returns it along with its stored
+// details. The token itself is only available now. A ttl of zero means the token
+// never expires, unless MaxTTL is set, in which case it is used instead.
+func (s *Service) Create(ctx context.Context, userID int, name string, scopes []string, ttl time.Duration) (string, *data.AccessToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", nil, fmt.Errorf("%w: a name is required", ErrInvalidRequest)
+	}
+
+	scopes, err := normalizeScopes(scopes)
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch {
+	case ttl < 0:
+		return "", nil, fmt.Errorf("%w: the lifetime must not be negative", ErrInvalidRequest)
+	case s.MaxTTL > 0 && (ttl == 0 || ttl > s.MaxTTL):
+		ttl = s.MaxTTL
+	}
+
+	secret, _, err := securetoken.New()
+	if err != nil {
+		return "", nil, err
+	}
+	token := Prefix + secret
+
+	t := data.AccessToken{
+		UserID:    userID,
+		Name:      name,
+		Scopes:    scopes,
+		TokenHash: securetoken.Hash(token),
+	}
+	if ttl > 0 {
+		expiresAt := time.Now().Add(ttl)
+		t.ExpiresAt = &expiresAt
+	}
+
+	t.ID, err = s.DB.InsertAccessToken(ctx, t)
+	if err != nil {
+		return "", nil, err
+	}
+	t.CreatedAt = time.Now()
+
+	return token, &t, nil
+}
+
+// List returns the user's tokens, oldest first.
+func (s *Service) List(ctx context.Context, userID int) ([]*data.AccessToken, error) {
+	return s.DB.AllAccessTokens(ctx, userID)
+}
+
+// Revoke deletes one of the user's tokens. It returns repository.ErrNotFound if
+// the user has no token with that id.
+func (s *Service) Revoke(ctx context.Context, userID, id int) error {
+	return s.DB.DeleteAccessToken(ctx, userID, id)
+}
+
+// Authenticate returns the user a token belongs to, and the token's details. It
+// returns ErrInvalidToken for a bad token.
+func (s *Service) Authenticate(ctx context.Context, token string) (*data.User, *data.AccessToken, error) {
+	if !IsAccessToken(token) {
+		return nil, nil, ErrInvalidToken
+	}
+
+	t, err := s.DB.GetAccessTokenByHash(ctx, securetoken.Hash(token))
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	if t.Expired(now) {
+		return nil, nil, ErrInvalidToken
+	}
+
+	user, err := s.DB.GetUser(ctx, t.UserID)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	interval := s.UsageInterval
+	if interval <= 0 {
+		interval = DefaultUsageInterval
+	}
+
+	if t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) >= interval {
+		// a failure to record usage shouldn't lock the caller out
+		if err := s.DB.TouchAccessToken(ctx, t.ID, now); err == nil {
+			t.LastUsedAt = &now
+		}
+	}
+
+	return user, t, nil
+}
+
+// IsAccessToken reports whether token looks like a personal access token rather
+// than a JWT.
+func IsAccessToken(token string) bool {
+	return strings.HasPrefix(token, Prefix)
+}
+
+// normalizeScopes checks that every scope is known, and returns them without
+// duplicates in the order of Scopes.
+func normalizeScopes(scopes []string) ([]string, error) {
+	requested := make(map[string]bool, len(scopes))
+	for _, scope := range scopes {
+		if !known(scope) {
+			return nil, fmt.Errorf("%w: unknown scope %q", ErrInvalidRequest, scope)
+		}
+		requested[scope] = true
+	}
+
+	if len(requested) == 0 {
+		return nil, fmt.Errorf("%w: at least one scope is required", ErrInvalidRequest)
+	}
+
+	var normalized []string
+	for _, scope := range Scopes {
+		if requested[scope] {
+			normalized = append(normalized, scope)
+		}
+	}
+
+	return normalized, nil
+}
+
+func known(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
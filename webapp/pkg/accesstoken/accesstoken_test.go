@@ -0,0 +1,142 @@
+package accesstoken
+
+import (
+	"context"
+	"errors"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository/dbrepo"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository/dbrepo/dbrepotest"
+	"github.com/spacesedan/testing-course/webapp/pkg/securetoken"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newService(t *testing.T) (*Service, *dbrepo.MemoryDBRepo) {
+	t.Helper()
+
+	repo := dbrepotest.NewSeeded(t)
+
+	return &Service{DB: repo}, repo
+}
+
+func TestService_Create(t *testing.T) {
+	tests := []struct {
+		name        string
+		tokenName   string
+		scopes      []string
+		ttl         time.Duration
+		maxTTL      time.Duration
+		expectedErr error
+		expectedTTL time.Duration
+	}{
+		{"valid", "deploy", []string{ScopeUsersRead}, time.Hour, 0, nil, time.Hour},
+		{"never expires", "deploy", []string{ScopeUsersRead}, 0, 0, nil, 0},
+		{"capped", "deploy", []string{ScopeUsersRead}, 48 * time.Hour, 24 * time.Hour, nil, 24 * time.Hour},
+		{"capped when unlimited", "deploy", []string{ScopeUsersRead}, 0, 24 * time.Hour, nil, 24 * time.Hour},
+		{"missing name", " ", []string{ScopeUsersRead}, 0, 0, ErrInvalidRequest, 0},
+		{"no scopes", "deploy", nil, 0, 0, ErrInvalidRequest, 0},
+		{"unknown scope", "deploy", []string{"admin"}, 0, 0, ErrInvalidRequest, 0},
+		{"negative lifetime", "deploy", []string{ScopeUsersRead}, -time.Hour, 0, ErrInvalidRequest, 0},
+	}
+
+	for _, e := range tests {
+		s, _ := newService(t)
+		s.MaxTTL = e.maxTTL
+
+		token, stored, err := s.Create(context.Background(), 1, e.tokenName, e.scopes, e.ttl)
+		if !errors.Is(err, e.expectedErr) {
+			t.Errorf("%s: expected error %v, but got %v", e.name, e.expectedErr, err)
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if !strings.HasPrefix(token, Prefix) || stored.ID == 0 {
+			t.Errorf("%s: expected a stored token starting with %s, but got %q", e.name, Prefix, token)
+		}
+
+		switch {
+		case e.expectedTTL == 0 && stored.ExpiresAt != nil:
+			t.Errorf("%s: expected a token that never expires, but it expires at %s", e.name, stored.ExpiresAt)
+		case e.expectedTTL != 0 && (stored.ExpiresAt == nil || time.Until(*stored.ExpiresAt) > e.expectedTTL):
+			t.Errorf("%s: expected the token to expire within %s, but got %v", e.name, e.expectedTTL, stored.ExpiresAt)
+		}
+	}
+}
+
+func TestService_Create_normalizesScopes(t *testing.T) {
+	s, _ := newService(t)
+
+	_, stored, err := s.Create(context.Background(), 1, "deploy", []string{ScopeUsersWrite, ScopeUsersRead, ScopeUsersWrite}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(stored.Scopes, " ") != "users:read users:write" {
+		t.Errorf("expected each scope once, in order, but got %v", stored.Scopes)
+	}
+}
+
+func TestService_Authenticate(t *testing.T) {
+	ctx := context.Background()
+	s, repo := newService(t)
+
+	token, stored, err := s.Create(ctx, 1, "deploy", []string{ScopeUsersRead}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, got, err := s.Authenticate(ctx, token)
+	if err != nil {
+		t.Fatalf("Authenticate() returned an error: %s", err)
+	}
+
+	if user.ID != 1 || got.ID != stored.ID || !got.HasScope(ScopeUsersRead) || got.HasScope(ScopeUsersWrite) {
+		t.Errorf("Authenticate() returned the wrong user %d or token %+v", user.ID, got)
+	}
+
+	tokens, _ := s.List(ctx, 1)
+	if len(tokens) != 1 || tokens[0].LastUsedAt == nil {
+		t.Error("expected the token's last use to be recorded")
+	}
+
+	expiresAt := time.Now().Add(-time.Minute)
+	_, _ = repo.InsertAccessToken(ctx, data.AccessToken{
+		UserID:    1,
+		Name:      "old",
+		Scopes:    []string{ScopeUsersRead},
+		TokenHash: securetoken.Hash(Prefix + "expired"),
+		ExpiresAt: &expiresAt,
+	})
+
+	badTokens := []struct {
+		name  string
+		token string
+	}{
+		{"jwt", "eyJhbGciOiJIUzI1NiJ9.e30.sig"},
+		{"unknown", Prefix + "unknown"},
+		{"expired", Prefix + "expired"},
+	}
+
+	for _, e := range badTokens {
+		if _, _, err := s.Authenticate(ctx, e.token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: expected ErrInvalidToken, but got %v", e.name, err)
+		}
+	}
+
+	if err := s.Revoke(ctx, 2, stored.ID); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected another user's revoke to return ErrNotFound, but got %v", err)
+	}
+
+	if err := s.Revoke(ctx, 1, stored.ID); err != nil {
+		t.Fatalf("Revoke() returned an error: %s", err)
+	}
+
+	if _, _, err := s.Authenticate(ctx, token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected a revoked token to be refused, but got %v", err)
+	}
+}
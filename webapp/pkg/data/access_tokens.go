@@ -0,0 +1,30 @@
+package data
+
+import "time"
+
+// AccessToken is a personal access token: a long-lived credential a user creates
+// so that scripts and other services can call the API as them, limited to Scopes.
+// Only the hash of the token itself is stored.
+type AccessToken struct {
+	ID        int      `json:"id"`
+	UserID    int      `json:"user_id"`
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	TokenHash string   `json:"-"`
+
+	// ExpiresAt is nil for tokens that never expire, and LastUsedAt for tokens
+	// that have not been used yet.
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// Expired reports whether the token had expired by now.
+func (t *AccessToken) Expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
+
+// HasScope reports whether the token grants scope.
+func (t *AccessToken) HasScope(scope string) bool {
+	return contains(t.Scopes, scope)
+}
@@ -0,0 +1,69 @@
+package data
+
+import "time"
+
+// OAuthClient is an application registered to get tokens from the OAuth2
+// endpoints. Confidential clients have a secret, of which only the hash is stored;
+// public clients, such as single page apps, have none and must use PKCE.
+type OAuthClient struct {
+	ID           int      `json:"-"`
+	ClientID     string   `json:"client_id"`
+	SecretHash   string   `json:"-"`
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	GrantTypes   []string `json:"grant_types"`
+	Scopes       []string `json:"scopes"`
+
+	// OwnerID is the user who registered the client; tokens from the
+	// client_credentials grant act as them.
+	OwnerID   int       `json:"owner_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Confidential reports whether the client authenticates with a secret.
+func (c *OAuthClient) Confidential() bool {
+	return c.SecretHash != ""
+}
+
+// AllowsGrant reports whether the client may use grantType.
+func (c *OAuthClient) AllowsGrant(grantType string) bool {
+	return contains(c.GrantTypes, grantType)
+}
+
+// AllowsRedirect reports whether uri exactly matches one of the client's
+// registered redirect URIs.
+func (c *OAuthClient) AllowsRedirect(uri string) bool {
+	return contains(c.RedirectURIs, uri)
+}
+
+// AllowsScope reports whether the client may ask for scope.
+func (c *OAuthClient) AllowsScope(scope string) bool {
+	return contains(c.Scopes, scope)
+}
+
+// OAuthCode is an authorization code, issued when a user approves a client and
+// exchanged by the client for tokens. Only its hash is stored.
+type OAuthCode struct {
+	CodeHash    string
+	ClientID    string
+	UserID      int
+	RedirectURI string
+	Scopes      []string
+
+	// CodeChallenge is the PKCE challenge, the S256 hash of the verifier the
+	// client must present with the code.
+	CodeChallenge string
+
+	// Nonce is the OpenID Connect nonce of the authorization request, if any.
+	Nonce     string
+	ExpiresAt time.Time
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,224 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+// ErrUnknownHashFormat is returned when a stored password hash was not produced by
+// any hasher we know about.
+var ErrUnknownHashFormat = errors.New("unknown password hash format")
+
+// PasswordHasher hashes new passwords and checks stored ones. The algorithm and
+// its parameters are encoded in every hash, so a hash can always be verified even
+// after the configured hasher has changed; NeedsRehash reports when it should be
+// replaced with a fresh one.
+type PasswordHasher interface {
+	// Hash returns an encoded hash of password.
+	Hash(password string) (string, error)
+
+	// Verify reports whether password matches hash. It returns an error if hash
+	// is not in this hasher's format.
+	Verify(hash, password string) (bool, error)
+
+	// NeedsRehash reports whether hash uses a different algorithm or different
+	// parameters than this hasher would.
+	NeedsRehash(hash string) bool
+}
+
+// DefaultPasswordHasher is used wherever no hasher is configured.
+var DefaultPasswordHasher PasswordHasher = DefaultArgon2idHasher()
+
+// NewPasswordHasher returns the default hasher for the named algorithm, argon2id or
+// bcrypt.
+func NewPasswordHasher(algorithm string) (PasswordHasher, error) {
+	switch algorithm {
+	case "argon2id":
+		return DefaultArgon2idHasher(), nil
+	case "bcrypt":
+		return BcryptHasher{Cost: 12}, nil
+	default:
+		return nil, fmt.Errorf("unknown password hashing algorithm %q; expected argon2id or bcrypt", algorithm)
+	}
+}
+
+// VerifyPassword reports whether password matches hash, using whichever algorithm
+// and parameters the hash was created with.
+func VerifyPassword(hash, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return Argon2idHasher{}.Verify(hash, password)
+	case isBcryptHash(hash):
+		return BcryptHasher{}.Verify(hash, password)
+	default:
+		return false, ErrUnknownHashFormat
+	}
+}
+
+// BcryptHasher hashes passwords with bcrypt at the given cost.
+type BcryptHasher struct {
+	Cost int
+}
+
+// Hash returns a bcrypt hash of password.
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hashed), nil
+}
+
+// Verify reports whether password matches the bcrypt hash. The cost is read from
+// the hash.
+func (h BcryptHasher) Verify(hash, password string) (bool, error) {
+	if !isBcryptHash(hash) {
+		return false, ErrUnknownHashFormat
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			// invalid password
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// NeedsRehash reports whether hash is not a bcrypt hash at h.Cost.
+func (h BcryptHasher) NeedsRehash(hash string) bool {
+	if !isBcryptHash(hash) {
+		return true
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != h.Cost
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// Argon2idHasher hashes passwords with argon2id. Hashes are stored in the PHC string
+// format, $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>, with the
+// salt and key in unpadded base64.
+type Argon2idHasher struct {
+	Time    uint32 // number of passes over the memory
+	Memory  uint32 // memory in KiB
+	Threads uint8
+	KeyLen  uint32
+	SaltLen uint32
+}
+
+// DefaultArgon2idHasher returns an argon2id hasher with the parameters recommended
+// by OWASP.
+func DefaultArgon2idHasher() Argon2idHasher {
+	return Argon2idHasher{
+		Time:    2,
+		Memory:  19 * 1024,
+		Threads: 1,
+		KeyLen:  32,
+		SaltLen: 16,
+	}
+}
+
+// Hash returns an argon2id hash of password with a random salt.
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.Memory,
+		h.Time,
+		h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Verify reports whether password matches the argon2id hash. The parameters are
+// read from the hash, not from h.
+func (h Argon2idHasher) Verify(hash, password string) (bool, error) {
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// NeedsRehash reports whether hash is not an argon2id hash with h's parameters.
+func (h Argon2idHasher) NeedsRehash(hash string) bool {
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return true
+	}
+
+	return params.Time != h.Time ||
+		params.Memory != h.Memory ||
+		params.Threads != h.Threads ||
+		uint32(len(key)) != h.KeyLen ||
+		uint32(len(salt)) != h.SaltLen
+}
+
+// decodeArgon2id splits an encoded argon2id hash into its parameters, salt and key.
+func decodeArgon2id(hash string) (Argon2idHasher, []byte, []byte, error) {
+	var params Argon2idHasher
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnknownHashFormat
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id hash: %w", err)
+	}
+
+	if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads)
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id hash: %w", err)
+	}
+
+	if params.Time < 1 || params.Threads < 1 {
+		return params, nil, nil, errors.New("invalid argon2id hash: time and parallelism must be at least 1")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id key: %w", err)
+	}
+
+	params.KeyLen = uint32(len(key))
+	params.SaltLen = uint32(len(salt))
+
+	return params, salt, key, nil
+}
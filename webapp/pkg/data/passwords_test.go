@@ -0,0 +1,69 @@
+package data
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPasswordHashers(t *testing.T) {
+	fast := Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLen: 32, SaltLen: 16}
+
+	tests := []struct {
+		name   string
+		hasher PasswordHasher
+		other  PasswordHasher
+	}{
+		{"argon2id", fast, Argon2idHasher{Time: 2, Memory: 1024, Threads: 1, KeyLen: 32, SaltLen: 16}},
+		{"bcrypt", BcryptHasher{Cost: 4}, BcryptHasher{Cost: 5}},
+	}
+
+	for _, e := range tests {
+		hash, err := e.hasher.Hash("secret")
+		if err != nil {
+			t.Fatalf("%s: Hash() returned an error: %s", e.name, err)
+		}
+
+		if matches, err := VerifyPassword(hash, "secret"); err != nil || !matches {
+			t.Errorf("%s: password should match 'secret' but does not: %v", e.name, err)
+		}
+
+		if matches, _ := VerifyPassword(hash, "wrong"); matches {
+			t.Errorf("%s: wrong password matched", e.name)
+		}
+
+		if e.hasher.NeedsRehash(hash) {
+			t.Errorf("%s: a fresh hash should not need rehashing", e.name)
+		}
+
+		if !e.other.NeedsRehash(hash) {
+			t.Errorf("%s: a hash with different parameters should need rehashing", e.name)
+		}
+	}
+
+	bcryptHash, _ := BcryptHasher{Cost: 4}.Hash("secret")
+	if !fast.NeedsRehash(bcryptHash) {
+		t.Error("a bcrypt hash should need rehashing when argon2id is configured")
+	}
+
+	if _, err := VerifyPassword("plain text", "plain text"); !errors.Is(err, ErrUnknownHashFormat) {
+		t.Errorf("expected ErrUnknownHashFormat, got %v", err)
+	}
+
+	if _, err := VerifyPassword("$argon2id$v=19$m=1024,t=0,p=1$c2FsdA$a2V5", "secret"); err == nil {
+		t.Error("expected an error for an argon2id hash with invalid parameters")
+	}
+}
+
+func TestNewPasswordHasher(t *testing.T) {
+	if _, err := NewPasswordHasher("argon2id"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := NewPasswordHasher("bcrypt"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := NewPasswordHasher("md5"); err == nil {
+		t.Error("expected an error for an unknown algorithm")
+	}
+}
@@ -0,0 +1,32 @@
+package data
+
+import "time"
+
+// The kinds of session a user can have.
+const (
+	// SessionAPI is a login to the API, kept alive by refresh tokens.
+	SessionAPI = "api"
+
+	// SessionWeb is a login to the web application, kept in its session store.
+	SessionWeb = "web"
+)
+
+// Session is one place a user is logged in: a chain of refresh tokens from the
+// API, or a web application session. Deleting it logs that place out.
+type Session struct {
+	ID        int    `json:"id"`
+	UserID    int    `json:"user_id"`
+	Kind      string `json:"kind"`
+	Device    string `json:"device"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// Expired reports whether the session had expired by now.
+func (s *Session) Expired(now time.Time) bool {
+	return !now.Before(s.ExpiresAt)
+}
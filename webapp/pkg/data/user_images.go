@@ -1,12 +1,39 @@
 package data
 
-import "time"
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
 
-// UserImage is the type for user profile images.
+// ImageSizes are the widths, in pixels, of the square versions of a profile
+// picture, smallest first.
+var ImageSizes = []int{64, 256, 512}
+
+// UserImage is the type for user profile images. A user keeps the images they
+// replace, and has at most one current image.
 type UserImage struct {
 	ID        int       `json:"id"`
 	UserID    int       `json:"user_id"`
 	FileName  string    `json:"file_name"`
-	CreatedAt time.Time `json:"-"`
+	IsCurrent bool      `json:"is_current"`
+	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"-"`
+
+	// URL is where the API serves the image; it is set by the API, not stored.
+	URL string `json:"url,omitempty"`
+}
+
+// Variant returns the file name of the version of the image that is size pixels
+// wide; see ImageSizes.
+func (i UserImage) Variant(size int) string {
+	return VariantName(i.FileName, size)
+}
+
+// VariantName returns the file name of the version of the picture called name
+// that is size pixels wide, e.g. "face_64.jpg" for "face.jpg".
+func VariantName(name string, size int) string {
+	ext := path.Ext(name)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(name, ext), size, ext)
 }
@@ -0,0 +1,13 @@
+package data
+
+import "testing"
+
+func TestVariantName(t *testing.T) {
+	if name := VariantName("face.jpg", 64); name != "face_64.jpg" {
+		t.Errorf("expected face_64.jpg, but got %s", name)
+	}
+
+	if name := (UserImage{FileName: "face.png"}).Variant(512); name != "face_512.png" {
+		t.Errorf("expected face_512.png, but got %s", name)
+	}
+}
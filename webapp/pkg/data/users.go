@@ -1,8 +1,7 @@
 package data
 
 import (
-	"errors"
-	"golang.org/x/crypto/bcrypt"
+	"strings"
 	"time"
 )
 
@@ -17,22 +16,56 @@ type User struct {
 	CreatedAt  time.Time `json:"-"`
 	UpdatedAt  time.Time `json:"-"`
 	ProfilePic UserImage `json:"-"`
+
+	// AvatarURL is where the API serves the user's profile picture, if they have
+	// one. The API sets it; it isn't stored.
+	AvatarURL string `json:"avatar_url,omitempty"`
+
+	// SessionsRevokedAt is when the user's sessions and tokens were last revoked,
+	// e.g. by a password reset. Anything issued before then must be rejected.
+	SessionsRevokedAt time.Time `json:"-"`
+
+	// EmailVerifiedAt is when the user confirmed their email address. Users who
+	// registered themselves can't log in until they have.
+	EmailVerifiedAt time.Time `json:"-"`
+
+	// TOTPSecret is the user's authenticator app secret, set when they start
+	// enrolling in two-factor authentication; TOTPEnabledAt is set once they have
+	// confirmed it with a code.
+	TOTPSecret    string    `json:"-"`
+	TOTPEnabledAt time.Time `json:"-"`
+}
+
+// EmailVerified reports whether the user has confirmed their email address.
+func (u *User) EmailVerified() bool {
+	return !u.EmailVerifiedAt.IsZero()
 }
 
-// PasswordMatches uses Go's bcrypt package to compare a user supplied password
-// with the hash we have stored for a given user in the database. If the password
-// and hash match, we return true; otherwise, we return false.
+// TOTPEnabled reports whether the user must give a one-time code to log in.
+func (u *User) TOTPEnabled() bool {
+	return !u.TOTPEnabledAt.IsZero()
+}
+
+// PasswordMatches compares a user supplied password with the hash we have stored
+// for a given user in the database, using whichever algorithm the hash was created
+// with. If the password and hash match, we return true; otherwise, we return false.
 func (u *User) PasswordMatches(plainText string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(plainText))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			// invalid password
-			return false, nil
-		default:
-			return false, err
-		}
+	return VerifyPassword(u.Password, plainText)
+}
+
+// PasswordNeedsRehash reports whether the stored hash is outdated compared to h, or
+// DefaultPasswordHasher when h is nil. Call it after a successful PasswordMatches, while
+// the plain text password is still at hand to hash again.
+func (u *User) PasswordNeedsRehash(h PasswordHasher) bool {
+	if h == nil {
+		h = DefaultPasswordHasher
 	}
 
-	return true, nil
+	return h.NeedsRehash(u.Password)
+}
+
+// NormalizeEmail returns the canonical form of an email address, which is how it is
+// stored and looked up. Email addresses are treated as case-insensitive.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
 }
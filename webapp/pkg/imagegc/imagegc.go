@@ -0,0 +1,119 @@
+// Package imagegc removes stored profile pictures that no user image refers to
+// any more: pictures deleted from a user's history, and uploads that were never
+// recorded because the request failed part way. Only blobs named the way
+// package upload names them are considered, so other files kept in the same
+// store are left alone.
+package imagegc
+
+import (
+	"context"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+	"github.com/spacesedan/testing-course/webapp/pkg/storage"
+	"log"
+	"regexp"
+	"time"
+)
+
+// DefaultMinAge is how old an unreferenced blob must be to be removed when
+// Collector.MinAge is zero.
+const DefaultMinAge = time.Hour
+
+// uploadKey matches the keys of uploads, made by upload.NewKey, and of the
+// sizes imaging.Store makes of them.
+var uploadKey = regexp.MustCompile(`^[0-9a-f]{32}(_[0-9]+)?\.[a-z]+$`)
+
+// Collector removes the blobs of profile pictures that no user image refers to.
+type Collector struct {
+	DB    repository.DataBaseRepo
+	Blobs storage.BlobStore
+
+	// MinAge is how old an unreferenced blob must be to be removed; zero means
+	// DefaultMinAge. Pictures are stored before the image that refers to them
+	// is inserted, so younger blobs may still be about to be used.
+	MinAge time.Duration
+
+	// Logger is where Run reports; nil means the standard logger.
+	Logger *log.Logger
+
+	// now returns the current time; tests fix it.
+	now func() time.Time
+}
+
+// Collect removes every unreferenced blob that is old enough, and returns how
+// many it removed.
+func (c *Collector) Collect(ctx context.Context) (int, error) {
+	// list the blobs first: a picture stored after the names are read must not
+	// look unreferenced
+	infos, err := c.Blobs.List(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+
+	names, err := c.DB.UserImageFileNames(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	referenced := make(map[string]bool, len(names)*(len(data.ImageSizes)+1))
+	for _, name := range names {
+		// pictures from before they were resized are stored as they are
+		referenced[name] = true
+		for _, size := range data.ImageSizes {
+			referenced[data.VariantName(name, size)] = true
+		}
+	}
+
+	minAge := c.MinAge
+	if minAge <= 0 {
+		minAge = DefaultMinAge
+	}
+	now := time.Now
+	if c.now != nil {
+		now = c.now
+	}
+	cutoff := now().Add(-minAge)
+
+	removed := 0
+	for _, info := range infos {
+		if referenced[info.Key] || !uploadKey.MatchString(info.Key) || info.ModTime.After(cutoff) {
+			continue
+		}
+
+		err = c.Blobs.Delete(ctx, info.Key)
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// Run collects every interval until ctx is done, logging what it removed and
+// any errors.
+func (c *Collector) Run(ctx context.Context, interval time.Duration) {
+	logger := c.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		removed, err := c.Collect(ctx)
+		if err != nil {
+			logger.Println("imagegc: collecting unused profile pictures:", err)
+		}
+		if removed > 0 {
+			logger.Printf("imagegc: removed %d unused profile picture files\n", removed)
+		}
+	}
+}
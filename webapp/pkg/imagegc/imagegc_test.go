@@ -0,0 +1,129 @@
+package imagegc
+
+import (
+	"context"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository/dbrepo"
+	"github.com/spacesedan/testing-course/webapp/pkg/storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCollector_Collect(t *testing.T) {
+	ctx := context.Background()
+	repo := dbrepo.NewMemoryDBRepo()
+	store := &storage.MemoryStore{}
+
+	userID, _ := repo.InsertUser(ctx, data.User{Email: "jack@smith.com", Password: "secret"})
+
+	const (
+		current = "0123456789abcdef0123456789abcdef.jpg"
+		past    = "11111111111111111111111111111111.png"
+		deleted = "22222222222222222222222222222222.jpg"
+		failed  = "33333333333333333333333333333333.webp"
+	)
+
+	put := func(keys ...string) {
+		for _, key := range keys {
+			if err := store.Put(ctx, key, strings.NewReader("x"), ""); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, name := range []string{current, past, deleted} {
+		for _, size := range data.ImageSizes {
+			put(data.VariantName(name, size))
+		}
+	}
+	// an upload whose request failed before it was processed, a picture from
+	// before pictures were resized, and a file that isn't an upload
+	put(failed, "legacy.jpg", "IMG_0394.JPG")
+
+	deletedID, _ := repo.InsertUserImage(ctx, data.UserImage{UserID: userID, FileName: deleted})
+	_, _ = repo.InsertUserImage(ctx, data.UserImage{UserID: userID, FileName: past})
+	_, _ = repo.InsertUserImage(ctx, data.UserImage{UserID: userID, FileName: "legacy.jpg"})
+	_, _ = repo.InsertUserImage(ctx, data.UserImage{UserID: userID, FileName: current})
+	_ = repo.DeleteUserImage(ctx, userID, deletedID)
+
+	collector := &Collector{DB: repo, Blobs: store}
+
+	// everything is too new to be removed yet
+	removed, err := collector.Collect(ctx)
+	if err != nil || removed != 0 {
+		t.Errorf("expected new blobs to be kept, but %d were removed (%v)", removed, err)
+	}
+
+	collector.now = func() time.Time { return time.Now().Add(2 * DefaultMinAge) }
+	removed, err = collector.Collect(ctx)
+	if err != nil {
+		t.Fatalf("Collect() returned an error: %s", err)
+	}
+
+	expectedRemoved := len(data.ImageSizes) + 1
+	if removed != expectedRemoved {
+		t.Errorf("expected %d blobs to be removed, but %d were", expectedRemoved, removed)
+	}
+
+	infos, _ := store.List(ctx, "")
+	left := make(map[string]bool)
+	for _, info := range infos {
+		left[info.Key] = true
+	}
+
+	for _, size := range data.ImageSizes {
+		for _, name := range []string{current, past} {
+			if !left[data.VariantName(name, size)] {
+				t.Errorf("expected %s, which an image refers to, to be kept", data.VariantName(name, size))
+			}
+		}
+		if left[data.VariantName(deleted, size)] {
+			t.Errorf("expected %s, which no image refers to, to be removed", data.VariantName(deleted, size))
+		}
+	}
+
+	if left[failed] {
+		t.Errorf("expected the unprocessed upload %s to be removed", failed)
+	}
+	if !left["legacy.jpg"] || !left["IMG_0394.JPG"] {
+		t.Errorf("expected legacy pictures and other files to be kept, but got %v", left)
+	}
+}
+
+func TestCollector_Run(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	store := &storage.MemoryStore{}
+	_ = store.Put(ctx, "0123456789abcdef0123456789abcdef.jpg", strings.NewReader("x"), "")
+
+	collector := &Collector{
+		DB:    dbrepo.NewMemoryDBRepo(),
+		Blobs: store,
+		now:   func() time.Time { return time.Now().Add(2 * DefaultMinAge) },
+	}
+
+	done := make(chan struct{})
+	go func() {
+		collector.Run(ctx, time.Millisecond)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		infos, _ := store.List(ctx, "")
+		if len(infos) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected Run() to remove the unused blob")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Run() to return once its context is done")
+	}
+}
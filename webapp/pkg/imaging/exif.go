@@ -0,0 +1,93 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// The JPEG markers jpegOrientation looks for.
+const (
+	markerSOI  = 0xd8
+	markerAPP1 = 0xe1
+	markerSOS  = 0xda
+)
+
+// orientationTag is the EXIF tag of the orientation of an image.
+const orientationTag = 0x0112
+
+// jpegOrientation returns the EXIF orientation of a JPEG file, from 1 to 8, or 1
+// if it has none or it can't be read.
+func jpegOrientation(contents []byte) int {
+	if len(contents) < 4 || contents[0] != 0xff || contents[1] != markerSOI {
+		return 1
+	}
+
+	// walk the segments before the image data, looking for the EXIF one
+	for i := 2; i+4 <= len(contents); {
+		if contents[i] != 0xff {
+			return 1
+		}
+
+		marker := contents[i+1]
+		if marker == markerSOS {
+			return 1
+		}
+
+		length := int(binary.BigEndian.Uint16(contents[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(contents) {
+			return 1
+		}
+
+		segment := contents[i+4 : end]
+		if marker == markerAPP1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+
+		i = end
+	}
+
+	return 1
+}
+
+// tiffOrientation returns the orientation in the first IFD of EXIF data, which is
+// laid out like a TIFF file.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+
+	entries := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < entries; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+
+		if order.Uint16(tiff[entry:]) == orientationTag {
+			// a SHORT, kept in the first two bytes of the value
+			o := int(order.Uint16(tiff[entry+8:]))
+			if o < 1 || o > 8 {
+				return 1
+			}
+			return o
+		}
+	}
+
+	return 1
+}
@@ -0,0 +1,197 @@
+// Package imaging turns uploaded profile pictures into the square versions that
+// are served. Each picture is decoded, turned upright as its EXIF orientation
+// says, cropped to a square around its center and scaled to every size. Only
+// the pixels are encoded again, so the metadata of the upload, such as where a
+// photo was taken, is left behind.
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/storage"
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"path"
+	"strings"
+)
+
+// MaxPixels is the most pixels an image may have to be decoded, so a small file
+// can't claim to be a huge image and exhaust memory.
+const MaxPixels = 50_000_000
+
+// jpegQuality is the quality pictures without transparency are encoded with.
+const jpegQuality = 85
+
+var (
+	// ErrUnsupported is returned for files that can't be decoded as an image.
+	ErrUnsupported = errors.New("the image could not be read")
+
+	// ErrTooManyPixels is returned for images with more than MaxPixels pixels.
+	ErrTooManyPixels = fmt.Errorf("the image must have at most %d megapixels", MaxPixels/1_000_000)
+)
+
+// Result is a picture processed by Process.
+type Result struct {
+	// Ext is the extension of the encoding: .png for pictures with transparency,
+	// .jpg for the rest.
+	Ext string
+
+	// Images holds the encoded picture for each size.
+	Images map[int][]byte
+}
+
+// Process decodes the image in contents, turns it upright, crops it to a square
+// and encodes it at each of sizes.
+func Process(contents []byte, sizes []int) (*Result, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(contents))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+
+	if int64(config.Width)*int64(config.Height) > MaxPixels {
+		return nil, ErrTooManyPixels
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(contents))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+
+	// the center square of the upright picture is the upright center square
+	square := cropSquare(img)
+	if format == "jpeg" {
+		square = orient(square, jpegOrientation(contents))
+	}
+
+	result := &Result{Ext: ".jpg", Images: make(map[int][]byte, len(sizes))}
+	if !square.Opaque() {
+		result.Ext = ".png"
+	}
+
+	for _, size := range sizes {
+		scaled := image.NewNRGBA(image.Rect(0, 0, size, size))
+		xdraw.CatmullRom.Scale(scaled, scaled.Bounds(), square, square.Bounds(), draw.Src, nil)
+
+		var b bytes.Buffer
+		if result.Ext == ".png" {
+			err = png.Encode(&b, scaled)
+		} else {
+			err = jpeg.Encode(&b, scaled, &jpeg.Options{Quality: jpegQuality})
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		result.Images[size] = b.Bytes()
+	}
+
+	return result, nil
+}
+
+// Store processes the upload stored as key in store into the square versions
+// for every one of data.ImageSizes, stored next to it under data.VariantName. It
+// returns the name the versions are known by. The upload is deleted either way,
+// since it still has its metadata.
+func Store(ctx context.Context, store storage.BlobStore, key string) (string, error) {
+	blob, err := store.Get(ctx, key)
+	if err != nil {
+		_ = store.Delete(ctx, key)
+		return "", err
+	}
+	contents, err := io.ReadAll(blob.Body)
+	_ = blob.Body.Close()
+	_ = store.Delete(ctx, key)
+	if err != nil {
+		return "", err
+	}
+
+	result, err := Process(contents, data.ImageSizes)
+	if err != nil {
+		return "", err
+	}
+
+	name := strings.TrimSuffix(key, path.Ext(key)) + result.Ext
+	contentType := mime.TypeByExtension(result.Ext)
+
+	for _, size := range data.ImageSizes {
+		err = store.Put(ctx, data.VariantName(name, size), bytes.NewReader(result.Images[size]), contentType)
+		if err != nil {
+			Remove(ctx, store, name)
+			return "", err
+		}
+	}
+
+	return name, nil
+}
+
+// Remove deletes every version of the picture called name from store.
+func Remove(ctx context.Context, store storage.BlobStore, name string) {
+	for _, size := range data.ImageSizes {
+		_ = store.Delete(ctx, data.VariantName(name, size))
+	}
+}
+
+// cropSquare returns the largest square in the center of img.
+func cropSquare(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+
+	min := image.Pt(b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2)
+	square := image.NewNRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(square, square.Bounds(), img, min, draw.Src)
+
+	return square
+}
+
+// orient returns square turned as EXIF orientation o says it must be to be shown
+// upright: 1 is upright already, 2 to 4 are mirrored or upside down, and 5 to 8
+// are on their side.
+func orient(square *image.NRGBA, o int) *image.NRGBA {
+	if o < 2 || o > 8 {
+		return square
+	}
+
+	n := square.Bounds().Dx()
+	last := n - 1
+
+	// where the pixel at x, y of the upright picture is in square
+	var source func(x, y int) (int, int)
+	switch o {
+	case 2:
+		source = func(x, y int) (int, int) { return last - x, y }
+	case 3:
+		source = func(x, y int) (int, int) { return last - x, last - y }
+	case 4:
+		source = func(x, y int) (int, int) { return x, last - y }
+	case 5:
+		source = func(x, y int) (int, int) { return y, x }
+	case 6:
+		source = func(x, y int) (int, int) { return y, last - x }
+	case 7:
+		source = func(x, y int) (int, int) { return last - y, last - x }
+	case 8:
+		source = func(x, y int) (int, int) { return last - y, x }
+	}
+
+	upright := image.NewNRGBA(image.Rect(0, 0, n, n))
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			upright.SetNRGBA(x, y, square.NRGBAAt(source(x, y)))
+		}
+	}
+
+	return upright
+}
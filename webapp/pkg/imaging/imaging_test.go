@@ -0,0 +1,224 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/storage"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+var (
+	red  = color.NRGBA{R: 255, A: 255}
+	blue = color.NRGBA{B: 255, A: 255}
+)
+
+// halves returns an opaque image that is red on the left and blue on the right.
+func halves(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if x < w/2 {
+				img.SetNRGBA(x, y, red)
+			} else {
+				img.SetNRGBA(x, y, blue)
+			}
+		}
+	}
+	return img
+}
+
+// withOrientation returns a JPEG of img with an EXIF segment giving orientation
+// o, in the given byte order.
+func withOrientation(t *testing.T, img image.Image, o uint16, order binary.ByteOrder) []byte {
+	t.Helper()
+
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	var tiff bytes.Buffer
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	_ = binary.Write(&tiff, order, uint16(42))
+	_ = binary.Write(&tiff, order, uint32(8))
+	_ = binary.Write(&tiff, order, uint16(1))
+	_ = binary.Write(&tiff, order, []uint16{orientationTag, 3})
+	_ = binary.Write(&tiff, order, uint32(1))
+	_ = binary.Write(&tiff, order, []uint16{o, 0})
+	_ = binary.Write(&tiff, order, uint32(0))
+
+	segment := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+
+	var out bytes.Buffer
+	out.Write(encoded.Bytes()[:2])
+	out.Write([]byte{0xff, markerAPP1})
+	_ = binary.Write(&out, binary.BigEndian, uint16(len(segment)+2))
+	out.Write(segment)
+	out.Write(encoded.Bytes()[2:])
+
+	return out.Bytes()
+}
+
+func near(c color.Color, expected color.NRGBA) bool {
+	r, g, b, _ := c.RGBA()
+	er, eg, eb, _ := expected.RGBA()
+	diff := func(x, y uint32) bool { return x > y+0x2000 || y > x+0x2000 }
+	return !diff(r, er) && !diff(g, eg) && !diff(b, eb)
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	img := halves(8, 8)
+
+	for o := uint16(1); o <= 8; o++ {
+		if got := jpegOrientation(withOrientation(t, img, o, binary.BigEndian)); got != int(o) {
+			t.Errorf("big endian orientation %d: got %d", o, got)
+		}
+		if got := jpegOrientation(withOrientation(t, img, o, binary.LittleEndian)); got != int(o) {
+			t.Errorf("little endian orientation %d: got %d", o, got)
+		}
+	}
+
+	var plain bytes.Buffer
+	_ = jpeg.Encode(&plain, img, nil)
+
+	tests := []struct {
+		name     string
+		contents []byte
+	}{
+		{"no EXIF", plain.Bytes()},
+		{"out of range", withOrientation(t, img, 9, binary.BigEndian)},
+		{"truncated", withOrientation(t, img, 6, binary.BigEndian)[:30]},
+		{"not a JPEG", []byte("GIF89a")},
+	}
+
+	for _, e := range tests {
+		if got := jpegOrientation(e.contents); got != 1 {
+			t.Errorf("%s: expected orientation 1, but got %d", e.name, got)
+		}
+	}
+}
+
+func TestProcess(t *testing.T) {
+	// a landscape photo taken with the phone on its side: rotated upright, the
+	// red half is on top
+	photo := withOrientation(t, halves(400, 200), 6, binary.BigEndian)
+
+	result, err := Process(photo, data.ImageSizes)
+	if err != nil {
+		t.Fatalf("Process() returned an error: %s", err)
+	}
+
+	if result.Ext != ".jpg" {
+		t.Errorf("expected an opaque picture to be a JPEG, but got %s", result.Ext)
+	}
+
+	for _, size := range data.ImageSizes {
+		img, err := jpeg.Decode(bytes.NewReader(result.Images[size]))
+		if err != nil {
+			t.Fatalf("size %d: %s", size, err)
+		}
+
+		if b := img.Bounds(); b.Dx() != size || b.Dy() != size {
+			t.Errorf("size %d: expected a square of that size, but got %v", size, b)
+		}
+
+		if top, bottom := img.At(size/2, 2), img.At(size/2, size-3); !near(top, red) || !near(bottom, blue) {
+			t.Errorf("size %d: expected red over blue, but got %v over %v", size, top, bottom)
+		}
+
+		if bytes.Contains(result.Images[size], []byte("Exif")) {
+			t.Errorf("size %d: expected the metadata to be stripped", size)
+		}
+	}
+
+	var transparent bytes.Buffer
+	_ = png.Encode(&transparent, image.NewNRGBA(image.Rect(0, 0, 10, 30)))
+	result, err = Process(transparent.Bytes(), []int{64})
+	if err != nil || result.Ext != ".png" {
+		t.Errorf("expected a transparent picture to stay a PNG, but got %+v and %v", result, err)
+	}
+
+	if _, err := Process([]byte("\x89PNG\r\n\x1a\n broken"), data.ImageSizes); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("expected ErrUnsupported for a broken image, but got %v", err)
+	}
+}
+
+func TestProcess_tooManyPixels(t *testing.T) {
+	// a header claiming a huge image is all DecodeConfig reads
+	var header bytes.Buffer
+	header.WriteString("\x89PNG\r\n\x1a\n")
+	var ihdr bytes.Buffer
+	ihdr.WriteString("IHDR")
+	_ = binary.Write(&ihdr, binary.BigEndian, []uint32{100000, 100000})
+	ihdr.Write([]byte{8, 6, 0, 0, 0})
+	_ = binary.Write(&header, binary.BigEndian, uint32(ihdr.Len()-4))
+	header.Write(ihdr.Bytes())
+	_ = binary.Write(&header, binary.BigEndian, crc32.ChecksumIEEE(ihdr.Bytes()))
+
+	if _, err := Process(header.Bytes(), data.ImageSizes); !errors.Is(err, ErrTooManyPixels) {
+		t.Errorf("expected ErrTooManyPixels, but got %v", err)
+	}
+}
+
+func TestStore(t *testing.T) {
+	store := &storage.MemoryStore{}
+	ctx := context.Background()
+
+	var upload bytes.Buffer
+	_ = jpeg.Encode(&upload, halves(30, 20), nil)
+	_ = store.Put(ctx, "face.webp", &upload, "image/webp")
+
+	name, err := Store(ctx, store, "face.webp")
+	if err != nil {
+		t.Fatalf("Store() returned an error: %s", err)
+	}
+
+	if name != "face.jpg" {
+		t.Errorf("expected the name to have the extension of the encoding, but got %s", name)
+	}
+
+	infos, _ := store.List(ctx, "")
+	var stored []string
+	for _, info := range infos {
+		stored = append(stored, info.Key)
+		if info.ContentType != "image/jpeg" {
+			t.Errorf("expected %s to be stored as image/jpeg, but got %s", info.Key, info.ContentType)
+		}
+	}
+
+	expected := []string{"face_256.jpg", "face_512.jpg", "face_64.jpg"}
+	if len(stored) != len(expected) {
+		t.Fatalf("expected %v to be stored, but found %v", expected, stored)
+	}
+	for i := range expected {
+		if stored[i] != expected[i] {
+			t.Errorf("expected %v to be stored, but found %v", expected, stored)
+			break
+		}
+	}
+
+	Remove(ctx, store, name)
+	if infos, _ := store.List(ctx, ""); len(infos) != 0 {
+		t.Errorf("expected Remove() to delete every size, but %d blobs are left", len(infos))
+	}
+
+	_ = store.Put(ctx, "broken.png", bytes.NewReader([]byte("not an image")), "image/png")
+	if _, err := Store(ctx, store, "broken.png"); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("expected ErrUnsupported, but got %v", err)
+	}
+	if infos, _ := store.List(ctx, ""); len(infos) != 0 {
+		t.Errorf("expected a refused upload to be removed, but %d blobs are left", len(infos))
+	}
+}
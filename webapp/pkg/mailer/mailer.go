@@ -0,0 +1,216 @@
+// Package mailer sends email. Production uses SMTPMailer; during development
+// LogMailer and FileMailer keep messages on the machine, so that links in them
+// (such as password reset links) can be followed by hand, and tests capture
+// messages with MemoryMailer. Messages are usually rendered from Templates and
+// sent through a Queue, which retries failed deliveries in the background.
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Message is an email. Body is the plain text version; when HTMLBody is set as
+// well, the message is sent as multipart/alternative with both.
+type Message struct {
+	To       string
+	Subject  string
+	Body     string
+	HTMLBody string
+}
+
+// Mailer sends messages.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Config selects and configures a Mailer; see New.
+type Config struct {
+	// Kind is one of log, file, memory or smtp.
+	Kind string
+
+	// From is the sender address.
+	From string
+
+	// Dir is where the file mailer writes messages.
+	Dir string
+
+	// SMTPAddr is the host:port of the SMTP server. Username and Password are
+	// optional; when set, PLAIN authentication is used.
+	SMTPAddr string
+	Username string
+	Password string
+}
+
+// New returns the mailer described by cfg.
+func New(cfg Config) (Mailer, error) {
+	switch cfg.Kind {
+	case "log":
+		return &LogMailer{From: cfg.From}, nil
+	case "file":
+		if cfg.Dir == "" {
+			return nil, errors.New("mailer: the file mailer needs a directory")
+		}
+		return &FileMailer{From: cfg.From, Dir: cfg.Dir}, nil
+	case "memory":
+		return &MemoryMailer{}, nil
+	case "smtp":
+		if cfg.SMTPAddr == "" {
+			return nil, errors.New("mailer: the smtp mailer needs a server address")
+		}
+		m := &SMTPMailer{Addr: cfg.SMTPAddr, From: cfg.From}
+		if cfg.Username != "" {
+			host, _, _ := strings.Cut(cfg.SMTPAddr, ":")
+			m.Auth = smtp.PlainAuth("", cfg.Username, cfg.Password, host)
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("mailer: unknown mailer %q; expected log, file, memory or smtp", cfg.Kind)
+	}
+}
+
+// SMTPMailer sends messages through an SMTP server.
+type SMTPMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+// Send delivers msg to the SMTP server. net/smtp does not take a context, so ctx
+// is only checked before connecting.
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	body, err := format(m.From, msg)
+	if err != nil {
+		return err
+	}
+
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{msg.To}, body)
+}
+
+// LogMailer writes messages to a logger instead of sending them. Logger defaults
+// to the standard logger.
+type LogMailer struct {
+	From   string
+	Logger *log.Logger
+}
+
+// Send logs msg.
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	logger := m.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	body, err := format(m.From, msg)
+	if err != nil {
+		return err
+	}
+
+	logger.Printf("mail not sent (log mailer):\n%s", body)
+	return nil
+}
+
+// FileMailer writes each message to its own .eml file in Dir instead of sending it.
+type FileMailer struct {
+	From string
+	Dir  string
+
+	seq uint64
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^a-zA-Z0-9@._-]+`)
+
+// Send writes msg to a new file in m.Dir, creating the directory if needed.
+func (m *FileMailer) Send(ctx context.Context, msg Message) error {
+	body, err := format(m.From, msg)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(m.Dir, 0755); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%03d-%s.eml",
+		time.Now().UTC().Format("20060102T150405"),
+		atomic.AddUint64(&m.seq, 1)%1000,
+		unsafeFileChars.ReplaceAllString(msg.To, "_"),
+	)
+
+	return os.WriteFile(filepath.Join(m.Dir, name), body, 0644)
+}
+
+// ErrInvalidHeader is returned for messages whose headers contain line breaks,
+// which would let a caller inject headers of their own.
+var ErrInvalidHeader = errors.New("mailer: header contains a line break")
+
+// format renders msg as an RFC 5322 message.
+func format(from string, msg Message) ([]byte, error) {
+	for _, header := range []string{from, msg.To, msg.Subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, ErrInvalidHeader
+		}
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+
+	if msg.HTMLBody == "" {
+		b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+		b.WriteString("\r\n")
+		b.WriteString(crlf(msg.Body))
+
+		return []byte(b.String()), nil
+	}
+
+	var parts strings.Builder
+	w := multipart.NewWriter(&parts)
+
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=UTF-8", msg.Body},
+		{"text/html; charset=UTF-8", msg.HTMLBody},
+	} {
+		pw, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {part.contentType}})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := pw.Write([]byte(crlf(part.body))); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%s\r\n", w.Boundary())
+	b.WriteString("\r\n")
+	b.WriteString(parts.String())
+
+	return []byte(b.String()), nil
+}
+
+// crlf converts the line endings in s to CRLF, as SMTP requires.
+func crlf(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\r\n")
+}
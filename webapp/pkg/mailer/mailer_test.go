@@ -0,0 +1,242 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      Config
+		expectedErr bool
+	}{
+		{"log", Config{Kind: "log"}, false},
+		{"file", Config{Kind: "file", Dir: "mail"}, false},
+		{"file without dir", Config{Kind: "file"}, true},
+		{"memory", Config{Kind: "memory"}, false},
+		{"smtp", Config{Kind: "smtp", SMTPAddr: "localhost:25", Username: "user"}, false},
+		{"smtp without address", Config{Kind: "smtp"}, true},
+		{"unknown", Config{Kind: "carrier pigeon"}, true},
+	}
+
+	for _, e := range tests {
+		_, err := New(e.config)
+		if e.expectedErr && err == nil {
+			t.Errorf("%s: expected an error but got none", e.name)
+		}
+
+		if !e.expectedErr && err != nil {
+			t.Errorf("%s: expected no error but got %s", e.name, err)
+		}
+	}
+}
+
+func TestFileMailer_Send(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	m := &FileMailer{From: "no-reply@example.com", Dir: dir}
+
+	for i := 0; i < 2; i++ {
+		err := m.Send(context.Background(), Message{To: "admin@example.com", Subject: "Hello", Body: "line one\nline two"})
+		if err != nil {
+			t.Fatalf("Send() returned an error: %s", err)
+		}
+	}
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 2 {
+		t.Fatalf("expected a file per message, but got %d", len(files))
+	}
+
+	content, _ := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	for _, expected := range []string{"From: no-reply@example.com\r\n", "To: admin@example.com\r\n", "Subject: Hello\r\n", "\r\n\r\nline one\r\nline two"} {
+		if !strings.Contains(string(content), expected) {
+			t.Errorf("expected message to contain %q, but got:\n%s", expected, content)
+		}
+	}
+}
+
+func TestLogMailer_Send(t *testing.T) {
+	var buf bytes.Buffer
+	m := &LogMailer{From: "no-reply@example.com", Logger: log.New(&buf, "", 0)}
+
+	_ = m.Send(context.Background(), Message{To: "admin@example.com", Subject: "Hello", Body: "reset link"})
+	if !strings.Contains(buf.String(), "reset link") {
+		t.Errorf("expected the message to be logged, but got %q", buf.String())
+	}
+
+	err := m.Send(context.Background(), Message{To: "admin@example.com\r\nBcc: everyone@example.com", Subject: "Hello"})
+	if !errors.Is(err, ErrInvalidHeader) {
+		t.Errorf("expected ErrInvalidHeader for a header with a line break, got %v", err)
+	}
+}
+
+func TestFormat_multipart(t *testing.T) {
+	body, err := format("no-reply@example.com", Message{To: "admin@example.com", Subject: "Hello", Body: "plain", HTMLBody: "<p>html</p>"})
+	if err != nil {
+		t.Fatalf("format() returned an error: %s", err)
+	}
+
+	for _, expected := range []string{"Content-Type: multipart/alternative; boundary=", "Content-Type: text/plain; charset=UTF-8\r\n\r\nplain", "Content-Type: text/html; charset=UTF-8\r\n\r\n<p>html</p>"} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("expected message to contain %q, but got:\n%s", expected, body)
+		}
+	}
+}
+
+func TestMemoryMailer(t *testing.T) {
+	m := &MemoryMailer{}
+
+	if _, ok := m.Last(); ok {
+		t.Error("expected no last message before anything was sent")
+	}
+
+	_ = m.Send(context.Background(), Message{To: "one@example.com"})
+	_ = m.Send(context.Background(), Message{To: "two@example.com"})
+
+	if err := m.Send(context.Background(), Message{To: "three@example.com\nBcc: everyone@example.com"}); !errors.Is(err, ErrInvalidHeader) {
+		t.Errorf("expected ErrInvalidHeader for a header with a line break, got %v", err)
+	}
+
+	if len(m.Messages()) != 2 {
+		t.Errorf("expected 2 messages, but got %d", len(m.Messages()))
+	}
+
+	if last, _ := m.Last(); last.To != "two@example.com" {
+		t.Errorf("expected the last message to be to two@example.com, but got %s", last.To)
+	}
+
+	m.Reset()
+	if len(m.Messages()) != 0 {
+		t.Error("expected Reset to forget all messages")
+	}
+}
+
+func TestTemplates_Message(t *testing.T) {
+	templates := &Templates{Dir: "./testdata"}
+
+	tests := []struct {
+		name            string
+		template        string
+		expectedSubject string
+		expectedBody    string
+		expectedHTML    string
+		expectedErr     bool
+	}{
+		{"text and html", "welcome", "Welcome, <Ann>", "Hello <Ann>, your account is ready.\n", "<html><body><p>Hello &lt;Ann&gt;, your account is ready.</p></body></html>", false},
+		{"text only", "plain", "Just text", "Hello <Ann>.\n", "", false},
+		{"no subject", "nosubject", "", "", "", true},
+		{"missing", "missing", "", "", "", true},
+	}
+
+	for _, e := range tests {
+		msg, err := templates.Message(e.template, "ann@example.com", map[string]string{"Name": "<Ann>"})
+		if e.expectedErr {
+			if err == nil {
+				t.Errorf("%s: expected an error but got none", e.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+			continue
+		}
+
+		if msg.To != "ann@example.com" || msg.Subject != e.expectedSubject || msg.Body != e.expectedBody || strings.TrimSpace(msg.HTMLBody) != e.expectedHTML {
+			t.Errorf("%s: unexpected message %+v", e.name, msg)
+		}
+	}
+}
+
+// flakyMailer fails the first m.failures sends, then succeeds.
+type flakyMailer struct {
+	failures int32
+	calls    int32
+	sent     MemoryMailer
+}
+
+func (m *flakyMailer) Send(ctx context.Context, msg Message) error {
+	if atomic.AddInt32(&m.calls, 1) <= m.failures {
+		return errors.New("connection refused")
+	}
+
+	return m.sent.Send(ctx, msg)
+}
+
+func TestQueue(t *testing.T) {
+	tests := []struct {
+		name          string
+		failures      int32
+		expectedCalls int32
+		expectedSent  int
+	}{
+		{"first attempt", 0, 1, 1},
+		{"after retries", 2, 3, 1},
+		{"gives up", 10, 4, 0},
+	}
+
+	for _, e := range tests {
+		var logs bytes.Buffer
+		m := &flakyMailer{failures: e.failures}
+		q := NewQueue(m, QueueOptions{Retries: 3, Backoff: time.Millisecond, Logger: log.New(&logs, "", 0)})
+
+		if err := q.Send(context.Background(), Message{To: "admin@example.com", Subject: "Hello"}); err != nil {
+			t.Errorf("%s: Send() returned an error: %s", e.name, err)
+		}
+
+		if err := q.Close(context.Background()); err != nil {
+			t.Errorf("%s: Close() returned an error: %s", e.name, err)
+		}
+
+		if m.calls != e.expectedCalls {
+			t.Errorf("%s: expected %d attempts, but got %d", e.name, e.expectedCalls, m.calls)
+		}
+
+		if len(m.sent.Messages()) != e.expectedSent {
+			t.Errorf("%s: expected %d messages sent, but got %d", e.name, e.expectedSent, len(m.sent.Messages()))
+		}
+
+		if e.expectedSent == 0 && !strings.Contains(logs.String(), "giving up") {
+			t.Errorf("%s: expected the failed delivery to be logged, but got %q", e.name, logs.String())
+		}
+
+		if err := q.Send(context.Background(), Message{To: "admin@example.com"}); !errors.Is(err, ErrQueueClosed) {
+			t.Errorf("%s: expected ErrQueueClosed after Close, got %v", e.name, err)
+		}
+	}
+}
+
+func TestQueue_full(t *testing.T) {
+	block := make(chan struct{})
+	q := NewQueue(blockingMailer(block), QueueOptions{Size: 1})
+	defer func() {
+		close(block)
+		_ = q.Close(context.Background())
+	}()
+
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = q.Send(context.Background(), Message{To: "admin@example.com"})
+	}
+
+	if !errors.Is(err, ErrQueueFull) {
+		t.Errorf("expected ErrQueueFull, got %v", err)
+	}
+}
+
+// blockingMailer waits until its channel is closed before accepting a message.
+type blockingMailer chan struct{}
+
+func (m blockingMailer) Send(ctx context.Context, msg Message) error {
+	<-m
+	return nil
+}
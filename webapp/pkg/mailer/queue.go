@@ -0,0 +1,140 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrQueueFull is returned by Queue.Send when the queue cannot take any more
+// messages.
+var ErrQueueFull = errors.New("mailer: queue is full")
+
+// ErrQueueClosed is returned by Queue.Send after Close.
+var ErrQueueClosed = errors.New("mailer: queue is closed")
+
+// Queue sends messages through another Mailer in the background, so a slow or
+// briefly unavailable mail server does not hold up requests. A delivery that fails
+// is retried with exponential backoff; one that still fails is logged and dropped.
+type Queue struct {
+	mailer  Mailer
+	retries int
+	backoff time.Duration
+	logger  *log.Logger
+
+	mu      sync.Mutex
+	closed  bool
+	pending chan Message
+	done    chan struct{}
+}
+
+// QueueOptions configures a Queue. Zero fields take the defaults shown.
+type QueueOptions struct {
+	Size    int           // messages that can wait to be sent; 100
+	Retries int           // further attempts after the first failure; 3, or negative for none
+	Backoff time.Duration // wait before the first retry, doubled for each one after; 1s
+	Logger  *log.Logger   // where failed deliveries are logged; the standard logger
+}
+
+// NewQueue starts a queue that delivers messages with m. Call Close to stop it.
+func NewQueue(m Mailer, opts QueueOptions) *Queue {
+	if opts.Size <= 0 {
+		opts.Size = 100
+	}
+	if opts.Retries < 0 {
+		opts.Retries = 0
+	} else if opts.Retries == 0 {
+		opts.Retries = 3
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = time.Second
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.Default()
+	}
+
+	q := &Queue{
+		mailer:  m,
+		retries: opts.Retries,
+		backoff: opts.Backoff,
+		logger:  opts.Logger,
+		pending: make(chan Message, opts.Size),
+		done:    make(chan struct{}),
+	}
+
+	go q.run()
+
+	return q
+}
+
+// Send queues msg for delivery. The headers are checked straight away, so a
+// message that could never be sent is rejected here rather than in the
+// background.
+func (q *Queue) Send(ctx context.Context, msg Message) error {
+	if _, err := format("", msg); err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	select {
+	case q.pending <- msg:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Close stops accepting messages and waits until the queued ones have been
+// delivered, or ctx is done.
+func (q *Queue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.pending)
+	}
+	q.mu.Unlock()
+
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run delivers queued messages one at a time until the queue is closed.
+func (q *Queue) run() {
+	defer close(q.done)
+
+	for msg := range q.pending {
+		q.deliver(msg)
+	}
+}
+
+// deliver sends msg, retrying failures.
+func (q *Queue) deliver(msg Message) {
+	wait := q.backoff
+
+	for attempt := 0; ; attempt++ {
+		err := q.mailer.Send(context.Background(), msg)
+		if err == nil {
+			return
+		}
+
+		if attempt == q.retries || errors.Is(err, ErrInvalidHeader) {
+			q.logger.Printf("mailer: giving up on %q to %s after %d attempts: %s", msg.Subject, msg.To, attempt+1, err)
+			return
+		}
+
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
@@ -0,0 +1,66 @@
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Templates renders messages from the templates in Dir. A message called name
+// needs a text template, name.txt.gohtml, which must also define a "subject"
+// template. An HTML version, name.html.gohtml, is optional; it is parsed together
+// with base.layout.gohtml, the shared layout, and is escaped with html/template.
+type Templates struct {
+	Dir string
+}
+
+// Message renders the named message for the recipient to, passing data to the
+// templates.
+func (t *Templates) Message(name, to string, data any) (Message, error) {
+	msg := Message{To: to}
+
+	text, err := texttemplate.ParseFiles(filepath.Join(t.Dir, name+".txt.gohtml"))
+	if err != nil {
+		return msg, err
+	}
+
+	if text.Lookup("subject") == nil {
+		return msg, fmt.Errorf("mailer: template %s does not define a subject", name)
+	}
+
+	var buf bytes.Buffer
+
+	if err := text.ExecuteTemplate(&buf, "subject", data); err != nil {
+		return msg, err
+	}
+	msg.Subject = strings.TrimSpace(buf.String())
+
+	buf.Reset()
+	if err := text.Execute(&buf, data); err != nil {
+		return msg, err
+	}
+	msg.Body = strings.TrimLeft(buf.String(), "\n")
+
+	htmlPath := filepath.Join(t.Dir, name+".html.gohtml")
+	if _, err := os.Stat(htmlPath); errors.Is(err, os.ErrNotExist) {
+		return msg, nil
+	}
+
+	html, err := htmltemplate.ParseFiles(htmlPath, filepath.Join(t.Dir, "base.layout.gohtml"))
+	if err != nil {
+		return msg, err
+	}
+
+	buf.Reset()
+	if err := html.Execute(&buf, data); err != nil {
+		return msg, err
+	}
+	msg.HTMLBody = buf.String()
+
+	return msg, nil
+}
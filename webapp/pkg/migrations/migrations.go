@@ -0,0 +1,470 @@
+// Package migrations holds the versioned database schema and applies it.
+//
+// Each migration is a pair of files named NNNN_description.up.sql and
+// NNNN_description.down.sql, embedded into the binary. The version a database is
+// at is recorded in the schema_migrations table.
+//
+// Databases created from the pg_dump schema that came before migrations already
+// have the tables of the first migration, but no version. Baseline records them
+// as being at BaselineVersion, after which Up applies the rest as usual; until
+// then Check, Up and Goto return ErrNeedsBaseline.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed postgres/*.sql sqlite/*.sql
+var migrationsFS embed.FS
+
+// Postgres returns the migrations for the Postgres schema.
+func Postgres() fs.FS {
+	sub, _ := fs.Sub(migrationsFS, "postgres")
+	return sub
+}
+
+// SQLite returns the migrations for the SQLite schema. They are kept at the same
+// version numbers as the Postgres ones.
+func SQLite() fs.FS {
+	sub, _ := fs.Sub(migrationsFS, "sqlite")
+	return sub
+}
+
+// For returns the migrations for the named database driver, "postgres" or "sqlite".
+func For(driver string) (fs.FS, error) {
+	switch driver {
+	case "postgres":
+		return Postgres(), nil
+	case "sqlite":
+		return SQLite(), nil
+	}
+
+	return nil, fmt.Errorf("migrations: unknown database driver %q", driver)
+}
+
+// ErrSchemaOutOfDate is returned by Check when the database is not at the latest version.
+var ErrSchemaOutOfDate = errors.New("migrations: schema is out of date")
+
+// ErrNeedsBaseline is returned when the database has the schema from before
+// migrations but no recorded version, so it must be baselined before migrating.
+var ErrNeedsBaseline = errors.New("migrations: database was created before migrations and needs a baseline")
+
+// BaselineVersion is the version the schema from before migrations is at. Some
+// of those databases also have the email index of version 2, which that
+// migration leaves alone.
+const BaselineVersion = 1
+
+// Migration is one versioned schema change.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status describes whether a migration has been applied to the database.
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Load reads the migrations in fsys and returns them sorted by version. Every
+// version needs both an up and a down file, and versions must be unique.
+func Load(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+
+	for _, file := range files {
+		name := path.Base(file)
+
+		base, direction, ok := cutDirection(name)
+		if !ok {
+			return nil, fmt.Errorf("migrations: %s must end in .up.sql or .down.sql", name)
+		}
+
+		prefix, description, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migrations: %s must start with a positive version number", name)
+		}
+
+		contents, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		m, exists := byVersion[version]
+		if !exists {
+			m = &Migration{Version: version, Name: description}
+			byVersion[version] = m
+		}
+
+		if m.Name != description {
+			return nil, fmt.Errorf("migrations: version %d is used by both %s and %s", version, m.Name, description)
+		}
+
+		if direction == "up" {
+			m.Up = string(contents)
+		} else {
+			m.Down = string(contents)
+		}
+	}
+
+	var migrations []Migration
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migrations: version %d (%s) needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+func cutDirection(name string) (base, direction string, ok bool) {
+	switch {
+	case strings.HasSuffix(name, ".up.sql"):
+		return strings.TrimSuffix(name, ".up.sql"), "up", true
+	case strings.HasSuffix(name, ".down.sql"):
+		return strings.TrimSuffix(name, ".down.sql"), "down", true
+	}
+
+	return "", "", false
+}
+
+// Migrator applies migrations to a database.
+type Migrator struct {
+	DB         *sql.DB
+	Migrations []Migration
+
+	// Driver is the database driver, "postgres" or "sqlite", which decides how
+	// the migrator looks for tables.
+	Driver string
+}
+
+// New returns a Migrator for db using the migrations for the named database
+// driver, "postgres" or "sqlite".
+func New(db *sql.DB, driver string) (*Migrator, error) {
+	fsys, err := For(driver)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations, err := Load(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{DB: db, Migrations: migrations, Driver: driver}, nil
+}
+
+// Latest returns the version of the newest migration, or 0 if there are none.
+func (m *Migrator) Latest() int {
+	if len(m.Migrations) == 0 {
+		return 0
+	}
+
+	return m.Migrations[len(m.Migrations)-1].Version
+}
+
+// Version returns the version the database is currently at; 0 means no migrations
+// have been applied.
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	exists, err := m.tableExists(ctx, "schema_migrations")
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	var version int
+	row := m.DB.QueryRowContext(ctx, `select coalesce(max(version), 0) from schema_migrations`)
+	if err := row.Scan(&version); err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// Status lists every known migration and whether it has been applied.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []Status
+	for _, migration := range m.Migrations {
+		appliedAt, ok := applied[migration.Version]
+		statuses = append(statuses, Status{Migration: migration, Applied: ok, AppliedAt: appliedAt})
+	}
+
+	return statuses, nil
+}
+
+// Up applies every pending migration.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.Goto(ctx, m.Latest())
+}
+
+// Down reverts the most recently applied migration.
+func (m *Migrator) Down(ctx context.Context) error {
+	current, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	if current == 0 {
+		return nil
+	}
+
+	target := 0
+	for _, migration := range m.Migrations {
+		if migration.Version < current {
+			target = migration.Version
+		}
+	}
+
+	return m.Goto(ctx, target)
+}
+
+// Goto migrates the database up or down until it is at version. Version 0 reverts
+// every migration.
+func (m *Migrator) Goto(ctx context.Context, version int) error {
+	if version != 0 && m.find(version) == nil {
+		return fmt.Errorf("migrations: unknown version %d", version)
+	}
+
+	if err := m.ensureTable(ctx); err != nil {
+		return err
+	}
+
+	current, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	if current == 0 && version > 0 {
+		if err := m.checkBaselined(ctx); err != nil {
+			return err
+		}
+	}
+
+	if version >= current {
+		for _, migration := range m.Migrations {
+			if migration.Version > current && migration.Version <= version {
+				if err := m.apply(ctx, migration, true); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	for i := len(m.Migrations) - 1; i >= 0; i-- {
+		migration := m.Migrations[i]
+		if migration.Version <= current && migration.Version > version {
+			if err := m.apply(ctx, migration, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Check returns ErrSchemaOutOfDate unless the database is at the latest version.
+// The applications call it on startup, so they never run against a schema they
+// don't understand. It only reads from the database.
+func (m *Migrator) Check(ctx context.Context) error {
+	current, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	if current == 0 {
+		if err := m.checkBaselined(ctx); err != nil {
+			return err
+		}
+	}
+
+	if current != m.Latest() {
+		return fmt.Errorf("%w: database is at version %d, expected %d", ErrSchemaOutOfDate, current, m.Latest())
+	}
+
+	return nil
+}
+
+// Baseline records every migration up to version as applied without running
+// them, for a database whose schema was created some other way. It refuses a
+// database that already has a version.
+func (m *Migrator) Baseline(ctx context.Context, version int) (err error) {
+	if m.find(version) == nil {
+		return fmt.Errorf("migrations: unknown version %d", version)
+	}
+
+	if err := m.ensureTable(ctx); err != nil {
+		return err
+	}
+
+	current, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	if current != 0 {
+		return fmt.Errorf("migrations: database is already at version %d", current)
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	for _, migration := range m.Migrations {
+		if migration.Version > version {
+			break
+		}
+
+		_, err = tx.ExecContext(ctx, `insert into schema_migrations (version, name, applied_at) values ($1, $2, $3)`,
+			migration.Version, migration.Name, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// checkBaselined returns ErrNeedsBaseline if the database has no version but
+// already has a users table, as databases created before migrations do.
+func (m *Migrator) checkBaselined(ctx context.Context) error {
+	exists, err := m.tableExists(ctx, "users")
+	if err != nil || !exists {
+		return err
+	}
+
+	return fmt.Errorf("%w; record it as being at version %d first", ErrNeedsBaseline, BaselineVersion)
+}
+
+// tableExists reports whether the database has the named table, in the current
+// schema for Postgres.
+func (m *Migrator) tableExists(ctx context.Context, name string) (bool, error) {
+	query := `select count(*) from information_schema.tables where table_schema = current_schema() and table_name = $1`
+	if m.Driver == "sqlite" {
+		query = `select count(*) from sqlite_master where type = 'table' and name = $1`
+	}
+
+	var count int
+	if err := m.DB.QueryRowContext(ctx, query, name).Scan(&count); err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// applied returns when each applied migration was applied, by version.
+func (m *Migrator) applied(ctx context.Context) (map[int]time.Time, error) {
+	applied := make(map[int]time.Time)
+
+	exists, err := m.tableExists(ctx, "schema_migrations")
+	if err != nil || !exists {
+		return applied, err
+	}
+
+	rows, err := m.DB.QueryContext(ctx, `select version, applied_at from schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+func (m *Migrator) find(version int) *Migration {
+	for i := range m.Migrations {
+		if m.Migrations[i].Version == version {
+			return &m.Migrations[i]
+		}
+	}
+
+	return nil
+}
+
+func (m *Migrator) ensureTable(ctx context.Context) error {
+	_, err := m.DB.ExecContext(ctx, `create table if not exists schema_migrations (
+		version integer primary key,
+		name varchar(255) not null,
+		applied_at timestamp not null
+	)`)
+
+	return err
+}
+
+// apply runs one migration in a transaction, together with the bookkeeping in
+// schema_migrations, so a failed migration leaves the version unchanged.
+func (m *Migrator) apply(ctx context.Context, migration Migration, up bool) (err error) {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if up {
+		if _, err = tx.ExecContext(ctx, migration.Up); err != nil {
+			return fmt.Errorf("migrations: applying %04d_%s: %w", migration.Version, migration.Name, err)
+		}
+
+		_, err = tx.ExecContext(ctx, `insert into schema_migrations (version, name, applied_at) values ($1, $2, $3)`,
+			migration.Version, migration.Name, time.Now().UTC())
+	} else {
+		if _, err = tx.ExecContext(ctx, migration.Down); err != nil {
+			return fmt.Errorf("migrations: reverting %04d_%s: %w", migration.Version, migration.Name, err)
+		}
+
+		_, err = tx.ExecContext(ctx, `delete from schema_migrations where version = $1`, migration.Version)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
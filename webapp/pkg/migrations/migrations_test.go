@@ -0,0 +1,248 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	_ "modernc.org/sqlite"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name             string
+		files            fstest.MapFS
+		expectedVersions []int
+		errorExpected    bool
+	}{
+		{
+			name: "valid",
+			files: fstest.MapFS{
+				"0002_second.up.sql":   {Data: []byte("create table b ();")},
+				"0002_second.down.sql": {Data: []byte("drop table b;")},
+				"0001_first.up.sql":    {Data: []byte("create table a ();")},
+				"0001_first.down.sql":  {Data: []byte("drop table a;")},
+			},
+			expectedVersions: []int{1, 2},
+		},
+		{
+			name: "missing down",
+			files: fstest.MapFS{
+				"0001_first.up.sql": {Data: []byte("create table a ();")},
+			},
+			errorExpected: true,
+		},
+		{
+			name: "no version",
+			files: fstest.MapFS{
+				"first.up.sql":   {Data: []byte("create table a ();")},
+				"first.down.sql": {Data: []byte("drop table a;")},
+			},
+			errorExpected: true,
+		},
+		{
+			name: "duplicate version",
+			files: fstest.MapFS{
+				"0001_first.up.sql":    {Data: []byte("create table a ();")},
+				"0001_first.down.sql":  {Data: []byte("drop table a;")},
+				"0001_second.up.sql":   {Data: []byte("create table b ();")},
+				"0001_second.down.sql": {Data: []byte("drop table b;")},
+			},
+			errorExpected: true,
+		},
+		{
+			name: "wrong suffix",
+			files: fstest.MapFS{
+				"0001_first.sql": {Data: []byte("create table a ();")},
+			},
+			errorExpected: true,
+		},
+	}
+
+	for _, e := range tests {
+		migrations, err := Load(e.files)
+		if err != nil && !e.errorExpected {
+			t.Errorf("%s: did not expect error but got one - %s", e.name, err)
+		}
+
+		if err == nil && e.errorExpected {
+			t.Errorf("%s: expected error, but did not get one", e.name)
+		}
+
+		if len(migrations) != len(e.expectedVersions) {
+			t.Errorf("%s: expected %d migrations, but got %d", e.name, len(e.expectedVersions), len(migrations))
+			continue
+		}
+
+		for i, version := range e.expectedVersions {
+			if migrations[i].Version != version {
+				t.Errorf("%s: expected migration %d to be version %d, but got %d", e.name, i, version, migrations[i].Version)
+			}
+		}
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	postgres, err := Load(Postgres())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, m := range postgres {
+		if m.Version != i+1 {
+			t.Errorf("postgres migrations should be numbered without gaps; expected %d, but got %d (%s)", i+1, m.Version, m.Name)
+		}
+	}
+
+	sqlite, err := Load(SQLite())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sqlite) != len(postgres) {
+		t.Fatalf("expected %d sqlite migrations to match postgres, but got %d", len(postgres), len(sqlite))
+	}
+
+	for i := range sqlite {
+		if sqlite[i].Version != postgres[i].Version || sqlite[i].Name != postgres[i].Name {
+			t.Errorf("sqlite migration %04d_%s does not match postgres migration %04d_%s",
+				sqlite[i].Version, sqlite[i].Name, postgres[i].Version, postgres[i].Name)
+		}
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "migrations.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	migrator, err := New(db, "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrator.Check(ctx); !errors.Is(err, ErrSchemaOutOfDate) {
+		t.Errorf("expected a new database to be out of date, but got %v", err)
+	}
+
+	// Check and Status only read, so the new database is left empty
+	if _, err := migrator.Status(ctx); err != nil {
+		t.Fatalf("Status() returned an error: %s", err)
+	}
+
+	if exists, err := migrator.tableExists(ctx, "schema_migrations"); err != nil || exists {
+		t.Errorf("expected Check() and Status() not to create schema_migrations, but got %t, %v", exists, err)
+	}
+
+	if err := migrator.Up(ctx); err != nil {
+		t.Fatalf("Up() returned an error: %s", err)
+	}
+
+	if err := migrator.Check(ctx); err != nil {
+		t.Errorf("expected database to be up to date after Up(), but got %s", err)
+	}
+
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range statuses {
+		if !s.Applied {
+			t.Errorf("expected %04d_%s to be applied", s.Version, s.Name)
+		}
+	}
+
+	if err := migrator.Down(ctx); err != nil {
+		t.Fatalf("Down() returned an error: %s", err)
+	}
+
+	if version, _ := migrator.Version(ctx); version != migrator.Latest()-1 {
+		t.Errorf("expected version %d after Down(), but got %d", migrator.Latest()-1, version)
+	}
+
+	if err := migrator.Goto(ctx, 0); err != nil {
+		t.Fatalf("Goto(0) returned an error: %s", err)
+	}
+
+	if _, err := db.Exec("select * from users"); err == nil {
+		t.Error("expected users table to be dropped after Goto(0)")
+	}
+
+	if err := migrator.Goto(ctx, 1); err != nil {
+		t.Fatalf("Goto(1) returned an error: %s", err)
+	}
+
+	if version, _ := migrator.Version(ctx); version != 1 {
+		t.Errorf("expected version 1 after Goto(1), but got %d", version)
+	}
+
+	if err := migrator.Goto(ctx, 999); err == nil {
+		t.Error("expected an error migrating to an unknown version")
+	}
+}
+
+func TestMigrator_Baseline(t *testing.T) {
+	ctx := context.Background()
+	migrator, err := New(nil, "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the schema from before migrations, with and without the email index
+	tests := []struct {
+		name   string
+		schema string
+	}{
+		{"original", migrator.Migrations[0].Up},
+		{"with email index", migrator.Migrations[0].Up + "CREATE UNIQUE INDEX users_email_lower_idx ON users (lower(email));"},
+	}
+
+	for _, e := range tests {
+		db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "legacy.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		if _, err := db.Exec(e.schema); err != nil {
+			t.Fatal(err)
+		}
+
+		migrator.DB = db
+
+		if err := migrator.Check(ctx); !errors.Is(err, ErrNeedsBaseline) {
+			t.Errorf("%s: expected Check() to ask for a baseline, but got %v", e.name, err)
+		}
+
+		if err := migrator.Up(ctx); !errors.Is(err, ErrNeedsBaseline) {
+			t.Errorf("%s: expected Up() to ask for a baseline, but got %v", e.name, err)
+		}
+
+		if err := migrator.Baseline(ctx, BaselineVersion); err != nil {
+			t.Fatalf("%s: Baseline() returned an error: %s", e.name, err)
+		}
+
+		if err := migrator.Baseline(ctx, BaselineVersion); err == nil {
+			t.Errorf("%s: expected a second Baseline() to be refused", e.name)
+		}
+
+		if err := migrator.Up(ctx); err != nil {
+			t.Fatalf("%s: Up() after Baseline() returned an error: %s", e.name, err)
+		}
+
+		if err := migrator.Check(ctx); err != nil {
+			t.Errorf("%s: expected database to be up to date, but got %s", e.name, err)
+		}
+	}
+
+	if err := migrator.Baseline(ctx, 999); err == nil {
+		t.Error("expected an error baselining at an unknown version")
+	}
+}
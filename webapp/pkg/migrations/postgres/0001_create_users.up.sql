@@ -0,0 +1,21 @@
+CREATE TABLE public.users (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY,
+    first_name character varying(255),
+    last_name character varying(255),
+    email character varying(255),
+    password character varying(60),
+    is_admin integer,
+    created_at timestamp without time zone,
+    updated_at timestamp without time zone,
+    CONSTRAINT users_pkey PRIMARY KEY (id)
+);
+
+CREATE TABLE public.user_images (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY,
+    user_id integer,
+    file_name character varying(255),
+    created_at timestamp without time zone,
+    updated_at timestamp without time zone,
+    CONSTRAINT user_images_pkey PRIMARY KEY (id),
+    CONSTRAINT user_images_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE
+);
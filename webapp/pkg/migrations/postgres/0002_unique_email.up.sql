@@ -0,0 +1,25 @@
+-- Refuse to run while two accounts share an email address (ignoring case), and list
+-- them so they can be merged or renamed by hand first.
+DO $$
+DECLARE
+    duplicates text;
+BEGIN
+    SELECT string_agg(format('%s (user ids %s)', email, ids), E'\n')
+    INTO duplicates
+    FROM (
+        SELECT lower(trim(email)) AS email, string_agg(id::text, ', ' ORDER BY id) AS ids
+        FROM public.users
+        GROUP BY lower(trim(email))
+        HAVING count(*) > 1
+    ) d;
+
+    IF duplicates IS NOT NULL THEN
+        RAISE EXCEPTION E'cannot add unique email index; these addresses are used by more than one user:\n%', duplicates;
+    END IF;
+END
+$$;
+
+UPDATE public.users SET email = lower(trim(email)) WHERE email <> lower(trim(email));
+
+-- databases created from the pg_dump schema before migrations may have it already
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_idx ON public.users USING btree (lower((email)::text));
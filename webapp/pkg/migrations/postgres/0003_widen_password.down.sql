@@ -0,0 +1,3 @@
+-- Fails while any user still has a hash longer than 60 characters; switch back to
+-- bcrypt and have those users reset their passwords first.
+ALTER TABLE public.users ALTER COLUMN password TYPE character varying(60);
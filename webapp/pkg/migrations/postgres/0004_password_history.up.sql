@@ -0,0 +1,10 @@
+CREATE TABLE public.password_history (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY,
+    user_id integer NOT NULL,
+    password character varying(255),
+    created_at timestamp without time zone,
+    CONSTRAINT password_history_pkey PRIMARY KEY (id),
+    CONSTRAINT password_history_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE INDEX password_history_user_id_idx ON public.password_history USING btree (user_id, id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS public.password_reset_tokens;
+ALTER TABLE public.users DROP COLUMN IF EXISTS sessions_revoked_at;
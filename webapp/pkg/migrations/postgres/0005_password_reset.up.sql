@@ -0,0 +1,15 @@
+-- Sessions and tokens issued to a user before this time are no longer accepted.
+ALTER TABLE public.users ADD COLUMN sessions_revoked_at timestamp without time zone;
+
+-- Only a SHA-256 hash of each reset token is stored, so a leaked table can't be
+-- used to reset anyone's password.
+CREATE TABLE public.password_reset_tokens (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY,
+    user_id integer NOT NULL,
+    token_hash character varying(64) NOT NULL,
+    expires_at timestamp without time zone NOT NULL,
+    created_at timestamp without time zone,
+    CONSTRAINT password_reset_tokens_pkey PRIMARY KEY (id),
+    CONSTRAINT password_reset_tokens_token_hash_key UNIQUE (token_hash),
+    CONSTRAINT password_reset_tokens_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE
+);
@@ -0,0 +1,16 @@
+-- Users who signed up themselves can't log in until they have confirmed their
+-- email address. Everyone created before self-registration counts as confirmed.
+ALTER TABLE public.users ADD COLUMN email_verified_at timestamp without time zone;
+UPDATE public.users SET email_verified_at = coalesce(created_at, now());
+
+-- Like reset tokens, only a SHA-256 hash of each verification token is stored.
+CREATE TABLE public.email_verification_tokens (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY,
+    user_id integer NOT NULL,
+    token_hash character varying(64) NOT NULL,
+    expires_at timestamp without time zone NOT NULL,
+    created_at timestamp without time zone,
+    CONSTRAINT email_verification_tokens_pkey PRIMARY KEY (id),
+    CONSTRAINT email_verification_tokens_token_hash_key UNIQUE (token_hash),
+    CONSTRAINT email_verification_tokens_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE
+);
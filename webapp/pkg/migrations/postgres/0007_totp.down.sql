@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS public.recovery_codes;
+ALTER TABLE public.users DROP COLUMN IF EXISTS totp_last_step;
+ALTER TABLE public.users DROP COLUMN IF EXISTS totp_enabled_at;
+ALTER TABLE public.users DROP COLUMN IF EXISTS totp_secret;
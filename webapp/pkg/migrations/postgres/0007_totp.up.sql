@@ -0,0 +1,19 @@
+-- Two-factor authentication with an authenticator app. totp_secret is set when
+-- enrollment starts, and totp_enabled_at once the user has proved they can
+-- generate codes. totp_last_step is the period of the last accepted code, so a
+-- code can't be replayed.
+ALTER TABLE public.users ADD COLUMN totp_secret character varying(64);
+ALTER TABLE public.users ADD COLUMN totp_enabled_at timestamp without time zone;
+ALTER TABLE public.users ADD COLUMN totp_last_step bigint NOT NULL DEFAULT 0;
+
+-- Single-use codes for when the authenticator is lost; only SHA-256 hashes are
+-- stored.
+CREATE TABLE public.recovery_codes (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY,
+    user_id integer NOT NULL,
+    code_hash character varying(64) NOT NULL,
+    created_at timestamp without time zone,
+    CONSTRAINT recovery_codes_pkey PRIMARY KEY (id),
+    CONSTRAINT recovery_codes_user_id_code_hash_key UNIQUE (user_id, code_hash),
+    CONSTRAINT recovery_codes_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE
+);
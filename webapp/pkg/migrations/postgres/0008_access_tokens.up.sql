@@ -0,0 +1,19 @@
+-- Personal access tokens let scripts and other services call the API as a user,
+-- instead of with a short-lived JWT. Only a SHA-256 hash of each token is stored.
+-- scopes is a space separated list; a null expires_at means the token never
+-- expires.
+CREATE TABLE public.access_tokens (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY,
+    user_id integer NOT NULL,
+    name character varying(255) NOT NULL,
+    token_hash character varying(64) NOT NULL,
+    scopes text NOT NULL DEFAULT '',
+    expires_at timestamp without time zone,
+    last_used_at timestamp without time zone,
+    created_at timestamp without time zone,
+    CONSTRAINT access_tokens_pkey PRIMARY KEY (id),
+    CONSTRAINT access_tokens_token_hash_key UNIQUE (token_hash),
+    CONSTRAINT access_tokens_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE INDEX access_tokens_user_id_idx ON public.access_tokens (user_id);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS public.oauth_consents;
+DROP TABLE IF EXISTS public.oauth_codes;
+DROP TABLE IF EXISTS public.oauth_clients;
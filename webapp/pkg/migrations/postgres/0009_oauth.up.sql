@@ -0,0 +1,48 @@
+-- Applications registered to use the OAuth2 endpoints. secret_hash is the SHA-256
+-- hash of a confidential client's secret, and null for public clients. The list
+-- columns are space separated.
+CREATE TABLE public.oauth_clients (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY,
+    client_id character varying(64) NOT NULL,
+    secret_hash character varying(64),
+    name character varying(255) NOT NULL,
+    redirect_uris text NOT NULL DEFAULT '',
+    grant_types text NOT NULL DEFAULT '',
+    scopes text NOT NULL DEFAULT '',
+    owner_id integer NOT NULL,
+    created_at timestamp without time zone,
+    CONSTRAINT oauth_clients_pkey PRIMARY KEY (id),
+    CONSTRAINT oauth_clients_client_id_key UNIQUE (client_id),
+    CONSTRAINT oauth_clients_owner_id_fkey FOREIGN KEY (owner_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+-- Authorization codes waiting to be exchanged for tokens; like other tokens, only
+-- their hashes are stored.
+CREATE TABLE public.oauth_codes (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY,
+    code_hash character varying(64) NOT NULL,
+    client_id character varying(64) NOT NULL,
+    user_id integer NOT NULL,
+    redirect_uri text NOT NULL,
+    scopes text NOT NULL DEFAULT '',
+    code_challenge character varying(128) NOT NULL,
+    expires_at timestamp without time zone NOT NULL,
+    created_at timestamp without time zone,
+    CONSTRAINT oauth_codes_pkey PRIMARY KEY (id),
+    CONSTRAINT oauth_codes_code_hash_key UNIQUE (code_hash),
+    CONSTRAINT oauth_codes_client_id_fkey FOREIGN KEY (client_id) REFERENCES public.oauth_clients(client_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    CONSTRAINT oauth_codes_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+-- The scopes each user has agreed to give each client, so they are only asked
+-- again when a client wants more.
+CREATE TABLE public.oauth_consents (
+    user_id integer NOT NULL,
+    client_id character varying(64) NOT NULL,
+    scopes text NOT NULL DEFAULT '',
+    created_at timestamp without time zone,
+    updated_at timestamp without time zone,
+    CONSTRAINT oauth_consents_pkey PRIMARY KEY (user_id, client_id),
+    CONSTRAINT oauth_consents_client_id_fkey FOREIGN KEY (client_id) REFERENCES public.oauth_clients(client_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    CONSTRAINT oauth_consents_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE
+);
@@ -0,0 +1 @@
+ALTER TABLE public.oauth_codes DROP COLUMN IF EXISTS nonce;
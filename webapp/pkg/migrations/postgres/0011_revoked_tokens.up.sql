@@ -0,0 +1,8 @@
+-- JWTs revoked before they expire, by their jti claim. Rows can be dropped once
+-- expires_at has passed, since the token is refused anyway by then.
+CREATE TABLE public.revoked_tokens (
+    token_id character varying(64) NOT NULL,
+    expires_at timestamp without time zone NOT NULL,
+    created_at timestamp without time zone,
+    CONSTRAINT revoked_tokens_pkey PRIMARY KEY (token_id)
+);
@@ -0,0 +1,18 @@
+-- The places each user is logged in: API logins, which are kept alive by refresh
+-- tokens carrying the session id, and web application sessions. Deleting a row
+-- logs that place out. device is a label derived from the user agent.
+CREATE TABLE public.sessions (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY,
+    user_id integer NOT NULL,
+    kind character varying(16) NOT NULL,
+    device character varying(255) NOT NULL DEFAULT '',
+    ip character varying(255) NOT NULL DEFAULT '',
+    user_agent character varying(512) NOT NULL DEFAULT '',
+    created_at timestamp without time zone,
+    last_seen_at timestamp without time zone,
+    expires_at timestamp without time zone NOT NULL,
+    CONSTRAINT sessions_pkey PRIMARY KEY (id),
+    CONSTRAINT sessions_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE INDEX sessions_user_id_idx ON public.sessions (user_id);
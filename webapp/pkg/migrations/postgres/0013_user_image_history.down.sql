@@ -0,0 +1,4 @@
+DELETE FROM public.user_images WHERE NOT is_current;
+DROP INDEX IF EXISTS public.user_images_user_id_idx;
+DROP INDEX IF EXISTS public.user_images_current_idx;
+ALTER TABLE public.user_images DROP COLUMN IF EXISTS is_current;
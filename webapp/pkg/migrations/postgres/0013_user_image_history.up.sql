@@ -0,0 +1,6 @@
+-- Profile pictures are kept when they are replaced, so users can go back to
+-- one. is_current marks the picture a user is showing; they have at most one.
+ALTER TABLE public.user_images ADD COLUMN is_current boolean NOT NULL DEFAULT true;
+
+CREATE UNIQUE INDEX user_images_current_idx ON public.user_images (user_id) WHERE is_current;
+CREATE INDEX user_images_user_id_idx ON public.user_images (user_id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS user_images;
+DROP TABLE IF EXISTS users;
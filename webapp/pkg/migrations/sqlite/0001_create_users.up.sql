@@ -0,0 +1,18 @@
+CREATE TABLE users (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    first_name varchar(255),
+    last_name varchar(255),
+    email varchar(255),
+    password varchar(60),
+    is_admin integer,
+    created_at timestamp,
+    updated_at timestamp
+);
+
+CREATE TABLE user_images (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    user_id integer REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    file_name varchar(255),
+    created_at timestamp,
+    updated_at timestamp
+);
@@ -0,0 +1,3 @@
+-- SQLite does not enforce varchar lengths, so argon2id hashes already fit. This
+-- migration only keeps the version in step with Postgres.
+SELECT 1;
@@ -0,0 +1,8 @@
+CREATE TABLE password_history (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    user_id integer NOT NULL REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    password varchar(255),
+    created_at timestamp
+);
+
+CREATE INDEX password_history_user_id_idx ON password_history (user_id, id);
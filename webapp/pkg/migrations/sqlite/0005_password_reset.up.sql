@@ -0,0 +1,12 @@
+-- Sessions and tokens issued to a user before this time are no longer accepted.
+ALTER TABLE users ADD COLUMN sessions_revoked_at timestamp;
+
+-- Only a SHA-256 hash of each reset token is stored, so a leaked table can't be
+-- used to reset anyone's password.
+CREATE TABLE password_reset_tokens (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    user_id integer NOT NULL REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    token_hash varchar(64) NOT NULL UNIQUE,
+    expires_at timestamp NOT NULL,
+    created_at timestamp
+);
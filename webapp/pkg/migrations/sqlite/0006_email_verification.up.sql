@@ -0,0 +1,13 @@
+-- Users who signed up themselves can't log in until they have confirmed their
+-- email address. Everyone created before self-registration counts as confirmed.
+ALTER TABLE users ADD COLUMN email_verified_at timestamp;
+UPDATE users SET email_verified_at = coalesce(created_at, CURRENT_TIMESTAMP);
+
+-- Like reset tokens, only a SHA-256 hash of each verification token is stored.
+CREATE TABLE email_verification_tokens (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    user_id integer NOT NULL REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    token_hash varchar(64) NOT NULL UNIQUE,
+    expires_at timestamp NOT NULL,
+    created_at timestamp
+);
@@ -0,0 +1,17 @@
+-- Two-factor authentication with an authenticator app. totp_secret is set when
+-- enrollment starts, and totp_enabled_at once the user has proved they can
+-- generate codes. totp_last_step is the period of the last accepted code, so a
+-- code can't be replayed.
+ALTER TABLE users ADD COLUMN totp_secret varchar(64);
+ALTER TABLE users ADD COLUMN totp_enabled_at timestamp;
+ALTER TABLE users ADD COLUMN totp_last_step integer NOT NULL DEFAULT 0;
+
+-- Single-use codes for when the authenticator is lost; only SHA-256 hashes are
+-- stored.
+CREATE TABLE recovery_codes (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    user_id integer NOT NULL REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    code_hash varchar(64) NOT NULL,
+    created_at timestamp,
+    UNIQUE (user_id, code_hash)
+);
@@ -0,0 +1,16 @@
+-- Personal access tokens let scripts and other services call the API as a user,
+-- instead of with a short-lived JWT. Only a SHA-256 hash of each token is stored.
+-- scopes is a space separated list; a null expires_at means the token never
+-- expires.
+CREATE TABLE access_tokens (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    user_id integer NOT NULL REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    name varchar(255) NOT NULL,
+    token_hash varchar(64) NOT NULL UNIQUE,
+    scopes text NOT NULL DEFAULT '',
+    expires_at timestamp,
+    last_used_at timestamp,
+    created_at timestamp
+);
+
+CREATE INDEX access_tokens_user_id_idx ON access_tokens (user_id);
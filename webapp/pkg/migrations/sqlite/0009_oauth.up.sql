@@ -0,0 +1,39 @@
+-- Applications registered to use the OAuth2 endpoints. secret_hash is the SHA-256
+-- hash of a confidential client's secret, and null for public clients. The list
+-- columns are space separated.
+CREATE TABLE oauth_clients (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    client_id varchar(64) NOT NULL UNIQUE,
+    secret_hash varchar(64),
+    name varchar(255) NOT NULL,
+    redirect_uris text NOT NULL DEFAULT '',
+    grant_types text NOT NULL DEFAULT '',
+    scopes text NOT NULL DEFAULT '',
+    owner_id integer NOT NULL REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    created_at timestamp
+);
+
+-- Authorization codes waiting to be exchanged for tokens; like other tokens, only
+-- their hashes are stored.
+CREATE TABLE oauth_codes (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    code_hash varchar(64) NOT NULL UNIQUE,
+    client_id varchar(64) NOT NULL REFERENCES oauth_clients(client_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    user_id integer NOT NULL REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    redirect_uri text NOT NULL,
+    scopes text NOT NULL DEFAULT '',
+    code_challenge varchar(128) NOT NULL,
+    expires_at timestamp NOT NULL,
+    created_at timestamp
+);
+
+-- The scopes each user has agreed to give each client, so they are only asked
+-- again when a client wants more.
+CREATE TABLE oauth_consents (
+    user_id integer NOT NULL REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    client_id varchar(64) NOT NULL REFERENCES oauth_clients(client_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    scopes text NOT NULL DEFAULT '',
+    created_at timestamp,
+    updated_at timestamp,
+    PRIMARY KEY (user_id, client_id)
+);
@@ -0,0 +1,3 @@
+-- The OpenID Connect nonce of the authorization request, echoed in the ID token
+-- issued for the code so the client can tie it to its own request.
+ALTER TABLE oauth_codes ADD COLUMN nonce varchar(255) NOT NULL DEFAULT '';
@@ -0,0 +1,7 @@
+-- JWTs revoked before they expire, by their jti claim. Rows can be dropped once
+-- expires_at has passed, since the token is refused anyway by then.
+CREATE TABLE revoked_tokens (
+    token_id varchar(64) PRIMARY KEY,
+    expires_at timestamp NOT NULL,
+    created_at timestamp
+);
@@ -0,0 +1,16 @@
+-- The places each user is logged in: API logins, which are kept alive by refresh
+-- tokens carrying the session id, and web application sessions. Deleting a row
+-- logs that place out. device is a label derived from the user agent.
+CREATE TABLE sessions (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    user_id integer NOT NULL REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    kind varchar(16) NOT NULL,
+    device varchar(255) NOT NULL DEFAULT '',
+    ip varchar(255) NOT NULL DEFAULT '',
+    user_agent varchar(512) NOT NULL DEFAULT '',
+    created_at timestamp,
+    last_seen_at timestamp,
+    expires_at timestamp NOT NULL
+);
+
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
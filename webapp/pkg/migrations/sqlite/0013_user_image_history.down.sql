@@ -0,0 +1,4 @@
+DELETE FROM user_images WHERE NOT is_current;
+DROP INDEX IF EXISTS user_images_user_id_idx;
+DROP INDEX IF EXISTS user_images_current_idx;
+ALTER TABLE user_images DROP COLUMN is_current;
@@ -0,0 +1,465 @@
+// Package oauth implements the parts of an OAuth2 authorization server (RFC 6749)
+// that don't depend on how tokens are minted: registered clients, validation of
+// authorization requests and redirect URIs, consent, and single-use authorization
+// codes bound to a PKCE challenge (RFC 7636). The API issues the tokens itself.
+package oauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+	"github.com/spacesedan/testing-course/webapp/pkg/securetoken"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The grant types clients can be registered for.
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantRefreshToken      = "refresh_token"
+	GrantClientCredentials = "client_credentials"
+)
+
+// maxNonceLength is the longest OpenID Connect nonce that can be stored with a
+// code.
+const maxNonceLength = 255
+
+// DefaultCodeTTL is how long an authorization code is valid when Service.CodeTTL
+// is zero.
+const DefaultCodeTTL = 5 * time.Minute
+
+// Error is an OAuth2 error response, as described in RFC 6749 sections 4.1.2.1
+// and 5.2.
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+func newError(code, format string, args ...any) *Error {
+	return &Error{Code: code, Description: fmt.Sprintf(format, args...)}
+}
+
+// AuthorizeRequest holds the parameters of an authorization request. Only the
+// authorization code flow with an S256 PKCE challenge is supported.
+type AuthorizeRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+
+	// Nonce is the OpenID Connect nonce, echoed in the ID token.
+	Nonce string `json:"nonce"`
+}
+
+// AuthorizeRequestFromQuery reads an authorization request from URL query
+// parameters.
+func AuthorizeRequestFromQuery(q url.Values) AuthorizeRequest {
+	return AuthorizeRequest{
+		ResponseType:        q.Get("response_type"),
+		ClientID:            q.Get("client_id"),
+		RedirectURI:         q.Get("redirect_uri"),
+		Scope:               q.Get("scope"),
+		State:               q.Get("state"),
+		CodeChallenge:       q.Get("code_challenge"),
+		CodeChallengeMethod: q.Get("code_challenge_method"),
+		Nonce:               q.Get("nonce"),
+	}
+}
+
+// Service registers clients and runs the authorization code flow.
+type Service struct {
+	DB repository.DataBaseRepo
+
+	// Scopes lists the scopes clients may be registered for.
+	Scopes []string
+
+	// CodeTTL is how long an authorization code is valid; zero means
+	// DefaultCodeTTL.
+	CodeTTL time.Duration
+}
+
+// RegisterClient registers c, giving it a new client id. For a confidential
+// client it also creates a secret, which is returned now and never again. Only
+// confidential clients may use the client_credentials grant. It returns an *Error
+// with the code invalid_client_metadata if c is not acceptable.
+func (s *Service) RegisterClient(ctx context.Context, c data.OAuthClient, confidential bool) (string, *data.OAuthClient, error) {
+	if err := s.validateClient(&c, confidential); err != nil {
+		return "", nil, err
+	}
+
+	id, _, err := securetoken.New()
+	if err != nil {
+		return "", nil, err
+	}
+	c.ClientID = id[:24]
+
+	var secret string
+	if confidential {
+		secret, c.SecretHash, err = securetoken.New()
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	c.ID, err = s.DB.InsertOAuthClient(ctx, c)
+	if err != nil {
+		return "", nil, err
+	}
+	c.CreatedAt = time.Now()
+
+	return secret, &c, nil
+}
+
+func (s *Service) validateClient(c *data.OAuthClient, confidential bool) error {
+	invalid := func(format string, args ...any) error {
+		return newError("invalid_client_metadata", format, args...)
+	}
+
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Name == "" {
+		return invalid("a name is required")
+	}
+
+	if len(c.GrantTypes) == 0 {
+		return invalid("at least one grant type is required")
+	}
+
+	for _, grant := range c.GrantTypes {
+		switch grant {
+		case GrantAuthorizationCode:
+		case GrantRefreshToken:
+			if !c.AllowsGrant(GrantAuthorizationCode) {
+				return invalid("the refresh_token grant needs the authorization_code grant")
+			}
+		case GrantClientCredentials:
+			if !confidential {
+				return invalid("only confidential clients may use the client_credentials grant")
+			}
+		default:
+			return invalid("unsupported grant type %q", grant)
+		}
+	}
+
+	if c.AllowsGrant(GrantAuthorizationCode) && len(c.RedirectURIs) == 0 {
+		return invalid("the authorization_code grant needs a redirect URI")
+	}
+
+	for _, uri := range c.RedirectURIs {
+		if err := validateRedirectURI(uri); err != nil {
+			return invalid("redirect URI %q %s", uri, err)
+		}
+	}
+
+	for _, scope := range c.Scopes {
+		if !contains(s.Scopes, scope) {
+			return invalid("unknown scope %q", scope)
+		}
+	}
+
+	return nil
+}
+
+// validateRedirectURI accepts absolute https URIs without a fragment, and http
+// ones on the loopback interface, for native apps and development.
+func validateRedirectURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return errors.New("is not an absolute URI")
+	}
+
+	if u.Fragment != "" || strings.Contains(uri, "#") {
+		return errors.New("must not have a fragment")
+	}
+
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		host := u.Hostname()
+		if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+			return nil
+		}
+		return errors.New("must use https unless it is on localhost")
+	default:
+		return errors.New("must use https")
+	}
+}
+
+// Clients returns every registered client.
+func (s *Service) Clients(ctx context.Context) ([]*data.OAuthClient, error) {
+	return s.DB.AllOAuthClients(ctx)
+}
+
+// DeleteClient deletes a client, with its codes and consents. Tokens already
+// issued to it stay valid until they expire, but can't be refreshed.
+func (s *Service) DeleteClient(ctx context.Context, clientID string) error {
+	return s.DB.DeleteOAuthClient(ctx, clientID)
+}
+
+// AuthenticateClient returns the client with the given id, checking its secret if
+// it is confidential. Public clients must not send a secret. It returns an *Error
+// with the code invalid_client if authentication fails.
+func (s *Service) AuthenticateClient(ctx context.Context, clientID, secret string) (*data.OAuthClient, error) {
+	client, err := s.DB.GetOAuthClient(ctx, clientID)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, newError("invalid_client", "unknown client")
+	} else if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case client.Confidential() && subtle.ConstantTimeCompare([]byte(securetoken.Hash(secret)), []byte(client.SecretHash)) != 1:
+		return nil, newError("invalid_client", "wrong client secret")
+	case !client.Confidential() && secret != "":
+		return nil, newError("invalid_client", "public clients have no secret")
+	}
+
+	return client, nil
+}
+
+// ValidateAuthorize checks an authorization request, and returns the client and
+// the scopes it asked for; a request without a scope asks for every scope the
+// client is registered for.
+//
+// The client is nil when the request names an unknown client or a redirect URI it
+// didn't register. The error must then be shown to the user, since redirecting
+// would send them somewhere untrusted. Any other error should be sent back to the
+// client with ErrorRedirect.
+func (s *Service) ValidateAuthorize(ctx context.Context, req AuthorizeRequest) (*data.OAuthClient, []string, error) {
+	client, err := s.DB.GetOAuthClient(ctx, req.ClientID)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, nil, newError("invalid_request", "unknown client")
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	if !client.AllowsRedirect(req.RedirectURI) {
+		return nil, nil, newError("invalid_request", "the redirect URI is not registered for this client")
+	}
+
+	if req.ResponseType != "code" {
+		return client, nil, newError("unsupported_response_type", "only the code response type is supported")
+	}
+
+	if !client.AllowsGrant(GrantAuthorizationCode) {
+		return client, nil, newError("unauthorized_client", "the client may not use the authorization code grant")
+	}
+
+	if req.CodeChallengeMethod != "S256" || !pkceValue.MatchString(req.CodeChallenge) {
+		return client, nil, newError("invalid_request", "a PKCE code_challenge with the S256 method is required")
+	}
+
+	if len(req.Nonce) > maxNonceLength {
+		return client, nil, newError("invalid_request", "the nonce is longer than %d characters", maxNonceLength)
+	}
+
+	scopes, err := requestedScopes(client.Scopes, req.Scope)
+	if err != nil {
+		return client, nil, err
+	}
+
+	return client, scopes, nil
+}
+
+// ConsentNeeded reports whether the user has yet to agree to give the client all
+// of scopes.
+func (s *Service) ConsentNeeded(ctx context.Context, userID int, clientID string, scopes []string) (bool, error) {
+	granted, err := s.DB.OAuthConsent(ctx, userID, clientID)
+	if errors.Is(err, repository.ErrNotFound) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	for _, scope := range scopes {
+		if !contains(granted, scope) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Approve records that the user agreed to the authorization request, and returns
+// the redirect URI that hands the client its authorization code. The request is
+// validated again, so it can come straight from the user.
+func (s *Service) Approve(ctx context.Context, userID int, req AuthorizeRequest) (string, error) {
+	client, scopes, err := s.ValidateAuthorize(ctx, req)
+	if err != nil {
+		return "", err
+	}
+
+	granted, err := s.DB.OAuthConsent(ctx, userID, client.ClientID)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		return "", err
+	}
+
+	for _, scope := range scopes {
+		if !contains(granted, scope) {
+			granted = append(granted, scope)
+		}
+	}
+
+	code, hash, err := securetoken.New()
+	if err != nil {
+		return "", err
+	}
+
+	ttl := s.CodeTTL
+	if ttl <= 0 {
+		ttl = DefaultCodeTTL
+	}
+
+	err = s.DB.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		if err := repo.SaveOAuthConsent(ctx, userID, client.ClientID, granted); err != nil {
+			return err
+		}
+
+		return repo.InsertOAuthCode(ctx, data.OAuthCode{
+			CodeHash:      hash,
+			ClientID:      client.ClientID,
+			UserID:        userID,
+			RedirectURI:   req.RedirectURI,
+			Scopes:        scopes,
+			CodeChallenge: req.CodeChallenge,
+			Nonce:         req.Nonce,
+			ExpiresAt:     time.Now().Add(ttl),
+		})
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return redirect(req.RedirectURI, url.Values{"code": {code}}, req.State), nil
+}
+
+// ErrorRedirect returns the redirect URI that tells the client its request
+// failed. Only use it once ValidateAuthorize has returned a client.
+func ErrorRedirect(req AuthorizeRequest, err *Error) string {
+	params := url.Values{"error": {err.Code}}
+	if err.Description != "" {
+		params.Set("error_description", err.Description)
+	}
+
+	return redirect(req.RedirectURI, params, req.State)
+}
+
+// Exchange redeems an authorization code for the client, checking the redirect
+// URI and PKCE verifier against the ones in the authorization request. It
+// returns the code, which says whom to issue tokens to and with which scopes, or
+// an *Error with the code invalid_grant.
+func (s *Service) Exchange(ctx context.Context, client *data.OAuthClient, code, redirectURI, verifier string) (*data.OAuthCode, error) {
+	if !client.AllowsGrant(GrantAuthorizationCode) {
+		return nil, newError("unauthorized_client", "the client may not use the authorization code grant")
+	}
+
+	// the code is used up even if the checks below fail, so a stolen code can't be
+	// tried again
+	c, err := s.DB.ConsumeOAuthCode(ctx, securetoken.Hash(code))
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, newError("invalid_grant", "the authorization code is invalid or has expired")
+	} else if err != nil {
+		return nil, err
+	}
+
+	if c.ClientID != client.ClientID || c.RedirectURI != redirectURI {
+		return nil, newError("invalid_grant", "the authorization code was issued for another client or redirect URI")
+	}
+
+	if !pkceValue.MatchString(verifier) || subtle.ConstantTimeCompare([]byte(challenge(verifier)), []byte(c.CodeChallenge)) != 1 {
+		return nil, newError("invalid_grant", "the code verifier does not match the code challenge")
+	}
+
+	return c, nil
+}
+
+// ClientCredentials checks a client_credentials grant and returns the scopes to
+// issue, which default to every scope the client is registered for.
+func (s *Service) ClientCredentials(client *data.OAuthClient, scope string) ([]string, error) {
+	if !client.AllowsGrant(GrantClientCredentials) {
+		return nil, newError("unauthorized_client", "the client may not use the client credentials grant")
+	}
+
+	return requestedScopes(client.Scopes, scope)
+}
+
+// RefreshScopes returns the scopes for tokens refreshed from ones that had
+// granted: the requested space separated scopes, which may only narrow them, or
+// all of granted if none are requested.
+func RefreshScopes(granted []string, requested string) ([]string, error) {
+	return requestedScopes(granted, requested)
+}
+
+// requestedScopes returns the scopes in the space separated scope parameter, all
+// of which must be in allowed; an empty parameter means all of allowed.
+func requestedScopes(allowed []string, scope string) ([]string, error) {
+	requested := strings.Fields(scope)
+	if len(requested) == 0 {
+		return append([]string(nil), allowed...), nil
+	}
+
+	var scopes []string
+	for _, s := range requested {
+		if !contains(allowed, s) {
+			return nil, newError("invalid_scope", "scope %q is not allowed", s)
+		}
+		if !contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+
+	return scopes, nil
+}
+
+// pkceValue matches PKCE code verifiers, and S256 challenges (RFC 7636 section 4).
+var pkceValue = regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`)
+
+// challenge returns the S256 code challenge for verifier.
+func challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// redirect adds params and state to the query of uri, which has been checked to be
+// a registered redirect URI.
+func redirect(uri string, params url.Values, state string) string {
+	u, _ := url.Parse(uri)
+
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	if state != "" {
+		query.Set("state", state)
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
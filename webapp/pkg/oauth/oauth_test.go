@@ -0,0 +1,303 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository/dbrepo/dbrepotest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const (
+	testRedirect = "https://app.example.com/callback"
+	testVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+	// testChallenge is the S256 challenge for testVerifier, from RFC 7636
+	// appendix B.
+	testChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+func newService(t *testing.T) *Service {
+	t.Helper()
+
+	repo := dbrepotest.NewSeeded(t)
+
+	return &Service{DB: repo, Scopes: []string{"users:read", "users:write"}}
+}
+
+// register registers a client owned by the admin user and fails the test on error.
+func register(t *testing.T, s *Service, confidential bool, grants ...string) (string, *data.OAuthClient) {
+	t.Helper()
+
+	secret, client, err := s.RegisterClient(context.Background(), data.OAuthClient{
+		Name:         "App",
+		RedirectURIs: []string{testRedirect},
+		GrantTypes:   grants,
+		Scopes:       []string{"users:read", "users:write"},
+		OwnerID:      1,
+	}, confidential)
+	if err != nil {
+		t.Fatalf("RegisterClient() returned an error: %s", err)
+	}
+
+	return secret, client
+}
+
+func authorizeRequest(clientID string) AuthorizeRequest {
+	return AuthorizeRequest{
+		ResponseType:        "code",
+		ClientID:            clientID,
+		RedirectURI:         testRedirect,
+		Scope:               "users:read",
+		State:               "xyz",
+		CodeChallenge:       testChallenge,
+		CodeChallengeMethod: "S256",
+	}
+}
+
+// errorCode returns the OAuth error code of err, or "" if it is not an *Error.
+func errorCode(err error) string {
+	var oauthErr *Error
+	if errors.As(err, &oauthErr) {
+		return oauthErr.Code
+	}
+	return ""
+}
+
+func TestChallenge(t *testing.T) {
+	if got := challenge(testVerifier); got != testChallenge {
+		t.Errorf("expected %s, but got %s", testChallenge, got)
+	}
+}
+
+func TestService_RegisterClient(t *testing.T) {
+	tests := []struct {
+		name         string
+		client       data.OAuthClient
+		confidential bool
+		valid        bool
+	}{
+		{"public spa", data.OAuthClient{Name: "SPA", RedirectURIs: []string{"http://localhost:8090/callback"}, GrantTypes: []string{GrantAuthorizationCode, GrantRefreshToken}}, false, true},
+		{"service", data.OAuthClient{Name: "Sync", GrantTypes: []string{GrantClientCredentials}, Scopes: []string{"users:read"}}, true, true},
+		{"missing name", data.OAuthClient{RedirectURIs: []string{testRedirect}, GrantTypes: []string{GrantAuthorizationCode}}, false, false},
+		{"no grants", data.OAuthClient{Name: "App", RedirectURIs: []string{testRedirect}}, false, false},
+		{"unknown grant", data.OAuthClient{Name: "App", GrantTypes: []string{"password"}}, true, false},
+		{"public client credentials", data.OAuthClient{Name: "App", GrantTypes: []string{GrantClientCredentials}}, false, false},
+		{"refresh alone", data.OAuthClient{Name: "App", GrantTypes: []string{GrantRefreshToken}}, true, false},
+		{"code without redirect", data.OAuthClient{Name: "App", GrantTypes: []string{GrantAuthorizationCode}}, false, false},
+		{"plain http redirect", data.OAuthClient{Name: "App", RedirectURIs: []string{"http://app.example.com/callback"}, GrantTypes: []string{GrantAuthorizationCode}}, false, false},
+		{"relative redirect", data.OAuthClient{Name: "App", RedirectURIs: []string{"/callback"}, GrantTypes: []string{GrantAuthorizationCode}}, false, false},
+		{"redirect with fragment", data.OAuthClient{Name: "App", RedirectURIs: []string{testRedirect + "#top"}, GrantTypes: []string{GrantAuthorizationCode}}, false, false},
+		{"custom scheme redirect", data.OAuthClient{Name: "App", RedirectURIs: []string{"javascript://alert(1)"}, GrantTypes: []string{GrantAuthorizationCode}}, false, false},
+		{"unknown scope", data.OAuthClient{Name: "App", RedirectURIs: []string{testRedirect}, GrantTypes: []string{GrantAuthorizationCode}, Scopes: []string{"admin"}}, false, false},
+	}
+
+	for _, e := range tests {
+		s := newService(t)
+		e.client.OwnerID = 1
+
+		secret, client, err := s.RegisterClient(context.Background(), e.client, e.confidential)
+		if !e.valid {
+			if errorCode(err) != "invalid_client_metadata" {
+				t.Errorf("%s: expected invalid_client_metadata, but got %v", e.name, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+			continue
+		}
+
+		if client.ClientID == "" || (secret != "") != e.confidential || client.Confidential() != e.confidential {
+			t.Errorf("%s: expected a client id, and a secret only for confidential clients", e.name)
+		}
+	}
+}
+
+func TestService_AuthenticateClient(t *testing.T) {
+	ctx := context.Background()
+	s := newService(t)
+
+	secret, confidential := register(t, s, true, GrantAuthorizationCode)
+	_, public := register(t, s, false, GrantAuthorizationCode)
+
+	tests := []struct {
+		name     string
+		clientID string
+		secret   string
+		valid    bool
+	}{
+		{"confidential", confidential.ClientID, secret, true},
+		{"wrong secret", confidential.ClientID, "wrong", false},
+		{"missing secret", confidential.ClientID, "", false},
+		{"public", public.ClientID, "", true},
+		{"public with secret", public.ClientID, "anything", false},
+		{"unknown", "nobody", "", false},
+	}
+
+	for _, e := range tests {
+		_, err := s.AuthenticateClient(ctx, e.clientID, e.secret)
+		if e.valid && err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+		} else if !e.valid && errorCode(err) != "invalid_client" {
+			t.Errorf("%s: expected invalid_client, but got %v", e.name, err)
+		}
+	}
+}
+
+func TestService_ValidateAuthorize(t *testing.T) {
+	s := newService(t)
+	_, client := register(t, s, false, GrantAuthorizationCode)
+	_, service := register(t, s, true, GrantClientCredentials)
+
+	tests := []struct {
+		name          string
+		change        func(r *AuthorizeRequest)
+		expectClient  bool
+		expectedError string
+	}{
+		{"valid", func(r *AuthorizeRequest) {}, true, ""},
+		{"unknown client", func(r *AuthorizeRequest) { r.ClientID = "nobody" }, false, "invalid_request"},
+		{"unregistered redirect", func(r *AuthorizeRequest) { r.RedirectURI = "https://evil.example.com/callback" }, false, "invalid_request"},
+		{"token response type", func(r *AuthorizeRequest) { r.ResponseType = "token" }, true, "unsupported_response_type"},
+		{"missing challenge", func(r *AuthorizeRequest) { r.CodeChallenge = "" }, true, "invalid_request"},
+		{"plain challenge", func(r *AuthorizeRequest) { r.CodeChallengeMethod = "plain" }, true, "invalid_request"},
+		{"unknown scope", func(r *AuthorizeRequest) { r.Scope = "users:read admin" }, true, "invalid_scope"},
+		{"long nonce", func(r *AuthorizeRequest) { r.Nonce = strings.Repeat("n", 256) }, true, "invalid_request"},
+		{"client without code grant", func(r *AuthorizeRequest) { r.ClientID = service.ClientID; r.RedirectURI = "" }, false, "invalid_request"},
+	}
+
+	for _, e := range tests {
+		req := authorizeRequest(client.ClientID)
+		e.change(&req)
+
+		got, scopes, err := s.ValidateAuthorize(context.Background(), req)
+		if (got != nil) != e.expectClient {
+			t.Errorf("%s: expected a client: %t, but got %v", e.name, e.expectClient, got)
+		}
+
+		if errorCode(err) != e.expectedError {
+			t.Errorf("%s: expected error %q, but got %v", e.name, e.expectedError, err)
+		}
+
+		if e.expectedError == "" && strings.Join(scopes, " ") != "users:read" {
+			t.Errorf("%s: expected the requested scopes, but got %v", e.name, scopes)
+		}
+	}
+}
+
+func TestService_authorizationCodeFlow(t *testing.T) {
+	ctx := context.Background()
+	s := newService(t)
+	_, client := register(t, s, false, GrantAuthorizationCode)
+	_, other := register(t, s, false, GrantAuthorizationCode)
+
+	req := authorizeRequest(client.ClientID)
+	req.Nonce = "n-0S6_WzA2Mj"
+
+	if needed, _ := s.ConsentNeeded(ctx, 1, client.ClientID, []string{"users:read"}); !needed {
+		t.Error("expected consent to be needed before the user has approved anything")
+	}
+
+	redirectTo, err := s.Approve(ctx, 1, req)
+	if err != nil {
+		t.Fatalf("Approve() returned an error: %s", err)
+	}
+
+	if needed, _ := s.ConsentNeeded(ctx, 1, client.ClientID, []string{"users:read"}); needed {
+		t.Error("expected the approved scopes not to need consent again")
+	}
+
+	if needed, _ := s.ConsentNeeded(ctx, 1, client.ClientID, []string{"users:read", "users:write"}); !needed {
+		t.Error("expected more scopes to need consent")
+	}
+
+	u, _ := url.Parse(redirectTo)
+	if !strings.HasPrefix(redirectTo, testRedirect+"?") || u.Query().Get("state") != "xyz" {
+		t.Fatalf("expected a redirect to the client with the state, but got %s", redirectTo)
+	}
+	code := u.Query().Get("code")
+
+	if _, err := s.Exchange(ctx, client, code, testRedirect, strings.Repeat("a", 43)); errorCode(err) != "invalid_grant" {
+		t.Errorf("expected a wrong verifier to give invalid_grant, but got %v", err)
+	}
+
+	// a failed exchange uses the code up
+	if _, err := s.Exchange(ctx, client, code, testRedirect, testVerifier); errorCode(err) != "invalid_grant" {
+		t.Errorf("expected a used code to give invalid_grant, but got %v", err)
+	}
+
+	exchangeTests := []struct {
+		name        string
+		client      *data.OAuthClient
+		redirectURI string
+		valid       bool
+	}{
+		{"other client", other, testRedirect, false},
+		{"other redirect", client, "https://app.example.com/other", false},
+		{"valid", client, testRedirect, true},
+	}
+
+	for _, e := range exchangeTests {
+		redirectTo, _ := s.Approve(ctx, 1, req)
+		u, _ := url.Parse(redirectTo)
+
+		c, err := s.Exchange(ctx, e.client, u.Query().Get("code"), e.redirectURI, testVerifier)
+		if !e.valid {
+			if errorCode(err) != "invalid_grant" {
+				t.Errorf("%s: expected invalid_grant, but got %v", e.name, err)
+			}
+			continue
+		}
+
+		if err != nil || c.UserID != 1 || c.Nonce != req.Nonce || strings.Join(c.Scopes, " ") != "users:read" {
+			t.Errorf("%s: expected the admin's code with their scopes and nonce, but got %+v (%v)", e.name, c, err)
+		}
+	}
+}
+
+func TestErrorRedirect(t *testing.T) {
+	req := authorizeRequest("app")
+
+	got := ErrorRedirect(req, &Error{Code: "access_denied"})
+	if got != testRedirect+"?error=access_denied&state=xyz" {
+		t.Errorf("unexpected redirect %s", got)
+	}
+}
+
+func TestService_ClientCredentials(t *testing.T) {
+	s := newService(t)
+	_, service := register(t, s, true, GrantClientCredentials)
+	_, app := register(t, s, true, GrantAuthorizationCode)
+
+	if scopes, err := s.ClientCredentials(service, ""); err != nil || len(scopes) != 2 {
+		t.Errorf("expected every registered scope by default, but got %v (%v)", scopes, err)
+	}
+
+	if _, err := s.ClientCredentials(service, "admin"); errorCode(err) != "invalid_scope" {
+		t.Errorf("expected an unknown scope to give invalid_scope, but got %v", err)
+	}
+
+	if _, err := s.ClientCredentials(app, ""); errorCode(err) != "unauthorized_client" {
+		t.Errorf("expected a client without the grant to give unauthorized_client, but got %v", err)
+	}
+}
+
+func TestRefreshScopes(t *testing.T) {
+	granted := []string{"users:read", "users:write"}
+
+	if scopes, _ := RefreshScopes(granted, ""); len(scopes) != 2 {
+		t.Errorf("expected all granted scopes, but got %v", scopes)
+	}
+
+	if scopes, _ := RefreshScopes(granted, "users:read"); strings.Join(scopes, " ") != "users:read" {
+		t.Errorf("expected the narrowed scopes, but got %v", scopes)
+	}
+
+	if _, err := RefreshScopes([]string{"users:read"}, "users:write"); errorCode(err) != "invalid_scope" {
+		t.Errorf("expected widening to give invalid_scope, but got %v", err)
+	}
+}
@@ -0,0 +1,240 @@
+// Package oidc adds the OpenID Connect identity layer (OpenID Connect Core 1.0)
+// to the OAuth2 endpoints: ID tokens with the standard claims of a user, the
+// claims returned by the userinfo endpoint, and the keys clients check ID tokens
+// with. ID tokens are signed with RS256, so clients can check them without
+// sharing a secret with us.
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// The scopes OpenID Connect defines for the claims we have.
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+// Scopes lists every OpenID Connect scope, in the order they are documented.
+var Scopes = []string{ScopeOpenID, ScopeProfile, ScopeEmail}
+
+// Claims lists every claim about a user that UserClaims can return.
+var Claims = []string{"sub", "name", "given_name", "family_name", "updated_at", "email", "email_verified"}
+
+// DefaultIDTokenTTL is how long an ID token is valid when Provider.TTL is zero.
+const DefaultIDTokenTTL = time.Hour
+
+// Provider issues ID tokens.
+type Provider struct {
+	// Issuer is the URL clients know us by; it is the iss claim of ID tokens, and
+	// the discovery document is served below it.
+	Issuer string
+
+	// TTL is how long an ID token is valid; zero means DefaultIDTokenTTL.
+	TTL time.Duration
+
+	key   *rsa.PrivateKey
+	keyID string
+}
+
+// NewProvider returns a provider that signs ID tokens with key.
+func NewProvider(issuer string, key *rsa.PrivateKey) *Provider {
+	return &Provider{
+		Issuer: strings.TrimSuffix(issuer, "/"),
+		key:    key,
+		keyID:  thumbprint(&key.PublicKey),
+	}
+}
+
+// GenerateKey returns a new 2048 bit RSA key for signing ID tokens.
+func GenerateKey() (*rsa.PrivateKey, error) {
+	return rsa.GenerateKey(rand.Reader, 2048)
+}
+
+// LoadKey reads an RSA private key from a PEM file, in PKCS #1 or PKCS #8 form.
+func LoadKey(path string) (*rsa.PrivateKey, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA key", path)
+	}
+
+	return key, nil
+}
+
+// UserClaims returns the claims about user that scopes allow: always the
+// subject, the names with the profile scope, and the email address with the
+// email scope.
+func UserClaims(user *data.User, scopes []string) map[string]any {
+	claims := map[string]any{
+		"sub": fmt.Sprint(user.ID),
+	}
+
+	if contains(scopes, ScopeProfile) {
+		claims["name"] = strings.TrimSpace(user.FirstName + " " + user.LastName)
+		claims["given_name"] = user.FirstName
+		claims["family_name"] = user.LastName
+		if !user.UpdatedAt.IsZero() {
+			claims["updated_at"] = user.UpdatedAt.Unix()
+		}
+	}
+
+	if contains(scopes, ScopeEmail) {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.EmailVerified()
+	}
+
+	return claims
+}
+
+// IDToken returns a signed ID token telling clientID who user is, with the claims
+// scopes allow. nonce is the one from the authorization request, if any. If
+// accessToken is given, its hash is included so the client can check that the
+// two were issued together.
+func (p *Provider) IDToken(user *data.User, clientID string, scopes []string, nonce, accessToken string) (string, error) {
+	if p.key == nil {
+		return "", errors.New("oidc: provider has no signing key")
+	}
+
+	ttl := p.TTL
+	if ttl <= 0 {
+		ttl = DefaultIDTokenTTL
+	}
+
+	token := jwt.New(jwt.SigningMethodRS256)
+	token.Header["kid"] = p.keyID
+
+	claims := token.Claims.(jwt.MapClaims)
+	for name, value := range UserClaims(user, scopes) {
+		claims[name] = value
+	}
+	claims["iss"] = p.Issuer
+	claims["aud"] = clientID
+	claims["iat"] = time.Now().Unix()
+	claims["exp"] = time.Now().Add(ttl).Unix()
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	if accessToken != "" {
+		claims["at_hash"] = tokenHash(accessToken)
+	}
+
+	return token.SignedString(p.key)
+}
+
+// JWK is a public key, as a JSON Web Key (RFC 7517).
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Modulus   string `json:"n"`
+	Exponent  string `json:"e"`
+}
+
+// JWKS is a JSON Web Key Set, as served at the discovery document's jwks_uri.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// KeySet returns the public keys clients check ID tokens with.
+func (p *Provider) KeySet() JWKS {
+	if p.key == nil {
+		return JWKS{Keys: []JWK{}}
+	}
+
+	return JWKS{Keys: []JWK{{
+		KeyType:   "RSA",
+		Use:       "sig",
+		Algorithm: "RS256",
+		KeyID:     p.keyID,
+		Modulus:   encodeInt(p.key.N),
+		Exponent:  encodeInt(big.NewInt(int64(p.key.E))),
+	}}}
+}
+
+// Configuration is the discovery document served at
+// /.well-known/openid-configuration (OpenID Connect Discovery 1.0).
+type Configuration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint,omitempty"`
+	RevocationEndpoint                string   `json:"revocation_endpoint,omitempty"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// thumbprint returns the RFC 7638 thumbprint of key, used as its key id.
+func thumbprint(key *rsa.PublicKey) string {
+	// the members must be in lexicographic order, without whitespace
+	canonical, _ := json.Marshal(struct {
+		E   string `json:"e"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+	}{encodeInt(big.NewInt(int64(key.E))), "RSA", encodeInt(key.N)})
+
+	sum := sha256.Sum256(canonical)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// tokenHash returns the at_hash of an access token for an RS256 ID token: the
+// left half of its SHA-256 hash.
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
+
+func encodeInt(n *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(n.Bytes())
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package oidc
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testKey is shared by the tests, since generating RSA keys is slow.
+var testKey, _ = GenerateKey()
+
+var testUser = data.User{
+	ID:              7,
+	FirstName:       "Jane",
+	LastName:        "Doe",
+	Email:           "jane@example.com",
+	UpdatedAt:       time.Date(2022, 8, 19, 0, 0, 0, 0, time.UTC),
+	EmailVerifiedAt: time.Date(2022, 8, 19, 0, 0, 0, 0, time.UTC),
+}
+
+func TestUserClaims(t *testing.T) {
+	tests := []struct {
+		name     string
+		scopes   []string
+		expected []string
+		missing  []string
+	}{
+		{"openid", []string{ScopeOpenID}, []string{"sub"}, []string{"name", "email"}},
+		{"profile", []string{ScopeOpenID, ScopeProfile}, []string{"sub", "name", "given_name", "family_name", "updated_at"}, []string{"email"}},
+		{"email", []string{ScopeOpenID, ScopeEmail}, []string{"sub", "email", "email_verified"}, []string{"name"}},
+	}
+
+	for _, e := range tests {
+		claims := UserClaims(&testUser, e.scopes)
+
+		for _, name := range e.expected {
+			if _, ok := claims[name]; !ok {
+				t.Errorf("%s: expected the %s claim", e.name, name)
+			}
+		}
+
+		for _, name := range e.missing {
+			if _, ok := claims[name]; ok {
+				t.Errorf("%s: did not expect the %s claim", e.name, name)
+			}
+		}
+	}
+
+	claims := UserClaims(&testUser, Scopes)
+	if claims["sub"] != "7" || claims["name"] != "Jane Doe" || claims["email_verified"] != true {
+		t.Errorf("unexpected claims %v", claims)
+	}
+}
+
+func TestProvider_IDToken(t *testing.T) {
+	p := NewProvider("http://localhost:8090/", testKey)
+
+	signed, err := p.IDToken(&testUser, "spa", []string{ScopeOpenID, ScopeEmail}, "n-0S6_WzA2Mj", "access-token")
+	if err != nil {
+		t.Fatalf("IDToken() returned an error: %s", err)
+	}
+
+	// check the token the way a client would, with the published key
+	keys := p.KeySet().Keys
+	if len(keys) != 1 {
+		t.Fatalf("expected one published key, but got %d", len(keys))
+	}
+
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(signed, claims, func(token *jwt.Token) (any, error) {
+		if token.Header["kid"] != keys[0].KeyID {
+			t.Errorf("expected the key id %s, but got %v", keys[0].KeyID, token.Header["kid"])
+		}
+		return publicKey(t, keys[0]), nil
+	})
+	if err != nil || !token.Valid {
+		t.Fatalf("the ID token does not verify with the published key: %v", err)
+	}
+
+	expected := map[string]any{
+		"iss":            "http://localhost:8090",
+		"aud":            "spa",
+		"sub":            "7",
+		"nonce":          "n-0S6_WzA2Mj",
+		"at_hash":        tokenHash("access-token"),
+		"email":          "jane@example.com",
+		"email_verified": true,
+	}
+
+	for name, value := range expected {
+		if claims[name] != value {
+			t.Errorf("expected %s to be %v, but got %v", name, value, claims[name])
+		}
+	}
+
+	if _, ok := claims["name"]; ok {
+		t.Error("expected no profile claims without the profile scope")
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	dir := t.TempDir()
+
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(testKey)
+	files := []struct {
+		name  string
+		block *pem.Block
+		valid bool
+	}{
+		{"pkcs1.pem", &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(testKey)}, true},
+		{"pkcs8.pem", &pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}, true},
+		{"garbage.pem", &pem.Block{Type: "PRIVATE KEY", Bytes: []byte("garbage")}, false},
+	}
+
+	for _, e := range files {
+		path := filepath.Join(dir, e.name)
+		_ = os.WriteFile(path, pem.EncodeToMemory(e.block), 0600)
+
+		key, err := LoadKey(path)
+		if e.valid && (err != nil || !key.Equal(testKey)) {
+			t.Errorf("%s: expected the key to load, but got %v", e.name, err)
+		} else if !e.valid && err == nil {
+			t.Errorf("%s: expected an error", e.name)
+		}
+	}
+
+	if _, err := LoadKey(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+// publicKey decodes a published key.
+func publicKey(t *testing.T, key JWK) *rsa.PublicKey {
+	t.Helper()
+
+	n, err := base64.RawURLEncoding.DecodeString(key.Modulus)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := base64.RawURLEncoding.DecodeString(key.Exponent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+}
@@ -0,0 +1,163 @@
+// Package passwordpolicy decides whether a password is acceptable: long enough,
+// varied enough, not in a list of breached passwords and not one the user has had
+// recently. Both applications check new passwords with it before handing them to
+// the repository.
+package passwordpolicy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// ErrRejected is matched (with errors.Is) by every *Error returned by a Policy.
+var ErrRejected = errors.New("password rejected by policy")
+
+// Error lists every rule a password broke, so the user can fix them all at once.
+type Error struct {
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	return "password rejected: " + strings.Join(e.Problems, "; ")
+}
+
+// Is reports whether target is ErrRejected.
+func (e *Error) Is(target error) bool {
+	return target == ErrRejected
+}
+
+// Policy is a set of password rules. The zero value accepts any non-empty password.
+type Policy struct {
+	// MinLength is the minimum number of characters (not bytes).
+	MinLength int
+
+	// MinClasses is how many of the character classes lowercase, uppercase,
+	// digits and symbols a password must contain.
+	MinClasses int
+
+	// History is how many of the user's most recent passwords, including the
+	// current one, may not be reused.
+	History int
+
+	// Breached is a set of known breached passwords, in lower case. Load one
+	// with LoadBreachList.
+	Breached map[string]struct{}
+}
+
+// Default returns the policy used when nothing else is configured: at least 10
+// characters from at least 2 classes, and none of the last 5 passwords.
+func Default() *Policy {
+	return &Policy{
+		MinLength:  10,
+		MinClasses: 2,
+		History:    5,
+	}
+}
+
+// LoadBreachList reads a breached password list: one password per line, with
+// blank lines and lines starting with # ignored. Passwords are matched
+// case-insensitively.
+func LoadBreachList(path string) (map[string]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	breached := make(map[string]struct{})
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		breached[strings.ToLower(line)] = struct{}{}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading breach list %s: %w", path, err)
+	}
+
+	return breached, nil
+}
+
+// Validate checks password against the rules that do not depend on the user:
+// length, character classes and the breach list. Use it for new users.
+func (p *Policy) Validate(password string) error {
+	var problems []string
+
+	if password == "" {
+		problems = append(problems, "must not be empty")
+	} else if len([]rune(password)) < p.MinLength {
+		problems = append(problems, fmt.Sprintf("must be at least %d characters long", p.MinLength))
+	}
+
+	if classes := countClasses(password); classes < p.MinClasses {
+		problems = append(problems, fmt.Sprintf("must contain at least %d of: lowercase letters, uppercase letters, digits, symbols", p.MinClasses))
+	}
+
+	if _, ok := p.Breached[strings.ToLower(password)]; ok {
+		problems = append(problems, "appears in a list of breached passwords")
+	}
+
+	if len(problems) > 0 {
+		return &Error{Problems: problems}
+	}
+
+	return nil
+}
+
+// Check runs Validate and also rejects any of the user's last p.History
+// passwords. Use it whenever an existing user changes their password.
+func (p *Policy) Check(ctx context.Context, repo repository.DataBaseRepo, userID int, password string) error {
+	err := p.Validate(password)
+	if err != nil || p.History < 1 {
+		return err
+	}
+
+	user, err := repo.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	hashes, err := repo.PasswordHistory(ctx, userID, p.History-1)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range append([]string{user.Password}, hashes...) {
+		if matches, _ := data.VerifyPassword(hash, password); matches {
+			return &Error{Problems: []string{fmt.Sprintf("must not be one of your last %d passwords", p.History)}}
+		}
+	}
+
+	return nil
+}
+
+// countClasses returns how many character classes password draws from.
+func countClasses(password string) int {
+	var lower, upper, digit, symbol int
+
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+
+	return lower + upper + digit + symbol
+}
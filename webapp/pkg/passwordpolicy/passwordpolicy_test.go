@@ -0,0 +1,100 @@
+package passwordpolicy
+
+import (
+	"context"
+	"errors"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository/dbrepo"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPolicy_Validate(t *testing.T) {
+	policy := &Policy{
+		MinLength:  8,
+		MinClasses: 3,
+		Breached:   map[string]struct{}{"password1!": {}},
+	}
+
+	tests := []struct {
+		name          string
+		password      string
+		expectedValid bool
+	}{
+		{"valid", "Tr0ub4dor", true},
+		{"valid unicode", "Pässwörd1", true},
+		{"empty", "", false},
+		{"too short", "Ab1!", false},
+		{"too few classes", "alllowercase1", false},
+		{"breached ignoring case", "PASSWORD1!", false},
+	}
+
+	for _, e := range tests {
+		err := policy.Validate(e.password)
+		if e.expectedValid && err != nil {
+			t.Errorf("%s: expected password to be valid, but got %s", e.name, err)
+		}
+
+		if !e.expectedValid && !errors.Is(err, ErrRejected) {
+			t.Errorf("%s: expected ErrRejected, but got %v", e.name, err)
+		}
+	}
+
+	var policyErr *Error
+	if err := policy.Validate("abc"); !errors.As(err, &policyErr) || len(policyErr.Problems) != 2 {
+		t.Errorf("expected both the length and class problems to be reported, got %v", err)
+	}
+
+	if err := (&Policy{}).Validate("x"); err != nil {
+		t.Errorf("the zero policy should accept any non-empty password, got %s", err)
+	}
+}
+
+func TestPolicy_Check(t *testing.T) {
+	ctx := context.Background()
+	repo := dbrepo.NewMemoryDBRepo()
+	repo.Hasher = data.BcryptHasher{Cost: 4}
+	policy := &Policy{History: 3}
+
+	id, _ := repo.InsertUser(ctx, data.User{Email: "admin@example.com", Password: "first"})
+	_ = repo.ResetPassword(ctx, id, "second")
+	_ = repo.ResetPassword(ctx, id, "third")
+	_ = repo.ResetPassword(ctx, id, "fourth")
+
+	for _, password := range []string{"second", "third", "fourth"} {
+		if err := policy.Check(ctx, repo, id, password); !errors.Is(err, ErrRejected) {
+			t.Errorf("reusing %q should be rejected, got %v", password, err)
+		}
+	}
+
+	if err := policy.Check(ctx, repo, id, "first"); err != nil {
+		t.Errorf("a password older than the history should be allowed, got %s", err)
+	}
+
+	if err := policy.Check(ctx, repo, 100, "fifth"); err == nil {
+		t.Error("expected an error for a missing user")
+	}
+}
+
+func TestLoadBreachList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	_ = os.WriteFile(path, []byte("# common passwords\n123456\n\n  Password \nqwerty\n"), 0644)
+
+	breached, err := LoadBreachList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(breached) != 3 {
+		t.Errorf("expected 3 passwords, but got %d", len(breached))
+	}
+
+	if _, ok := breached["password"]; !ok {
+		t.Error("expected passwords to be trimmed and lower cased")
+	}
+
+	if _, err := LoadBreachList(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
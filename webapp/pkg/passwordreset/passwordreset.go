@@ -0,0 +1,109 @@
+// Package passwordreset implements the forgot-password flow shared by the web and
+// API applications: a user asks for a reset link by email, and the random,
+// single-use token in that link lets them choose a new password within a limited
+// time. Only a SHA-256 hash of each token is stored.
+package passwordreset
+
+import (
+	"context"
+	"errors"
+	"github.com/spacesedan/testing-course/webapp/pkg/mailer"
+	"github.com/spacesedan/testing-course/webapp/pkg/passwordpolicy"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+	"github.com/spacesedan/testing-course/webapp/pkg/securetoken"
+	"time"
+)
+
+// DefaultTTL is how long a reset token is valid when Service.TTL is zero.
+const DefaultTTL = time.Hour
+
+// ErrInvalidToken is returned by Reset for tokens that are unknown, expired or
+// already used.
+var ErrInvalidToken = errors.New("password reset link is invalid or has expired")
+
+// Service issues and redeems password reset tokens.
+type Service struct {
+	DB        repository.DataBaseRepo
+	Mailer    mailer.Mailer
+	Templates *mailer.Templates
+	Policy    *passwordpolicy.Policy
+
+	// ResetURL is the page that accepts the token, e.g.
+	// http://localhost:8080/reset-password; the token is added as the "token"
+	// query parameter.
+	ResetURL string
+
+	// TTL is how long a token is valid; zero means DefaultTTL.
+	TTL time.Duration
+}
+
+// Request emails a reset link to the user with the given address. To avoid
+// revealing which addresses have accounts, it returns nil when there is no such
+// user.
+func (s *Service) Request(ctx context.Context, email string) error {
+	user, err := s.DB.GetUserByEmail(ctx, email)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	token, hash, err := securetoken.New()
+	if err != nil {
+		return err
+	}
+
+	ttl := s.TTL
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+
+	err = s.DB.InsertPasswordResetToken(ctx, user.ID, hash, time.Now().Add(ttl))
+	if err != nil {
+		return err
+	}
+
+	link, err := securetoken.Link(s.ResetURL, token)
+	if err != nil {
+		return err
+	}
+
+	msg, err := s.Templates.Message("password-reset", user.Email, map[string]any{
+		"User": user,
+		"Link": link,
+		"TTL":  ttl,
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.Mailer.Send(ctx, msg)
+}
+
+// Reset sets a new password for the user the token was issued to, and revokes all
+// of their existing sessions. The token is only used up when the new password is
+// accepted, so a password rejected by the policy can be corrected and resubmitted.
+// It returns ErrInvalidToken for a bad token and a *passwordpolicy.Error for a
+// rejected password.
+func (s *Service) Reset(ctx context.Context, token, password string) error {
+	return s.DB.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		userID, err := repo.ConsumePasswordResetToken(ctx, securetoken.Hash(token))
+		if errors.Is(err, repository.ErrNotFound) {
+			return ErrInvalidToken
+		} else if err != nil {
+			return err
+		}
+
+		err = s.Policy.Check(ctx, repo, userID, password)
+		if err != nil {
+			return err
+		}
+
+		err = repo.ResetPassword(ctx, userID, password)
+		if err != nil {
+			return err
+		}
+
+		return repo.RevokeSessions(ctx, userID)
+	})
+}
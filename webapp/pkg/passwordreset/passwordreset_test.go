@@ -0,0 +1,120 @@
+package passwordreset
+
+import (
+	"context"
+	"errors"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/mailer"
+	"github.com/spacesedan/testing-course/webapp/pkg/passwordpolicy"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository/dbrepo"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var linkRegexp = regexp.MustCompile(`https?://\S+`)
+
+// tokenFrom returns the reset token from the link in msg.
+func tokenFrom(t *testing.T, msg mailer.Message) string {
+	t.Helper()
+
+	link, err := url.Parse(linkRegexp.FindString(msg.Body))
+	if err != nil {
+		t.Fatalf("reset email has no valid link: %s", msg.Body)
+	}
+
+	return link.Query().Get("token")
+}
+
+func newService(t *testing.T) (*Service, *dbrepo.MemoryDBRepo, *mailer.MemoryMailer) {
+	t.Helper()
+
+	repo := dbrepo.NewMemoryDBRepo()
+	repo.Hasher = data.BcryptHasher{Cost: 4}
+	_, _ = repo.InsertUser(context.Background(), data.User{FirstName: "Admin", Email: "admin@example.com", Password: "old password 1"})
+
+	m := &mailer.MemoryMailer{}
+	return &Service{
+		DB:        repo,
+		Mailer:    m,
+		Templates: &mailer.Templates{Dir: "./../../templates/email/"},
+		Policy:    &passwordpolicy.Policy{MinLength: 10, History: 2},
+		ResetURL:  "http://localhost:8080/reset-password",
+	}, repo, m
+}
+
+func TestService_Request(t *testing.T) {
+	s, _, m := newService(t)
+
+	if err := s.Request(context.Background(), "nobody@example.com"); err != nil {
+		t.Errorf("Request() for an unknown email should not return an error, got %s", err)
+	}
+
+	if len(m.Messages()) != 0 {
+		t.Errorf("expected no email for an unknown address, but %d were sent", len(m.Messages()))
+	}
+
+	if err := s.Request(context.Background(), "Admin@Example.com"); err != nil {
+		t.Fatalf("Request() returned an error: %s", err)
+	}
+
+	if len(m.Messages()) != 1 || m.Messages()[0].To != "admin@example.com" {
+		t.Fatalf("expected one email to admin@example.com, but got %+v", m.Messages())
+	}
+
+	if token := tokenFrom(t, m.Messages()[0]); len(token) < 40 {
+		t.Errorf("expected a long random token in the link, but got %q", token)
+	}
+}
+
+func TestService_Reset(t *testing.T) {
+	ctx := context.Background()
+	s, repo, m := newService(t)
+
+	_ = s.Request(ctx, "admin@example.com")
+	token := tokenFrom(t, m.Messages()[0])
+
+	// a rejected password leaves the token usable
+	if err := s.Reset(ctx, token, "short"); !errors.Is(err, passwordpolicy.ErrRejected) {
+		t.Errorf("expected a short password to be rejected by the policy, got %v", err)
+	}
+
+	if err := s.Reset(ctx, token, "old password 1"); !errors.Is(err, passwordpolicy.ErrRejected) {
+		t.Errorf("expected the current password to be rejected by the policy, got %v", err)
+	}
+
+	if err := s.Reset(ctx, token, "new password 2"); err != nil {
+		t.Fatalf("Reset() returned an error: %s", err)
+	}
+
+	user, _ := repo.GetUser(ctx, 1)
+	if matches, _ := user.PasswordMatches("new password 2"); !matches {
+		t.Error("expected the password to be changed")
+	}
+
+	if user.SessionsRevokedAt.IsZero() {
+		t.Error("expected resetting the password to revoke existing sessions")
+	}
+
+	if err := s.Reset(ctx, token, "new password 3"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("a token should only work once; expected ErrInvalidToken, got %v", err)
+	}
+
+	if err := s.Reset(ctx, "made up", "new password 3"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected ErrInvalidToken for an unknown token, got %v", err)
+	}
+}
+
+func TestService_ResetExpired(t *testing.T) {
+	ctx := context.Background()
+	s, _, m := newService(t)
+	s.TTL = time.Millisecond
+
+	_ = s.Request(ctx, "admin@example.com")
+	time.Sleep(5 * time.Millisecond)
+
+	if err := s.Reset(ctx, tokenFrom(t, m.Messages()[0]), "new password 2"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected ErrInvalidToken for an expired token, got %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+// Package registration lets people create their own accounts. A new account can't
+// log in until its email address has been confirmed through the link emailed to
+// it, which carries a random, expiring token. Only a SHA-256 hash of each token is
+// stored.
+package registration
+
+import (
+	"context"
+	"errors"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/mailer"
+	"github.com/spacesedan/testing-course/webapp/pkg/passwordpolicy"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+	"github.com/spacesedan/testing-course/webapp/pkg/securetoken"
+	"strings"
+	"time"
+)
+
+// DefaultTTL is how long a verification link is valid when Service.TTL is zero.
+const DefaultTTL = 24 * time.Hour
+
+// ErrInvalidToken is returned by Verify for tokens that are unknown, expired or
+// already used.
+var ErrInvalidToken = errors.New("verification link is invalid or has expired")
+
+// ErrMissingFields is returned by Register when the user has no name or email.
+var ErrMissingFields = errors.New("first name, last name and email are required")
+
+// ErrUnverified is returned by apps that refuse to log in a user whose email
+// address has not been confirmed yet.
+var ErrUnverified = errors.New("please confirm your email address before logging in")
+
+// Service registers users and confirms their email addresses.
+type Service struct {
+	DB        repository.DataBaseRepo
+	Mailer    mailer.Mailer
+	Templates *mailer.Templates
+	Policy    *passwordpolicy.Policy
+
+	// VerifyURL is the page that accepts the token, e.g.
+	// http://localhost:8080/verify-email; the token is added as the "token"
+	// query parameter.
+	VerifyURL string
+
+	// TTL is how long a token is valid; zero means DefaultTTL.
+	TTL time.Duration
+}
+
+// Register creates an unverified, non-admin account for user with the given
+// password, and emails them a verification link. It returns the new user's id,
+// ErrMissingFields, a *passwordpolicy.Error for a rejected password, or
+// repository.ErrDuplicate if the email address is taken.
+func (s *Service) Register(ctx context.Context, user data.User, password string) (int, error) {
+	user.FirstName = strings.TrimSpace(user.FirstName)
+	user.LastName = strings.TrimSpace(user.LastName)
+	user.Email = data.NormalizeEmail(user.Email)
+
+	if user.FirstName == "" || user.LastName == "" || user.Email == "" {
+		return 0, ErrMissingFields
+	}
+
+	err := s.Policy.Validate(password)
+	if err != nil {
+		return 0, err
+	}
+
+	user.Password = password
+	user.IsAdmin = 0
+	user.EmailVerifiedAt = time.Time{}
+
+	var id int
+	err = s.DB.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		id, err = repo.InsertUser(ctx, user)
+		if err != nil {
+			return err
+		}
+
+		user.ID = id
+
+		// if the email can't be sent, don't keep an account nobody can verify
+		return s.sendVerification(ctx, repo, &user)
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// Resend emails a new verification link to the user with the given address. To
+// avoid revealing which addresses have accounts, it returns nil when there is no
+// such user, or when they are already verified.
+func (s *Service) Resend(ctx context.Context, email string) error {
+	user, err := s.DB.GetUserByEmail(ctx, email)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if user.EmailVerified() {
+		return nil
+	}
+
+	return s.sendVerification(ctx, s.DB, user)
+}
+
+// Verify marks the email address the token was sent to as confirmed. It returns
+// ErrInvalidToken for a bad token.
+func (s *Service) Verify(ctx context.Context, token string) error {
+	_, err := s.DB.VerifyEmail(ctx, securetoken.Hash(token))
+	if errors.Is(err, repository.ErrNotFound) {
+		return ErrInvalidToken
+	}
+
+	return err
+}
+
+// sendVerification stores a new token for user and emails them a link with it.
+func (s *Service) sendVerification(ctx context.Context, repo repository.DataBaseRepo, user *data.User) error {
+	token, hash, err := securetoken.New()
+	if err != nil {
+		return err
+	}
+
+	ttl := s.TTL
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+
+	err = repo.InsertEmailVerificationToken(ctx, user.ID, hash, time.Now().Add(ttl))
+	if err != nil {
+		return err
+	}
+
+	link, err := securetoken.Link(s.VerifyURL, token)
+	if err != nil {
+		return err
+	}
+
+	msg, err := s.Templates.Message("verify-email", user.Email, map[string]any{
+		"User": user,
+		"Link": link,
+		"TTL":  ttl,
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.Mailer.Send(ctx, msg)
+}
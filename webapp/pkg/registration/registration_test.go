@@ -0,0 +1,155 @@
+package registration
+
+import (
+	"context"
+	"errors"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/mailer"
+	"github.com/spacesedan/testing-course/webapp/pkg/passwordpolicy"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository/dbrepo"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var linkRegexp = regexp.MustCompile(`https?://\S+`)
+
+// tokenFrom returns the verification token from the link in msg.
+func tokenFrom(t *testing.T, msg mailer.Message) string {
+	t.Helper()
+
+	link, err := url.Parse(linkRegexp.FindString(msg.Body))
+	if err != nil {
+		t.Fatalf("verification email has no valid link: %s", msg.Body)
+	}
+
+	return link.Query().Get("token")
+}
+
+func newService(t *testing.T) (*Service, *dbrepo.MemoryDBRepo, *mailer.MemoryMailer) {
+	t.Helper()
+
+	repo := dbrepo.NewMemoryDBRepo()
+	repo.Hasher = data.BcryptHasher{Cost: 4}
+
+	m := &mailer.MemoryMailer{}
+	return &Service{
+		DB:        repo,
+		Mailer:    m,
+		Templates: &mailer.Templates{Dir: "./../../templates/email/"},
+		Policy:    &passwordpolicy.Policy{MinLength: 10},
+		VerifyURL: "http://localhost:8080/verify-email",
+	}, repo, m
+}
+
+func TestService_Register(t *testing.T) {
+	ctx := context.Background()
+	s, repo, m := newService(t)
+
+	tests := []struct {
+		name        string
+		user        data.User
+		password    string
+		expectedErr error
+	}{
+		{"valid", data.User{FirstName: "Jack", LastName: "Smith", Email: " Jack@Smith.com", IsAdmin: 1}, "correct horse 42", nil},
+		{"duplicate email", data.User{FirstName: "Jack", LastName: "Smith", Email: "jack@smith.com"}, "correct horse 42", repository.ErrDuplicate},
+		{"missing name", data.User{FirstName: " ", LastName: "Smith", Email: "jane@smith.com"}, "correct horse 42", ErrMissingFields},
+		{"weak password", data.User{FirstName: "Jane", LastName: "Smith", Email: "jane@smith.com"}, "secret", passwordpolicy.ErrRejected},
+	}
+
+	for _, e := range tests {
+		_, err := s.Register(ctx, e.user, e.password)
+		if !errors.Is(err, e.expectedErr) {
+			t.Errorf("%s: expected error %v, but got %v", e.name, e.expectedErr, err)
+		}
+	}
+
+	if len(m.Messages()) != 1 || m.Messages()[0].To != "jack@smith.com" {
+		t.Fatalf("expected one email to jack@smith.com, but got %+v", m.Messages())
+	}
+
+	user, err := repo.GetUserByEmail(ctx, "jack@smith.com")
+	if err != nil {
+		t.Fatalf("expected the user to be created, but got %s", err)
+	}
+
+	if user.EmailVerified() || user.IsAdmin != 0 {
+		t.Errorf("expected an unverified, non-admin user, but got %+v", user)
+	}
+
+	if err := s.Verify(ctx, tokenFrom(t, m.Messages()[0])); err != nil {
+		t.Fatalf("Verify() returned an error: %s", err)
+	}
+
+	user, _ = repo.GetUser(ctx, user.ID)
+	if !user.EmailVerified() {
+		t.Error("expected the email address to be verified")
+	}
+
+	if err := s.Verify(ctx, tokenFrom(t, m.Messages()[0])); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("a token should only work once; expected ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestService_RegisterRollsBackWhenMailFails(t *testing.T) {
+	ctx := context.Background()
+	s, repo, _ := newService(t)
+	s.Templates = &mailer.Templates{Dir: "./missing/"}
+
+	if _, err := s.Register(ctx, data.User{FirstName: "Jack", LastName: "Smith", Email: "jack@smith.com"}, "correct horse 42"); err == nil {
+		t.Fatal("expected an error when the email can't be rendered")
+	}
+
+	if _, err := repo.GetUserByEmail(ctx, "jack@smith.com"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected the user not to be kept, got %v", err)
+	}
+}
+
+func TestService_Resend(t *testing.T) {
+	ctx := context.Background()
+	s, _, m := newService(t)
+
+	_, _ = s.Register(ctx, data.User{FirstName: "Jack", LastName: "Smith", Email: "jack@smith.com"}, "correct horse 42")
+	first := tokenFrom(t, m.Messages()[0])
+
+	if err := s.Resend(ctx, "nobody@example.com"); err != nil {
+		t.Errorf("Resend() for an unknown email should not return an error, got %s", err)
+	}
+
+	if err := s.Resend(ctx, "JACK@smith.com"); err != nil {
+		t.Fatalf("Resend() returned an error: %s", err)
+	}
+
+	if len(m.Messages()) != 2 {
+		t.Fatalf("expected a second email, but got %d", len(m.Messages()))
+	}
+
+	// either link works, until one of them is used
+	if err := s.Verify(ctx, tokenFrom(t, m.Messages()[1])); err != nil {
+		t.Fatalf("Verify() returned an error: %s", err)
+	}
+
+	if err := s.Verify(ctx, first); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected the other token to be used up, got %v", err)
+	}
+
+	if err := s.Resend(ctx, "jack@smith.com"); err != nil || len(m.Messages()) != 2 {
+		t.Errorf("expected no email for a verified user, got %v and %d messages", err, len(m.Messages()))
+	}
+}
+
+func TestService_VerifyExpired(t *testing.T) {
+	ctx := context.Background()
+	s, _, m := newService(t)
+	s.TTL = time.Millisecond
+
+	_, _ = s.Register(ctx, data.User{FirstName: "Jack", LastName: "Smith", Email: "jack@smith.com"}, "correct horse 42")
+	time.Sleep(5 * time.Millisecond)
+
+	if err := s.Verify(ctx, tokenFrom(t, m.Messages()[0])); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected ErrInvalidToken for an expired token, got %v", err)
+	}
+}
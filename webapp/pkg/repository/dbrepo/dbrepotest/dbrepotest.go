@@ -0,0 +1,22 @@
+// Package dbrepotest sets up in-memory repositories for the tests of packages
+// built on dbrepo.
+package dbrepotest
+
+import (
+	"github.com/spacesedan/testing-course/webapp/pkg/repository/dbrepo"
+	"testing"
+)
+
+// NewSeeded returns a memory repository holding dbrepo.DefaultFixtures, with the
+// admin user as user 1. It fails the test if the fixtures can't be loaded, so a
+// broken fixture shows up here rather than as confusing failures later.
+func NewSeeded(t testing.TB) *dbrepo.MemoryDBRepo {
+	t.Helper()
+
+	repo := dbrepo.NewMemoryDBRepo()
+	if err := repo.Seed(dbrepo.DefaultFixtures()); err != nil {
+		t.Fatalf("seeding the memory repository: %s", err)
+	}
+
+	return repo
+}
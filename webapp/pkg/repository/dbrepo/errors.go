@@ -0,0 +1,58 @@
+package dbrepo
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgconn"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+)
+
+// postgres error codes, see https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+	pgUniqueViolation      = "23505"
+	pgForeignKeyViolation  = "23503"
+	pgCheckViolation       = "23514"
+	pgSerializationFailure = "40001"
+	pgDeadlockDetected     = "40P01"
+)
+
+// translateError converts errors returned by database/sql and pgx into the typed
+// errors declared in the repository package. Errors it does not recognise are
+// returned unchanged.
+func translateError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return repository.ErrNotFound
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case pgUniqueViolation:
+			return fmt.Errorf("%w: %s", repository.ErrDuplicate, pgErr.Message)
+		case pgForeignKeyViolation, pgCheckViolation, pgSerializationFailure, pgDeadlockDetected:
+			return fmt.Errorf("%w: %s", repository.ErrConflict, pgErr.Message)
+		}
+	}
+
+	return err
+}
+
+// checkRowsAffected returns repository.ErrNotFound when a statement that targets
+// a single row did not touch anything.
+func checkRowsAffected(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return repository.ErrNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,26 @@
+package dbrepo
+
+import (
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+)
+
+// hashPassword hashes password with h, or data.DefaultPasswordHasher when the
+// repository has no hasher configured.
+func hashPassword(h data.PasswordHasher, password string) (string, error) {
+	if h == nil {
+		h = data.DefaultPasswordHasher
+	}
+
+	return h.Hash(password)
+}
+
+// historyLimit returns limit, or repository.DefaultHistoryLimit when the
+// repository has no limit configured.
+func historyLimit(limit int) int {
+	if limit < 1 {
+		return repository.DefaultHistoryLimit
+	}
+
+	return limit
+}
@@ -0,0 +1,122 @@
+package dbrepo
+
+import (
+	"database/sql"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"strings"
+	"time"
+)
+
+// accessTokenColumns are the columns of access_tokens, in the order
+// accessTokenRow.dest scans them.
+const accessTokenColumns = `id, user_id, name, scopes, token_hash, expires_at, last_used_at, created_at`
+
+// accessTokenRow is an access_tokens row being scanned by the SQL repositories,
+// which store scopes space separated and missing times as null.
+type accessTokenRow struct {
+	token                 data.AccessToken
+	scopes                string
+	expiresAt, lastUsedAt sql.NullTime
+}
+
+func (r *accessTokenRow) dest() []any {
+	return []any{
+		&r.token.ID,
+		&r.token.UserID,
+		&r.token.Name,
+		&r.scopes,
+		&r.token.TokenHash,
+		&r.expiresAt,
+		&r.lastUsedAt,
+		&r.token.CreatedAt,
+	}
+}
+
+func (r *accessTokenRow) accessToken() *data.AccessToken {
+	t := r.token
+	t.Scopes = strings.Fields(r.scopes)
+	t.ExpiresAt = timePtr(r.expiresAt)
+	t.LastUsedAt = timePtr(r.lastUsedAt)
+	return &t
+}
+
+func timePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: *t, Valid: true}
+}
+
+// oauthClientColumns are the columns of oauth_clients, in the order
+// oauthClientRow.dest scans them.
+const oauthClientColumns = `id, client_id, secret_hash, name, redirect_uris, grant_types, scopes, owner_id, created_at`
+
+// oauthClientRow is an oauth_clients row being scanned by the SQL repositories.
+type oauthClientRow struct {
+	c                                data.OAuthClient
+	secretHash                       sql.NullString
+	redirectURIs, grantTypes, scopes string
+}
+
+func (r *oauthClientRow) dest() []any {
+	return []any{
+		&r.c.ID,
+		&r.c.ClientID,
+		&r.secretHash,
+		&r.c.Name,
+		&r.redirectURIs,
+		&r.grantTypes,
+		&r.scopes,
+		&r.c.OwnerID,
+		&r.c.CreatedAt,
+	}
+}
+
+func (r *oauthClientRow) client() *data.OAuthClient {
+	c := r.c
+	c.SecretHash = r.secretHash.String
+	c.RedirectURIs = strings.Fields(r.redirectURIs)
+	c.GrantTypes = strings.Fields(r.grantTypes)
+	c.Scopes = strings.Fields(r.scopes)
+	return &c
+}
+
+// sessionColumns are the columns of sessions, in the order sessionDest scans
+// them.
+const sessionColumns = `id, user_id, kind, device, ip, user_agent, created_at, last_seen_at, expires_at`
+
+func sessionDest(s *data.Session) []any {
+	return []any{
+		&s.ID,
+		&s.UserID,
+		&s.Kind,
+		&s.Device,
+		&s.IP,
+		&s.UserAgent,
+		&s.CreatedAt,
+		&s.LastSeenAt,
+		&s.ExpiresAt,
+	}
+}
+
+// userImageColumns are the columns of user_images, in the order userImageDest
+// scans them.
+const userImageColumns = `id, user_id, file_name, is_current, created_at, updated_at`
+
+func userImageDest(i *data.UserImage) []any {
+	return []any{
+		&i.ID,
+		&i.UserID,
+		&i.FileName,
+		&i.IsCurrent,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+	}
+}
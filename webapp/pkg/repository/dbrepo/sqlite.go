@@ -0,0 +1,78 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+	"net/url"
+)
+
+// SQLiteDSN turns the path of a SQLite database file into a data source name for
+// the "sqlite" driver, with the pragmas SQLiteDBRepo relies on: enforced foreign
+// keys, and a busy timeout so concurrent writers wait instead of failing.
+func SQLiteDSN(path string) string {
+	q := url.Values{}
+	q.Add("_pragma", "foreign_keys(1)")
+	q.Add("_pragma", "busy_timeout(5000)")
+	q.Add("_pragma", "journal_mode(WAL)")
+
+	return fmt.Sprintf("file:%s?%s", path, q.Encode())
+}
+
+// translateSQLiteError converts errors returned by the sqlite driver into the
+// typed errors declared in the repository package. Errors it does not recognise
+// are returned unchanged.
+func translateSQLiteError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return repository.ErrNotFound
+	}
+
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code() {
+		case sqlite3.SQLITE_CONSTRAINT_UNIQUE, sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY:
+			return fmt.Errorf("%w: %s", repository.ErrDuplicate, sqliteErr.Error())
+		case sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY, sqlite3.SQLITE_CONSTRAINT_CHECK, sqlite3.SQLITE_BUSY:
+			return fmt.Errorf("%w: %s", repository.ErrConflict, sqliteErr.Error())
+		}
+	}
+
+	return err
+}
+
+// conn returns the transaction the repository is bound to, or the pool otherwise.
+func (m *SQLiteDBRepo) conn() dbtx {
+	if m.tx != nil {
+		return m.tx
+	}
+
+	return m.DB
+}
+
+// WithTx runs fn inside a transaction. See repository.DataBaseRepo for details.
+// SQLite transactions are always serializable, so isolation levels are ignored.
+func (m *SQLiteDBRepo) WithTx(ctx context.Context, fn func(repo repository.DataBaseRepo) error, opts ...repository.TxOption) error {
+	if m.tx != nil {
+		return fn(m)
+	}
+
+	txOpts := repository.NewTxOptions(opts...)
+	tx, err := m.DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: txOpts.ReadOnly})
+	if err != nil {
+		return translateSQLiteError(err)
+	}
+
+	err = runTx(tx, func() error {
+		return fn(&SQLiteDBRepo{DB: m.DB, Timeouts: m.Timeouts, Hasher: m.Hasher, HistoryLimit: m.HistoryLimit, tx: tx})
+	})
+
+	return translateSQLiteError(err)
+}
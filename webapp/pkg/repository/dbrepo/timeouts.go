@@ -0,0 +1,93 @@
+package dbrepo
+
+import (
+	"context"
+	"fmt"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// dbTimeout is used for any operation that has no timeout configured.
+const dbTimeout = time.Second * 3
+
+// Timeouts configures how long each repository operation may run before its context
+// is cancelled. Operations are keyed by method name (e.g. "AllUsers"); anything not
+// listed in PerOperation uses Default, and a zero Default falls back to dbTimeout.
+type Timeouts struct {
+	Default      time.Duration
+	PerOperation map[string]time.Duration
+}
+
+// For returns the timeout to use for the named operation.
+func (t Timeouts) For(op string) time.Duration {
+	if d, ok := t.PerOperation[op]; ok && d > 0 {
+		return d
+	}
+
+	if t.Default > 0 {
+		return t.Default
+	}
+
+	return dbTimeout
+}
+
+// withTimeout derives a context for the named operation from the caller's context,
+// so that request cancellation still reaches the database.
+func (t Timeouts) withTimeout(ctx context.Context, op string) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, t.For(op))
+}
+
+// ParseTimeouts parses a comma separated list of operation=duration pairs, such as
+// "AllUsers=5s,InsertUser=500ms", into a map suitable for Timeouts.PerOperation.
+// Operations must be methods of repository.DataBaseRepo that talk to the
+// database, so a misspelt name is an error rather than silently ignored, and
+// durations must be positive.
+func ParseTimeouts(s string) (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration)
+
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		op, value, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid timeout %q; expected operation=duration", pair)
+		}
+
+		op = strings.TrimSpace(op)
+		if !isOperation(op) {
+			return nil, fmt.Errorf("invalid timeout for %s: no such database operation", op)
+		}
+
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout for %s: %w", op, err)
+		}
+
+		// a context with no time left fails every query at once
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid timeout for %s: %s is not positive", op, d)
+		}
+
+		timeouts[op] = d
+	}
+
+	return timeouts, nil
+}
+
+// isOperation reports whether op names a method of repository.DataBaseRepo that
+// runs with a timeout.
+func isOperation(op string) bool {
+	switch op {
+	case "Connection", "WithTx":
+		// these don't run queries of their own
+		return false
+	}
+
+	_, ok := reflect.TypeOf((*repository.DataBaseRepo)(nil)).Elem().MethodByName(op)
+	return ok
+}
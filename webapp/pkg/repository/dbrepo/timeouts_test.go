@@ -0,0 +1,63 @@
+package dbrepo
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimeouts(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         string
+		expected      map[string]time.Duration
+		errorExpected bool
+	}{
+		{"empty", "", map[string]time.Duration{}, false},
+		{"single", "AllUsers=5s", map[string]time.Duration{"AllUsers": 5 * time.Second}, false},
+		{"multiple", "AllUsers=5s, InsertUser=500ms", map[string]time.Duration{"AllUsers": 5 * time.Second, "InsertUser": 500 * time.Millisecond}, false},
+		{"missing equals", "AllUsers", nil, true},
+		{"bad duration", "AllUsers=soon", nil, true},
+		{"unknown operation", "GetUsr=2s", nil, true},
+		{"not timed", "WithTx=2s", nil, true},
+		{"zero", "AllUsers=0", nil, true},
+		{"negative", "AllUsers=-1s", nil, true},
+	}
+
+	for _, e := range tests {
+		timeouts, err := ParseTimeouts(e.input)
+		if err != nil && !e.errorExpected {
+			t.Errorf("%s: did not expect error but got one - %s", e.name, err)
+		}
+
+		if err == nil && e.errorExpected {
+			t.Errorf("%s: expected error, but did not get one", e.name)
+		}
+
+		if len(timeouts) != len(e.expected) {
+			t.Errorf("%s: expected %d timeouts, but got %d", e.name, len(e.expected), len(timeouts))
+		}
+
+		for op, d := range e.expected {
+			if timeouts[op] != d {
+				t.Errorf("%s: expected %s for %s, but got %s", e.name, d, op, timeouts[op])
+			}
+		}
+	}
+}
+
+func TestTimeouts_For(t *testing.T) {
+	timeouts := Timeouts{PerOperation: map[string]time.Duration{"AllUsers": time.Minute}}
+
+	if d := timeouts.For("AllUsers"); d != time.Minute {
+		t.Errorf("expected per-operation timeout of %s, but got %s", time.Minute, d)
+	}
+
+	if d := timeouts.For("GetUser"); d != dbTimeout {
+		t.Errorf("expected fallback timeout of %s, but got %s", dbTimeout, d)
+	}
+
+	timeouts.Default = time.Second
+	if d := timeouts.For("GetUser"); d != time.Second {
+		t.Errorf("expected default timeout of %s, but got %s", time.Second, d)
+	}
+}
@@ -0,0 +1,60 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+)
+
+// dbtx is the part of *sql.DB and *sql.Tx used by the repository methods, so that
+// the same queries run whether or not a transaction is in progress.
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// conn returns the transaction the repository is bound to, or the pool otherwise.
+func (m *PostgresDBRepo) conn() dbtx {
+	if m.tx != nil {
+		return m.tx
+	}
+
+	return m.DB
+}
+
+// WithTx runs fn inside a transaction. See repository.DataBaseRepo for details.
+func (m *PostgresDBRepo) WithTx(ctx context.Context, fn func(repo repository.DataBaseRepo) error, opts ...repository.TxOption) error {
+	if m.tx != nil {
+		return fn(m)
+	}
+
+	tx, err := m.DB.BeginTx(ctx, repository.NewTxOptions(opts...))
+	if err != nil {
+		return translateError(err)
+	}
+
+	return runTx(tx, func() error {
+		return fn(&PostgresDBRepo{DB: m.DB, Timeouts: m.Timeouts, Hasher: m.Hasher, HistoryLimit: m.HistoryLimit, tx: tx})
+	})
+}
+
+// runTx calls fn and then commits tx, rolling it back if fn fails or panics.
+func runTx(tx *sql.Tx, fn func() error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err := fn(); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("%w (rollback failed: %v)", err, rbErr)
+		}
+		return err
+	}
+
+	return translateError(tx.Commit())
+}
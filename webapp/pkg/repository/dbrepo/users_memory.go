@@ -0,0 +1,1235 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryDBRepo keeps users and images in memory. It is safe for concurrent use and
+// enforces the same constraints as the Postgres schema, which makes it suitable for
+// tests that need real state changes and for running the applications in demo mode.
+// Create one with NewMemoryDBRepo.
+type MemoryDBRepo struct {
+	// Hasher hashes new passwords; nil means data.DefaultPasswordHasher.
+	Hasher data.PasswordHasher
+
+	// HistoryLimit is how many of a user's previous passwords ResetPassword
+	// keeps; 0 means repository.DefaultHistoryLimit. A password policy looks at
+	// its History-1 most recent ones.
+	HistoryLimit int
+
+	mu    *sync.RWMutex
+	state *memoryState
+
+	// inTx is set on the copy of the repository handed to WithTx callbacks, which
+	// already holds the write lock.
+	inTx bool
+}
+
+// memoryToken is a password reset or email verification token.
+type memoryToken struct {
+	userID    int
+	expiresAt time.Time
+}
+
+type memoryState struct {
+	users         map[int]data.User
+	images        map[int]data.UserImage
+	history       map[int][]string // previous password hashes by user id, oldest first
+	resetTokens   map[string]memoryToken
+	verifyTokens  map[string]memoryToken
+	totpSteps     map[int]int64               // last accepted TOTP step by user id
+	recovery      map[int]map[string]struct{} // recovery code hashes by user id
+	accessTokens  map[int]data.AccessToken
+	oauthClients  map[string]data.OAuthClient // by client id
+	oauthCodes    map[string]data.OAuthCode   // by code hash
+	consents      map[memoryConsentKey][]string
+	revoked       map[string]time.Time // expiry of revoked JWTs by token id
+	sessions      map[int]data.Session
+	nextUserID    int
+	nextImageID   int
+	nextTokenID   int
+	nextClientID  int
+	nextSessionID int
+}
+
+// memoryConsentKey identifies the consent a user gave an OAuth client.
+type memoryConsentKey struct {
+	userID   int
+	clientID string
+}
+
+// Fixtures is the data loaded into a MemoryDBRepo by Seed. User passwords are
+// hashes, as they would be stored in the database.
+type Fixtures struct {
+	Users  []data.User
+	Images []data.UserImage
+}
+
+// DefaultFixtures returns the same data as sql/seed.sql: an admin user,
+// admin@example.com, whose password is "secret".
+func DefaultFixtures() Fixtures {
+	created := time.Date(2022, 8, 19, 0, 0, 0, 0, time.UTC)
+
+	return Fixtures{
+		Users: []data.User{
+			{
+				ID:        1,
+				FirstName: "Admin",
+				LastName:  "User",
+				Email:     "admin@example.com",
+				Password:  "$2a$14$ajq8Q7fbtFRQvXpdCq7Jcuy.Rx1h/L4J60Otx.gyNLbAYctGMJ9tK",
+				IsAdmin:   1,
+				CreatedAt: created,
+				UpdatedAt: created,
+
+				EmailVerifiedAt: created,
+			},
+		},
+	}
+}
+
+// NewMemoryDBRepo returns an empty in-memory repository.
+func NewMemoryDBRepo() *MemoryDBRepo {
+	return &MemoryDBRepo{
+		mu: &sync.RWMutex{},
+		state: &memoryState{
+			users:         make(map[int]data.User),
+			images:        make(map[int]data.UserImage),
+			history:       make(map[int][]string),
+			resetTokens:   make(map[string]memoryToken),
+			verifyTokens:  make(map[string]memoryToken),
+			totpSteps:     make(map[int]int64),
+			recovery:      make(map[int]map[string]struct{}),
+			accessTokens:  make(map[int]data.AccessToken),
+			oauthClients:  make(map[string]data.OAuthClient),
+			oauthCodes:    make(map[string]data.OAuthCode),
+			revoked:       make(map[string]time.Time),
+			consents:      make(map[memoryConsentKey][]string),
+			sessions:      make(map[int]data.Session),
+			nextUserID:    1,
+			nextImageID:   1,
+			nextTokenID:   1,
+			nextClientID:  1,
+			nextSessionID: 1,
+		},
+	}
+}
+
+// Seed loads fixtures into the repository, in a single transaction. Rows that
+// have no ID are given the next one, as the database would.
+func (m *MemoryDBRepo) Seed(fixtures Fixtures) error {
+	return m.WithTx(context.Background(), func(repo repository.DataBaseRepo) error {
+		s := repo.(*MemoryDBRepo).state
+
+		for _, u := range fixtures.Users {
+			if u.ID == 0 {
+				u.ID = s.nextUserID
+			}
+			if _, exists := s.users[u.ID]; exists {
+				return fmt.Errorf("%w: user id %d", repository.ErrDuplicate, u.ID)
+			}
+			if s.emailTaken(u.Email, u.ID) {
+				return fmt.Errorf("%w: email %s", repository.ErrDuplicate, u.Email)
+			}
+
+			u.Email = data.NormalizeEmail(u.Email)
+			u.ProfilePic = data.UserImage{}
+			s.users[u.ID] = u
+			if u.ID >= s.nextUserID {
+				s.nextUserID = u.ID + 1
+			}
+		}
+
+		for _, i := range fixtures.Images {
+			if i.ID == 0 {
+				i.ID = s.nextImageID
+			}
+			if _, exists := s.users[i.UserID]; !exists {
+				return fmt.Errorf("%w: image %d belongs to missing user %d", repository.ErrConflict, i.ID, i.UserID)
+			}
+
+			s.images[i.ID] = i
+			if i.ID >= s.nextImageID {
+				s.nextImageID = i.ID + 1
+			}
+		}
+
+		return nil
+	})
+}
+
+// lock takes the read or write lock, unless the repository is already bound to a
+// transaction, and returns the function that releases it.
+func (m *MemoryDBRepo) lock(write bool) func() {
+	if m.inTx {
+		return func() {}
+	}
+
+	if write {
+		m.mu.Lock()
+		return m.mu.Unlock
+	}
+
+	m.mu.RLock()
+	return m.mu.RUnlock
+}
+
+func (m *MemoryDBRepo) Connection() *sql.DB {
+	return nil
+}
+
+// AllUsers returns all users as a slice of *data.User
+func (m *MemoryDBRepo) AllUsers(ctx context.Context) ([]*data.User, error) {
+	defer m.lock(false)()
+
+	var users []*data.User
+	for _, u := range m.state.users {
+		u := u
+		u.ProfilePic.FileName = m.state.imageFor(u.ID).FileName
+		users = append(users, &u)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].LastName == users[j].LastName {
+			return users[i].ID < users[j].ID
+		}
+		return users[i].LastName < users[j].LastName
+	})
+
+	return users, nil
+}
+
+// GetUser returns one user by id
+func (m *MemoryDBRepo) GetUser(ctx context.Context, id int) (*data.User, error) {
+	defer m.lock(false)()
+
+	u, ok := m.state.users[id]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+
+	u.ProfilePic.FileName = m.state.imageFor(id).FileName
+	return &u, nil
+}
+
+// GetUserByEmail returns one user by email address
+func (m *MemoryDBRepo) GetUserByEmail(ctx context.Context, email string) (*data.User, error) {
+	defer m.lock(false)()
+
+	email = data.NormalizeEmail(email)
+	for _, u := range m.state.users {
+		if u.Email == email {
+			u.ProfilePic.FileName = m.state.imageFor(u.ID).FileName
+			return &u, nil
+		}
+	}
+
+	return nil, repository.ErrNotFound
+}
+
+// UpdateUser updates one user in the database
+func (m *MemoryDBRepo) UpdateUser(ctx context.Context, u data.User) error {
+	defer m.lock(true)()
+
+	existing, ok := m.state.users[u.ID]
+	if !ok {
+		return repository.ErrNotFound
+	}
+
+	if m.state.emailTaken(u.Email, u.ID) {
+		return fmt.Errorf("%w: email %s", repository.ErrDuplicate, data.NormalizeEmail(u.Email))
+	}
+
+	existing.Email = data.NormalizeEmail(u.Email)
+	existing.FirstName = u.FirstName
+	existing.LastName = u.LastName
+	existing.IsAdmin = u.IsAdmin
+	existing.UpdatedAt = time.Now()
+	m.state.users[u.ID] = existing
+
+	return nil
+}
+
+// DeleteUser deletes one user from the database, by id, along with their images.
+func (m *MemoryDBRepo) DeleteUser(ctx context.Context, id int) error {
+	defer m.lock(true)()
+
+	if _, ok := m.state.users[id]; !ok {
+		return repository.ErrNotFound
+	}
+
+	delete(m.state.users, id)
+	delete(m.state.history, id)
+	deleteTokens(m.state.resetTokens, id)
+	deleteTokens(m.state.verifyTokens, id)
+	delete(m.state.totpSteps, id)
+	delete(m.state.recovery, id)
+	for tokenID, t := range m.state.accessTokens {
+		if t.UserID == id {
+			delete(m.state.accessTokens, tokenID)
+		}
+	}
+	for clientID, c := range m.state.oauthClients {
+		if c.OwnerID == id {
+			m.state.deleteOAuthClient(clientID)
+		}
+	}
+	for hash, c := range m.state.oauthCodes {
+		if c.UserID == id {
+			delete(m.state.oauthCodes, hash)
+		}
+	}
+	for key := range m.state.consents {
+		if key.userID == id {
+			delete(m.state.consents, key)
+		}
+	}
+	m.state.deleteSessions(id, 0)
+	for imageID, i := range m.state.images {
+		if i.UserID == id {
+			delete(m.state.images, imageID)
+		}
+	}
+
+	return nil
+}
+
+// InsertUser inserts a new user into the database, and returns the ID of the newly inserted row
+func (m *MemoryDBRepo) InsertUser(ctx context.Context, user data.User) (int, error) {
+	hashedPassword, err := hashPassword(m.Hasher, user.Password)
+	if err != nil {
+		return 0, err
+	}
+
+	defer m.lock(true)()
+
+	if m.state.emailTaken(user.Email, 0) {
+		return 0, fmt.Errorf("%w: email %s", repository.ErrDuplicate, data.NormalizeEmail(user.Email))
+	}
+
+	user.ID = m.state.nextUserID
+	user.Email = data.NormalizeEmail(user.Email)
+	user.Password = hashedPassword
+	user.CreatedAt = time.Now()
+	user.UpdatedAt = time.Now()
+	user.ProfilePic = data.UserImage{}
+
+	m.state.users[user.ID] = user
+	m.state.nextUserID++
+
+	return user.ID, nil
+}
+
+// ResetPassword is the method we will use to change a user's password.
+func (m *MemoryDBRepo) ResetPassword(ctx context.Context, id int, password string) error {
+	hashedPassword, err := hashPassword(m.Hasher, password)
+	if err != nil {
+		return err
+	}
+
+	defer m.lock(true)()
+
+	u, ok := m.state.users[id]
+	if !ok {
+		return repository.ErrNotFound
+	}
+
+	history := append(m.state.history[id], u.Password)
+	if limit := historyLimit(m.HistoryLimit); len(history) > limit {
+		history = append([]string(nil), history[len(history)-limit:]...)
+	}
+	m.state.history[id] = history
+	u.Password = hashedPassword
+	m.state.users[id] = u
+
+	return nil
+}
+
+// UpdatePasswordHash replaces the hash of a user's password, such as one made
+// with outdated settings, without adding to their password history.
+func (m *MemoryDBRepo) UpdatePasswordHash(ctx context.Context, id int, password string) error {
+	hashedPassword, err := hashPassword(m.Hasher, password)
+	if err != nil {
+		return err
+	}
+
+	defer m.lock(true)()
+
+	u, ok := m.state.users[id]
+	if !ok {
+		return repository.ErrNotFound
+	}
+
+	u.Password = hashedPassword
+	m.state.users[id] = u
+
+	return nil
+}
+
+// PasswordHistory returns the hashes of up to limit passwords the user had before
+// their current one, newest first.
+func (m *MemoryDBRepo) PasswordHistory(ctx context.Context, id int, limit int) ([]string, error) {
+	defer m.lock(false)()
+
+	var hashes []string
+	history := m.state.history[id]
+	for i := len(history) - 1; i >= 0 && len(hashes) < limit; i-- {
+		hashes = append(hashes, history[i])
+	}
+
+	return hashes, nil
+}
+
+// InsertUserImage inserts a user profile image into the database, and makes it
+// the user's current one.
+func (m *MemoryDBRepo) InsertUserImage(ctx context.Context, i data.UserImage) (int, error) {
+	defer m.lock(true)()
+
+	if _, ok := m.state.users[i.UserID]; !ok {
+		return 0, fmt.Errorf("%w: user %d does not exist", repository.ErrConflict, i.UserID)
+	}
+
+	m.state.clearCurrentImage(i.UserID)
+
+	i.ID = m.state.nextImageID
+	i.IsCurrent = true
+	i.CreatedAt = time.Now()
+	i.UpdatedAt = time.Now()
+
+	m.state.images[i.ID] = i
+	m.state.nextImageID++
+
+	return i.ID, nil
+}
+
+// AllUserImages returns the user's profile images, newest first.
+func (m *MemoryDBRepo) AllUserImages(ctx context.Context, userID int) ([]*data.UserImage, error) {
+	defer m.lock(false)()
+
+	var images []*data.UserImage
+	for _, i := range m.state.images {
+		if i.UserID == userID {
+			i := i
+			images = append(images, &i)
+		}
+	}
+
+	sort.Slice(images, func(a, b int) bool {
+		if !images[a].CreatedAt.Equal(images[b].CreatedAt) {
+			return images[a].CreatedAt.After(images[b].CreatedAt)
+		}
+		return images[a].ID > images[b].ID
+	})
+
+	return images, nil
+}
+
+// SetCurrentUserImage makes one of the user's profile images their current one.
+func (m *MemoryDBRepo) SetCurrentUserImage(ctx context.Context, userID, id int) error {
+	defer m.lock(true)()
+
+	i, ok := m.state.images[id]
+	if !ok || i.UserID != userID {
+		return repository.ErrNotFound
+	}
+
+	m.state.clearCurrentImage(userID)
+
+	i.IsCurrent = true
+	i.UpdatedAt = time.Now()
+	m.state.images[id] = i
+
+	return nil
+}
+
+// ClearCurrentUserImage leaves the user without a current profile image.
+func (m *MemoryDBRepo) ClearCurrentUserImage(ctx context.Context, userID int) error {
+	defer m.lock(true)()
+
+	if !m.state.clearCurrentImage(userID) {
+		return repository.ErrNotFound
+	}
+
+	return nil
+}
+
+// UserImageFileNames returns the file names of every profile image.
+func (m *MemoryDBRepo) UserImageFileNames(ctx context.Context) ([]string, error) {
+	defer m.lock(false)()
+
+	seen := make(map[string]bool)
+	var names []string
+	for _, i := range m.state.images {
+		if !seen[i.FileName] {
+			seen[i.FileName] = true
+			names = append(names, i.FileName)
+		}
+	}
+
+	return names, nil
+}
+
+// WithTx runs fn inside a transaction. See repository.DataBaseRepo for details.
+// The transaction holds the write lock until it finishes, so transactions are
+// serializable and isolation levels are ignored.
+func (m *MemoryDBRepo) WithTx(ctx context.Context, fn func(repo repository.DataBaseRepo) error, opts ...repository.TxOption) error {
+	if m.inTx {
+		return fn(m)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// work on a copy, and only swap it in when fn succeeds; if fn returns an
+	// error or panics the copy is simply dropped.
+	tx := &MemoryDBRepo{Hasher: m.Hasher, HistoryLimit: m.HistoryLimit, mu: m.mu, state: m.state.clone(), inTx: true}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	*m.state = *tx.state
+	return nil
+}
+
+// DeleteUserImage deletes one of the user's profile images.
+func (m *MemoryDBRepo) DeleteUserImage(ctx context.Context, userID, id int) error {
+	defer m.lock(true)()
+
+	i, ok := m.state.images[id]
+	if !ok || i.UserID != userID {
+		return repository.ErrNotFound
+	}
+
+	delete(m.state.images, id)
+	return nil
+}
+
+// RevokeSessions sets the user's SessionsRevokedAt to now, and deletes their
+// sessions.
+func (m *MemoryDBRepo) RevokeSessions(ctx context.Context, id int) error {
+	defer m.lock(true)()
+
+	u, ok := m.state.users[id]
+	if !ok {
+		return repository.ErrNotFound
+	}
+
+	u.SessionsRevokedAt = time.Now()
+	m.state.users[id] = u
+	m.state.deleteSessions(id, 0)
+
+	return nil
+}
+
+// InsertPasswordResetToken stores the hash of a password reset token for the user,
+// and clears out any of their tokens that have already expired.
+func (m *MemoryDBRepo) InsertPasswordResetToken(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error {
+	defer m.lock(true)()
+
+	if _, ok := m.state.users[userID]; !ok {
+		return fmt.Errorf("%w: user %d does not exist", repository.ErrConflict, userID)
+	}
+
+	if _, ok := m.state.resetTokens[tokenHash]; ok {
+		return fmt.Errorf("%w: reset token", repository.ErrDuplicate)
+	}
+
+	for hash, t := range m.state.resetTokens {
+		if t.userID == userID && !t.expiresAt.After(time.Now()) {
+			delete(m.state.resetTokens, hash)
+		}
+	}
+
+	m.state.resetTokens[tokenHash] = memoryToken{userID: userID, expiresAt: expiresAt}
+
+	return nil
+}
+
+// ConsumePasswordResetToken returns the user an unexpired reset token belongs to,
+// and deletes all of that user's reset tokens.
+func (m *MemoryDBRepo) ConsumePasswordResetToken(ctx context.Context, tokenHash string) (int, error) {
+	defer m.lock(true)()
+
+	t, ok := m.state.resetTokens[tokenHash]
+	if !ok || !t.expiresAt.After(time.Now()) {
+		return 0, repository.ErrNotFound
+	}
+
+	deleteTokens(m.state.resetTokens, t.userID)
+
+	return t.userID, nil
+}
+
+// InsertEmailVerificationToken stores the hash of an email verification token for
+// the user, and clears out any of their tokens that have already expired.
+func (m *MemoryDBRepo) InsertEmailVerificationToken(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error {
+	defer m.lock(true)()
+
+	if _, ok := m.state.users[userID]; !ok {
+		return fmt.Errorf("%w: user %d does not exist", repository.ErrConflict, userID)
+	}
+
+	if _, ok := m.state.verifyTokens[tokenHash]; ok {
+		return fmt.Errorf("%w: verification token", repository.ErrDuplicate)
+	}
+
+	for hash, t := range m.state.verifyTokens {
+		if t.userID == userID && !t.expiresAt.After(time.Now()) {
+			delete(m.state.verifyTokens, hash)
+		}
+	}
+
+	m.state.verifyTokens[tokenHash] = memoryToken{userID: userID, expiresAt: expiresAt}
+
+	return nil
+}
+
+// VerifyEmail marks the email address of the user an unexpired verification token
+// belongs to as verified, and deletes all of that user's verification tokens.
+func (m *MemoryDBRepo) VerifyEmail(ctx context.Context, tokenHash string) (int, error) {
+	defer m.lock(true)()
+
+	t, ok := m.state.verifyTokens[tokenHash]
+	if !ok || !t.expiresAt.After(time.Now()) {
+		return 0, repository.ErrNotFound
+	}
+
+	deleteTokens(m.state.verifyTokens, t.userID)
+
+	u := m.state.users[t.userID]
+	if !u.EmailVerified() {
+		u.EmailVerifiedAt = time.Now()
+		m.state.users[t.userID] = u
+	}
+
+	return t.userID, nil
+}
+
+// SetTOTPSecret stores a new authenticator secret for the user, with two-factor
+// authentication off until it is confirmed.
+func (m *MemoryDBRepo) SetTOTPSecret(ctx context.Context, id int, secret string) error {
+	defer m.lock(true)()
+
+	u, ok := m.state.users[id]
+	if !ok {
+		return repository.ErrNotFound
+	}
+
+	u.TOTPSecret = secret
+	u.TOTPEnabledAt = time.Time{}
+	m.state.users[id] = u
+	delete(m.state.totpSteps, id)
+
+	return nil
+}
+
+// EnableTOTP turns on two-factor authentication for the user and replaces their
+// recovery codes.
+func (m *MemoryDBRepo) EnableTOTP(ctx context.Context, id int, recoveryCodeHashes []string) error {
+	defer m.lock(true)()
+
+	u, ok := m.state.users[id]
+	if !ok || u.TOTPSecret == "" {
+		return repository.ErrNotFound
+	}
+
+	codes := make(map[string]struct{}, len(recoveryCodeHashes))
+	for _, hash := range recoveryCodeHashes {
+		if _, ok := codes[hash]; ok {
+			return fmt.Errorf("%w: recovery code", repository.ErrDuplicate)
+		}
+		codes[hash] = struct{}{}
+	}
+
+	u.TOTPEnabledAt = time.Now()
+	m.state.users[id] = u
+	m.state.recovery[id] = codes
+
+	return nil
+}
+
+// DisableTOTP turns off two-factor authentication for the user, and deletes their
+// secret and recovery codes.
+func (m *MemoryDBRepo) DisableTOTP(ctx context.Context, id int) error {
+	defer m.lock(true)()
+
+	u, ok := m.state.users[id]
+	if !ok {
+		return repository.ErrNotFound
+	}
+
+	u.TOTPSecret = ""
+	u.TOTPEnabledAt = time.Time{}
+	m.state.users[id] = u
+	delete(m.state.totpSteps, id)
+	delete(m.state.recovery, id)
+
+	return nil
+}
+
+// UseTOTPStep records the time step of an accepted code, refusing steps that are
+// not later than the last one.
+func (m *MemoryDBRepo) UseTOTPStep(ctx context.Context, id int, step int64) error {
+	defer m.lock(true)()
+
+	if _, ok := m.state.users[id]; !ok {
+		return repository.ErrNotFound
+	}
+
+	if step <= m.state.totpSteps[id] {
+		return fmt.Errorf("%w: code already used", repository.ErrConflict)
+	}
+
+	m.state.totpSteps[id] = step
+
+	return nil
+}
+
+// UseRecoveryCode deletes one of the user's recovery codes.
+func (m *MemoryDBRepo) UseRecoveryCode(ctx context.Context, id int, codeHash string) error {
+	defer m.lock(true)()
+
+	if _, ok := m.state.recovery[id][codeHash]; !ok {
+		return repository.ErrNotFound
+	}
+
+	delete(m.state.recovery[id], codeHash)
+
+	return nil
+}
+
+// InsertAccessToken stores a personal access token and returns its id.
+func (m *MemoryDBRepo) InsertAccessToken(ctx context.Context, t data.AccessToken) (int, error) {
+	defer m.lock(true)()
+
+	if _, ok := m.state.users[t.UserID]; !ok {
+		return 0, fmt.Errorf("%w: user %d does not exist", repository.ErrConflict, t.UserID)
+	}
+
+	for _, existing := range m.state.accessTokens {
+		if existing.TokenHash == t.TokenHash {
+			return 0, fmt.Errorf("%w: access token", repository.ErrDuplicate)
+		}
+	}
+
+	t = *copyAccessToken(t)
+	t.ID = m.state.nextTokenID
+	t.LastUsedAt = nil
+	t.CreatedAt = time.Now()
+
+	m.state.accessTokens[t.ID] = t
+	m.state.nextTokenID++
+
+	return t.ID, nil
+}
+
+// GetAccessTokenByHash returns the access token with the given hash.
+func (m *MemoryDBRepo) GetAccessTokenByHash(ctx context.Context, tokenHash string) (*data.AccessToken, error) {
+	defer m.lock(false)()
+
+	for _, t := range m.state.accessTokens {
+		if t.TokenHash == tokenHash {
+			return copyAccessToken(t), nil
+		}
+	}
+
+	return nil, repository.ErrNotFound
+}
+
+// AllAccessTokens returns the user's access tokens, oldest first.
+func (m *MemoryDBRepo) AllAccessTokens(ctx context.Context, userID int) ([]*data.AccessToken, error) {
+	defer m.lock(false)()
+
+	var tokens []*data.AccessToken
+	for _, t := range m.state.accessTokens {
+		if t.UserID == userID {
+			tokens = append(tokens, copyAccessToken(t))
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].ID < tokens[j].ID
+	})
+
+	return tokens, nil
+}
+
+// TouchAccessToken sets the time the access token was last used.
+func (m *MemoryDBRepo) TouchAccessToken(ctx context.Context, id int, usedAt time.Time) error {
+	defer m.lock(true)()
+
+	t, ok := m.state.accessTokens[id]
+	if !ok {
+		return repository.ErrNotFound
+	}
+
+	t.LastUsedAt = &usedAt
+	m.state.accessTokens[id] = t
+
+	return nil
+}
+
+// DeleteAccessToken revokes one of the user's access tokens.
+func (m *MemoryDBRepo) DeleteAccessToken(ctx context.Context, userID, id int) error {
+	defer m.lock(true)()
+
+	t, ok := m.state.accessTokens[id]
+	if !ok || t.UserID != userID {
+		return repository.ErrNotFound
+	}
+
+	delete(m.state.accessTokens, id)
+
+	return nil
+}
+
+// InsertOAuthClient registers an OAuth client and returns its id.
+func (m *MemoryDBRepo) InsertOAuthClient(ctx context.Context, c data.OAuthClient) (int, error) {
+	defer m.lock(true)()
+
+	if _, ok := m.state.users[c.OwnerID]; !ok {
+		return 0, fmt.Errorf("%w: user %d does not exist", repository.ErrConflict, c.OwnerID)
+	}
+
+	if _, ok := m.state.oauthClients[c.ClientID]; ok {
+		return 0, fmt.Errorf("%w: client id %s", repository.ErrDuplicate, c.ClientID)
+	}
+
+	c = *copyOAuthClient(c)
+	c.ID = m.state.nextClientID
+	c.CreatedAt = time.Now()
+
+	m.state.oauthClients[c.ClientID] = c
+	m.state.nextClientID++
+
+	return c.ID, nil
+}
+
+// GetOAuthClient returns the OAuth client with the given client id.
+func (m *MemoryDBRepo) GetOAuthClient(ctx context.Context, clientID string) (*data.OAuthClient, error) {
+	defer m.lock(false)()
+
+	c, ok := m.state.oauthClients[clientID]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+
+	return copyOAuthClient(c), nil
+}
+
+// AllOAuthClients returns every OAuth client, oldest first.
+func (m *MemoryDBRepo) AllOAuthClients(ctx context.Context) ([]*data.OAuthClient, error) {
+	defer m.lock(false)()
+
+	var clients []*data.OAuthClient
+	for _, c := range m.state.oauthClients {
+		clients = append(clients, copyOAuthClient(c))
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ID < clients[j].ID
+	})
+
+	return clients, nil
+}
+
+// DeleteOAuthClient deletes an OAuth client, with its codes and consents.
+func (m *MemoryDBRepo) DeleteOAuthClient(ctx context.Context, clientID string) error {
+	defer m.lock(true)()
+
+	if _, ok := m.state.oauthClients[clientID]; !ok {
+		return repository.ErrNotFound
+	}
+
+	m.state.deleteOAuthClient(clientID)
+
+	return nil
+}
+
+// InsertOAuthCode stores an authorization code, and clears out codes that have
+// already expired.
+func (m *MemoryDBRepo) InsertOAuthCode(ctx context.Context, c data.OAuthCode) error {
+	defer m.lock(true)()
+
+	if _, ok := m.state.oauthClients[c.ClientID]; !ok {
+		return fmt.Errorf("%w: client %s does not exist", repository.ErrConflict, c.ClientID)
+	}
+
+	if _, ok := m.state.users[c.UserID]; !ok {
+		return fmt.Errorf("%w: user %d does not exist", repository.ErrConflict, c.UserID)
+	}
+
+	if _, ok := m.state.oauthCodes[c.CodeHash]; ok {
+		return fmt.Errorf("%w: authorization code", repository.ErrDuplicate)
+	}
+
+	for hash, existing := range m.state.oauthCodes {
+		if !existing.ExpiresAt.After(time.Now()) {
+			delete(m.state.oauthCodes, hash)
+		}
+	}
+
+	c.Scopes = append([]string(nil), c.Scopes...)
+	m.state.oauthCodes[c.CodeHash] = c
+
+	return nil
+}
+
+// ConsumeOAuthCode deletes an authorization code and returns it, unless it has
+// expired.
+func (m *MemoryDBRepo) ConsumeOAuthCode(ctx context.Context, codeHash string) (*data.OAuthCode, error) {
+	defer m.lock(true)()
+
+	c, ok := m.state.oauthCodes[codeHash]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+
+	delete(m.state.oauthCodes, codeHash)
+
+	if !c.ExpiresAt.After(time.Now()) {
+		return nil, repository.ErrNotFound
+	}
+
+	c.Scopes = append([]string(nil), c.Scopes...)
+	return &c, nil
+}
+
+// OAuthConsent returns the scopes the user has agreed to give the client.
+func (m *MemoryDBRepo) OAuthConsent(ctx context.Context, userID int, clientID string) ([]string, error) {
+	defer m.lock(false)()
+
+	scopes, ok := m.state.consents[memoryConsentKey{userID, clientID}]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+
+	return append([]string(nil), scopes...), nil
+}
+
+// SaveOAuthConsent records the scopes the user has agreed to give the client.
+func (m *MemoryDBRepo) SaveOAuthConsent(ctx context.Context, userID int, clientID string, scopes []string) error {
+	defer m.lock(true)()
+
+	if _, ok := m.state.oauthClients[clientID]; !ok {
+		return fmt.Errorf("%w: client %s does not exist", repository.ErrConflict, clientID)
+	}
+
+	if _, ok := m.state.users[userID]; !ok {
+		return fmt.Errorf("%w: user %d does not exist", repository.ErrConflict, userID)
+	}
+
+	m.state.consents[memoryConsentKey{userID, clientID}] = append([]string(nil), scopes...)
+
+	return nil
+}
+
+// RevokeTokenID records that the JWT with the given id must no longer be
+// accepted, and forgets revocations of tokens that have expired.
+func (m *MemoryDBRepo) RevokeTokenID(ctx context.Context, id string, expiresAt time.Time) error {
+	defer m.lock(true)()
+
+	now := time.Now()
+	for revokedID, revokedExpiry := range m.state.revoked {
+		if !revokedExpiry.After(now) {
+			delete(m.state.revoked, revokedID)
+		}
+	}
+
+	if _, ok := m.state.revoked[id]; !ok {
+		m.state.revoked[id] = expiresAt
+	}
+
+	return nil
+}
+
+// TokenIDRevoked reports whether the JWT with the given id has been revoked.
+func (m *MemoryDBRepo) TokenIDRevoked(ctx context.Context, id string) (bool, error) {
+	defer m.lock(false)()
+
+	_, ok := m.state.revoked[id]
+	return ok, nil
+}
+
+// InsertSession stores a new session, seen now, and returns its id. The user's
+// expired sessions are deleted.
+func (m *MemoryDBRepo) InsertSession(ctx context.Context, s data.Session) (int, error) {
+	defer m.lock(true)()
+
+	if _, ok := m.state.users[s.UserID]; !ok {
+		return 0, fmt.Errorf("%w: user %d does not exist", repository.ErrConflict, s.UserID)
+	}
+
+	now := time.Now()
+	for id, existing := range m.state.sessions {
+		if existing.UserID == s.UserID && existing.Expired(now) {
+			delete(m.state.sessions, id)
+		}
+	}
+
+	s.ID = m.state.nextSessionID
+	s.CreatedAt = now
+	s.LastSeenAt = now
+
+	m.state.sessions[s.ID] = s
+	m.state.nextSessionID++
+
+	return s.ID, nil
+}
+
+// GetSession returns the session with the given id.
+func (m *MemoryDBRepo) GetSession(ctx context.Context, id int) (*data.Session, error) {
+	defer m.lock(false)()
+
+	s, ok := m.state.sessions[id]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+
+	return &s, nil
+}
+
+// AllSessions returns the user's unexpired sessions, oldest first.
+func (m *MemoryDBRepo) AllSessions(ctx context.Context, userID int) ([]*data.Session, error) {
+	defer m.lock(false)()
+
+	now := time.Now()
+	var sessions []*data.Session
+	for _, s := range m.state.sessions {
+		if s.UserID == userID && !s.Expired(now) {
+			s := s
+			sessions = append(sessions, &s)
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID < sessions[j].ID
+	})
+
+	return sessions, nil
+}
+
+// UpdateSession stores the device, IP address, user agent, last seen and expiry
+// times of a session.
+func (m *MemoryDBRepo) UpdateSession(ctx context.Context, s data.Session) error {
+	defer m.lock(true)()
+
+	existing, ok := m.state.sessions[s.ID]
+	if !ok {
+		return repository.ErrNotFound
+	}
+
+	existing.Device = s.Device
+	existing.IP = s.IP
+	existing.UserAgent = s.UserAgent
+	existing.LastSeenAt = s.LastSeenAt
+	existing.ExpiresAt = s.ExpiresAt
+	m.state.sessions[s.ID] = existing
+
+	return nil
+}
+
+// DeleteSession logs one of the user's sessions out.
+func (m *MemoryDBRepo) DeleteSession(ctx context.Context, userID, id int) error {
+	defer m.lock(true)()
+
+	s, ok := m.state.sessions[id]
+	if !ok || s.UserID != userID {
+		return repository.ErrNotFound
+	}
+
+	delete(m.state.sessions, id)
+
+	return nil
+}
+
+// DeleteOtherSessions logs out every session of the user except keepID.
+func (m *MemoryDBRepo) DeleteOtherSessions(ctx context.Context, userID, keepID int) error {
+	defer m.lock(true)()
+
+	m.state.deleteSessions(userID, keepID)
+
+	return nil
+}
+
+// copyOAuthClient returns a copy of c that shares nothing with it.
+func copyOAuthClient(c data.OAuthClient) *data.OAuthClient {
+	c.RedirectURIs = append([]string(nil), c.RedirectURIs...)
+	c.GrantTypes = append([]string(nil), c.GrantTypes...)
+	c.Scopes = append([]string(nil), c.Scopes...)
+	return &c
+}
+
+// copyAccessToken returns a copy of t that shares nothing with it.
+func copyAccessToken(t data.AccessToken) *data.AccessToken {
+	t.Scopes = append([]string(nil), t.Scopes...)
+	if t.ExpiresAt != nil {
+		expiresAt := *t.ExpiresAt
+		t.ExpiresAt = &expiresAt
+	}
+	if t.LastUsedAt != nil {
+		lastUsedAt := *t.LastUsedAt
+		t.LastUsedAt = &lastUsedAt
+	}
+	return &t
+}
+
+// deleteTokens deletes every token in tokens belonging to userID.
+func deleteTokens(tokens map[string]memoryToken, userID int) {
+	for hash, t := range tokens {
+		if t.userID == userID {
+			delete(tokens, hash)
+		}
+	}
+}
+
+// deleteOAuthClient deletes a client along with its codes and consents.
+func (s *memoryState) deleteOAuthClient(clientID string) {
+	delete(s.oauthClients, clientID)
+	for hash, c := range s.oauthCodes {
+		if c.ClientID == clientID {
+			delete(s.oauthCodes, hash)
+		}
+	}
+	for key := range s.consents {
+		if key.clientID == clientID {
+			delete(s.consents, key)
+		}
+	}
+}
+
+// deleteSessions deletes every session of userID, except keepID.
+func (s *memoryState) deleteSessions(userID, keepID int) {
+	for id, session := range s.sessions {
+		if session.UserID == userID && id != keepID {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// emailTaken reports whether a user other than exceptID already uses email.
+func (s *memoryState) emailTaken(email string, exceptID int) bool {
+	email = data.NormalizeEmail(email)
+	for _, u := range s.users {
+		if u.ID != exceptID && u.Email == email {
+			return true
+		}
+	}
+
+	return false
+}
+
+// imageFor returns the user's current profile image, or an empty one.
+func (s *memoryState) imageFor(userID int) data.UserImage {
+	for _, i := range s.images {
+		if i.UserID == userID && i.IsCurrent {
+			return i
+		}
+	}
+
+	return data.UserImage{}
+}
+
+// clearCurrentImage makes the user's current profile image a past one, and
+// reports whether they had one.
+func (s *memoryState) clearCurrentImage(userID int) bool {
+	for id, i := range s.images {
+		if i.UserID == userID && i.IsCurrent {
+			i.IsCurrent = false
+			i.UpdatedAt = time.Now()
+			s.images[id] = i
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *memoryState) clone() *memoryState {
+	c := &memoryState{
+		users:         make(map[int]data.User, len(s.users)),
+		images:        make(map[int]data.UserImage, len(s.images)),
+		history:       make(map[int][]string, len(s.history)),
+		resetTokens:   make(map[string]memoryToken, len(s.resetTokens)),
+		verifyTokens:  make(map[string]memoryToken, len(s.verifyTokens)),
+		totpSteps:     make(map[int]int64, len(s.totpSteps)),
+		recovery:      make(map[int]map[string]struct{}, len(s.recovery)),
+		accessTokens:  make(map[int]data.AccessToken, len(s.accessTokens)),
+		oauthClients:  make(map[string]data.OAuthClient, len(s.oauthClients)),
+		oauthCodes:    make(map[string]data.OAuthCode, len(s.oauthCodes)),
+		consents:      make(map[memoryConsentKey][]string, len(s.consents)),
+		revoked:       make(map[string]time.Time, len(s.revoked)),
+		sessions:      make(map[int]data.Session, len(s.sessions)),
+		nextUserID:    s.nextUserID,
+		nextImageID:   s.nextImageID,
+		nextTokenID:   s.nextTokenID,
+		nextClientID:  s.nextClientID,
+		nextSessionID: s.nextSessionID,
+	}
+
+	for id, u := range s.users {
+		c.users[id] = u
+	}
+
+	for id, i := range s.images {
+		c.images[id] = i
+	}
+
+	for id, h := range s.history {
+		c.history[id] = append([]string(nil), h...)
+	}
+
+	for hash, t := range s.resetTokens {
+		c.resetTokens[hash] = t
+	}
+
+	for hash, t := range s.verifyTokens {
+		c.verifyTokens[hash] = t
+	}
+
+	for id, step := range s.totpSteps {
+		c.totpSteps[id] = step
+	}
+
+	for id, codes := range s.recovery {
+		c.recovery[id] = make(map[string]struct{}, len(codes))
+		for hash := range codes {
+			c.recovery[id][hash] = struct{}{}
+		}
+	}
+
+	// stored tokens, clients, codes, consents and sessions are never changed in place, so
+	// sharing them is safe
+	for id, t := range s.accessTokens {
+		c.accessTokens[id] = t
+	}
+
+	for id, client := range s.oauthClients {
+		c.oauthClients[id] = client
+	}
+
+	for hash, code := range s.oauthCodes {
+		c.oauthCodes[hash] = code
+	}
+
+	for key, scopes := range s.consents {
+		c.consents[key] = scopes
+	}
+
+	for id, expiresAt := range s.revoked {
+		c.revoked[id] = expiresAt
+	}
+
+	for id, session := range s.sessions {
+		c.sessions[id] = session
+	}
+
+	return c
+}
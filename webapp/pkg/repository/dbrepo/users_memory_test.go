@@ -0,0 +1,170 @@
+package dbrepo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository/repotest"
+	"sync"
+	"testing"
+)
+
+func TestMemoryDBRepo_Seed(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryDBRepo()
+
+	if err := repo.Seed(DefaultFixtures()); err != nil {
+		t.Fatalf("Seed() returned an error: %s", err)
+	}
+
+	user, err := repo.GetUserByEmail(ctx, "admin@example.com")
+	if err != nil {
+		t.Fatalf("GetUserByEmail() returned an error: %s", err)
+	}
+
+	if matches, _ := user.PasswordMatches("secret"); !matches {
+		t.Error("seeded admin password should match 'secret' but does not")
+	}
+
+	id, _ := repo.InsertUser(ctx, data.User{Email: "jack@smith.com", Password: "secret"})
+	if id != 2 {
+		t.Errorf("expected the first inserted user after seeding to get id 2, but got %d", id)
+	}
+
+	if err := repo.Seed(DefaultFixtures()); !errors.Is(err, repository.ErrDuplicate) {
+		t.Errorf("seeding the same user twice should return ErrDuplicate, got %v", err)
+	}
+
+	err = repo.Seed(Fixtures{Images: []data.UserImage{{UserID: 100, FileName: "x.jpg"}}})
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("seeding an image for a missing user should return ErrConflict, got %v", err)
+	}
+}
+
+func TestMemoryDBRepo_Constraints(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryDBRepo()
+	if err := repo.Seed(DefaultFixtures()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := repo.InsertUser(ctx, data.User{Email: "ADMIN@example.com"}); !errors.Is(err, repository.ErrDuplicate) {
+		t.Errorf("InsertUser() with an existing email should return ErrDuplicate, got %v", err)
+	}
+
+	id, _ := repo.InsertUser(ctx, data.User{Email: "jack@smith.com"})
+	jack, _ := repo.GetUser(ctx, id)
+	jack.Email = "Admin@Example.com"
+	if err := repo.UpdateUser(ctx, *jack); !errors.Is(err, repository.ErrDuplicate) {
+		t.Errorf("UpdateUser() to an existing email should return ErrDuplicate, got %v", err)
+	}
+
+	if err := repo.UpdateUser(ctx, data.User{ID: 100}); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("UpdateUser() for a missing user should return ErrNotFound, got %v", err)
+	}
+
+	if err := repo.ResetPassword(ctx, 100, "secret"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("ResetPassword() for a missing user should return ErrNotFound, got %v", err)
+	}
+
+	if _, err := repo.InsertUserImage(ctx, data.UserImage{UserID: 100}); !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("InsertUserImage() for a missing user should return ErrConflict, got %v", err)
+	}
+
+	_, _ = repo.InsertUserImage(ctx, data.UserImage{UserID: id, FileName: "first.jpg"})
+	_, _ = repo.InsertUserImage(ctx, data.UserImage{UserID: id, FileName: "second.jpg"})
+
+	jack, _ = repo.GetUser(ctx, id)
+	if jack.ProfilePic.FileName != "second.jpg" {
+		t.Errorf("expected the newest image second.jpg to replace the old one, but got %s", jack.ProfilePic.FileName)
+	}
+
+	if err := repo.DeleteUser(ctx, id); err != nil {
+		t.Errorf("DeleteUser() returned an error: %s", err)
+	}
+
+	if len(repo.state.images) != 0 {
+		t.Errorf("expected deleting a user to delete their images, but %d remain", len(repo.state.images))
+	}
+
+	if err := repo.DeleteUser(ctx, id); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("DeleteUser() for a missing user should return ErrNotFound, got %v", err)
+	}
+}
+
+func TestMemoryDBRepo_WithTx(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryDBRepo()
+
+	err := repo.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		_, _ = repo.InsertUser(ctx, data.User{Email: "tx@example.com"})
+		return errors.New("abort")
+	})
+	if err == nil {
+		t.Error("WithTx() should return the callback error")
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("WithTx() swallowed a panic")
+			}
+		}()
+
+		_ = repo.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+			_, _ = repo.InsertUser(ctx, data.User{Email: "tx@example.com"})
+			panic("boom")
+		})
+	}()
+
+	users, _ := repo.AllUsers(ctx)
+	if len(users) != 0 {
+		t.Errorf("expected rolled back transactions to leave no users, but found %d", len(users))
+	}
+
+	err = repo.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		_, err := repo.InsertUser(ctx, data.User{Email: "tx@example.com"})
+		return err
+	})
+	if err != nil {
+		t.Errorf("WithTx() returned an error: %s", err)
+	}
+
+	if _, err := repo.GetUserByEmail(ctx, "tx@example.com"); err != nil {
+		t.Errorf("user inserted in a committed transaction should exist, got %v", err)
+	}
+}
+
+func TestMemoryDBRepo_Concurrent(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryDBRepo()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id, err := repo.InsertUser(ctx, data.User{Email: fmt.Sprintf("user%d@example.com", i)})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_, _ = repo.GetUser(ctx, id)
+			_, _ = repo.AllUsers(ctx)
+		}(i)
+	}
+	wg.Wait()
+
+	users, _ := repo.AllUsers(ctx)
+	if len(users) != 10 {
+		t.Errorf("expected 10 users after concurrent inserts, but got %d", len(users))
+	}
+}
+
+func TestMemoryDBRepo_Conformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) repository.DataBaseRepo {
+		return NewMemoryDBRepo()
+	})
+}
@@ -3,16 +3,28 @@ package dbrepo
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"github.com/spacesedan/testing-course/webapp/pkg/data"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
 	"log"
+	"strings"
 	"time"
 )
 
-const dbTimeout = time.Second * 3
-
 type PostgresDBRepo struct {
-	DB *sql.DB
+	DB       *sql.DB
+	Timeouts Timeouts
+
+	// Hasher hashes new passwords; nil means data.DefaultPasswordHasher.
+	Hasher data.PasswordHasher
+
+	// HistoryLimit is how many of a user's previous passwords ResetPassword
+	// keeps; 0 means repository.DefaultHistoryLimit. A password policy looks at
+	// its History-1 most recent ones.
+	HistoryLimit int
+
+	// tx is set on the copy of the repository handed to WithTx callbacks.
+	tx *sql.Tx
 }
 
 func (m *PostgresDBRepo) Connection() *sql.DB {
@@ -20,16 +32,22 @@ func (m *PostgresDBRepo) Connection() *sql.DB {
 }
 
 // AllUsers returns all users as a slice of *data.User
-func (m *PostgresDBRepo) AllUsers() ([]*data.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (m *PostgresDBRepo) AllUsers(ctx context.Context) ([]*data.User, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "AllUsers")
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, is_admin, created_at, updated_at
-	from users order by last_name`
+	query := `
+		select
+			u.id, u.email, u.first_name, u.last_name, u.password, u.is_admin, u.created_at, u.updated_at,
+			coalesce(ui.file_name, '')
+		from
+			users u
+			left join user_images ui on (ui.user_id = u.id and ui.is_current)
+		order by u.last_name`
 
-	rows, err := m.DB.QueryContext(ctx, query)
+	rows, err := m.conn().QueryContext(ctx, query)
 	if err != nil {
-		return nil, err
+		return nil, translateError(err)
 	}
 	defer rows.Close()
 
@@ -46,6 +64,7 @@ func (m *PostgresDBRepo) AllUsers() ([]*data.User, error) {
 			&user.IsAdmin,
 			&user.CreatedAt,
 			&user.UpdatedAt,
+			&user.ProfilePic.FileName,
 		)
 		if err != nil {
 			log.Println("Error scanning", err)
@@ -55,26 +74,32 @@ func (m *PostgresDBRepo) AllUsers() ([]*data.User, error) {
 		users = append(users, &user)
 	}
 
+	if err := rows.Err(); err != nil {
+		return nil, translateError(err)
+	}
+
 	return users, nil
 }
 
 // GetUser returns one user by id
-func (m *PostgresDBRepo) GetUser(id int) (*data.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (m *PostgresDBRepo) GetUser(ctx context.Context, id int) (*data.User, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "GetUser")
 	defer cancel()
 
 	query := `
 		select 
 			u.id, u.email, u.first_name, u.last_name, u.password, u.is_admin, u.created_at, u.updated_at,
+			u.sessions_revoked_at, u.email_verified_at, coalesce(u.totp_secret, ''), u.totp_enabled_at,
 			coalesce(ui.file_name, '')
 		from 
 			users u
-			left join user_images ui on (ui.user_id = u.id)
+			left join user_images ui on (ui.user_id = u.id and ui.is_current)
 		where 
 		    u.id = $1`
 
 	var user data.User
-	row := m.DB.QueryRowContext(ctx, query, id)
+	var sessionsRevokedAt, emailVerifiedAt, totpEnabledAt sql.NullTime
+	row := m.conn().QueryRowContext(ctx, query, id)
 
 	err := row.Scan(
 		&user.ID,
@@ -85,33 +110,43 @@ func (m *PostgresDBRepo) GetUser(id int) (*data.User, error) {
 		&user.IsAdmin,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&sessionsRevokedAt,
+		&emailVerifiedAt,
+		&user.TOTPSecret,
+		&totpEnabledAt,
 		&user.ProfilePic.FileName,
 	)
 
 	if err != nil {
-		return nil, err
+		return nil, translateError(err)
 	}
 
+	user.SessionsRevokedAt = sessionsRevokedAt.Time
+	user.EmailVerifiedAt = emailVerifiedAt.Time
+	user.TOTPEnabledAt = totpEnabledAt.Time
+
 	return &user, nil
 }
 
 // GetUserByEmail returns one user by email address
-func (m *PostgresDBRepo) GetUserByEmail(email string) (*data.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (m *PostgresDBRepo) GetUserByEmail(ctx context.Context, email string) (*data.User, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "GetUserByEmail")
 	defer cancel()
 
 	query := `
 		select 
 			u.id, u.email, u.first_name, u.last_name, u.password, u.is_admin, u.created_at, u.updated_at,
+			u.sessions_revoked_at, u.email_verified_at, coalesce(u.totp_secret, ''), u.totp_enabled_at,
 			coalesce(ui.file_name, '')
 		from 
 			users u
-			left join user_images ui on (ui.user_id = u.id)
+			left join user_images ui on (ui.user_id = u.id and ui.is_current)
 		where 
-		    u.email = $1`
+		    lower(u.email) = $1`
 
 	var user data.User
-	row := m.DB.QueryRowContext(ctx, query, email)
+	var sessionsRevokedAt, emailVerifiedAt, totpEnabledAt sql.NullTime
+	row := m.conn().QueryRowContext(ctx, query, data.NormalizeEmail(email))
 
 	err := row.Scan(
 		&user.ID,
@@ -122,19 +157,27 @@ func (m *PostgresDBRepo) GetUserByEmail(email string) (*data.User, error) {
 		&user.IsAdmin,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&sessionsRevokedAt,
+		&emailVerifiedAt,
+		&user.TOTPSecret,
+		&totpEnabledAt,
 		&user.ProfilePic.FileName,
 	)
 
 	if err != nil {
-		return nil, err
+		return nil, translateError(err)
 	}
 
+	user.SessionsRevokedAt = sessionsRevokedAt.Time
+	user.EmailVerifiedAt = emailVerifiedAt.Time
+	user.TOTPEnabledAt = totpEnabledAt.Time
+
 	return &user, nil
 }
 
 // UpdateUser updates one user in the database
-func (m *PostgresDBRepo) UpdateUser(u data.User) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (m *PostgresDBRepo) UpdateUser(ctx context.Context, u data.User) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "UpdateUser")
 	defer cancel()
 
 	stmt := `update users set
@@ -146,8 +189,8 @@ func (m *PostgresDBRepo) UpdateUser(u data.User) error {
 		where id = $6
 	`
 
-	_, err := m.DB.ExecContext(ctx, stmt,
-		u.Email,
+	result, err := m.conn().ExecContext(ctx, stmt,
+		data.NormalizeEmail(u.Email),
 		u.FirstName,
 		u.LastName,
 		u.IsAdmin,
@@ -156,102 +199,993 @@ func (m *PostgresDBRepo) UpdateUser(u data.User) error {
 	)
 
 	if err != nil {
-		return err
+		return translateError(err)
 	}
 
-	return nil
+	return checkRowsAffected(result)
 }
 
 // DeleteUser deletes one user from the database, by id
-func (m *PostgresDBRepo) DeleteUser(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (m *PostgresDBRepo) DeleteUser(ctx context.Context, id int) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "DeleteUser")
 	defer cancel()
 
 	stmt := `delete from users where id = $1`
 
-	_, err := m.DB.ExecContext(ctx, stmt, id)
+	result, err := m.conn().ExecContext(ctx, stmt, id)
 	if err != nil {
-		return err
+		return translateError(err)
 	}
 
-	return nil
+	return checkRowsAffected(result)
 }
 
 // InsertUser inserts a new user into the database, and returns the ID of the newly inserted row
-func (m *PostgresDBRepo) InsertUser(user data.User) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (m *PostgresDBRepo) InsertUser(ctx context.Context, user data.User) (int, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "InsertUser")
 	defer cancel()
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
+	hashedPassword, err := hashPassword(m.Hasher, user.Password)
 	if err != nil {
 		return 0, err
 	}
 
 	var newID int
-	stmt := `insert into users (email, first_name, last_name, password, is_admin, created_at, updated_at)
-		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+	stmt := `insert into users (email, first_name, last_name, password, is_admin, created_at, updated_at, email_verified_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
 
-	err = m.DB.QueryRowContext(ctx, stmt,
-		user.Email,
+	err = m.conn().QueryRowContext(ctx, stmt,
+		data.NormalizeEmail(user.Email),
 		user.FirstName,
 		user.LastName,
 		hashedPassword,
 		user.IsAdmin,
 		time.Now(),
 		time.Now(),
+		sql.NullTime{Time: user.EmailVerifiedAt, Valid: user.EmailVerified()},
 	).Scan(&newID)
 
 	if err != nil {
-		return 0, err
+		return 0, translateError(err)
 	}
 
 	return newID, nil
 }
 
 // ResetPassword is the method we will use to change a user's password.
-func (m *PostgresDBRepo) ResetPassword(id int, password string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (m *PostgresDBRepo) ResetPassword(ctx context.Context, id int, password string) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "ResetPassword")
 	defer cancel()
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	hashedPassword, err := hashPassword(m.Hasher, password)
 	if err != nil {
 		return err
 	}
 
-	stmt := `update users set password = $1 where id = $2`
-	_, err = m.DB.ExecContext(ctx, stmt, hashedPassword, id)
+	return m.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		tx := repo.(*PostgresDBRepo).conn()
+
+		// keep the password being replaced, so it can't be reused
+		stmt := `insert into password_history (user_id, password, created_at)
+			select id, password, $2::timestamp from users where id = $1`
+		_, err := tx.ExecContext(ctx, stmt, id, time.Now())
+		if err != nil {
+			return translateError(err)
+		}
+
+		// and forget the ones too old for anyone to look at
+		stmt = `delete from password_history where user_id = $1 and id not in (
+			select id from password_history where user_id = $1 order by id desc limit $2)`
+		_, err = tx.ExecContext(ctx, stmt, id, historyLimit(m.HistoryLimit))
+		if err != nil {
+			return translateError(err)
+		}
+
+		stmt = `update users set password = $1 where id = $2`
+		result, err := tx.ExecContext(ctx, stmt, hashedPassword, id)
+		if err != nil {
+			return translateError(err)
+		}
+
+		return checkRowsAffected(result)
+	})
+}
+
+// UpdatePasswordHash replaces the hash of a user's password, such as one made
+// with outdated settings, without adding to their password history.
+func (m *PostgresDBRepo) UpdatePasswordHash(ctx context.Context, id int, password string) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "UpdatePasswordHash")
+	defer cancel()
+
+	hashedPassword, err := hashPassword(m.Hasher, password)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	stmt := `update users set password = $1 where id = $2`
+	result, err := m.conn().ExecContext(ctx, stmt, hashedPassword, id)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return checkRowsAffected(result)
 }
 
-// InsertUserImage inserts a user profile image into the database.
-func (m *PostgresDBRepo) InsertUserImage(i data.UserImage) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// PasswordHistory returns the hashes of up to limit passwords the user had before
+// their current one, newest first.
+func (m *PostgresDBRepo) PasswordHistory(ctx context.Context, id int, limit int) ([]string, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "PasswordHistory")
 	defer cancel()
 
-	stmt := `delete from user_images where user_id = $1`
-	_, err := m.DB.ExecContext(ctx, stmt, i.UserID)
+	if limit < 1 {
+		return nil, nil
+	}
+
+	query := `select password from password_history where user_id = $1 order by id desc limit $2`
+
+	rows, err := m.conn().QueryContext(ctx, query, id, limit)
 	if err != nil {
-		return 0, err
+		return nil, translateError(err)
 	}
+	defer rows.Close()
+
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, translateError(err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, translateError(err)
+	}
+
+	return hashes, nil
+}
+
+// InsertUserImage inserts a user profile image into the database, and makes it
+// the user's current one.
+func (m *PostgresDBRepo) InsertUserImage(ctx context.Context, i data.UserImage) (int, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "InsertUserImage")
+	defer cancel()
 
 	var newID int
-	stmt = `insert into user_images (user_id, file_name, created_at, updated_at)
-		values ($1, $2, $3, $4) returning id`
+	err := m.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		tx := repo.(*PostgresDBRepo).conn()
+
+		stmt := `update user_images set is_current = false, updated_at = $1 where user_id = $2 and is_current`
+		_, err := tx.ExecContext(ctx, stmt, time.Now(), i.UserID)
+		if err != nil {
+			return translateError(err)
+		}
+
+		stmt = `insert into user_images (user_id, file_name, is_current, created_at, updated_at)
+			values ($1, $2, true, $3, $4) returning id`
+
+		err = tx.QueryRowContext(ctx, stmt,
+			i.UserID,
+			i.FileName,
+			time.Now(),
+			time.Now(),
+		).Scan(&newID)
+
+		return translateError(err)
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// AllUserImages returns the user's profile images, newest first.
+func (m *PostgresDBRepo) AllUserImages(ctx context.Context, userID int) ([]*data.UserImage, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "AllUserImages")
+	defer cancel()
+
+	query := `select ` + userImageColumns + ` from user_images where user_id = $1 order by created_at desc, id desc`
+
+	rows, err := m.conn().QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	defer rows.Close()
+
+	var images []*data.UserImage
+	for rows.Next() {
+		var i data.UserImage
+		if err := rows.Scan(userImageDest(&i)...); err != nil {
+			return nil, translateError(err)
+		}
+		images = append(images, &i)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, translateError(err)
+	}
+
+	return images, nil
+}
+
+// SetCurrentUserImage makes one of the user's profile images their current one.
+func (m *PostgresDBRepo) SetCurrentUserImage(ctx context.Context, userID, id int) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "SetCurrentUserImage")
+	defer cancel()
+
+	return m.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		tx := repo.(*PostgresDBRepo).conn()
+
+		var exists int
+		query := `select 1 from user_images where id = $1 and user_id = $2`
+		err := tx.QueryRowContext(ctx, query, id, userID).Scan(&exists)
+		if err != nil {
+			return translateError(err)
+		}
+
+		// the old one goes first, so the user never has two
+		stmt := `update user_images set is_current = false, updated_at = $1 where user_id = $2 and is_current`
+		_, err = tx.ExecContext(ctx, stmt, time.Now(), userID)
+		if err != nil {
+			return translateError(err)
+		}
+
+		stmt = `update user_images set is_current = true, updated_at = $1 where id = $2`
+		_, err = tx.ExecContext(ctx, stmt, time.Now(), id)
+
+		return translateError(err)
+	})
+}
+
+// ClearCurrentUserImage leaves the user without a current profile image.
+func (m *PostgresDBRepo) ClearCurrentUserImage(ctx context.Context, userID int) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "ClearCurrentUserImage")
+	defer cancel()
+
+	stmt := `update user_images set is_current = false, updated_at = $1 where user_id = $2 and is_current`
+
+	result, err := m.conn().ExecContext(ctx, stmt, time.Now(), userID)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// DeleteUserImage deletes one of the user's profile images.
+func (m *PostgresDBRepo) DeleteUserImage(ctx context.Context, userID, id int) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "DeleteUserImage")
+	defer cancel()
+
+	stmt := `delete from user_images where id = $1 and user_id = $2`
+
+	result, err := m.conn().ExecContext(ctx, stmt, id, userID)
+	if err != nil {
+		return translateError(err)
+	}
 
-	err = m.DB.QueryRowContext(ctx, stmt,
-		i.UserID,
-		i.FileName,
+	return checkRowsAffected(result)
+}
+
+// UserImageFileNames returns the file names of every profile image.
+func (m *PostgresDBRepo) UserImageFileNames(ctx context.Context) ([]string, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "UserImageFileNames")
+	defer cancel()
+
+	rows, err := m.conn().QueryContext(ctx, `select distinct file_name from user_images where file_name is not null`)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, translateError(err)
+		}
+		names = append(names, name)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, translateError(err)
+	}
+
+	return names, nil
+}
+
+// RevokeSessions sets the user's SessionsRevokedAt to now, and deletes their
+// sessions.
+func (m *PostgresDBRepo) RevokeSessions(ctx context.Context, id int) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "RevokeSessions")
+	defer cancel()
+
+	return m.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		tx := repo.(*PostgresDBRepo).conn()
+
+		stmt := `update users set sessions_revoked_at = $1 where id = $2`
+		result, err := tx.ExecContext(ctx, stmt, time.Now(), id)
+		if err != nil {
+			return translateError(err)
+		}
+
+		if err := checkRowsAffected(result); err != nil {
+			return err
+		}
+
+		stmt = `delete from sessions where user_id = $1`
+		_, err = tx.ExecContext(ctx, stmt, id)
+
+		return translateError(err)
+	})
+}
+
+// InsertPasswordResetToken stores the hash of a password reset token for the user,
+// and clears out any of their tokens that have already expired.
+func (m *PostgresDBRepo) InsertPasswordResetToken(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "InsertPasswordResetToken")
+	defer cancel()
+
+	return m.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		tx := repo.(*PostgresDBRepo).conn()
+
+		stmt := `delete from password_reset_tokens where user_id = $1 and expires_at <= $2`
+		_, err := tx.ExecContext(ctx, stmt, userID, time.Now())
+		if err != nil {
+			return translateError(err)
+		}
+
+		stmt = `insert into password_reset_tokens (user_id, token_hash, expires_at, created_at)
+			values ($1, $2, $3, $4)`
+		_, err = tx.ExecContext(ctx, stmt, userID, tokenHash, expiresAt, time.Now())
+
+		return translateError(err)
+	})
+}
+
+// ConsumePasswordResetToken returns the user an unexpired reset token belongs to,
+// and deletes all of that user's reset tokens.
+func (m *PostgresDBRepo) ConsumePasswordResetToken(ctx context.Context, tokenHash string) (int, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "ConsumePasswordResetToken")
+	defer cancel()
+
+	var userID int
+	err := m.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		tx := repo.(*PostgresDBRepo).conn()
+
+		// deleting the token claims it, so two concurrent resets can't both use it
+		stmt := `delete from password_reset_tokens where token_hash = $1 and expires_at > $2 returning user_id`
+		err := tx.QueryRowContext(ctx, stmt, tokenHash, time.Now()).Scan(&userID)
+		if err != nil {
+			return translateError(err)
+		}
+
+		stmt = `delete from password_reset_tokens where user_id = $1`
+		_, err = tx.ExecContext(ctx, stmt, userID)
+
+		return translateError(err)
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+// InsertEmailVerificationToken stores the hash of an email verification token for
+// the user, and clears out any of their tokens that have already expired.
+func (m *PostgresDBRepo) InsertEmailVerificationToken(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "InsertEmailVerificationToken")
+	defer cancel()
+
+	return m.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		tx := repo.(*PostgresDBRepo).conn()
+
+		stmt := `delete from email_verification_tokens where user_id = $1 and expires_at <= $2`
+		_, err := tx.ExecContext(ctx, stmt, userID, time.Now())
+		if err != nil {
+			return translateError(err)
+		}
+
+		stmt = `insert into email_verification_tokens (user_id, token_hash, expires_at, created_at)
+			values ($1, $2, $3, $4)`
+		_, err = tx.ExecContext(ctx, stmt, userID, tokenHash, expiresAt, time.Now())
+
+		return translateError(err)
+	})
+}
+
+// VerifyEmail marks the email address of the user an unexpired verification token
+// belongs to as verified, and deletes all of that user's verification tokens.
+func (m *PostgresDBRepo) VerifyEmail(ctx context.Context, tokenHash string) (int, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "VerifyEmail")
+	defer cancel()
+
+	var userID int
+	err := m.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		tx := repo.(*PostgresDBRepo).conn()
+
+		// deleting the token claims it, so it can only be used once
+		stmt := `delete from email_verification_tokens where token_hash = $1 and expires_at > $2 returning user_id`
+		err := tx.QueryRowContext(ctx, stmt, tokenHash, time.Now()).Scan(&userID)
+		if err != nil {
+			return translateError(err)
+		}
+
+		stmt = `delete from email_verification_tokens where user_id = $1`
+		_, err = tx.ExecContext(ctx, stmt, userID)
+		if err != nil {
+			return translateError(err)
+		}
+
+		stmt = `update users set email_verified_at = coalesce(email_verified_at, $2) where id = $1`
+		_, err = tx.ExecContext(ctx, stmt, userID, time.Now())
+
+		return translateError(err)
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+// SetTOTPSecret stores a new authenticator secret for the user, with two-factor
+// authentication off until it is confirmed.
+func (m *PostgresDBRepo) SetTOTPSecret(ctx context.Context, id int, secret string) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "SetTOTPSecret")
+	defer cancel()
+
+	stmt := `update users set totp_secret = $1, totp_enabled_at = null, totp_last_step = 0 where id = $2`
+	result, err := m.conn().ExecContext(ctx, stmt, secret, id)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// EnableTOTP turns on two-factor authentication for the user and replaces their
+// recovery codes.
+func (m *PostgresDBRepo) EnableTOTP(ctx context.Context, id int, recoveryCodeHashes []string) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "EnableTOTP")
+	defer cancel()
+
+	return m.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		tx := repo.(*PostgresDBRepo).conn()
+
+		stmt := `update users set totp_enabled_at = $1 where id = $2 and totp_secret is not null`
+		result, err := tx.ExecContext(ctx, stmt, time.Now(), id)
+		if err != nil {
+			return translateError(err)
+		}
+
+		if err := checkRowsAffected(result); err != nil {
+			return err
+		}
+
+		stmt = `delete from recovery_codes where user_id = $1`
+		_, err = tx.ExecContext(ctx, stmt, id)
+		if err != nil {
+			return translateError(err)
+		}
+
+		stmt = `insert into recovery_codes (user_id, code_hash, created_at) values ($1, $2, $3)`
+		for _, hash := range recoveryCodeHashes {
+			_, err = tx.ExecContext(ctx, stmt, id, hash, time.Now())
+			if err != nil {
+				return translateError(err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// DisableTOTP turns off two-factor authentication for the user, and deletes their
+// secret and recovery codes.
+func (m *PostgresDBRepo) DisableTOTP(ctx context.Context, id int) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "DisableTOTP")
+	defer cancel()
+
+	return m.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		tx := repo.(*PostgresDBRepo).conn()
+
+		stmt := `update users set totp_secret = null, totp_enabled_at = null, totp_last_step = 0 where id = $1`
+		result, err := tx.ExecContext(ctx, stmt, id)
+		if err != nil {
+			return translateError(err)
+		}
+
+		if err := checkRowsAffected(result); err != nil {
+			return err
+		}
+
+		stmt = `delete from recovery_codes where user_id = $1`
+		_, err = tx.ExecContext(ctx, stmt, id)
+
+		return translateError(err)
+	})
+}
+
+// UseTOTPStep records the time step of an accepted code, refusing steps that are
+// not later than the last one.
+func (m *PostgresDBRepo) UseTOTPStep(ctx context.Context, id int, step int64) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "UseTOTPStep")
+	defer cancel()
+
+	stmt := `update users set totp_last_step = $1 where id = $2 and totp_last_step < $3`
+	result, err := m.conn().ExecContext(ctx, stmt, step, id, step)
+	if err != nil {
+		return translateError(err)
+	}
+
+	if err := checkRowsAffected(result); err != nil {
+		// tell a missing user apart from a replayed code
+		if _, getErr := m.GetUser(ctx, id); getErr != nil {
+			return getErr
+		}
+		return fmt.Errorf("%w: code already used", repository.ErrConflict)
+	}
+
+	return nil
+}
+
+// UseRecoveryCode deletes one of the user's recovery codes.
+func (m *PostgresDBRepo) UseRecoveryCode(ctx context.Context, id int, codeHash string) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "UseRecoveryCode")
+	defer cancel()
+
+	stmt := `delete from recovery_codes where user_id = $1 and code_hash = $2`
+	result, err := m.conn().ExecContext(ctx, stmt, id, codeHash)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// InsertAccessToken stores a personal access token and returns its id.
+func (m *PostgresDBRepo) InsertAccessToken(ctx context.Context, t data.AccessToken) (int, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "InsertAccessToken")
+	defer cancel()
+
+	stmt := `insert into access_tokens (user_id, name, scopes, token_hash, expires_at, created_at)
+		values ($1, $2, $3, $4, $5, $6) returning id`
+
+	var newID int
+	err := m.conn().QueryRowContext(ctx, stmt,
+		t.UserID,
+		t.Name,
+		strings.Join(t.Scopes, " "),
+		t.TokenHash,
+		nullTime(t.ExpiresAt),
 		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, translateError(err)
+	}
+
+	return newID, nil
+}
+
+// GetAccessTokenByHash returns the access token with the given hash.
+func (m *PostgresDBRepo) GetAccessTokenByHash(ctx context.Context, tokenHash string) (*data.AccessToken, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "GetAccessTokenByHash")
+	defer cancel()
+
+	query := `select ` + accessTokenColumns + ` from access_tokens where token_hash = $1`
+
+	var row accessTokenRow
+	err := m.conn().QueryRowContext(ctx, query, tokenHash).Scan(row.dest()...)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	return row.accessToken(), nil
+}
+
+// AllAccessTokens returns the user's access tokens, oldest first.
+func (m *PostgresDBRepo) AllAccessTokens(ctx context.Context, userID int) ([]*data.AccessToken, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "AllAccessTokens")
+	defer cancel()
+
+	query := `select ` + accessTokenColumns + ` from access_tokens where user_id = $1 order by id`
+
+	rows, err := m.conn().QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	defer rows.Close()
+
+	var tokens []*data.AccessToken
+	for rows.Next() {
+		var row accessTokenRow
+		if err := rows.Scan(row.dest()...); err != nil {
+			return nil, translateError(err)
+		}
+		tokens = append(tokens, row.accessToken())
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, translateError(err)
+	}
+
+	return tokens, nil
+}
+
+// TouchAccessToken sets the time the access token was last used.
+func (m *PostgresDBRepo) TouchAccessToken(ctx context.Context, id int, usedAt time.Time) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "TouchAccessToken")
+	defer cancel()
+
+	stmt := `update access_tokens set last_used_at = $1 where id = $2`
+	result, err := m.conn().ExecContext(ctx, stmt, usedAt, id)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// DeleteAccessToken revokes one of the user's access tokens.
+func (m *PostgresDBRepo) DeleteAccessToken(ctx context.Context, userID, id int) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "DeleteAccessToken")
+	defer cancel()
+
+	stmt := `delete from access_tokens where id = $1 and user_id = $2`
+	result, err := m.conn().ExecContext(ctx, stmt, id, userID)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// InsertOAuthClient registers an OAuth client and returns its id.
+func (m *PostgresDBRepo) InsertOAuthClient(ctx context.Context, c data.OAuthClient) (int, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "InsertOAuthClient")
+	defer cancel()
+
+	stmt := `insert into oauth_clients (client_id, secret_hash, name, redirect_uris, grant_types, scopes, owner_id, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
+
+	var newID int
+	err := m.conn().QueryRowContext(ctx, stmt,
+		c.ClientID,
+		sql.NullString{String: c.SecretHash, Valid: c.SecretHash != ""},
+		c.Name,
+		strings.Join(c.RedirectURIs, " "),
+		strings.Join(c.GrantTypes, " "),
+		strings.Join(c.Scopes, " "),
+		c.OwnerID,
 		time.Now(),
 	).Scan(&newID)
+	if err != nil {
+		return 0, translateError(err)
+	}
+
+	return newID, nil
+}
+
+// GetOAuthClient returns the OAuth client with the given client id.
+func (m *PostgresDBRepo) GetOAuthClient(ctx context.Context, clientID string) (*data.OAuthClient, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "GetOAuthClient")
+	defer cancel()
+
+	query := `select ` + oauthClientColumns + ` from oauth_clients where client_id = $1`
+
+	var row oauthClientRow
+	err := m.conn().QueryRowContext(ctx, query, clientID).Scan(row.dest()...)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	return row.client(), nil
+}
+
+// AllOAuthClients returns every OAuth client, oldest first.
+func (m *PostgresDBRepo) AllOAuthClients(ctx context.Context) ([]*data.OAuthClient, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "AllOAuthClients")
+	defer cancel()
+
+	query := `select ` + oauthClientColumns + ` from oauth_clients order by id`
+
+	rows, err := m.conn().QueryContext(ctx, query)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	defer rows.Close()
+
+	var clients []*data.OAuthClient
+	for rows.Next() {
+		var row oauthClientRow
+		if err := rows.Scan(row.dest()...); err != nil {
+			return nil, translateError(err)
+		}
+		clients = append(clients, row.client())
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, translateError(err)
+	}
+
+	return clients, nil
+}
+
+// DeleteOAuthClient deletes an OAuth client; its codes and consents go with it.
+func (m *PostgresDBRepo) DeleteOAuthClient(ctx context.Context, clientID string) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "DeleteOAuthClient")
+	defer cancel()
+
+	stmt := `delete from oauth_clients where client_id = $1`
+	result, err := m.conn().ExecContext(ctx, stmt, clientID)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// InsertOAuthCode stores an authorization code, and clears out codes that have
+// already expired.
+func (m *PostgresDBRepo) InsertOAuthCode(ctx context.Context, c data.OAuthCode) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "InsertOAuthCode")
+	defer cancel()
+
+	return m.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		tx := repo.(*PostgresDBRepo).conn()
+
+		stmt := `delete from oauth_codes where expires_at <= $1`
+		_, err := tx.ExecContext(ctx, stmt, time.Now())
+		if err != nil {
+			return translateError(err)
+		}
+
+		stmt = `insert into oauth_codes (code_hash, client_id, user_id, redirect_uri, scopes, code_challenge, nonce, expires_at, created_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+		_, err = tx.ExecContext(ctx, stmt,
+			c.CodeHash,
+			c.ClientID,
+			c.UserID,
+			c.RedirectURI,
+			strings.Join(c.Scopes, " "),
+			c.CodeChallenge,
+			c.Nonce,
+			c.ExpiresAt,
+			time.Now(),
+		)
+
+		return translateError(err)
+	})
+}
 
+// ConsumeOAuthCode deletes an authorization code and returns it, unless it has
+// expired.
+func (m *PostgresDBRepo) ConsumeOAuthCode(ctx context.Context, codeHash string) (*data.OAuthCode, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "ConsumeOAuthCode")
+	defer cancel()
+
+	// deleting the code claims it, so two exchanges can't both use it
+	stmt := `delete from oauth_codes where code_hash = $1
+		returning client_id, user_id, redirect_uri, scopes, code_challenge, nonce, expires_at`
+
+	c := data.OAuthCode{CodeHash: codeHash}
+	var scopes string
+	err := m.conn().QueryRowContext(ctx, stmt, codeHash).Scan(
+		&c.ClientID,
+		&c.UserID,
+		&c.RedirectURI,
+		&scopes,
+		&c.CodeChallenge,
+		&c.Nonce,
+		&c.ExpiresAt,
+	)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	if !c.ExpiresAt.After(time.Now()) {
+		return nil, repository.ErrNotFound
+	}
+
+	c.Scopes = strings.Fields(scopes)
+	return &c, nil
+}
+
+// OAuthConsent returns the scopes the user has agreed to give the client.
+func (m *PostgresDBRepo) OAuthConsent(ctx context.Context, userID int, clientID string) ([]string, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "OAuthConsent")
+	defer cancel()
+
+	query := `select scopes from oauth_consents where user_id = $1 and client_id = $2`
+
+	var scopes string
+	err := m.conn().QueryRowContext(ctx, query, userID, clientID).Scan(&scopes)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	return strings.Fields(scopes), nil
+}
+
+// SaveOAuthConsent records the scopes the user has agreed to give the client.
+func (m *PostgresDBRepo) SaveOAuthConsent(ctx context.Context, userID int, clientID string, scopes []string) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "SaveOAuthConsent")
+	defer cancel()
+
+	stmt := `insert into oauth_consents (user_id, client_id, scopes, created_at, updated_at)
+		values ($1, $2, $3, $4, $5)
+		on conflict (user_id, client_id) do update set scopes = excluded.scopes, updated_at = excluded.updated_at`
+	_, err := m.conn().ExecContext(ctx, stmt, userID, clientID, strings.Join(scopes, " "), time.Now(), time.Now())
+
+	return translateError(err)
+}
+
+// RevokeTokenID records that the JWT with the given id must no longer be
+// accepted, and forgets revocations of tokens that have expired.
+func (m *PostgresDBRepo) RevokeTokenID(ctx context.Context, id string, expiresAt time.Time) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "RevokeTokenID")
+	defer cancel()
+
+	return m.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		tx := repo.(*PostgresDBRepo).conn()
+
+		stmt := `delete from revoked_tokens where expires_at <= $1`
+		_, err := tx.ExecContext(ctx, stmt, time.Now())
+		if err != nil {
+			return translateError(err)
+		}
+
+		stmt = `insert into revoked_tokens (token_id, expires_at, created_at) values ($1, $2, $3)
+			on conflict (token_id) do nothing`
+		_, err = tx.ExecContext(ctx, stmt, id, expiresAt, time.Now())
+
+		return translateError(err)
+	})
+}
+
+// TokenIDRevoked reports whether the JWT with the given id has been revoked.
+func (m *PostgresDBRepo) TokenIDRevoked(ctx context.Context, id string) (bool, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "TokenIDRevoked")
+	defer cancel()
+
+	query := `select exists (select 1 from revoked_tokens where token_id = $1)`
+
+	var revoked bool
+	err := m.conn().QueryRowContext(ctx, query, id).Scan(&revoked)
+	if err != nil {
+		return false, translateError(err)
+	}
+
+	return revoked, nil
+}
+
+// InsertSession stores a new session, seen now, and returns its id. The user's
+// expired sessions are deleted.
+func (m *PostgresDBRepo) InsertSession(ctx context.Context, s data.Session) (int, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "InsertSession")
+	defer cancel()
+
+	var newID int
+	err := m.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		tx := repo.(*PostgresDBRepo).conn()
+		now := time.Now()
+
+		stmt := `delete from sessions where user_id = $1 and expires_at <= $2`
+		_, err := tx.ExecContext(ctx, stmt, s.UserID, now)
+		if err != nil {
+			return translateError(err)
+		}
+
+		stmt = `insert into sessions (user_id, kind, device, ip, user_agent, created_at, last_seen_at, expires_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
+		err = tx.QueryRowContext(ctx, stmt,
+			s.UserID,
+			s.Kind,
+			s.Device,
+			s.IP,
+			s.UserAgent,
+			now,
+			now,
+			s.ExpiresAt,
+		).Scan(&newID)
+
+		return translateError(err)
+	})
 	if err != nil {
 		return 0, err
 	}
 
 	return newID, nil
 }
+
+// GetSession returns the session with the given id.
+func (m *PostgresDBRepo) GetSession(ctx context.Context, id int) (*data.Session, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "GetSession")
+	defer cancel()
+
+	query := `select ` + sessionColumns + ` from sessions where id = $1`
+
+	var s data.Session
+	err := m.conn().QueryRowContext(ctx, query, id).Scan(sessionDest(&s)...)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	return &s, nil
+}
+
+// AllSessions returns the user's unexpired sessions, oldest first.
+func (m *PostgresDBRepo) AllSessions(ctx context.Context, userID int) ([]*data.Session, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "AllSessions")
+	defer cancel()
+
+	query := `select ` + sessionColumns + ` from sessions where user_id = $1 and expires_at > $2 order by id`
+
+	rows, err := m.conn().QueryContext(ctx, query, userID, time.Now())
+	if err != nil {
+		return nil, translateError(err)
+	}
+	defer rows.Close()
+
+	var sessions []*data.Session
+	for rows.Next() {
+		var s data.Session
+		if err := rows.Scan(sessionDest(&s)...); err != nil {
+			return nil, translateError(err)
+		}
+		sessions = append(sessions, &s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, translateError(err)
+	}
+
+	return sessions, nil
+}
+
+// UpdateSession stores the device, IP address, user agent, last seen and expiry
+// times of a session.
+func (m *PostgresDBRepo) UpdateSession(ctx context.Context, s data.Session) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "UpdateSession")
+	defer cancel()
+
+	stmt := `update sessions set device = $1, ip = $2, user_agent = $3, last_seen_at = $4, expires_at = $5
+		where id = $6`
+	result, err := m.conn().ExecContext(ctx, stmt, s.Device, s.IP, s.UserAgent, s.LastSeenAt, s.ExpiresAt, s.ID)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// DeleteSession logs one of the user's sessions out.
+func (m *PostgresDBRepo) DeleteSession(ctx context.Context, userID, id int) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "DeleteSession")
+	defer cancel()
+
+	stmt := `delete from sessions where id = $1 and user_id = $2`
+	result, err := m.conn().ExecContext(ctx, stmt, id, userID)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// DeleteOtherSessions logs out every session of the user except keepID.
+func (m *PostgresDBRepo) DeleteOtherSessions(ctx context.Context, userID, keepID int) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "DeleteOtherSessions")
+	defer cancel()
+
+	stmt := `delete from sessions where user_id = $1 and id <> $2`
+	_, err := m.conn().ExecContext(ctx, stmt, userID, keepID)
+
+	return translateError(err)
+}
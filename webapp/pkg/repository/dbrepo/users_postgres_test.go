@@ -3,7 +3,9 @@
 package dbrepo
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	_ "github.com/jackc/pgconn"
 	_ "github.com/jackc/pgx/v4"
@@ -11,9 +13,12 @@ import (
 	"github.com/ory/dockertest/v3"
 	"github.com/ory/dockertest/v3/docker"
 	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/migrations"
 	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository/repotest"
 	"log"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -101,13 +106,13 @@ func TestMain(m *testing.M) {
 }
 
 func createTables() error {
-	tableSQL, err := os.ReadFile("./testdata/users.sql")
+	migrator, err := migrations.New(testDB, "postgres")
 	if err != nil {
 		fmt.Println(err)
 		return err
 	}
 
-	_, err = testDB.Exec(string(tableSQL))
+	err = migrator.Up(context.Background())
 	if err != nil {
 		fmt.Println(err)
 		return err
@@ -134,7 +139,7 @@ func TestPostgresDBRepo_InsertUser(t *testing.T) {
 		UpdatedAt: time.Now(),
 	}
 
-	id, err := testRepo.InsertUser(testUser)
+	id, err := testRepo.InsertUser(context.Background(), testUser)
 	if err != nil {
 		t.Errorf("InsertUser() returned an error: %s", err)
 	}
@@ -145,7 +150,7 @@ func TestPostgresDBRepo_InsertUser(t *testing.T) {
 }
 
 func TestPostgresDBRepo_AllUsers(t *testing.T) {
-	users, err := testRepo.AllUsers()
+	users, err := testRepo.AllUsers(context.Background())
 	if err != nil {
 		t.Errorf("AllUsers() returned an error: %s", err)
 	}
@@ -164,9 +169,9 @@ func TestPostgresDBRepo_AllUsers(t *testing.T) {
 		UpdatedAt: time.Now(),
 	}
 
-	_, _ = testRepo.InsertUser(testUser)
+	_, _ = testRepo.InsertUser(context.Background(), testUser)
 
-	users, err = testRepo.AllUsers()
+	users, err = testRepo.AllUsers(context.Background())
 	if err != nil {
 		t.Errorf("AllUsers() returned an error: %s", err)
 	}
@@ -177,7 +182,7 @@ func TestPostgresDBRepo_AllUsers(t *testing.T) {
 }
 
 func TestPostgresDBRepo_GetUser(t *testing.T) {
-	user, err := testRepo.GetUser(1)
+	user, err := testRepo.GetUser(context.Background(), 1)
 	if err != nil {
 		t.Errorf("error getting user by id: %s", err)
 	}
@@ -186,14 +191,18 @@ func TestPostgresDBRepo_GetUser(t *testing.T) {
 		t.Errorf("GetUser() returned wrong user with given email; expected admin@example.com, got %s", user.Email)
 	}
 
-	_, err = testRepo.GetUser(3)
+	_, err = testRepo.GetUser(context.Background(), 3)
 	if err == nil {
 		t.Error("no error reported when getting a non existant user by id.")
 	}
+
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("GetUser() returned wrong error for a missing user; expected ErrNotFound, got %s", err)
+	}
 }
 
 func TestPostgresDBRepo_GetUserByEmail(t *testing.T) {
-	user, err := testRepo.GetUserByEmail("jack@smith.com")
+	user, err := testRepo.GetUserByEmail(context.Background(), "jack@smith.com")
 	if err != nil {
 		t.Errorf("error getting user by id: %s", err)
 	}
@@ -204,40 +213,45 @@ func TestPostgresDBRepo_GetUserByEmail(t *testing.T) {
 }
 
 func TestPostgresDBRepo_UpdateUser(t *testing.T) {
-	user, _ := testRepo.GetUser(2)
+	user, _ := testRepo.GetUser(context.Background(), 2)
 	user.FirstName = "Jane"
 	user.Email = "jane@smith.com"
 
-	err := testRepo.UpdateUser(*user)
+	err := testRepo.UpdateUser(context.Background(), *user)
 	if err != nil {
 		t.Errorf("error updating user %d: %s", 2, err)
 	}
 
-	user, _ = testRepo.GetUser(2)
+	user, _ = testRepo.GetUser(context.Background(), 2)
 	if user.FirstName != "Jane" || user.Email != "jane@smith.com" {
 		t.Errorf("expected updated record to have first name Jane and email jane@smaith.com, but got %s %s", user.FirstName, user.Email)
 	}
 }
 
 func TestPostgresDBRepo_DeleteUser(t *testing.T) {
-	err := testRepo.DeleteUser(2)
+	err := testRepo.DeleteUser(context.Background(), 2)
 	if err != nil {
 		t.Errorf("error deleting user id 2; %s", err)
 	}
 
-	_, err = testRepo.GetUser(2)
+	_, err = testRepo.GetUser(context.Background(), 2)
 	if err == nil {
 		t.Error("retrieved user id 2, who should have been deleted")
 	}
+
+	err = testRepo.DeleteUser(context.Background(), 2)
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("deleting a missing user should return ErrNotFound, got %v", err)
+	}
 }
 
 func TestPostgresDBRepo_ResetPassword(t *testing.T) {
-	err := testRepo.ResetPassword(1, "password")
+	err := testRepo.ResetPassword(context.Background(), 1, "password")
 	if err != nil {
 		t.Error("error resetting user's password; ", err)
 	}
 
-	user, _ := testRepo.GetUser(1)
+	user, _ := testRepo.GetUser(context.Background(), 1)
 	matches, err := user.PasswordMatches("password")
 	if err != nil {
 		t.Error(err)
@@ -255,7 +269,7 @@ func TestPostgresDBRepo_InsertUserImage(t *testing.T) {
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
-	newId, err := testRepo.InsertUserImage(userImage)
+	newId, err := testRepo.InsertUserImage(context.Background(), userImage)
 	if err != nil {
 		t.Error("inserting user image failed ", err)
 	}
@@ -265,8 +279,143 @@ func TestPostgresDBRepo_InsertUserImage(t *testing.T) {
 	}
 
 	userImage.UserID = 100
-	_, err = testRepo.InsertUserImage(userImage)
+	_, err = testRepo.InsertUserImage(context.Background(), userImage)
 	if err == nil {
 		t.Error("inserted an user image with non-existent user id", err)
 	}
+
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("InsertUserImage() with a non-existent user should return ErrConflict, got %v", err)
+	}
+}
+
+func TestPostgresDBRepo_WithTx(t *testing.T) {
+	ctx := context.Background()
+	testUser := data.User{
+		FirstName: "Tx",
+		LastName:  "User",
+		Email:     "tx@example.com",
+		Password:  "secret",
+	}
+
+	// an error returned from the callback rolls back the transaction
+	err := testRepo.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		if _, err := repo.InsertUser(ctx, testUser); err != nil {
+			return err
+		}
+		return errors.New("abort")
+	})
+	if err == nil || err.Error() != "abort" {
+		t.Errorf("WithTx() should return the callback error, got %v", err)
+	}
+
+	if _, err := testRepo.GetUserByEmail(ctx, testUser.Email); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("user inserted in a rolled back transaction should not exist, got %v", err)
+	}
+
+	// a panic in the callback rolls back the transaction and is re-raised
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("WithTx() swallowed a panic")
+			}
+		}()
+
+		_ = testRepo.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+			_, _ = repo.InsertUser(ctx, testUser)
+			panic("boom")
+		})
+	}()
+
+	if _, err := testRepo.GetUserByEmail(ctx, testUser.Email); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("user inserted before a panic should not exist, got %v", err)
+	}
+
+	// a nil error commits, and the isolation level can be chosen
+	err = testRepo.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		_, err := repo.InsertUser(ctx, testUser)
+		return err
+	}, repository.WithIsolation(sql.LevelSerializable))
+	if err != nil {
+		t.Errorf("WithTx() returned an error: %s", err)
+	}
+
+	if _, err := testRepo.GetUserByEmail(ctx, testUser.Email); err != nil {
+		t.Errorf("user inserted in a committed transaction should exist, got %v", err)
+	}
+}
+
+func TestPostgresDBRepo_EmailIsCaseInsensitive(t *testing.T) {
+	ctx := context.Background()
+	testUser := data.User{
+		FirstName: "Case",
+		LastName:  "User",
+		Email:     "  Case@Example.COM ",
+		Password:  "secret",
+	}
+
+	id, err := testRepo.InsertUser(ctx, testUser)
+	if err != nil {
+		t.Fatalf("InsertUser() returned an error: %s", err)
+	}
+
+	user, err := testRepo.GetUserByEmail(ctx, "CASE@example.com")
+	if err != nil {
+		t.Fatalf("GetUserByEmail() returned an error: %s", err)
+	}
+
+	if user.ID != id || user.Email != "case@example.com" {
+		t.Errorf("expected user %d with normalized email case@example.com, got %d %s", id, user.ID, user.Email)
+	}
+
+	testUser.Email = "case@EXAMPLE.com"
+	_, err = testRepo.InsertUser(ctx, testUser)
+	if !errors.Is(err, repository.ErrDuplicate) {
+		t.Errorf("InsertUser() with an existing email should return ErrDuplicate, got %v", err)
+	}
+}
+
+// TestPostgresDBRepo_Conformance runs last, since it empties the tables before
+// every check.
+func TestPostgresDBRepo_Conformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) repository.DataBaseRepo {
+		emptyTables(t)
+		return &PostgresDBRepo{DB: testDB}
+	})
+}
+
+// emptyTables empties every table but schema_migrations, including ones with no
+// foreign key to users, so no check sees rows left behind by another.
+func emptyTables(t *testing.T) {
+	t.Helper()
+
+	rows, err := testDB.Query(`select tablename from pg_tables
+		where schemaname = 'public' and tablename <> 'schema_migrations'`)
+	if err != nil {
+		t.Fatalf("could not list tables: %s", err)
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			t.Fatalf("could not list tables: %s", err)
+		}
+		tables = append(tables, quoteIdent(table))
+	}
+
+	if err := rows.Err(); err != nil {
+		t.Fatalf("could not list tables: %s", err)
+	}
+
+	_, err = testDB.Exec("truncate table " + strings.Join(tables, ", ") + " restart identity cascade")
+	if err != nil {
+		t.Fatalf("could not empty tables: %s", err)
+	}
+}
+
+// quoteIdent quotes a Postgres identifier.
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
 }
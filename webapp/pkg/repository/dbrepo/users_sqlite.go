@@ -0,0 +1,1194 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+	"log"
+	"strings"
+	"time"
+)
+
+// SQLiteDBRepo stores users in a SQLite database, so the applications can run
+// without a Postgres server. Open the database with SQLiteDSN so that foreign keys
+// are enforced.
+type SQLiteDBRepo struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+
+	// Hasher hashes new passwords; nil means data.DefaultPasswordHasher.
+	Hasher data.PasswordHasher
+
+	// HistoryLimit is how many of a user's previous passwords ResetPassword
+	// keeps; 0 means repository.DefaultHistoryLimit. A password policy looks at
+	// its History-1 most recent ones.
+	HistoryLimit int
+
+	// tx is set on the copy of the repository handed to WithTx callbacks.
+	tx *sql.Tx
+}
+
+func (m *SQLiteDBRepo) Connection() *sql.DB {
+	return m.DB
+}
+
+// AllUsers returns all users as a slice of *data.User
+func (m *SQLiteDBRepo) AllUsers(ctx context.Context) ([]*data.User, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "AllUsers")
+	defer cancel()
+
+	query := `
+		select
+			u.id, u.email, u.first_name, u.last_name, u.password, u.is_admin, u.created_at, u.updated_at,
+			coalesce(ui.file_name, '')
+		from
+			users u
+			left join user_images ui on (ui.user_id = u.id and ui.is_current)
+		order by u.last_name`
+
+	rows, err := m.conn().QueryContext(ctx, query)
+	if err != nil {
+		return nil, translateSQLiteError(err)
+	}
+	defer rows.Close()
+
+	var users []*data.User
+
+	for rows.Next() {
+		var user data.User
+		err := rows.Scan(
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.Password,
+			&user.IsAdmin,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+			&user.ProfilePic.FileName,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, translateSQLiteError(err)
+	}
+
+	return users, nil
+}
+
+// GetUser returns one user by id
+func (m *SQLiteDBRepo) GetUser(ctx context.Context, id int) (*data.User, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "GetUser")
+	defer cancel()
+
+	query := `
+		select 
+			u.id, u.email, u.first_name, u.last_name, u.password, u.is_admin, u.created_at, u.updated_at,
+			u.sessions_revoked_at, u.email_verified_at, coalesce(u.totp_secret, ''), u.totp_enabled_at,
+			coalesce(ui.file_name, '')
+		from 
+			users u
+			left join user_images ui on (ui.user_id = u.id and ui.is_current)
+		where 
+		    u.id = ?`
+
+	var user data.User
+	var sessionsRevokedAt, emailVerifiedAt, totpEnabledAt sql.NullTime
+	row := m.conn().QueryRowContext(ctx, query, id)
+
+	err := row.Scan(
+		&user.ID,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.Password,
+		&user.IsAdmin,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&sessionsRevokedAt,
+		&emailVerifiedAt,
+		&user.TOTPSecret,
+		&totpEnabledAt,
+		&user.ProfilePic.FileName,
+	)
+
+	if err != nil {
+		return nil, translateSQLiteError(err)
+	}
+
+	user.SessionsRevokedAt = sessionsRevokedAt.Time
+	user.EmailVerifiedAt = emailVerifiedAt.Time
+	user.TOTPEnabledAt = totpEnabledAt.Time
+
+	return &user, nil
+}
+
+// GetUserByEmail returns one user by email address
+func (m *SQLiteDBRepo) GetUserByEmail(ctx context.Context, email string) (*data.User, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "GetUserByEmail")
+	defer cancel()
+
+	query := `
+		select 
+			u.id, u.email, u.first_name, u.last_name, u.password, u.is_admin, u.created_at, u.updated_at,
+			u.sessions_revoked_at, u.email_verified_at, coalesce(u.totp_secret, ''), u.totp_enabled_at,
+			coalesce(ui.file_name, '')
+		from 
+			users u
+			left join user_images ui on (ui.user_id = u.id and ui.is_current)
+		where 
+		    lower(u.email) = ?`
+
+	var user data.User
+	var sessionsRevokedAt, emailVerifiedAt, totpEnabledAt sql.NullTime
+	row := m.conn().QueryRowContext(ctx, query, data.NormalizeEmail(email))
+
+	err := row.Scan(
+		&user.ID,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.Password,
+		&user.IsAdmin,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&sessionsRevokedAt,
+		&emailVerifiedAt,
+		&user.TOTPSecret,
+		&totpEnabledAt,
+		&user.ProfilePic.FileName,
+	)
+
+	if err != nil {
+		return nil, translateSQLiteError(err)
+	}
+
+	user.SessionsRevokedAt = sessionsRevokedAt.Time
+	user.EmailVerifiedAt = emailVerifiedAt.Time
+	user.TOTPEnabledAt = totpEnabledAt.Time
+
+	return &user, nil
+}
+
+// UpdateUser updates one user in the database
+func (m *SQLiteDBRepo) UpdateUser(ctx context.Context, u data.User) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "UpdateUser")
+	defer cancel()
+
+	stmt := `update users set
+		email = ?,
+		first_name = ?,
+		last_name = ?,
+		is_admin = ?,
+		updated_at = ?
+		where id = ?
+	`
+
+	result, err := m.conn().ExecContext(ctx, stmt,
+		data.NormalizeEmail(u.Email),
+		u.FirstName,
+		u.LastName,
+		u.IsAdmin,
+		time.Now(),
+		u.ID,
+	)
+
+	if err != nil {
+		return translateSQLiteError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// DeleteUser deletes one user from the database, by id
+func (m *SQLiteDBRepo) DeleteUser(ctx context.Context, id int) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "DeleteUser")
+	defer cancel()
+
+	stmt := `delete from users where id = ?`
+
+	result, err := m.conn().ExecContext(ctx, stmt, id)
+	if err != nil {
+		return translateSQLiteError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// InsertUser inserts a new user into the database, and returns the ID of the newly inserted row
+func (m *SQLiteDBRepo) InsertUser(ctx context.Context, user data.User) (int, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "InsertUser")
+	defer cancel()
+
+	hashedPassword, err := hashPassword(m.Hasher, user.Password)
+	if err != nil {
+		return 0, err
+	}
+
+	var newID int
+	stmt := `insert into users (email, first_name, last_name, password, is_admin, created_at, updated_at, email_verified_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?) returning id`
+
+	err = m.conn().QueryRowContext(ctx, stmt,
+		data.NormalizeEmail(user.Email),
+		user.FirstName,
+		user.LastName,
+		hashedPassword,
+		user.IsAdmin,
+		time.Now(),
+		time.Now(),
+		sql.NullTime{Time: user.EmailVerifiedAt, Valid: user.EmailVerified()},
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, translateSQLiteError(err)
+	}
+
+	return newID, nil
+}
+
+// ResetPassword is the method we will use to change a user's password.
+func (m *SQLiteDBRepo) ResetPassword(ctx context.Context, id int, password string) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "ResetPassword")
+	defer cancel()
+
+	hashedPassword, err := hashPassword(m.Hasher, password)
+	if err != nil {
+		return err
+	}
+
+	return m.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		tx := repo.(*SQLiteDBRepo).conn()
+
+		// keep the password being replaced, so it can't be reused
+		stmt := `insert into password_history (user_id, password, created_at)
+			select id, password, ? from users where id = ?`
+		_, err := tx.ExecContext(ctx, stmt, time.Now(), id)
+		if err != nil {
+			return translateSQLiteError(err)
+		}
+
+		// and forget the ones too old for anyone to look at
+		stmt = `delete from password_history where user_id = ? and id not in (
+			select id from password_history where user_id = ? order by id desc limit ?)`
+		_, err = tx.ExecContext(ctx, stmt, id, id, historyLimit(m.HistoryLimit))
+		if err != nil {
+			return translateSQLiteError(err)
+		}
+
+		stmt = `update users set password = ? where id = ?`
+		result, err := tx.ExecContext(ctx, stmt, hashedPassword, id)
+		if err != nil {
+			return translateSQLiteError(err)
+		}
+
+		return checkRowsAffected(result)
+	})
+}
+
+// UpdatePasswordHash replaces the hash of a user's password, such as one made
+// with outdated settings, without adding to their password history.
+func (m *SQLiteDBRepo) UpdatePasswordHash(ctx context.Context, id int, password string) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "UpdatePasswordHash")
+	defer cancel()
+
+	hashedPassword, err := hashPassword(m.Hasher, password)
+	if err != nil {
+		return err
+	}
+
+	stmt := `update users set password = ? where id = ?`
+	result, err := m.conn().ExecContext(ctx, stmt, hashedPassword, id)
+	if err != nil {
+		return translateSQLiteError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// PasswordHistory returns the hashes of up to limit passwords the user had before
+// their current one, newest first.
+func (m *SQLiteDBRepo) PasswordHistory(ctx context.Context, id int, limit int) ([]string, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "PasswordHistory")
+	defer cancel()
+
+	if limit < 1 {
+		return nil, nil
+	}
+
+	query := `select password from password_history where user_id = ? order by id desc limit ?`
+
+	rows, err := m.conn().QueryContext(ctx, query, id, limit)
+	if err != nil {
+		return nil, translateSQLiteError(err)
+	}
+	defer rows.Close()
+
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, translateSQLiteError(err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, translateSQLiteError(err)
+	}
+
+	return hashes, nil
+}
+
+// InsertUserImage inserts a user profile image into the database, and makes it
+// the user's current one.
+func (m *SQLiteDBRepo) InsertUserImage(ctx context.Context, i data.UserImage) (int, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "InsertUserImage")
+	defer cancel()
+
+	var newID int
+	err := m.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		tx := repo.(*SQLiteDBRepo).conn()
+
+		stmt := `update user_images set is_current = false, updated_at = ? where user_id = ? and is_current`
+		_, err := tx.ExecContext(ctx, stmt, time.Now(), i.UserID)
+		if err != nil {
+			return translateSQLiteError(err)
+		}
+
+		stmt = `insert into user_images (user_id, file_name, is_current, created_at, updated_at)
+			values (?, ?, true, ?, ?) returning id`
+
+		err = tx.QueryRowContext(ctx, stmt,
+			i.UserID,
+			i.FileName,
+			time.Now(),
+			time.Now(),
+		).Scan(&newID)
+
+		return translateSQLiteError(err)
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// AllUserImages returns the user's profile images, newest first.
+func (m *SQLiteDBRepo) AllUserImages(ctx context.Context, userID int) ([]*data.UserImage, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "AllUserImages")
+	defer cancel()
+
+	query := `select ` + userImageColumns + ` from user_images where user_id = ? order by created_at desc, id desc`
+
+	rows, err := m.conn().QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, translateSQLiteError(err)
+	}
+	defer rows.Close()
+
+	var images []*data.UserImage
+	for rows.Next() {
+		var i data.UserImage
+		if err := rows.Scan(userImageDest(&i)...); err != nil {
+			return nil, translateSQLiteError(err)
+		}
+		images = append(images, &i)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, translateSQLiteError(err)
+	}
+
+	return images, nil
+}
+
+// SetCurrentUserImage makes one of the user's profile images their current one.
+func (m *SQLiteDBRepo) SetCurrentUserImage(ctx context.Context, userID, id int) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "SetCurrentUserImage")
+	defer cancel()
+
+	return m.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		tx := repo.(*SQLiteDBRepo).conn()
+
+		var exists int
+		query := `select 1 from user_images where id = ? and user_id = ?`
+		err := tx.QueryRowContext(ctx, query, id, userID).Scan(&exists)
+		if err != nil {
+			return translateSQLiteError(err)
+		}
+
+		// the old one goes first, so the user never has two
+		stmt := `update user_images set is_current = false, updated_at = ? where user_id = ? and is_current`
+		_, err = tx.ExecContext(ctx, stmt, time.Now(), userID)
+		if err != nil {
+			return translateSQLiteError(err)
+		}
+
+		stmt = `update user_images set is_current = true, updated_at = ? where id = ?`
+		_, err = tx.ExecContext(ctx, stmt, time.Now(), id)
+
+		return translateSQLiteError(err)
+	})
+}
+
+// ClearCurrentUserImage leaves the user without a current profile image.
+func (m *SQLiteDBRepo) ClearCurrentUserImage(ctx context.Context, userID int) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "ClearCurrentUserImage")
+	defer cancel()
+
+	stmt := `update user_images set is_current = false, updated_at = ? where user_id = ? and is_current`
+
+	result, err := m.conn().ExecContext(ctx, stmt, time.Now(), userID)
+	if err != nil {
+		return translateSQLiteError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// DeleteUserImage deletes one of the user's profile images.
+func (m *SQLiteDBRepo) DeleteUserImage(ctx context.Context, userID, id int) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "DeleteUserImage")
+	defer cancel()
+
+	stmt := `delete from user_images where id = ? and user_id = ?`
+
+	result, err := m.conn().ExecContext(ctx, stmt, id, userID)
+	if err != nil {
+		return translateSQLiteError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// UserImageFileNames returns the file names of every profile image.
+func (m *SQLiteDBRepo) UserImageFileNames(ctx context.Context) ([]string, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "UserImageFileNames")
+	defer cancel()
+
+	rows, err := m.conn().QueryContext(ctx, `select distinct file_name from user_images where file_name is not null`)
+	if err != nil {
+		return nil, translateSQLiteError(err)
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, translateSQLiteError(err)
+		}
+		names = append(names, name)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, translateSQLiteError(err)
+	}
+
+	return names, nil
+}
+
+// RevokeSessions sets the user's SessionsRevokedAt to now, and deletes their
+// sessions.
+func (m *SQLiteDBRepo) RevokeSessions(ctx context.Context, id int) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "RevokeSessions")
+	defer cancel()
+
+	return m.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		tx := repo.(*SQLiteDBRepo).conn()
+
+		stmt := `update users set sessions_revoked_at = ? where id = ?`
+		result, err := tx.ExecContext(ctx, stmt, time.Now(), id)
+		if err != nil {
+			return translateSQLiteError(err)
+		}
+
+		if err := checkRowsAffected(result); err != nil {
+			return err
+		}
+
+		stmt = `delete from sessions where user_id = ?`
+		_, err = tx.ExecContext(ctx, stmt, id)
+
+		return translateSQLiteError(err)
+	})
+}
+
+// InsertPasswordResetToken stores the hash of a password reset token for the user,
+// and clears out any of their tokens that have already expired.
+func (m *SQLiteDBRepo) InsertPasswordResetToken(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "InsertPasswordResetToken")
+	defer cancel()
+
+	return m.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		tx := repo.(*SQLiteDBRepo).conn()
+
+		stmt := `delete from password_reset_tokens where user_id = ? and expires_at <= ?`
+		_, err := tx.ExecContext(ctx, stmt, userID, time.Now())
+		if err != nil {
+			return translateSQLiteError(err)
+		}
+
+		stmt = `insert into password_reset_tokens (user_id, token_hash, expires_at, created_at)
+			values (?, ?, ?, ?)`
+		_, err = tx.ExecContext(ctx, stmt, userID, tokenHash, expiresAt, time.Now())
+
+		return translateSQLiteError(err)
+	})
+}
+
+// ConsumePasswordResetToken returns the user an unexpired reset token belongs to,
+// and deletes all of that user's reset tokens.
+func (m *SQLiteDBRepo) ConsumePasswordResetToken(ctx context.Context, tokenHash string) (int, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "ConsumePasswordResetToken")
+	defer cancel()
+
+	var userID int
+	err := m.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		tx := repo.(*SQLiteDBRepo).conn()
+
+		// deleting the token claims it, so two concurrent resets can't both use it
+		stmt := `delete from password_reset_tokens where token_hash = ? and expires_at > ? returning user_id`
+		err := tx.QueryRowContext(ctx, stmt, tokenHash, time.Now()).Scan(&userID)
+		if err != nil {
+			return translateSQLiteError(err)
+		}
+
+		stmt = `delete from password_reset_tokens where user_id = ?`
+		_, err = tx.ExecContext(ctx, stmt, userID)
+
+		return translateSQLiteError(err)
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+// InsertEmailVerificationToken stores the hash of an email verification token for
+// the user, and clears out any of their tokens that have already expired.
+func (m *SQLiteDBRepo) InsertEmailVerificationToken(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "InsertEmailVerificationToken")
+	defer cancel()
+
+	return m.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		tx := repo.(*SQLiteDBRepo).conn()
+
+		stmt := `delete from email_verification_tokens where user_id = ? and expires_at <= ?`
+		_, err := tx.ExecContext(ctx, stmt, userID, time.Now())
+		if err != nil {
+			return translateSQLiteError(err)
+		}
+
+		stmt = `insert into email_verification_tokens (user_id, token_hash, expires_at, created_at)
+			values (?, ?, ?, ?)`
+		_, err = tx.ExecContext(ctx, stmt, userID, tokenHash, expiresAt, time.Now())
+
+		return translateSQLiteError(err)
+	})
+}
+
+// VerifyEmail marks the email address of the user an unexpired verification token
+// belongs to as verified, and deletes all of that user's verification tokens.
+func (m *SQLiteDBRepo) VerifyEmail(ctx context.Context, tokenHash string) (int, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "VerifyEmail")
+	defer cancel()
+
+	var userID int
+	err := m.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		tx := repo.(*SQLiteDBRepo).conn()
+
+		// deleting the token claims it, so it can only be used once
+		stmt := `delete from email_verification_tokens where token_hash = ? and expires_at > ? returning user_id`
+		err := tx.QueryRowContext(ctx, stmt, tokenHash, time.Now()).Scan(&userID)
+		if err != nil {
+			return translateSQLiteError(err)
+		}
+
+		stmt = `delete from email_verification_tokens where user_id = ?`
+		_, err = tx.ExecContext(ctx, stmt, userID)
+		if err != nil {
+			return translateSQLiteError(err)
+		}
+
+		stmt = `update users set email_verified_at = coalesce(email_verified_at, ?) where id = ?`
+		_, err = tx.ExecContext(ctx, stmt, time.Now(), userID)
+
+		return translateSQLiteError(err)
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+// SetTOTPSecret stores a new authenticator secret for the user, with two-factor
+// authentication off until it is confirmed.
+func (m *SQLiteDBRepo) SetTOTPSecret(ctx context.Context, id int, secret string) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "SetTOTPSecret")
+	defer cancel()
+
+	stmt := `update users set totp_secret = ?, totp_enabled_at = null, totp_last_step = 0 where id = ?`
+	result, err := m.conn().ExecContext(ctx, stmt, secret, id)
+	if err != nil {
+		return translateSQLiteError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// EnableTOTP turns on two-factor authentication for the user and replaces their
+// recovery codes.
+func (m *SQLiteDBRepo) EnableTOTP(ctx context.Context, id int, recoveryCodeHashes []string) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "EnableTOTP")
+	defer cancel()
+
+	return m.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		tx := repo.(*SQLiteDBRepo).conn()
+
+		stmt := `update users set totp_enabled_at = ? where id = ? and totp_secret is not null`
+		result, err := tx.ExecContext(ctx, stmt, time.Now(), id)
+		if err != nil {
+			return translateSQLiteError(err)
+		}
+
+		if err := checkRowsAffected(result); err != nil {
+			return err
+		}
+
+		stmt = `delete from recovery_codes where user_id = ?`
+		_, err = tx.ExecContext(ctx, stmt, id)
+		if err != nil {
+			return translateSQLiteError(err)
+		}
+
+		stmt = `insert into recovery_codes (user_id, code_hash, created_at) values (?, ?, ?)`
+		for _, hash := range recoveryCodeHashes {
+			_, err = tx.ExecContext(ctx, stmt, id, hash, time.Now())
+			if err != nil {
+				return translateSQLiteError(err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// DisableTOTP turns off two-factor authentication for the user, and deletes their
+// secret and recovery codes.
+func (m *SQLiteDBRepo) DisableTOTP(ctx context.Context, id int) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "DisableTOTP")
+	defer cancel()
+
+	return m.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		tx := repo.(*SQLiteDBRepo).conn()
+
+		stmt := `update users set totp_secret = null, totp_enabled_at = null, totp_last_step = 0 where id = ?`
+		result, err := tx.ExecContext(ctx, stmt, id)
+		if err != nil {
+			return translateSQLiteError(err)
+		}
+
+		if err := checkRowsAffected(result); err != nil {
+			return err
+		}
+
+		stmt = `delete from recovery_codes where user_id = ?`
+		_, err = tx.ExecContext(ctx, stmt, id)
+
+		return translateSQLiteError(err)
+	})
+}
+
+// UseTOTPStep records the time step of an accepted code, refusing steps that are
+// not later than the last one.
+func (m *SQLiteDBRepo) UseTOTPStep(ctx context.Context, id int, step int64) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "UseTOTPStep")
+	defer cancel()
+
+	stmt := `update users set totp_last_step = ? where id = ? and totp_last_step < ?`
+	result, err := m.conn().ExecContext(ctx, stmt, step, id, step)
+	if err != nil {
+		return translateSQLiteError(err)
+	}
+
+	if err := checkRowsAffected(result); err != nil {
+		// tell a missing user apart from a replayed code
+		if _, getErr := m.GetUser(ctx, id); getErr != nil {
+			return getErr
+		}
+		return fmt.Errorf("%w: code already used", repository.ErrConflict)
+	}
+
+	return nil
+}
+
+// UseRecoveryCode deletes one of the user's recovery codes.
+func (m *SQLiteDBRepo) UseRecoveryCode(ctx context.Context, id int, codeHash string) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "UseRecoveryCode")
+	defer cancel()
+
+	stmt := `delete from recovery_codes where user_id = ? and code_hash = ?`
+	result, err := m.conn().ExecContext(ctx, stmt, id, codeHash)
+	if err != nil {
+		return translateSQLiteError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// InsertAccessToken stores a personal access token and returns its id.
+func (m *SQLiteDBRepo) InsertAccessToken(ctx context.Context, t data.AccessToken) (int, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "InsertAccessToken")
+	defer cancel()
+
+	stmt := `insert into access_tokens (user_id, name, scopes, token_hash, expires_at, created_at)
+		values (?, ?, ?, ?, ?, ?) returning id`
+
+	var newID int
+	err := m.conn().QueryRowContext(ctx, stmt,
+		t.UserID,
+		t.Name,
+		strings.Join(t.Scopes, " "),
+		t.TokenHash,
+		nullTime(t.ExpiresAt),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, translateSQLiteError(err)
+	}
+
+	return newID, nil
+}
+
+// GetAccessTokenByHash returns the access token with the given hash.
+func (m *SQLiteDBRepo) GetAccessTokenByHash(ctx context.Context, tokenHash string) (*data.AccessToken, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "GetAccessTokenByHash")
+	defer cancel()
+
+	query := `select ` + accessTokenColumns + ` from access_tokens where token_hash = ?`
+
+	var row accessTokenRow
+	err := m.conn().QueryRowContext(ctx, query, tokenHash).Scan(row.dest()...)
+	if err != nil {
+		return nil, translateSQLiteError(err)
+	}
+
+	return row.accessToken(), nil
+}
+
+// AllAccessTokens returns the user's access tokens, oldest first.
+func (m *SQLiteDBRepo) AllAccessTokens(ctx context.Context, userID int) ([]*data.AccessToken, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "AllAccessTokens")
+	defer cancel()
+
+	query := `select ` + accessTokenColumns + ` from access_tokens where user_id = ? order by id`
+
+	rows, err := m.conn().QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, translateSQLiteError(err)
+	}
+	defer rows.Close()
+
+	var tokens []*data.AccessToken
+	for rows.Next() {
+		var row accessTokenRow
+		if err := rows.Scan(row.dest()...); err != nil {
+			return nil, translateSQLiteError(err)
+		}
+		tokens = append(tokens, row.accessToken())
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, translateSQLiteError(err)
+	}
+
+	return tokens, nil
+}
+
+// TouchAccessToken sets the time the access token was last used.
+func (m *SQLiteDBRepo) TouchAccessToken(ctx context.Context, id int, usedAt time.Time) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "TouchAccessToken")
+	defer cancel()
+
+	stmt := `update access_tokens set last_used_at = ? where id = ?`
+	result, err := m.conn().ExecContext(ctx, stmt, usedAt, id)
+	if err != nil {
+		return translateSQLiteError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// DeleteAccessToken revokes one of the user's access tokens.
+func (m *SQLiteDBRepo) DeleteAccessToken(ctx context.Context, userID, id int) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "DeleteAccessToken")
+	defer cancel()
+
+	stmt := `delete from access_tokens where id = ? and user_id = ?`
+	result, err := m.conn().ExecContext(ctx, stmt, id, userID)
+	if err != nil {
+		return translateSQLiteError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// InsertOAuthClient registers an OAuth client and returns its id.
+func (m *SQLiteDBRepo) InsertOAuthClient(ctx context.Context, c data.OAuthClient) (int, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "InsertOAuthClient")
+	defer cancel()
+
+	stmt := `insert into oauth_clients (client_id, secret_hash, name, redirect_uris, grant_types, scopes, owner_id, created_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?) returning id`
+
+	var newID int
+	err := m.conn().QueryRowContext(ctx, stmt,
+		c.ClientID,
+		sql.NullString{String: c.SecretHash, Valid: c.SecretHash != ""},
+		c.Name,
+		strings.Join(c.RedirectURIs, " "),
+		strings.Join(c.GrantTypes, " "),
+		strings.Join(c.Scopes, " "),
+		c.OwnerID,
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, translateSQLiteError(err)
+	}
+
+	return newID, nil
+}
+
+// GetOAuthClient returns the OAuth client with the given client id.
+func (m *SQLiteDBRepo) GetOAuthClient(ctx context.Context, clientID string) (*data.OAuthClient, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "GetOAuthClient")
+	defer cancel()
+
+	query := `select ` + oauthClientColumns + ` from oauth_clients where client_id = ?`
+
+	var row oauthClientRow
+	err := m.conn().QueryRowContext(ctx, query, clientID).Scan(row.dest()...)
+	if err != nil {
+		return nil, translateSQLiteError(err)
+	}
+
+	return row.client(), nil
+}
+
+// AllOAuthClients returns every OAuth client, oldest first.
+func (m *SQLiteDBRepo) AllOAuthClients(ctx context.Context) ([]*data.OAuthClient, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "AllOAuthClients")
+	defer cancel()
+
+	query := `select ` + oauthClientColumns + ` from oauth_clients order by id`
+
+	rows, err := m.conn().QueryContext(ctx, query)
+	if err != nil {
+		return nil, translateSQLiteError(err)
+	}
+	defer rows.Close()
+
+	var clients []*data.OAuthClient
+	for rows.Next() {
+		var row oauthClientRow
+		if err := rows.Scan(row.dest()...); err != nil {
+			return nil, translateSQLiteError(err)
+		}
+		clients = append(clients, row.client())
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, translateSQLiteError(err)
+	}
+
+	return clients, nil
+}
+
+// DeleteOAuthClient deletes an OAuth client; its codes and consents go with it.
+func (m *SQLiteDBRepo) DeleteOAuthClient(ctx context.Context, clientID string) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "DeleteOAuthClient")
+	defer cancel()
+
+	stmt := `delete from oauth_clients where client_id = ?`
+	result, err := m.conn().ExecContext(ctx, stmt, clientID)
+	if err != nil {
+		return translateSQLiteError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// InsertOAuthCode stores an authorization code, and clears out codes that have
+// already expired.
+func (m *SQLiteDBRepo) InsertOAuthCode(ctx context.Context, c data.OAuthCode) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "InsertOAuthCode")
+	defer cancel()
+
+	return m.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		tx := repo.(*SQLiteDBRepo).conn()
+
+		stmt := `delete from oauth_codes where expires_at <= ?`
+		_, err := tx.ExecContext(ctx, stmt, time.Now())
+		if err != nil {
+			return translateSQLiteError(err)
+		}
+
+		stmt = `insert into oauth_codes (code_hash, client_id, user_id, redirect_uri, scopes, code_challenge, nonce, expires_at, created_at)
+			values (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+		_, err = tx.ExecContext(ctx, stmt,
+			c.CodeHash,
+			c.ClientID,
+			c.UserID,
+			c.RedirectURI,
+			strings.Join(c.Scopes, " "),
+			c.CodeChallenge,
+			c.Nonce,
+			c.ExpiresAt,
+			time.Now(),
+		)
+
+		return translateSQLiteError(err)
+	})
+}
+
+// ConsumeOAuthCode deletes an authorization code and returns it, unless it has
+// expired.
+func (m *SQLiteDBRepo) ConsumeOAuthCode(ctx context.Context, codeHash string) (*data.OAuthCode, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "ConsumeOAuthCode")
+	defer cancel()
+
+	// deleting the code claims it, so two exchanges can't both use it
+	stmt := `delete from oauth_codes where code_hash = ?
+		returning client_id, user_id, redirect_uri, scopes, code_challenge, nonce, expires_at`
+
+	c := data.OAuthCode{CodeHash: codeHash}
+	var scopes string
+	err := m.conn().QueryRowContext(ctx, stmt, codeHash).Scan(
+		&c.ClientID,
+		&c.UserID,
+		&c.RedirectURI,
+		&scopes,
+		&c.CodeChallenge,
+		&c.Nonce,
+		&c.ExpiresAt,
+	)
+	if err != nil {
+		return nil, translateSQLiteError(err)
+	}
+
+	if !c.ExpiresAt.After(time.Now()) {
+		return nil, repository.ErrNotFound
+	}
+
+	c.Scopes = strings.Fields(scopes)
+	return &c, nil
+}
+
+// OAuthConsent returns the scopes the user has agreed to give the client.
+func (m *SQLiteDBRepo) OAuthConsent(ctx context.Context, userID int, clientID string) ([]string, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "OAuthConsent")
+	defer cancel()
+
+	query := `select scopes from oauth_consents where user_id = ? and client_id = ?`
+
+	var scopes string
+	err := m.conn().QueryRowContext(ctx, query, userID, clientID).Scan(&scopes)
+	if err != nil {
+		return nil, translateSQLiteError(err)
+	}
+
+	return strings.Fields(scopes), nil
+}
+
+// SaveOAuthConsent records the scopes the user has agreed to give the client.
+func (m *SQLiteDBRepo) SaveOAuthConsent(ctx context.Context, userID int, clientID string, scopes []string) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "SaveOAuthConsent")
+	defer cancel()
+
+	stmt := `insert into oauth_consents (user_id, client_id, scopes, created_at, updated_at)
+		values (?, ?, ?, ?, ?)
+		on conflict (user_id, client_id) do update set scopes = excluded.scopes, updated_at = excluded.updated_at`
+	_, err := m.conn().ExecContext(ctx, stmt, userID, clientID, strings.Join(scopes, " "), time.Now(), time.Now())
+
+	return translateSQLiteError(err)
+}
+
+// RevokeTokenID records that the JWT with the given id must no longer be
+// accepted, and forgets revocations of tokens that have expired.
+func (m *SQLiteDBRepo) RevokeTokenID(ctx context.Context, id string, expiresAt time.Time) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "RevokeTokenID")
+	defer cancel()
+
+	return m.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		tx := repo.(*SQLiteDBRepo).conn()
+
+		stmt := `delete from revoked_tokens where expires_at <= ?`
+		_, err := tx.ExecContext(ctx, stmt, time.Now())
+		if err != nil {
+			return translateSQLiteError(err)
+		}
+
+		stmt = `insert into revoked_tokens (token_id, expires_at, created_at) values (?, ?, ?)
+			on conflict (token_id) do nothing`
+		_, err = tx.ExecContext(ctx, stmt, id, expiresAt, time.Now())
+
+		return translateSQLiteError(err)
+	})
+}
+
+// TokenIDRevoked reports whether the JWT with the given id has been revoked.
+func (m *SQLiteDBRepo) TokenIDRevoked(ctx context.Context, id string) (bool, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "TokenIDRevoked")
+	defer cancel()
+
+	query := `select exists (select 1 from revoked_tokens where token_id = ?)`
+
+	var revoked bool
+	err := m.conn().QueryRowContext(ctx, query, id).Scan(&revoked)
+	if err != nil {
+		return false, translateSQLiteError(err)
+	}
+
+	return revoked, nil
+}
+
+// InsertSession stores a new session, seen now, and returns its id. The user's
+// expired sessions are deleted.
+func (m *SQLiteDBRepo) InsertSession(ctx context.Context, s data.Session) (int, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "InsertSession")
+	defer cancel()
+
+	var newID int
+	err := m.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		tx := repo.(*SQLiteDBRepo).conn()
+		now := time.Now()
+
+		stmt := `delete from sessions where user_id = ? and expires_at <= ?`
+		_, err := tx.ExecContext(ctx, stmt, s.UserID, now)
+		if err != nil {
+			return translateSQLiteError(err)
+		}
+
+		stmt = `insert into sessions (user_id, kind, device, ip, user_agent, created_at, last_seen_at, expires_at)
+			values (?, ?, ?, ?, ?, ?, ?, ?) returning id`
+		err = tx.QueryRowContext(ctx, stmt,
+			s.UserID,
+			s.Kind,
+			s.Device,
+			s.IP,
+			s.UserAgent,
+			now,
+			now,
+			s.ExpiresAt,
+		).Scan(&newID)
+
+		return translateSQLiteError(err)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// GetSession returns the session with the given id.
+func (m *SQLiteDBRepo) GetSession(ctx context.Context, id int) (*data.Session, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "GetSession")
+	defer cancel()
+
+	query := `select ` + sessionColumns + ` from sessions where id = ?`
+
+	var s data.Session
+	err := m.conn().QueryRowContext(ctx, query, id).Scan(sessionDest(&s)...)
+	if err != nil {
+		return nil, translateSQLiteError(err)
+	}
+
+	return &s, nil
+}
+
+// AllSessions returns the user's unexpired sessions, oldest first.
+func (m *SQLiteDBRepo) AllSessions(ctx context.Context, userID int) ([]*data.Session, error) {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "AllSessions")
+	defer cancel()
+
+	query := `select ` + sessionColumns + ` from sessions where user_id = ? and expires_at > ? order by id`
+
+	rows, err := m.conn().QueryContext(ctx, query, userID, time.Now())
+	if err != nil {
+		return nil, translateSQLiteError(err)
+	}
+	defer rows.Close()
+
+	var sessions []*data.Session
+	for rows.Next() {
+		var s data.Session
+		if err := rows.Scan(sessionDest(&s)...); err != nil {
+			return nil, translateSQLiteError(err)
+		}
+		sessions = append(sessions, &s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, translateSQLiteError(err)
+	}
+
+	return sessions, nil
+}
+
+// UpdateSession stores the device, IP address, user agent, last seen and expiry
+// times of a session.
+func (m *SQLiteDBRepo) UpdateSession(ctx context.Context, s data.Session) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "UpdateSession")
+	defer cancel()
+
+	stmt := `update sessions set device = ?, ip = ?, user_agent = ?, last_seen_at = ?, expires_at = ?
+		where id = ?`
+	result, err := m.conn().ExecContext(ctx, stmt, s.Device, s.IP, s.UserAgent, s.LastSeenAt, s.ExpiresAt, s.ID)
+	if err != nil {
+		return translateSQLiteError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// DeleteSession logs one of the user's sessions out.
+func (m *SQLiteDBRepo) DeleteSession(ctx context.Context, userID, id int) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "DeleteSession")
+	defer cancel()
+
+	stmt := `delete from sessions where id = ? and user_id = ?`
+	result, err := m.conn().ExecContext(ctx, stmt, id, userID)
+	if err != nil {
+		return translateSQLiteError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// DeleteOtherSessions logs out every session of the user except keepID.
+func (m *SQLiteDBRepo) DeleteOtherSessions(ctx context.Context, userID, keepID int) error {
+	ctx, cancel := m.Timeouts.withTimeout(ctx, "DeleteOtherSessions")
+	defer cancel()
+
+	stmt := `delete from sessions where user_id = ? and id <> ?`
+	_, err := m.conn().ExecContext(ctx, stmt, userID, keepID)
+
+	return translateSQLiteError(err)
+}
@@ -0,0 +1,163 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/migrations"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository/repotest"
+	_ "modernc.org/sqlite"
+	"path/filepath"
+	"testing"
+)
+
+// newSQLiteRepo returns a repository backed by a freshly migrated database file
+// that is removed when the test finishes.
+func newSQLiteRepo(t *testing.T) *SQLiteDBRepo {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", SQLiteDSN(filepath.Join(t.TempDir(), "users.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	migrator, err := migrations.New(db, "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrator.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return &SQLiteDBRepo{DB: db}
+}
+
+func TestSQLiteDBRepo_Users(t *testing.T) {
+	ctx := context.Background()
+	repo := newSQLiteRepo(t)
+
+	id, err := repo.InsertUser(ctx, data.User{FirstName: "Admin", LastName: "User", Email: "Admin@Example.com", Password: "secret", IsAdmin: 1})
+	if err != nil {
+		t.Fatalf("InsertUser() returned an error: %s", err)
+	}
+
+	if id != 1 {
+		t.Errorf("InsertUser() returned wrong id; expected 1, but got %d", id)
+	}
+
+	_, err = repo.InsertUser(ctx, data.User{FirstName: "Jack", LastName: "Smith", Email: "jack@smith.com", Password: "secret"})
+	if err != nil {
+		t.Fatalf("InsertUser() returned an error: %s", err)
+	}
+
+	users, err := repo.AllUsers(ctx)
+	if err != nil {
+		t.Errorf("AllUsers() returned an error: %s", err)
+	}
+
+	if len(users) != 2 {
+		t.Errorf("AllUsers() returned wrong size; expected 2, got %d", len(users))
+	}
+
+	user, err := repo.GetUserByEmail(ctx, "admin@EXAMPLE.com")
+	if err != nil {
+		t.Fatalf("GetUserByEmail() returned an error: %s", err)
+	}
+
+	if user.ID != 1 || user.Email != "admin@example.com" {
+		t.Errorf("GetUserByEmail() returned wrong user; expected 1 admin@example.com, got %d %s", user.ID, user.Email)
+	}
+
+	matches, err := user.PasswordMatches("secret")
+	if err != nil || !matches {
+		t.Errorf("stored password should match 'secret' but does not: %v", err)
+	}
+
+	user.FirstName = "Jane"
+	if err := repo.UpdateUser(ctx, *user); err != nil {
+		t.Errorf("UpdateUser() returned an error: %s", err)
+	}
+
+	user, _ = repo.GetUser(ctx, 1)
+	if user.FirstName != "Jane" {
+		t.Errorf("expected updated first name Jane, but got %s", user.FirstName)
+	}
+
+	if err := repo.ResetPassword(ctx, 1, "password"); err != nil {
+		t.Errorf("ResetPassword() returned an error: %s", err)
+	}
+
+	user, _ = repo.GetUser(ctx, 1)
+	if matches, _ := user.PasswordMatches("password"); !matches {
+		t.Error("password should match 'password' but does not")
+	}
+
+	if err := repo.DeleteUser(ctx, 2); err != nil {
+		t.Errorf("DeleteUser() returned an error: %s", err)
+	}
+
+	if _, err := repo.GetUser(ctx, 2); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("GetUser() for a deleted user should return ErrNotFound, got %v", err)
+	}
+
+	if err := repo.DeleteUser(ctx, 2); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("DeleteUser() for a missing user should return ErrNotFound, got %v", err)
+	}
+
+	_, err = repo.InsertUser(ctx, data.User{Email: "ADMIN@example.com", Password: "secret"})
+	if !errors.Is(err, repository.ErrDuplicate) {
+		t.Errorf("InsertUser() with an existing email should return ErrDuplicate, got %v", err)
+	}
+}
+
+func TestSQLiteDBRepo_InsertUserImage(t *testing.T) {
+	ctx := context.Background()
+	repo := newSQLiteRepo(t)
+
+	_, _ = repo.InsertUser(ctx, data.User{Email: "admin@example.com", Password: "secret"})
+
+	for _, fileName := range []string{"first.jpg", "second.jpg"} {
+		if _, err := repo.InsertUserImage(ctx, data.UserImage{UserID: 1, FileName: fileName}); err != nil {
+			t.Errorf("inserting user image %s failed: %s", fileName, err)
+		}
+	}
+
+	user, _ := repo.GetUser(ctx, 1)
+	if user.ProfilePic.FileName != "second.jpg" {
+		t.Errorf("expected the newest image second.jpg to replace the old one, but got %s", user.ProfilePic.FileName)
+	}
+
+	_, err := repo.InsertUserImage(ctx, data.UserImage{UserID: 100, FileName: "test.jpg"})
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("InsertUserImage() with a non-existent user should return ErrConflict, got %v", err)
+	}
+}
+
+func TestSQLiteDBRepo_WithTx(t *testing.T) {
+	ctx := context.Background()
+	repo := newSQLiteRepo(t)
+
+	err := repo.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		if _, err := repo.InsertUser(ctx, data.User{Email: "tx@example.com", Password: "secret"}); err != nil {
+			return err
+		}
+		return errors.New("abort")
+	}, repository.WithIsolation(sql.LevelSerializable))
+	if err == nil {
+		t.Error("WithTx() should return the callback error")
+	}
+
+	if _, err := repo.GetUserByEmail(ctx, "tx@example.com"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("user inserted in a rolled back transaction should not exist, got %v", err)
+	}
+}
+
+func TestSQLiteDBRepo_Conformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) repository.DataBaseRepo {
+		return newSQLiteRepo(t)
+	})
+}
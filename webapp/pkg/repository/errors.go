@@ -0,0 +1,19 @@
+package repository
+
+import "errors"
+
+// The errors below are returned (possibly wrapped) by every DataBaseRepo
+// implementation, so that callers can use errors.Is to tell a missing row
+// from a broken database.
+var (
+	// ErrNotFound is returned when the requested row does not exist.
+	ErrNotFound = errors.New("repository: not found")
+
+	// ErrDuplicate is returned when a write would violate a unique constraint,
+	// such as inserting a second user with the same email address.
+	ErrDuplicate = errors.New("repository: duplicate")
+
+	// ErrConflict is returned when a write conflicts with the current state of
+	// the data, such as a foreign key pointing at a row that does not exist.
+	ErrConflict = errors.New("repository: conflict")
+)
@@ -1,18 +1,196 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
 	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"time"
 )
 
+// DefaultHistoryLimit is how many of a user's previous passwords a repository
+// keeps when it isn't configured with a limit, which is more than the default
+// password policy looks at.
+const DefaultHistoryLimit = 10
+
 type DataBaseRepo interface {
 	Connection() *sql.DB
-	AllUsers() ([]*data.User, error)
-	GetUser(id int) (*data.User, error)
-	GetUserByEmail(email string) (*data.User, error)
-	UpdateUser(u data.User) error
-	DeleteUser(id int) error
-	InsertUser(user data.User) (int, error)
-	ResetPassword(id int, password string) error
-	InsertUserImage(i data.UserImage) (int, error)
+	AllUsers(ctx context.Context) ([]*data.User, error)
+	GetUser(ctx context.Context, id int) (*data.User, error)
+	GetUserByEmail(ctx context.Context, email string) (*data.User, error)
+	UpdateUser(ctx context.Context, u data.User) error
+	DeleteUser(ctx context.Context, id int) error
+
+	// InsertUser inserts a new user and returns their id. A zero EmailVerifiedAt
+	// is stored as unverified.
+	InsertUser(ctx context.Context, user data.User) (int, error)
+
+	// ResetPassword changes the user's password, adding the one it replaces to
+	// their history. Only the repository's history limit of previous passwords
+	// are kept; older ones are deleted in the same transaction.
+	ResetPassword(ctx context.Context, id int, password string) error
+
+	// UpdatePasswordHash stores a new hash of the user's current password, made
+	// with the repository's hasher. Unlike ResetPassword, it leaves the password
+	// history alone, since the password itself doesn't change.
+	UpdatePasswordHash(ctx context.Context, id int, password string) error
+
+	// PasswordHistory returns the hashes of up to limit passwords the user had
+	// before their current one, newest first. ResetPassword adds to it.
+	PasswordHistory(ctx context.Context, id int, limit int) ([]string, error)
+
+	// InsertUserImage inserts a profile image and makes it the user's current
+	// one. The image they had before stays in their history.
+	InsertUserImage(ctx context.Context, i data.UserImage) (int, error)
+
+	// AllUserImages returns the user's profile images, current or not, newest
+	// first.
+	AllUserImages(ctx context.Context, userID int) ([]*data.UserImage, error)
+
+	// SetCurrentUserImage makes one of the user's earlier profile images their
+	// current one again. It returns ErrNotFound if the user has no image with
+	// that id.
+	SetCurrentUserImage(ctx context.Context, userID, id int) error
+
+	// ClearCurrentUserImage leaves the user without a profile image; the image
+	// they had stays in their history. It returns ErrNotFound if they have none.
+	ClearCurrentUserImage(ctx context.Context, userID int) error
+
+	// DeleteUserImage deletes one of the user's profile images from their
+	// history, current or not. It returns ErrNotFound if the user has no image
+	// with that id.
+	DeleteUserImage(ctx context.Context, userID, id int) error
+
+	// UserImageFileNames returns the file names of every user's profile images,
+	// so that stored files no image refers to can be removed.
+	UserImageFileNames(ctx context.Context) ([]string, error)
+
+	// RevokeSessions sets the user's SessionsRevokedAt to now, so that every
+	// session and token issued to them before is rejected, and deletes their
+	// sessions.
+	RevokeSessions(ctx context.Context, id int) error
+
+	// InsertPasswordResetToken stores the hash of a password reset token for the
+	// user, valid until expiresAt.
+	InsertPasswordResetToken(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error
+
+	// ConsumePasswordResetToken returns the user an unexpired reset token belongs
+	// to, and deletes all of that user's reset tokens so none can be used again. It
+	// returns ErrNotFound if the token is unknown or has expired.
+	ConsumePasswordResetToken(ctx context.Context, tokenHash string) (int, error)
+
+	// InsertEmailVerificationToken stores the hash of an email verification token
+	// for the user, valid until expiresAt.
+	InsertEmailVerificationToken(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error
+
+	// VerifyEmail marks the email address of the user an unexpired verification
+	// token belongs to as verified, and deletes all of that user's verification
+	// tokens. It returns the user's id, or ErrNotFound if the token is unknown or
+	// has expired.
+	VerifyEmail(ctx context.Context, tokenHash string) (int, error)
+
+	// SetTOTPSecret stores a new authenticator secret for the user and turns
+	// two-factor authentication off until EnableTOTP confirms it.
+	SetTOTPSecret(ctx context.Context, id int, secret string) error
+
+	// EnableTOTP turns on two-factor authentication for the user, replacing their
+	// recovery codes with the given hashes. It returns ErrNotFound if the user has
+	// no secret.
+	EnableTOTP(ctx context.Context, id int, recoveryCodeHashes []string) error
+
+	// DisableTOTP turns off two-factor authentication for the user, and deletes
+	// their secret and recovery codes.
+	DisableTOTP(ctx context.Context, id int) error
+
+	// UseTOTPStep records that the user's code for the given time step has been
+	// accepted. It returns ErrConflict if a code for that step, or a later one,
+	// was accepted before, so codes can't be replayed.
+	UseTOTPStep(ctx context.Context, id int, step int64) error
+
+	// UseRecoveryCode deletes one of the user's recovery codes by its hash. It
+	// returns ErrNotFound if the user has no such code.
+	UseRecoveryCode(ctx context.Context, id int, codeHash string) error
+
+	// InsertAccessToken stores a personal access token, by its TokenHash, and
+	// returns its id.
+	InsertAccessToken(ctx context.Context, t data.AccessToken) (int, error)
+
+	// GetAccessTokenByHash returns the access token with the given hash, expired
+	// or not. It returns ErrNotFound if there is none.
+	GetAccessTokenByHash(ctx context.Context, tokenHash string) (*data.AccessToken, error)
+
+	// AllAccessTokens returns the user's access tokens, oldest first.
+	AllAccessTokens(ctx context.Context, userID int) ([]*data.AccessToken, error)
+
+	// TouchAccessToken sets the time the access token was last used.
+	TouchAccessToken(ctx context.Context, id int, usedAt time.Time) error
+
+	// DeleteAccessToken revokes one of the user's access tokens. It returns
+	// ErrNotFound if the user has no token with that id.
+	DeleteAccessToken(ctx context.Context, userID, id int) error
+
+	// InsertOAuthClient registers an OAuth client and returns its id.
+	InsertOAuthClient(ctx context.Context, c data.OAuthClient) (int, error)
+
+	// GetOAuthClient returns the OAuth client with the given client id. It
+	// returns ErrNotFound if there is none.
+	GetOAuthClient(ctx context.Context, clientID string) (*data.OAuthClient, error)
+
+	// AllOAuthClients returns every OAuth client, oldest first.
+	AllOAuthClients(ctx context.Context) ([]*data.OAuthClient, error)
+
+	// DeleteOAuthClient deletes an OAuth client, with its codes and consents. It
+	// returns ErrNotFound if there is no such client.
+	DeleteOAuthClient(ctx context.Context, clientID string) error
+
+	// InsertOAuthCode stores an authorization code, by its CodeHash.
+	InsertOAuthCode(ctx context.Context, c data.OAuthCode) error
+
+	// ConsumeOAuthCode deletes an authorization code and returns it, so it can
+	// only be used once. It returns ErrNotFound if the code is unknown or has
+	// expired.
+	ConsumeOAuthCode(ctx context.Context, codeHash string) (*data.OAuthCode, error)
+
+	// OAuthConsent returns the scopes the user has agreed to give the client. It
+	// returns ErrNotFound if they have never agreed to anything.
+	OAuthConsent(ctx context.Context, userID int, clientID string) ([]string, error)
+
+	// SaveOAuthConsent records the scopes the user has agreed to give the client,
+	// replacing what they agreed to before.
+	SaveOAuthConsent(ctx context.Context, userID int, clientID string, scopes []string) error
+
+	// RevokeTokenID records that the JWT with the given id, its jti claim, must no
+	// longer be accepted, and forgets revocations of tokens that have expired.
+	// Revoking an id twice is not an error.
+	RevokeTokenID(ctx context.Context, id string, expiresAt time.Time) error
+
+	// TokenIDRevoked reports whether the JWT with the given id has been revoked.
+	TokenIDRevoked(ctx context.Context, id string) (bool, error)
+
+	// InsertSession stores a new session, last seen now, and returns its id. The
+	// user's expired sessions are deleted.
+	InsertSession(ctx context.Context, s data.Session) (int, error)
+
+	// GetSession returns the session with the given id, expired or not. It
+	// returns ErrNotFound if there is none.
+	GetSession(ctx context.Context, id int) (*data.Session, error)
+
+	// AllSessions returns the user's unexpired sessions, oldest first.
+	AllSessions(ctx context.Context, userID int) ([]*data.Session, error)
+
+	// UpdateSession stores the Device, IP, UserAgent, LastSeenAt and ExpiresAt of
+	// a session. It returns ErrNotFound if there is no such session.
+	UpdateSession(ctx context.Context, s data.Session) error
+
+	// DeleteSession logs one of the user's sessions out. It returns ErrNotFound
+	// if the user has no session with that id.
+	DeleteSession(ctx context.Context, userID, id int) error
+
+	// DeleteOtherSessions logs out every session of the user except keepID.
+	DeleteOtherSessions(ctx context.Context, userID, keepID int) error
+
+	// WithTx runs fn inside a transaction, passing it a repository bound to that
+	// transaction. The transaction is committed when fn returns nil, and rolled back
+	// when fn returns an error or panics. Calling WithTx on a repository that is
+	// already bound to a transaction joins it, and opts are ignored.
+	WithTx(ctx context.Context, fn func(repo DataBaseRepo) error, opts ...TxOption) error
 }
@@ -0,0 +1,1191 @@
+// Package repotest is a conformance suite for repository.DataBaseRepo
+// implementations. Every backend runs the same checks, so they all agree on
+// behaviour, including which typed errors are returned:
+//
+//	func TestMyRepo(t *testing.T) {
+//		repotest.Run(t, func(t *testing.T) repository.DataBaseRepo {
+//			return newEmptyRepo(t)
+//		})
+//	}
+package repotest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Factory returns a new, empty repository for a single test. Use t.Cleanup to
+// release anything it opens.
+type Factory func(t *testing.T) repository.DataBaseRepo
+
+// Run runs every conformance check as a subtest of t, each against a fresh
+// repository from newRepo.
+func Run(t *testing.T, newRepo Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, repo repository.DataBaseRepo)
+	}{
+		{"InsertAndGetUser", testInsertAndGetUser},
+		{"AllUsers", testAllUsers},
+		{"EmailIsCaseInsensitive", testEmailIsCaseInsensitive},
+		{"UpdateUser", testUpdateUser},
+		{"DeleteUser", testDeleteUser},
+		{"ResetPassword", testResetPassword},
+		{"PasswordHistory", testPasswordHistory},
+		{"PasswordHistoryLimit", testPasswordHistoryLimit},
+		{"UpdatePasswordHash", testUpdatePasswordHash},
+		{"InsertUserImage", testInsertUserImage},
+		{"DeleteUserImage", testDeleteUserImage},
+		{"UserImageHistory", testUserImageHistory},
+		{"RevokeSessions", testRevokeSessions},
+		{"PasswordResetTokens", testPasswordResetTokens},
+		{"EmailVerification", testEmailVerification},
+		{"TOTP", testTOTP},
+		{"AccessTokens", testAccessTokens},
+		{"Sessions", testSessions},
+		{"OAuthClients", testOAuthClients},
+		{"OAuthCodesAndConsents", testOAuthCodesAndConsents},
+		{"RevokedTokens", testRevokedTokens},
+		{"NotFound", testNotFound},
+		{"Duplicate", testDuplicate},
+		{"Conflict", testConflict},
+		{"WithTx", testWithTx},
+	}
+
+	for _, e := range tests {
+		e := e
+		t.Run(e.name, func(t *testing.T) {
+			e.test(t, newRepo(t))
+		})
+	}
+}
+
+// insertUser inserts a user with password "secret" and fails the test on error.
+func insertUser(t *testing.T, repo repository.DataBaseRepo, firstName, lastName, email string) int {
+	t.Helper()
+
+	id, err := repo.InsertUser(context.Background(), data.User{
+		FirstName: firstName,
+		LastName:  lastName,
+		Email:     email,
+		Password:  "secret",
+	})
+	if err != nil {
+		t.Fatalf("InsertUser(%s) returned an error: %s", email, err)
+	}
+
+	return id
+}
+
+func testInsertAndGetUser(t *testing.T, repo repository.DataBaseRepo) {
+	ctx := context.Background()
+
+	id, err := repo.InsertUser(ctx, data.User{FirstName: "Admin", LastName: "User", Email: "admin@example.com", Password: "secret", IsAdmin: 1})
+	if err != nil {
+		t.Fatalf("InsertUser() returned an error: %s", err)
+	}
+
+	if id <= 0 {
+		t.Errorf("InsertUser() returned invalid id %d", id)
+	}
+
+	user, err := repo.GetUser(ctx, id)
+	if err != nil {
+		t.Fatalf("GetUser() returned an error: %s", err)
+	}
+
+	if user.ID != id || user.FirstName != "Admin" || user.LastName != "User" || user.Email != "admin@example.com" || user.IsAdmin != 1 {
+		t.Errorf("GetUser() returned wrong user: %+v", user)
+	}
+
+	if user.Password == "secret" {
+		t.Error("InsertUser() stored the password in plain text")
+	}
+
+	if matches, err := user.PasswordMatches("secret"); err != nil || !matches {
+		t.Errorf("stored password should match 'secret' but does not: %v", err)
+	}
+
+	if user.CreatedAt.IsZero() || user.UpdatedAt.IsZero() {
+		t.Error("InsertUser() did not set created_at and updated_at")
+	}
+
+	byEmail, err := repo.GetUserByEmail(ctx, "admin@example.com")
+	if err != nil {
+		t.Fatalf("GetUserByEmail() returned an error: %s", err)
+	}
+
+	if byEmail.ID != id {
+		t.Errorf("GetUserByEmail() returned wrong id; expected %d, got %d", id, byEmail.ID)
+	}
+}
+
+func testAllUsers(t *testing.T, repo repository.DataBaseRepo) {
+	ctx := context.Background()
+
+	users, err := repo.AllUsers(ctx)
+	if err != nil {
+		t.Fatalf("AllUsers() returned an error: %s", err)
+	}
+
+	if len(users) != 0 {
+		t.Errorf("AllUsers() on an empty repository returned %d users", len(users))
+	}
+
+	insertUser(t, repo, "Jack", "Smith", "jack@smith.com")
+	insertUser(t, repo, "Admin", "User", "admin@example.com")
+	insertUser(t, repo, "Ann", "Brown", "ann@brown.com")
+
+	users, err = repo.AllUsers(ctx)
+	if err != nil {
+		t.Fatalf("AllUsers() returned an error: %s", err)
+	}
+
+	var lastNames []string
+	for _, u := range users {
+		lastNames = append(lastNames, u.LastName)
+	}
+
+	expected := []string{"Brown", "Smith", "User"}
+	if len(lastNames) != len(expected) {
+		t.Fatalf("AllUsers() returned wrong size; expected %d, got %d", len(expected), len(lastNames))
+	}
+
+	for i := range expected {
+		if lastNames[i] != expected[i] {
+			t.Errorf("AllUsers() should be ordered by last name; expected %v, got %v", expected, lastNames)
+			break
+		}
+	}
+}
+
+func testEmailIsCaseInsensitive(t *testing.T, repo repository.DataBaseRepo) {
+	ctx := context.Background()
+
+	id := insertUser(t, repo, "Case", "User", "  Case@Example.COM ")
+
+	user, err := repo.GetUserByEmail(ctx, "CASE@example.com")
+	if err != nil {
+		t.Fatalf("GetUserByEmail() returned an error: %s", err)
+	}
+
+	if user.ID != id || user.Email != "case@example.com" {
+		t.Errorf("expected user %d with normalized email case@example.com, got %d %s", id, user.ID, user.Email)
+	}
+}
+
+func testUpdateUser(t *testing.T, repo repository.DataBaseRepo) {
+	ctx := context.Background()
+
+	id := insertUser(t, repo, "Jack", "Smith", "jack@smith.com")
+
+	user, _ := repo.GetUser(ctx, id)
+	user.FirstName = "Jane"
+	user.Email = "Jane@Smith.com"
+	user.IsAdmin = 1
+
+	if err := repo.UpdateUser(ctx, *user); err != nil {
+		t.Fatalf("UpdateUser() returned an error: %s", err)
+	}
+
+	user, _ = repo.GetUser(ctx, id)
+	if user.FirstName != "Jane" || user.Email != "jane@smith.com" || user.IsAdmin != 1 {
+		t.Errorf("expected updated record to have first name Jane, email jane@smith.com and be admin, but got %+v", user)
+	}
+
+	if matches, _ := user.PasswordMatches("secret"); !matches {
+		t.Error("UpdateUser() should not change the password")
+	}
+}
+
+func testDeleteUser(t *testing.T, repo repository.DataBaseRepo) {
+	ctx := context.Background()
+
+	id := insertUser(t, repo, "Jack", "Smith", "jack@smith.com")
+	_, _ = repo.InsertUserImage(ctx, data.UserImage{UserID: id, FileName: "jack.jpg"})
+
+	if err := repo.DeleteUser(ctx, id); err != nil {
+		t.Fatalf("DeleteUser() returned an error: %s", err)
+	}
+
+	if _, err := repo.GetUser(ctx, id); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("GetUser() for a deleted user should return ErrNotFound, got %v", err)
+	}
+
+	// the email address is free again once the user is gone
+	insertUser(t, repo, "Jack", "Smith", "jack@smith.com")
+}
+
+func testResetPassword(t *testing.T, repo repository.DataBaseRepo) {
+	ctx := context.Background()
+
+	id := insertUser(t, repo, "Admin", "User", "admin@example.com")
+
+	if err := repo.ResetPassword(ctx, id, "password"); err != nil {
+		t.Fatalf("ResetPassword() returned an error: %s", err)
+	}
+
+	user, _ := repo.GetUser(ctx, id)
+	if matches, _ := user.PasswordMatches("password"); !matches {
+		t.Error("password should match 'password' but does not")
+	}
+
+	if matches, _ := user.PasswordMatches("secret"); matches {
+		t.Error("old password should no longer match")
+	}
+}
+
+// testPasswordHistoryLimit expects the repository to keep the default number of
+// previous passwords.
+func testPasswordHistoryLimit(t *testing.T, repo repository.DataBaseRepo) {
+	ctx := context.Background()
+
+	id := insertUser(t, repo, "Admin", "User", "admin@example.com")
+
+	resets := repository.DefaultHistoryLimit + 2
+	for i := 1; i <= resets; i++ {
+		if err := repo.ResetPassword(ctx, id, fmt.Sprintf("password %d", i)); err != nil {
+			t.Fatalf("ResetPassword() returned an error: %s", err)
+		}
+	}
+
+	hashes, err := repo.PasswordHistory(ctx, id, resets)
+	if err != nil {
+		t.Fatalf("PasswordHistory() returned an error: %s", err)
+	}
+
+	if len(hashes) != repository.DefaultHistoryLimit {
+		t.Fatalf("expected the %d most recent previous passwords to be kept, but got %d", repository.DefaultHistoryLimit, len(hashes))
+	}
+
+	// "secret" and "password 1" were the oldest, so they are the ones deleted
+	if matches, _ := data.VerifyPassword(hashes[len(hashes)-1], fmt.Sprintf("password %d", resets-repository.DefaultHistoryLimit)); !matches {
+		t.Error("expected the oldest passwords to be the ones deleted")
+	}
+}
+
+func testUpdatePasswordHash(t *testing.T, repo repository.DataBaseRepo) {
+	ctx := context.Background()
+
+	id := insertUser(t, repo, "Admin", "User", "admin@example.com")
+	_ = repo.ResetPassword(ctx, id, "password")
+	before, _ := repo.GetUser(ctx, id)
+
+	if err := repo.UpdatePasswordHash(ctx, id, "password"); err != nil {
+		t.Fatalf("UpdatePasswordHash() returned an error: %s", err)
+	}
+
+	user, _ := repo.GetUser(ctx, id)
+	if matches, _ := user.PasswordMatches("password"); !matches || user.Password == before.Password {
+		t.Error("expected a new hash of the same password")
+	}
+
+	hashes, _ := repo.PasswordHistory(ctx, id, 5)
+	if len(hashes) != 1 {
+		t.Errorf("expected the password history to be left alone, but it has %d entries", len(hashes))
+	}
+}
+
+func testPasswordHistory(t *testing.T, repo repository.DataBaseRepo) {
+	ctx := context.Background()
+
+	id := insertUser(t, repo, "Admin", "User", "admin@example.com")
+
+	hashes, err := repo.PasswordHistory(ctx, id, 5)
+	if err != nil {
+		t.Fatalf("PasswordHistory() returned an error: %s", err)
+	}
+
+	if len(hashes) != 0 {
+		t.Errorf("a new user should have no password history, but got %d entries", len(hashes))
+	}
+
+	_ = repo.ResetPassword(ctx, id, "password")
+	_ = repo.ResetPassword(ctx, id, "current")
+
+	hashes, err = repo.PasswordHistory(ctx, id, 5)
+	if err != nil {
+		t.Fatalf("PasswordHistory() returned an error: %s", err)
+	}
+
+	if len(hashes) != 2 {
+		t.Fatalf("expected 2 previous passwords, but got %d", len(hashes))
+	}
+
+	for i, expected := range []string{"password", "secret"} {
+		if matches, _ := data.VerifyPassword(hashes[i], expected); !matches {
+			t.Errorf("expected history entry %d to match %q, newest first", i, expected)
+		}
+	}
+
+	hashes, _ = repo.PasswordHistory(ctx, id, 1)
+	if len(hashes) != 1 {
+		t.Errorf("PasswordHistory() should respect the limit; expected 1 entry, but got %d", len(hashes))
+	}
+
+	hashes, err = repo.PasswordHistory(ctx, 100, 5)
+	if err != nil || len(hashes) != 0 {
+		t.Errorf("PasswordHistory() for a missing user should be empty, got %d entries and %v", len(hashes), err)
+	}
+
+	if err := repo.DeleteUser(ctx, id); err != nil {
+		t.Fatalf("DeleteUser() returned an error: %s", err)
+	}
+
+	hashes, _ = repo.PasswordHistory(ctx, id, 5)
+	if len(hashes) != 0 {
+		t.Errorf("deleting a user should delete their password history, but %d entries remain", len(hashes))
+	}
+}
+
+func testInsertUserImage(t *testing.T, repo repository.DataBaseRepo) {
+	ctx := context.Background()
+
+	id := insertUser(t, repo, "Admin", "User", "admin@example.com")
+
+	user, _ := repo.GetUser(ctx, id)
+	if user.ProfilePic.FileName != "" {
+		t.Errorf("expected no profile image yet, but got %s", user.ProfilePic.FileName)
+	}
+
+	firstID, err := repo.InsertUserImage(ctx, data.UserImage{UserID: id, FileName: "first.jpg"})
+	if err != nil {
+		t.Fatalf("InsertUserImage() returned an error: %s", err)
+	}
+
+	secondID, err := repo.InsertUserImage(ctx, data.UserImage{UserID: id, FileName: "second.jpg"})
+	if err != nil {
+		t.Fatalf("InsertUserImage() returned an error: %s", err)
+	}
+
+	if firstID <= 0 || secondID <= 0 || firstID == secondID {
+		t.Errorf("InsertUserImage() should return new ids, got %d and %d", firstID, secondID)
+	}
+
+	user, _ = repo.GetUser(ctx, id)
+	if user.ProfilePic.FileName != "second.jpg" {
+		t.Errorf("expected the newest image second.jpg to replace the old one, but got %s", user.ProfilePic.FileName)
+	}
+
+	user, _ = repo.GetUserByEmail(ctx, "admin@example.com")
+	if user.ProfilePic.FileName != "second.jpg" {
+		t.Errorf("GetUserByEmail() should include the profile image second.jpg, but got %s", user.ProfilePic.FileName)
+	}
+
+	users, _ := repo.AllUsers(ctx)
+	if len(users) != 1 || users[0].ProfilePic.FileName != "second.jpg" {
+		t.Errorf("AllUsers() should include the profile image second.jpg, but got %+v", users)
+	}
+}
+
+func testDeleteUserImage(t *testing.T, repo repository.DataBaseRepo) {
+	ctx := context.Background()
+
+	id := insertUser(t, repo, "Admin", "User", "admin@example.com")
+	other := insertUser(t, repo, "Jack", "Smith", "jack@smith.com")
+
+	if err := repo.ClearCurrentUserImage(ctx, id); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("ClearCurrentUserImage() without an image should return ErrNotFound, got %v", err)
+	}
+
+	firstID, _ := repo.InsertUserImage(ctx, data.UserImage{UserID: id, FileName: "first.jpg"})
+	_, _ = repo.InsertUserImage(ctx, data.UserImage{UserID: id, FileName: "second.jpg"})
+
+	if err := repo.ClearCurrentUserImage(ctx, id); err != nil {
+		t.Fatalf("ClearCurrentUserImage() returned an error: %s", err)
+	}
+
+	user, _ := repo.GetUser(ctx, id)
+	if user.ProfilePic.FileName != "" {
+		t.Errorf("expected the user to have no profile image, but got %s", user.ProfilePic.FileName)
+	}
+
+	images, _ := repo.AllUserImages(ctx, id)
+	if len(images) != 2 {
+		t.Errorf("expected a cleared image to stay in the history, but got %d images", len(images))
+	}
+
+	if err := repo.DeleteUserImage(ctx, other, firstID); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("DeleteUserImage() of another user's image should return ErrNotFound, got %v", err)
+	}
+
+	if err := repo.DeleteUserImage(ctx, id, firstID); err != nil {
+		t.Fatalf("DeleteUserImage() returned an error: %s", err)
+	}
+
+	images, _ = repo.AllUserImages(ctx, id)
+	if len(images) != 1 || images[0].FileName != "second.jpg" {
+		t.Errorf("expected only second.jpg to be left, but got %+v", images)
+	}
+
+	if err := repo.DeleteUserImage(ctx, id, firstID); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("DeleteUserImage() of a deleted image should return ErrNotFound, got %v", err)
+	}
+
+	names, err := repo.UserImageFileNames(ctx)
+	if err != nil || len(names) != 1 || names[0] != "second.jpg" {
+		t.Errorf("expected only second.jpg to be referenced, but got %v and %v", names, err)
+	}
+}
+
+func testUserImageHistory(t *testing.T, repo repository.DataBaseRepo) {
+	ctx := context.Background()
+
+	id := insertUser(t, repo, "Admin", "User", "admin@example.com")
+	other := insertUser(t, repo, "Jack", "Smith", "jack@smith.com")
+
+	firstID, _ := repo.InsertUserImage(ctx, data.UserImage{UserID: id, FileName: "first.jpg"})
+	secondID, _ := repo.InsertUserImage(ctx, data.UserImage{UserID: id, FileName: "second.jpg"})
+	_, _ = repo.InsertUserImage(ctx, data.UserImage{UserID: other, FileName: "jack.jpg"})
+
+	images, err := repo.AllUserImages(ctx, id)
+	if err != nil {
+		t.Fatalf("AllUserImages() returned an error: %s", err)
+	}
+	if len(images) != 2 || images[0].ID != secondID || !images[0].IsCurrent || images[1].ID != firstID || images[1].IsCurrent {
+		t.Fatalf("expected second.jpg as the current image, then first.jpg, but got %+v", images)
+	}
+	if images[1].CreatedAt.IsZero() {
+		t.Errorf("expected images to have a creation time, but got %+v", images[1])
+	}
+
+	if err := repo.SetCurrentUserImage(ctx, other, firstID); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("SetCurrentUserImage() with another user's image should return ErrNotFound, got %v", err)
+	}
+
+	if err := repo.SetCurrentUserImage(ctx, id, firstID); err != nil {
+		t.Fatalf("SetCurrentUserImage() returned an error: %s", err)
+	}
+
+	user, _ := repo.GetUser(ctx, id)
+	if user.ProfilePic.FileName != "first.jpg" {
+		t.Errorf("expected first.jpg to be the profile image again, but got %s", user.ProfilePic.FileName)
+	}
+
+	images, _ = repo.AllUserImages(ctx, id)
+	current := 0
+	for _, i := range images {
+		if i.IsCurrent {
+			current++
+		}
+	}
+	if current != 1 {
+		t.Errorf("expected exactly one current image, but got %d", current)
+	}
+
+	// choosing the current image again changes nothing
+	if err := repo.SetCurrentUserImage(ctx, id, firstID); err != nil {
+		t.Errorf("SetCurrentUserImage() of the current image returned an error: %s", err)
+	}
+
+	jack, _ := repo.GetUser(ctx, other)
+	if jack.ProfilePic.FileName != "jack.jpg" {
+		t.Errorf("expected other users' images to be left alone, but got %s", jack.ProfilePic.FileName)
+	}
+
+	names, _ := repo.UserImageFileNames(ctx)
+	if len(names) != 3 {
+		t.Errorf("expected every image, current or not, to be referenced, but got %v", names)
+	}
+}
+
+func testRevokeSessions(t *testing.T, repo repository.DataBaseRepo) {
+	ctx := context.Background()
+
+	id := insertUser(t, repo, "Admin", "User", "admin@example.com")
+
+	user, _ := repo.GetUser(ctx, id)
+	if !user.SessionsRevokedAt.IsZero() {
+		t.Errorf("a new user should have no revoked sessions, but got %s", user.SessionsRevokedAt)
+	}
+
+	before := time.Now().Add(-time.Second)
+	if err := repo.RevokeSessions(ctx, id); err != nil {
+		t.Fatalf("RevokeSessions() returned an error: %s", err)
+	}
+
+	user, _ = repo.GetUserByEmail(ctx, "admin@example.com")
+	if !user.SessionsRevokedAt.After(before) {
+		t.Errorf("expected SessionsRevokedAt to be set to now, but got %s", user.SessionsRevokedAt)
+	}
+
+	if err := repo.RevokeSessions(ctx, 100); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("RevokeSessions() for a missing user should return ErrNotFound, got %v", err)
+	}
+}
+
+func testPasswordResetTokens(t *testing.T, repo repository.DataBaseRepo) {
+	ctx := context.Background()
+
+	id := insertUser(t, repo, "Admin", "User", "admin@example.com")
+	expires := time.Now().Add(time.Hour)
+
+	for _, hash := range []string{"first", "second"} {
+		if err := repo.InsertPasswordResetToken(ctx, id, hash, expires); err != nil {
+			t.Fatalf("InsertPasswordResetToken() returned an error: %s", err)
+		}
+	}
+
+	if err := repo.InsertPasswordResetToken(ctx, id, "first", expires); !errors.Is(err, repository.ErrDuplicate) {
+		t.Errorf("inserting the same token hash twice should return ErrDuplicate, got %v", err)
+	}
+
+	if err := repo.InsertPasswordResetToken(ctx, 100, "other", expires); !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("inserting a token for a missing user should return ErrConflict, got %v", err)
+	}
+
+	userID, err := repo.ConsumePasswordResetToken(ctx, "second")
+	if err != nil {
+		t.Fatalf("ConsumePasswordResetToken() returned an error: %s", err)
+	}
+
+	if userID != id {
+		t.Errorf("ConsumePasswordResetToken() returned wrong user; expected %d, got %d", id, userID)
+	}
+
+	// using a token deletes it along with every other token of the user
+	for _, hash := range []string{"first", "second", "unknown"} {
+		if _, err := repo.ConsumePasswordResetToken(ctx, hash); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("consuming token %q should return ErrNotFound, got %v", hash, err)
+		}
+	}
+
+	_ = repo.InsertPasswordResetToken(ctx, id, "expired", time.Now().Add(-time.Minute))
+	if _, err := repo.ConsumePasswordResetToken(ctx, "expired"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("consuming an expired token should return ErrNotFound, got %v", err)
+	}
+}
+
+func testEmailVerification(t *testing.T, repo repository.DataBaseRepo) {
+	ctx := context.Background()
+
+	verifiedAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	adminID, err := repo.InsertUser(ctx, data.User{Email: "admin@example.com", Password: "secret", EmailVerifiedAt: verifiedAt})
+	if err != nil {
+		t.Fatalf("InsertUser() returned an error: %s", err)
+	}
+
+	admin, _ := repo.GetUser(ctx, adminID)
+	if !admin.EmailVerifiedAt.Equal(verifiedAt) {
+		t.Errorf("expected EmailVerifiedAt %s to be stored, but got %s", verifiedAt, admin.EmailVerifiedAt)
+	}
+
+	id := insertUser(t, repo, "Jack", "Smith", "jack@smith.com")
+
+	user, _ := repo.GetUserByEmail(ctx, "jack@smith.com")
+	if user.EmailVerified() {
+		t.Errorf("a user inserted without EmailVerifiedAt should be unverified, but got %s", user.EmailVerifiedAt)
+	}
+
+	expires := time.Now().Add(time.Hour)
+	for _, hash := range []string{"first", "second"} {
+		if err := repo.InsertEmailVerificationToken(ctx, id, hash, expires); err != nil {
+			t.Fatalf("InsertEmailVerificationToken() returned an error: %s", err)
+		}
+	}
+
+	if err := repo.InsertEmailVerificationToken(ctx, id, "first", expires); !errors.Is(err, repository.ErrDuplicate) {
+		t.Errorf("inserting the same token hash twice should return ErrDuplicate, got %v", err)
+	}
+
+	if err := repo.InsertEmailVerificationToken(ctx, 100, "other", expires); !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("inserting a token for a missing user should return ErrConflict, got %v", err)
+	}
+
+	_ = repo.InsertEmailVerificationToken(ctx, id, "expired", time.Now().Add(-time.Minute))
+	if _, err := repo.VerifyEmail(ctx, "expired"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("verifying with an expired token should return ErrNotFound, got %v", err)
+	}
+
+	before := time.Now().Add(-time.Second)
+	userID, err := repo.VerifyEmail(ctx, "second")
+	if err != nil {
+		t.Fatalf("VerifyEmail() returned an error: %s", err)
+	}
+
+	if userID != id {
+		t.Errorf("VerifyEmail() returned wrong user; expected %d, got %d", id, userID)
+	}
+
+	user, _ = repo.GetUser(ctx, id)
+	if !user.EmailVerifiedAt.After(before) {
+		t.Errorf("expected EmailVerifiedAt to be set to now, but got %s", user.EmailVerifiedAt)
+	}
+
+	// using a token deletes it along with every other token of the user
+	for _, hash := range []string{"first", "second", "unknown"} {
+		if _, err := repo.VerifyEmail(ctx, hash); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("verifying with token %q should return ErrNotFound, got %v", hash, err)
+		}
+	}
+}
+
+func testTOTP(t *testing.T, repo repository.DataBaseRepo) {
+	ctx := context.Background()
+
+	id := insertUser(t, repo, "Admin", "User", "admin@example.com")
+
+	if err := repo.EnableTOTP(ctx, id, []string{"a"}); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("EnableTOTP() without a secret should return ErrNotFound, got %v", err)
+	}
+
+	if err := repo.SetTOTPSecret(ctx, id, "JBSWY3DPEHPK3PXP"); err != nil {
+		t.Fatalf("SetTOTPSecret() returned an error: %s", err)
+	}
+
+	user, _ := repo.GetUser(ctx, id)
+	if user.TOTPSecret != "JBSWY3DPEHPK3PXP" || user.TOTPEnabled() {
+		t.Errorf("expected a pending secret, but got %q enabled at %s", user.TOTPSecret, user.TOTPEnabledAt)
+	}
+
+	if err := repo.EnableTOTP(ctx, id, []string{"first", "second"}); err != nil {
+		t.Fatalf("EnableTOTP() returned an error: %s", err)
+	}
+
+	user, _ = repo.GetUserByEmail(ctx, "admin@example.com")
+	if !user.TOTPEnabled() {
+		t.Error("expected two-factor authentication to be enabled")
+	}
+
+	for _, step := range []int64{100, 101} {
+		if err := repo.UseTOTPStep(ctx, id, step); err != nil {
+			t.Errorf("UseTOTPStep(%d) returned an error: %s", step, err)
+		}
+	}
+
+	for _, step := range []int64{101, 99} {
+		if err := repo.UseTOTPStep(ctx, id, step); !errors.Is(err, repository.ErrConflict) {
+			t.Errorf("UseTOTPStep(%d) after step 101 should return ErrConflict, got %v", step, err)
+		}
+	}
+
+	if err := repo.UseTOTPStep(ctx, 100, 1); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("UseTOTPStep() for a missing user should return ErrNotFound, got %v", err)
+	}
+
+	if err := repo.UseRecoveryCode(ctx, id, "first"); err != nil {
+		t.Errorf("UseRecoveryCode() returned an error: %s", err)
+	}
+
+	for _, hash := range []string{"first", "unknown"} {
+		if err := repo.UseRecoveryCode(ctx, id, hash); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("using recovery code %q should return ErrNotFound, got %v", hash, err)
+		}
+	}
+
+	// enabling again replaces the recovery codes
+	_ = repo.EnableTOTP(ctx, id, []string{"third"})
+	if err := repo.UseRecoveryCode(ctx, id, "second"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected old recovery codes to be replaced, got %v", err)
+	}
+
+	if err := repo.DisableTOTP(ctx, id); err != nil {
+		t.Fatalf("DisableTOTP() returned an error: %s", err)
+	}
+
+	user, _ = repo.GetUser(ctx, id)
+	if user.TOTPSecret != "" || user.TOTPEnabled() {
+		t.Errorf("expected the secret to be removed, but got %q enabled at %s", user.TOTPSecret, user.TOTPEnabledAt)
+	}
+
+	if err := repo.UseRecoveryCode(ctx, id, "third"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected recovery codes to be deleted, got %v", err)
+	}
+}
+
+func testAccessTokens(t *testing.T, repo repository.DataBaseRepo) {
+	ctx := context.Background()
+
+	adminID := insertUser(t, repo, "Admin", "User", "admin@example.com")
+	otherID := insertUser(t, repo, "Jack", "Smith", "jack@smith.com")
+
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	tokenID, err := repo.InsertAccessToken(ctx, data.AccessToken{
+		UserID:    adminID,
+		Name:      "deploy",
+		Scopes:    []string{"users:read", "users:write"},
+		TokenHash: "hash-1",
+		ExpiresAt: &expiresAt,
+	})
+	if err != nil {
+		t.Fatalf("InsertAccessToken() returned an error: %s", err)
+	}
+
+	_, err = repo.InsertAccessToken(ctx, data.AccessToken{UserID: adminID, Name: "backup", TokenHash: "hash-2"})
+	if err != nil {
+		t.Fatalf("InsertAccessToken() without scopes or expiry returned an error: %s", err)
+	}
+
+	if _, err := repo.InsertAccessToken(ctx, data.AccessToken{UserID: otherID, Name: "copy", TokenHash: "hash-1"}); !errors.Is(err, repository.ErrDuplicate) {
+		t.Errorf("InsertAccessToken() with a used hash should return ErrDuplicate, got %v", err)
+	}
+
+	token, err := repo.GetAccessTokenByHash(ctx, "hash-1")
+	if err != nil {
+		t.Fatalf("GetAccessTokenByHash() returned an error: %s", err)
+	}
+
+	if token.ID != tokenID || token.UserID != adminID || token.Name != "deploy" || !token.HasScope("users:write") || len(token.Scopes) != 2 {
+		t.Errorf("GetAccessTokenByHash() returned the wrong token: %+v", token)
+	}
+
+	if token.ExpiresAt == nil || !token.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("expected the token to expire at %s, but got %v", expiresAt, token.ExpiresAt)
+	}
+
+	if token.LastUsedAt != nil {
+		t.Errorf("expected a new token to be unused, but it was used at %s", token.LastUsedAt)
+	}
+
+	usedAt := time.Now().UTC().Truncate(time.Second)
+	if err := repo.TouchAccessToken(ctx, tokenID, usedAt); err != nil {
+		t.Fatalf("TouchAccessToken() returned an error: %s", err)
+	}
+
+	tokens, err := repo.AllAccessTokens(ctx, adminID)
+	if err != nil {
+		t.Fatalf("AllAccessTokens() returned an error: %s", err)
+	}
+
+	if len(tokens) != 2 || tokens[0].Name != "deploy" || tokens[1].Name != "backup" {
+		t.Fatalf("expected the admin's two tokens, oldest first, but got %d", len(tokens))
+	}
+
+	if tokens[0].LastUsedAt == nil || !tokens[0].LastUsedAt.Equal(usedAt) {
+		t.Errorf("expected the token to have been used at %s, but got %v", usedAt, tokens[0].LastUsedAt)
+	}
+
+	if tokens[1].ExpiresAt != nil || len(tokens[1].Scopes) != 0 {
+		t.Errorf("expected a token without expiry or scopes, but got %+v", tokens[1])
+	}
+
+	if err := repo.DeleteAccessToken(ctx, otherID, tokenID); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("DeleteAccessToken() for another user's token should return ErrNotFound, got %v", err)
+	}
+
+	if err := repo.DeleteAccessToken(ctx, adminID, tokenID); err != nil {
+		t.Fatalf("DeleteAccessToken() returned an error: %s", err)
+	}
+
+	if _, err := repo.GetAccessTokenByHash(ctx, "hash-1"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected a revoked token to be gone, got %v", err)
+	}
+
+	if err := repo.TouchAccessToken(ctx, tokenID, usedAt); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("TouchAccessToken() for a revoked token should return ErrNotFound, got %v", err)
+	}
+
+	// tokens go with their user
+	_ = repo.DeleteUser(ctx, adminID)
+	if _, err := repo.GetAccessTokenByHash(ctx, "hash-2"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected a deleted user's tokens to be gone, got %v", err)
+	}
+}
+
+func testOAuthClients(t *testing.T, repo repository.DataBaseRepo) {
+	ctx := context.Background()
+
+	ownerID := insertUser(t, repo, "Admin", "User", "admin@example.com")
+
+	client := data.OAuthClient{
+		ClientID:     "reports",
+		SecretHash:   "secret-hash",
+		Name:         "Reports",
+		RedirectURIs: []string{"https://reports.example.com/callback", "http://localhost:9000/callback"},
+		GrantTypes:   []string{"authorization_code", "refresh_token"},
+		Scopes:       []string{"users:read"},
+		OwnerID:      ownerID,
+	}
+
+	if _, err := repo.InsertOAuthClient(ctx, client); err != nil {
+		t.Fatalf("InsertOAuthClient() returned an error: %s", err)
+	}
+
+	if _, err := repo.InsertOAuthClient(ctx, client); !errors.Is(err, repository.ErrDuplicate) {
+		t.Errorf("InsertOAuthClient() with a used client id should return ErrDuplicate, got %v", err)
+	}
+
+	public := data.OAuthClient{ClientID: "spa", Name: "SPA", GrantTypes: []string{"authorization_code"}, OwnerID: ownerID}
+	if _, err := repo.InsertOAuthClient(ctx, public); err != nil {
+		t.Fatalf("InsertOAuthClient() for a public client returned an error: %s", err)
+	}
+
+	if _, err := repo.InsertOAuthClient(ctx, data.OAuthClient{ClientID: "orphan", Name: "Orphan", OwnerID: 100}); !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("InsertOAuthClient() for a missing owner should return ErrConflict, got %v", err)
+	}
+
+	got, err := repo.GetOAuthClient(ctx, "reports")
+	if err != nil {
+		t.Fatalf("GetOAuthClient() returned an error: %s", err)
+	}
+
+	if got.Name != "Reports" || !got.Confidential() || !got.AllowsRedirect("http://localhost:9000/callback") || !got.AllowsGrant("refresh_token") || !got.AllowsScope("users:read") || got.OwnerID != ownerID {
+		t.Errorf("GetOAuthClient() returned the wrong client: %+v", got)
+	}
+
+	clients, err := repo.AllOAuthClients(ctx)
+	if err != nil {
+		t.Fatalf("AllOAuthClients() returned an error: %s", err)
+	}
+
+	if len(clients) != 2 || clients[0].ClientID != "reports" || clients[1].Confidential() {
+		t.Errorf("expected both clients, oldest first, but got %d", len(clients))
+	}
+
+	if err := repo.DeleteOAuthClient(ctx, "reports"); err != nil {
+		t.Fatalf("DeleteOAuthClient() returned an error: %s", err)
+	}
+
+	if err := repo.DeleteOAuthClient(ctx, "reports"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("DeleteOAuthClient() twice should return ErrNotFound, got %v", err)
+	}
+
+	// clients go with their owner
+	_ = repo.DeleteUser(ctx, ownerID)
+	if _, err := repo.GetOAuthClient(ctx, "spa"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected a deleted owner's clients to be gone, got %v", err)
+	}
+}
+
+func testOAuthCodesAndConsents(t *testing.T, repo repository.DataBaseRepo) {
+	ctx := context.Background()
+
+	ownerID := insertUser(t, repo, "Admin", "User", "admin@example.com")
+	userID := insertUser(t, repo, "Jack", "Smith", "jack@smith.com")
+
+	_, err := repo.InsertOAuthClient(ctx, data.OAuthClient{ClientID: "spa", Name: "SPA", OwnerID: ownerID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := data.OAuthCode{
+		CodeHash:      "code-1",
+		ClientID:      "spa",
+		UserID:        userID,
+		RedirectURI:   "http://localhost:9000/callback",
+		Scopes:        []string{"users:read", "users:write"},
+		CodeChallenge: "challenge",
+		Nonce:         "n-0S6_WzA2Mj",
+		ExpiresAt:     time.Now().Add(time.Minute),
+	}
+
+	if err := repo.InsertOAuthCode(ctx, code); err != nil {
+		t.Fatalf("InsertOAuthCode() returned an error: %s", err)
+	}
+
+	expired := code
+	expired.CodeHash = "code-2"
+	expired.ExpiresAt = time.Now().Add(-time.Minute)
+	_ = repo.InsertOAuthCode(ctx, expired)
+
+	unknownClient := code
+	unknownClient.CodeHash = "code-3"
+	unknownClient.ClientID = "nobody"
+	if err := repo.InsertOAuthCode(ctx, unknownClient); !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("InsertOAuthCode() for a missing client should return ErrConflict, got %v", err)
+	}
+
+	got, err := repo.ConsumeOAuthCode(ctx, "code-1")
+	if err != nil {
+		t.Fatalf("ConsumeOAuthCode() returned an error: %s", err)
+	}
+
+	if got.ClientID != "spa" || got.UserID != userID || got.RedirectURI != code.RedirectURI || got.CodeChallenge != "challenge" || got.Nonce != code.Nonce || len(got.Scopes) != 2 {
+		t.Errorf("ConsumeOAuthCode() returned the wrong code: %+v", got)
+	}
+
+	for _, hash := range []string{"code-1", "code-2", "unknown"} {
+		if _, err := repo.ConsumeOAuthCode(ctx, hash); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("ConsumeOAuthCode(%q) should return ErrNotFound, got %v", hash, err)
+		}
+	}
+
+	if _, err := repo.OAuthConsent(ctx, userID, "spa"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("OAuthConsent() before any consent should return ErrNotFound, got %v", err)
+	}
+
+	for _, scopes := range [][]string{{"users:read"}, {"users:read", "users:write"}} {
+		if err := repo.SaveOAuthConsent(ctx, userID, "spa", scopes); err != nil {
+			t.Fatalf("SaveOAuthConsent() returned an error: %s", err)
+		}
+	}
+
+	scopes, err := repo.OAuthConsent(ctx, userID, "spa")
+	if err != nil || strings.Join(scopes, " ") != "users:read users:write" {
+		t.Errorf("expected the last consent to replace the first, but got %v (%v)", scopes, err)
+	}
+
+	// consents go with their client
+	_ = repo.DeleteOAuthClient(ctx, "spa")
+	if _, err := repo.OAuthConsent(ctx, userID, "spa"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected a deleted client's consents to be gone, got %v", err)
+	}
+}
+
+func testRevokedTokens(t *testing.T, repo repository.DataBaseRepo) {
+	ctx := context.Background()
+
+	if revoked, err := repo.TokenIDRevoked(ctx, "jti-1"); err != nil || revoked {
+		t.Fatalf("TokenIDRevoked() before revoking should return false, got %t and %v", revoked, err)
+	}
+
+	if err := repo.RevokeTokenID(ctx, "jti-1", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("RevokeTokenID() returned an error: %s", err)
+	}
+
+	if err := repo.RevokeTokenID(ctx, "jti-1", time.Now().Add(time.Hour)); err != nil {
+		t.Errorf("RevokeTokenID() a second time returned an error: %s", err)
+	}
+
+	// revocations of expired tokens are cleared out by the next revocation
+	_ = repo.RevokeTokenID(ctx, "jti-2", time.Now().Add(-time.Minute))
+	_ = repo.RevokeTokenID(ctx, "jti-3", time.Now().Add(time.Hour))
+
+	expected := map[string]bool{"jti-1": true, "jti-2": false, "jti-3": true, "unknown": false}
+	for id, want := range expected {
+		if revoked, err := repo.TokenIDRevoked(ctx, id); err != nil || revoked != want {
+			t.Errorf("TokenIDRevoked(%q) should return %t, got %t and %v", id, want, revoked, err)
+		}
+	}
+}
+
+func testSessions(t *testing.T, repo repository.DataBaseRepo) {
+	ctx := context.Background()
+
+	adminID := insertUser(t, repo, "Admin", "User", "admin@example.com")
+	otherID := insertUser(t, repo, "Jack", "Smith", "jack@smith.com")
+
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	newSession := func(userID int, kind string, expiresAt time.Time) int {
+		t.Helper()
+
+		id, err := repo.InsertSession(ctx, data.Session{
+			UserID:    userID,
+			Kind:      kind,
+			Device:    "Firefox on Linux",
+			IP:        "192.0.2.1",
+			UserAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:105.0) Gecko/20100101 Firefox/105.0",
+			ExpiresAt: expiresAt,
+		})
+		if err != nil {
+			t.Fatalf("InsertSession() returned an error: %s", err)
+		}
+
+		return id
+	}
+
+	expiredID := newSession(adminID, data.SessionWeb, time.Now().Add(-time.Minute))
+	apiID := newSession(adminID, data.SessionAPI, expiresAt)
+	webID := newSession(adminID, data.SessionWeb, expiresAt)
+	otherSessionID := newSession(otherID, data.SessionAPI, expiresAt)
+
+	if _, err := repo.InsertSession(ctx, data.Session{UserID: 100, Kind: data.SessionAPI, ExpiresAt: expiresAt}); !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("InsertSession() for a missing user should return ErrConflict, got %v", err)
+	}
+
+	session, err := repo.GetSession(ctx, apiID)
+	if err != nil {
+		t.Fatalf("GetSession() returned an error: %s", err)
+	}
+
+	if session.UserID != adminID || session.Kind != data.SessionAPI || session.Device != "Firefox on Linux" || session.IP != "192.0.2.1" {
+		t.Errorf("GetSession() returned the wrong session: %+v", session)
+	}
+
+	if !session.ExpiresAt.Equal(expiresAt) || session.CreatedAt.IsZero() || session.LastSeenAt.IsZero() {
+		t.Errorf("expected the session to be created and seen now, and expire at %s, but got %+v", expiresAt, session)
+	}
+
+	// the expired session was cleared out by the ones inserted after it
+	if _, err := repo.GetSession(ctx, expiredID); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected the expired session to be gone, got %v", err)
+	}
+
+	seenAt := time.Now().UTC().Truncate(time.Second)
+	session.IP = "198.51.100.7"
+	session.Device = "Chrome on Android"
+	session.LastSeenAt = seenAt
+	session.ExpiresAt = expiresAt.Add(time.Hour)
+	if err := repo.UpdateSession(ctx, *session); err != nil {
+		t.Fatalf("UpdateSession() returned an error: %s", err)
+	}
+
+	sessions, err := repo.AllSessions(ctx, adminID)
+	if err != nil {
+		t.Fatalf("AllSessions() returned an error: %s", err)
+	}
+
+	if len(sessions) != 2 || sessions[0].ID != apiID || sessions[1].ID != webID {
+		t.Fatalf("expected the admin's two live sessions, oldest first, but got %d", len(sessions))
+	}
+
+	if sessions[0].IP != "198.51.100.7" || sessions[0].Device != "Chrome on Android" || !sessions[0].LastSeenAt.Equal(seenAt) || !sessions[0].ExpiresAt.Equal(expiresAt.Add(time.Hour)) {
+		t.Errorf("expected the updated session, but got %+v", sessions[0])
+	}
+
+	if err := repo.DeleteSession(ctx, otherID, apiID); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("DeleteSession() for another user's session should return ErrNotFound, got %v", err)
+	}
+
+	if err := repo.DeleteOtherSessions(ctx, adminID, webID); err != nil {
+		t.Fatalf("DeleteOtherSessions() returned an error: %s", err)
+	}
+
+	if _, err := repo.GetSession(ctx, apiID); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected the other session to be gone, got %v", err)
+	}
+
+	if _, err := repo.GetSession(ctx, otherSessionID); err != nil {
+		t.Errorf("expected another user's session to be kept, got %v", err)
+	}
+
+	if err := repo.DeleteSession(ctx, adminID, webID); err != nil {
+		t.Fatalf("DeleteSession() returned an error: %s", err)
+	}
+
+	if err := repo.UpdateSession(ctx, data.Session{ID: webID, ExpiresAt: expiresAt}); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("UpdateSession() for a deleted session should return ErrNotFound, got %v", err)
+	}
+
+	// revoking a user's sessions logs every one of them out
+	if err := repo.RevokeSessions(ctx, otherID); err != nil {
+		t.Fatalf("RevokeSessions() returned an error: %s", err)
+	}
+
+	if _, err := repo.GetSession(ctx, otherSessionID); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected RevokeSessions() to delete the user's sessions, got %v", err)
+	}
+
+	// sessions go with their user
+	newSession(adminID, data.SessionAPI, expiresAt)
+	_ = repo.DeleteUser(ctx, adminID)
+	if sessions, _ := repo.AllSessions(ctx, adminID); len(sessions) != 0 {
+		t.Errorf("expected a deleted user's sessions to be gone, but got %d", len(sessions))
+	}
+}
+
+func testNotFound(t *testing.T, repo repository.DataBaseRepo) {
+	ctx := context.Background()
+
+	if _, err := repo.GetUser(ctx, 100); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("GetUser() for a missing user should return ErrNotFound, got %v", err)
+	}
+
+	if _, err := repo.GetUserByEmail(ctx, "nobody@example.com"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("GetUserByEmail() for a missing user should return ErrNotFound, got %v", err)
+	}
+
+	if err := repo.UpdateUser(ctx, data.User{ID: 100, Email: "nobody@example.com"}); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("UpdateUser() for a missing user should return ErrNotFound, got %v", err)
+	}
+
+	if err := repo.DeleteUser(ctx, 100); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("DeleteUser() for a missing user should return ErrNotFound, got %v", err)
+	}
+
+	if err := repo.ResetPassword(ctx, 100, "password"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("ResetPassword() for a missing user should return ErrNotFound, got %v", err)
+	}
+
+	if err := repo.UpdatePasswordHash(ctx, 100, "password"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("UpdatePasswordHash() for a missing user should return ErrNotFound, got %v", err)
+	}
+}
+
+func testDuplicate(t *testing.T, repo repository.DataBaseRepo) {
+	ctx := context.Background()
+
+	insertUser(t, repo, "Admin", "User", "admin@example.com")
+	jackID := insertUser(t, repo, "Jack", "Smith", "jack@smith.com")
+
+	_, err := repo.InsertUser(ctx, data.User{Email: "ADMIN@example.com", Password: "secret"})
+	if !errors.Is(err, repository.ErrDuplicate) {
+		t.Errorf("InsertUser() with an existing email should return ErrDuplicate, got %v", err)
+	}
+
+	jack, _ := repo.GetUser(ctx, jackID)
+	jack.Email = "Admin@Example.com"
+	if err := repo.UpdateUser(ctx, *jack); !errors.Is(err, repository.ErrDuplicate) {
+		t.Errorf("UpdateUser() to an existing email should return ErrDuplicate, got %v", err)
+	}
+}
+
+func testConflict(t *testing.T, repo repository.DataBaseRepo) {
+	ctx := context.Background()
+
+	_, err := repo.InsertUserImage(ctx, data.UserImage{UserID: 100, FileName: "test.jpg"})
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("InsertUserImage() with a non-existent user should return ErrConflict, got %v", err)
+	}
+}
+
+func testWithTx(t *testing.T, repo repository.DataBaseRepo) {
+	ctx := context.Background()
+	testUser := data.User{FirstName: "Tx", LastName: "User", Email: "tx@example.com", Password: "secret"}
+
+	// an error returned from the callback rolls back the transaction
+	abort := errors.New("abort")
+	err := repo.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		if _, err := repo.InsertUser(ctx, testUser); err != nil {
+			return err
+		}
+		return abort
+	})
+	if !errors.Is(err, abort) {
+		t.Errorf("WithTx() should return the callback error, got %v", err)
+	}
+
+	if _, err := repo.GetUserByEmail(ctx, testUser.Email); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("user inserted in a rolled back transaction should not exist, got %v", err)
+	}
+
+	// a panic in the callback rolls back the transaction and is re-raised
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("WithTx() swallowed a panic")
+			}
+		}()
+
+		_ = repo.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+			_, _ = repo.InsertUser(ctx, testUser)
+			panic("boom")
+		})
+	}()
+
+	if _, err := repo.GetUserByEmail(ctx, testUser.Email); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("user inserted before a panic should not exist, got %v", err)
+	}
+
+	// a nil error commits, and nested calls join the outer transaction
+	err = repo.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		id, err := repo.InsertUser(ctx, testUser)
+		if err != nil {
+			return err
+		}
+
+		return repo.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+			_, err := repo.InsertUserImage(ctx, data.UserImage{UserID: id, FileName: "tx.jpg"})
+			return err
+		})
+	}, repository.WithIsolation(sql.LevelSerializable))
+	if err != nil {
+		t.Errorf("WithTx() returned an error: %s", err)
+	}
+
+	user, err := repo.GetUserByEmail(ctx, testUser.Email)
+	if err != nil {
+		t.Fatalf("user inserted in a committed transaction should exist, got %v", err)
+	}
+
+	if user.ProfilePic.FileName != "tx.jpg" {
+		t.Errorf("image inserted in a nested transaction should exist, got %q", user.ProfilePic.FileName)
+	}
+}
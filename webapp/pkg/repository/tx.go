@@ -0,0 +1,31 @@
+package repository
+
+import "database/sql"
+
+// TxOption customises the transaction started by DataBaseRepo.WithTx.
+type TxOption func(*sql.TxOptions)
+
+// WithIsolation runs the transaction at the given isolation level. Use it for
+// invariants that span several tables, e.g. sql.LevelSerializable.
+func WithIsolation(level sql.IsolationLevel) TxOption {
+	return func(o *sql.TxOptions) {
+		o.Isolation = level
+	}
+}
+
+// ReadOnly marks the transaction as read only.
+func ReadOnly() TxOption {
+	return func(o *sql.TxOptions) {
+		o.ReadOnly = true
+	}
+}
+
+// NewTxOptions applies opts on top of the driver's default transaction options.
+func NewTxOptions(opts ...TxOption) *sql.TxOptions {
+	var txOpts sql.TxOptions
+	for _, opt := range opts {
+		opt(&txOpts)
+	}
+
+	return &txOpts
+}
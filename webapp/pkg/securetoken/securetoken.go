@@ -0,0 +1,46 @@
+// Package securetoken creates the random tokens sent to users in links, such as
+// password reset and email verification links. Only the hash of a token is meant
+// to be stored, so a leaked table can't be used to act on anyone's behalf.
+package securetoken
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+)
+
+// New returns a token of 32 random bytes, URL-safe base64 encoded, along with its
+// hash.
+func New() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, Hash(token), nil
+}
+
+// Hash returns the hex encoded SHA-256 hash of token, which is what repositories
+// store.
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Link returns base with token added as the "token" query parameter.
+func Link(base, token string) (string, error) {
+	link, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("invalid link %q: %w", base, err)
+	}
+
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	return link.String(), nil
+}
@@ -0,0 +1,47 @@
+package securetoken
+
+import "testing"
+
+func TestNew(t *testing.T) {
+	token, hash, err := New()
+	if err != nil {
+		t.Fatalf("New() returned an error: %s", err)
+	}
+
+	if len(token) != 43 {
+		t.Errorf("expected a 43 character token, but got %q", token)
+	}
+
+	if hash != Hash(token) || len(hash) != 64 {
+		t.Errorf("expected the hex SHA-256 hash of the token, but got %q", hash)
+	}
+
+	other, _, _ := New()
+	if other == token {
+		t.Error("expected two calls to return different tokens")
+	}
+}
+
+func TestLink(t *testing.T) {
+	tests := []struct {
+		name        string
+		base        string
+		expected    string
+		expectedErr bool
+	}{
+		{"plain", "http://localhost:8080/verify-email", "http://localhost:8080/verify-email?token=abc", false},
+		{"existing query", "http://localhost:8080/verify?lang=en", "http://localhost:8080/verify?lang=en&token=abc", false},
+		{"invalid", "http://[::1", "", true},
+	}
+
+	for _, e := range tests {
+		link, err := Link(e.base, "abc")
+		if e.expectedErr != (err != nil) {
+			t.Errorf("%s: unexpected error %v", e.name, err)
+		}
+
+		if link != e.expected {
+			t.Errorf("%s: expected %s, but got %s", e.name, e.expected, link)
+		}
+	}
+}
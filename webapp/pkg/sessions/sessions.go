@@ -0,0 +1,211 @@
+// Package sessions keeps track of where each user is logged in, so they can see
+// their devices and log any of them out. A session is started when a user logs
+// in to the API or the web application, and checked on every request it makes.
+// Deleting it logs that device out.
+package sessions
+
+import (
+	"context"
+	"errors"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+	"strings"
+	"time"
+)
+
+// DefaultTouchInterval is how often the last seen time of a session is updated
+// when Service.TouchInterval is zero.
+const DefaultTouchInterval = time.Minute
+
+// maxUserAgentLength is as long as the sessions table stores user agents.
+const maxUserAgentLength = 512
+
+// ErrEnded is returned by Check for sessions that were logged out, have expired,
+// or belong to another user.
+var ErrEnded = errors.New("session has ended")
+
+// Client is where a request comes from.
+type Client struct {
+	IP        string
+	UserAgent string
+}
+
+// Service starts, checks and ends sessions.
+type Service struct {
+	DB repository.DataBaseRepo
+
+	// TouchInterval is how stale a session's last seen time may get before Check
+	// updates it, to save a write on every request; zero means
+	// DefaultTouchInterval.
+	TouchInterval time.Duration
+}
+
+// Start records that the user logged in from client, in a session of the given
+// kind that lasts until expiresAt.
+func (s *Service) Start(ctx context.Context, userID int, kind string, client Client, expiresAt time.Time) (*data.Session, error) {
+	session := data.Session{
+		UserID:    userID,
+		Kind:      kind,
+		ExpiresAt: expiresAt,
+	}
+	setClient(&session, client)
+
+	var err error
+	session.ID, err = s.DB.InsertSession(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session.CreatedAt = now
+	session.LastSeenAt = now
+
+	return &session, nil
+}
+
+// Check returns the user's session with the given id, and records that it was
+// seen from client. It returns ErrEnded if the session is no longer live.
+func (s *Service) Check(ctx context.Context, userID, id int, client Client) (*data.Session, error) {
+	session, err := s.DB.GetSession(ctx, id)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, ErrEnded
+	} else if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if session.UserID != userID || session.Expired(now) {
+		return nil, ErrEnded
+	}
+
+	interval := s.TouchInterval
+	if interval <= 0 {
+		interval = DefaultTouchInterval
+	}
+
+	moved := session.IP != client.IP || session.UserAgent != truncate(client.UserAgent)
+	if moved || now.Sub(session.LastSeenAt) >= interval {
+		updated := *session
+		setClient(&updated, client)
+		updated.LastSeenAt = now
+
+		// a failure to record the visit shouldn't log the user out
+		if err := s.DB.UpdateSession(ctx, updated); err == nil {
+			session = &updated
+		}
+	}
+
+	return session, nil
+}
+
+// Extend keeps a session alive until expiresAt, as when its refresh token is
+// replaced, and records that it was seen from client.
+func (s *Service) Extend(ctx context.Context, session *data.Session, client Client, expiresAt time.Time) error {
+	updated := *session
+	setClient(&updated, client)
+	updated.LastSeenAt = time.Now()
+	updated.ExpiresAt = expiresAt
+
+	err := s.DB.UpdateSession(ctx, updated)
+	if errors.Is(err, repository.ErrNotFound) {
+		return ErrEnded
+	} else if err != nil {
+		return err
+	}
+
+	*session = updated
+	return nil
+}
+
+// List returns the user's live sessions, oldest first.
+func (s *Service) List(ctx context.Context, userID int) ([]*data.Session, error) {
+	return s.DB.AllSessions(ctx, userID)
+}
+
+// End logs one of the user's sessions out. It returns repository.ErrNotFound if
+// the user has no session with that id.
+func (s *Service) End(ctx context.Context, userID, id int) error {
+	return s.DB.DeleteSession(ctx, userID, id)
+}
+
+// EndOthers logs out every session of the user except keepID, the one they are
+// using.
+func (s *Service) EndOthers(ctx context.Context, userID, keepID int) error {
+	return s.DB.DeleteOtherSessions(ctx, userID, keepID)
+}
+
+func setClient(session *data.Session, client Client) {
+	session.IP = client.IP
+	session.UserAgent = truncate(client.UserAgent)
+	session.Device = DeviceLabel(client.UserAgent)
+}
+
+func truncate(userAgent string) string {
+	if len(userAgent) > maxUserAgentLength {
+		return userAgent[:maxUserAgentLength]
+	}
+	return userAgent
+}
+
+// The browsers and operating systems DeviceLabel knows, each with the user agent
+// fragment that gives it away. Order matters: Edge and Opera claim to be Chrome,
+// Chrome claims to be Safari, iPhones claim to be Macs, and Android is Linux.
+var (
+	browsers = []struct{ name, marker string }{
+		{"Edge", "Edg"},
+		{"Opera", "OPR/"},
+		{"Firefox", "Firefox/"},
+		{"Firefox", "FxiOS/"},
+		{"Chrome", "CriOS/"},
+		{"Chrome", "Chrome/"},
+		{"Safari", "Safari/"},
+	}
+
+	systems = []struct{ name, marker string }{
+		{"iPhone", "iPhone"},
+		{"iPad", "iPad"},
+		{"Android", "Android"},
+		{"Windows", "Windows"},
+		{"ChromeOS", "CrOS"},
+		{"macOS", "Macintosh"},
+		{"Linux", "Linux"},
+	}
+)
+
+// DeviceLabel returns a short, human readable name for the device a user agent
+// belongs to, like "Firefox on Windows". Programs that aren't browsers are named
+// by the first product in their user agent, like "curl".
+func DeviceLabel(userAgent string) string {
+	var browser, system string
+
+	for _, b := range browsers {
+		if strings.Contains(userAgent, b.marker) {
+			browser = b.name
+			break
+		}
+	}
+
+	for _, s := range systems {
+		if strings.Contains(userAgent, s.marker) {
+			system = s.name
+			break
+		}
+	}
+
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	}
+
+	// the first product, without its version; every browser calls itself Mozilla
+	product, _, _ := strings.Cut(strings.TrimSpace(userAgent), "/")
+	if product == "" || product == "Mozilla" || strings.Contains(product, " ") {
+		return "Unknown device"
+	}
+
+	return product
+}
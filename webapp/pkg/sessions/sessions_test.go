@@ -0,0 +1,132 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository/dbrepo"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository/dbrepo/dbrepotest"
+	"testing"
+	"time"
+)
+
+const firefoxOnLinux = "Mozilla/5.0 (X11; Linux x86_64; rv:105.0) Gecko/20100101 Firefox/105.0"
+
+func newService(t *testing.T) (*Service, *dbrepo.MemoryDBRepo) {
+	t.Helper()
+
+	repo := dbrepotest.NewSeeded(t)
+
+	return &Service{DB: repo}, repo
+}
+
+func TestDeviceLabel(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		expected  string
+	}{
+		{firefoxOnLinux, "Firefox on Linux"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/106.0.0.0 Safari/537.36", "Chrome on Windows"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/106.0.0.0 Safari/537.36 Edg/106.0.1370.42", "Edge on Windows"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.0 Safari/605.1.15", "Safari on macOS"},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 16_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.0 Mobile/15E148 Safari/604.1", "Safari on iPhone"},
+		{"Mozilla/5.0 (Linux; Android 13; Pixel 7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/106.0.0.0 Mobile Safari/537.36", "Chrome on Android"},
+		{"curl/7.85.0", "curl"},
+		{"Go-http-client/1.1", "Go-http-client"},
+		{"Mozilla/5.0 (compatible)", "Unknown device"},
+		{"", "Unknown device"},
+	}
+
+	for _, e := range tests {
+		if label := DeviceLabel(e.userAgent); label != e.expected {
+			t.Errorf("DeviceLabel(%q): expected %q, but got %q", e.userAgent, e.expected, label)
+		}
+	}
+}
+
+func TestService_Start(t *testing.T) {
+	s, repo := newService(t)
+	ctx := context.Background()
+
+	expiresAt := time.Now().Add(time.Hour)
+	session, err := s.Start(ctx, 1, data.SessionWeb, Client{IP: "192.0.2.1", UserAgent: firefoxOnLinux}, expiresAt)
+	if err != nil {
+		t.Fatalf("Start() returned an error: %s", err)
+	}
+
+	stored, err := repo.GetSession(ctx, session.ID)
+	if err != nil {
+		t.Fatalf("expected the session to be stored, got %v", err)
+	}
+
+	if stored.Device != "Firefox on Linux" || stored.IP != "192.0.2.1" || stored.Kind != data.SessionWeb {
+		t.Errorf("unexpected session %+v", stored)
+	}
+
+	if _, err := s.Start(ctx, 100, data.SessionWeb, Client{}, expiresAt); !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("expected ErrConflict for a missing user, but got %v", err)
+	}
+}
+
+func TestService_Check(t *testing.T) {
+	s, repo := newService(t)
+	ctx := context.Background()
+	client := Client{IP: "192.0.2.1", UserAgent: firefoxOnLinux}
+
+	session, _ := s.Start(ctx, 1, data.SessionAPI, client, time.Now().Add(time.Hour))
+
+	if _, err := s.Check(ctx, 1, session.ID, client); err != nil {
+		t.Errorf("expected a live session to check out, but got %v", err)
+	}
+
+	if _, err := s.Check(ctx, 2, session.ID, client); !errors.Is(err, ErrEnded) {
+		t.Errorf("expected ErrEnded for another user's session, but got %v", err)
+	}
+
+	// a new address is recorded right away
+	moved := Client{IP: "198.51.100.7", UserAgent: "curl/7.85.0"}
+	if checked, err := s.Check(ctx, 1, session.ID, moved); err != nil || checked.IP != moved.IP || checked.Device != "curl" {
+		t.Errorf("expected the new address and device to be recorded, but got %+v and %v", checked, err)
+	}
+
+	if stored, _ := repo.GetSession(ctx, session.ID); stored.IP != moved.IP {
+		t.Errorf("expected the new address to be stored, but got %s", stored.IP)
+	}
+
+	if err := s.End(ctx, 1, session.ID); err != nil {
+		t.Fatalf("End() returned an error: %s", err)
+	}
+
+	if _, err := s.Check(ctx, 1, session.ID, client); !errors.Is(err, ErrEnded) {
+		t.Errorf("expected ErrEnded for a session that was logged out, but got %v", err)
+	}
+
+	expired, _ := s.Start(ctx, 1, data.SessionAPI, client, time.Now().Add(-time.Second))
+	if _, err := s.Check(ctx, 1, expired.ID, client); !errors.Is(err, ErrEnded) {
+		t.Errorf("expected ErrEnded for an expired session, but got %v", err)
+	}
+}
+
+func TestService_Extend(t *testing.T) {
+	s, _ := newService(t)
+	ctx := context.Background()
+	client := Client{IP: "192.0.2.1", UserAgent: firefoxOnLinux}
+
+	session, _ := s.Start(ctx, 1, data.SessionAPI, client, time.Now().Add(time.Minute))
+
+	expiresAt := time.Now().Add(time.Hour)
+	if err := s.Extend(ctx, session, client, expiresAt); err != nil {
+		t.Fatalf("Extend() returned an error: %s", err)
+	}
+
+	sessions, _ := s.List(ctx, 1)
+	if len(sessions) != 1 || !sessions[0].ExpiresAt.Equal(expiresAt) {
+		t.Errorf("expected the session to expire at %s, but got %+v", expiresAt, sessions)
+	}
+
+	_ = s.EndOthers(ctx, 1, 0)
+	if err := s.Extend(ctx, session, client, expiresAt); !errors.Is(err, ErrEnded) {
+		t.Errorf("expected ErrEnded for a session that was logged out, but got %v", err)
+	}
+}
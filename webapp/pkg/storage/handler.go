@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Handler serves the blobs of Store, by the key that is the rest of the request
+// path once it is mounted with http.StripPrefix. Unless Public, a request must
+// carry a URL signed by Signer.
+type Handler struct {
+	Store BlobStore
+
+	// Signer checks the signatures of requests when the handler isn't Public.
+	Signer *URLSigner
+
+	// Public serves blobs to anyone who knows their key.
+	Public bool
+
+	// CacheControl is sent with every blob; empty means "no-cache", so browsers
+	// check the ETag before they reuse a blob.
+	CacheControl string
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	if !ValidKey(key) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !h.Public {
+		if h.Signer == nil || h.Signer.Verify(key, r.URL.Query(), time.Now()) != nil {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+
+	cacheControl := h.CacheControl
+	if cacheControl == "" {
+		cacheControl = "no-cache"
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+
+	blob, err := h.Store.Get(r.Context(), key)
+	if errors.Is(err, ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Println("storage: reading blob", key, ":", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	ServeBlob(w, r, blob)
+}
+
+// ServeBlob writes blob to w, answering range and conditional requests, and
+// closes it.
+func ServeBlob(w http.ResponseWriter, r *http.Request, blob *Blob) {
+	defer blob.Body.Close()
+
+	if blob.ContentType != "" {
+		w.Header().Set("Content-Type", blob.ContentType)
+	}
+	if blob.ETag != "" {
+		w.Header().Set("ETag", fmt.Sprintf("%q", blob.ETag))
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	// ServeContent needs to seek to answer range requests and to work out the
+	// length; stores that can seek are served as they are
+	if body, ok := blob.Body.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, blob.Key, blob.ModTime, body)
+		return
+	}
+
+	contents, err := io.ReadAll(blob.Body)
+	if err != nil {
+		log.Println("storage: reading blob", blob.Key, ":", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	http.ServeContent(w, r, blob.Key, blob.ModTime, bytes.NewReader(contents))
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	signer := &URLSigner{BaseURL: "/images", Secret: []byte("secret")}
+	store := &MemoryStore{URLs: signer}
+	_ = store.Put(context.Background(), "a/face.png", strings.NewReader("face"), "image/png")
+
+	signed, err := store.SignedURL("a/face.png", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _ := signer.Sign("a/face.png", time.Now().Add(-time.Minute))
+
+	private := http.StripPrefix("/images", &Handler{Store: store, Signer: signer})
+	public := http.StripPrefix("/images", &Handler{Store: store, Public: true, CacheControl: "public, max-age=60"})
+
+	tests := []struct {
+		name           string
+		handler        http.Handler
+		method         string
+		url            string
+		expectedStatus int
+	}{
+		{"signed", private, http.MethodGet, signed, http.StatusOK},
+		{"head", private, http.MethodHead, signed, http.StatusOK},
+		{"unsigned", private, http.MethodGet, "/images/a/face.png", http.StatusForbidden},
+		{"expired", private, http.MethodGet, expired, http.StatusForbidden},
+		{"public", public, http.MethodGet, "/images/a/face.png", http.StatusOK},
+		{"missing", public, http.MethodGet, "/images/a/missing.png", http.StatusNotFound},
+		{"invalid key", public, http.MethodGet, "/images/a/%2e%2e/face.png", http.StatusNotFound},
+		{"post", public, http.MethodPost, "/images/a/face.png", http.StatusMethodNotAllowed},
+	}
+
+	for _, e := range tests {
+		req := httptest.NewRequest(e.method, e.url, nil)
+		rr := httptest.NewRecorder()
+		e.handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/images/a/face.png", nil)
+	rr := httptest.NewRecorder()
+	public.ServeHTTP(rr, req)
+
+	if rr.Body.String() != "face" || rr.Header().Get("Content-Type") != "image/png" ||
+		rr.Header().Get("Cache-Control") != "public, max-age=60" || rr.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("unexpected response %v %q", rr.Header(), rr.Body.String())
+	}
+
+	// the ETag lets browsers check their copy is current
+	req = httptest.NewRequest(http.MethodGet, "/images/a/face.png", nil)
+	req.Header.Set("If-None-Match", rr.Header().Get("ETag"))
+	rr = httptest.NewRecorder()
+	public.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("expected status %d for a current copy, got %d", http.StatusNotModified, rr.Code)
+	}
+}
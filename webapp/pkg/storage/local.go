@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// tempPrefix starts the names of the files LocalStore writes blobs to before
+// they are complete; List skips them.
+const tempPrefix = ".tmp-"
+
+// LocalStore keeps blobs as files in a directory, with slashes in keys making
+// subdirectories. A blob's content type is worked out from the extension of its
+// key.
+type LocalStore struct {
+	Dir string
+
+	// URLs signs the URLs SignedURL returns, which Handler serves.
+	URLs *URLSigner
+}
+
+func (s *LocalStore) path(key string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(key)), nil
+}
+
+// Put stores contents as key. It writes them to a temporary file first, so
+// readers never see half a blob.
+func (s *LocalStore) Put(ctx context.Context, key string, contents io.Reader, contentType string) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tmp, contents)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
+
+// Get returns the blob stored as key.
+func (s *LocalStore) Get(ctx context.Context, key string) (*Blob, error) {
+	name, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	if stat.IsDir() {
+		_ = file.Close()
+		return nil, ErrNotFound
+	}
+
+	return &Blob{Info: localInfo(key, stat), Body: file}, nil
+}
+
+// Delete removes the blob stored as key.
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// List describes the blobs whose keys start with prefix.
+func (s *LocalStore) List(ctx context.Context, prefix string) ([]Info, error) {
+	var infos []Info
+
+	err := filepath.WalkDir(s.Dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) && name == s.Dir {
+				return fs.SkipDir
+			}
+			return err
+		}
+
+		if d.IsDir() || strings.HasPrefix(d.Name(), tempPrefix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.Dir, name)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) || !ValidKey(key) {
+			return nil
+		}
+
+		stat, err := d.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			// deleted while we were looking
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		infos = append(infos, localInfo(key, stat))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos, nil
+}
+
+// SignedURL returns a URL for key signed by URLs.
+func (s *LocalStore) SignedURL(key string, ttl time.Duration) (string, error) {
+	return signedURL(s.URLs, key, ttl)
+}
+
+func localInfo(key string, stat fs.FileInfo) Info {
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	return Info{
+		Key:         key,
+		Size:        stat.Size(),
+		ContentType: contentType,
+		ModTime:     stat.ModTime(),
+		ETag:        fmt.Sprintf("%x-%x", stat.ModTime().UnixNano(), stat.Size()),
+	}
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps blobs in memory, for tests and demos. It is safe for
+// concurrent use.
+type MemoryStore struct {
+	// URLs signs the URLs SignedURL returns, which Handler serves.
+	URLs *URLSigner
+
+	mu    sync.RWMutex
+	blobs map[string]memoryBlob
+}
+
+type memoryBlob struct {
+	contents []byte
+	info     Info
+}
+
+// Put stores contents as key.
+func (s *MemoryStore) Put(ctx context.Context, key string, contents io.Reader, contentType string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	b, err := io.ReadAll(contents)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(b)
+	info := Info{
+		Key:         key,
+		Size:        int64(len(b)),
+		ContentType: contentType,
+		ModTime:     time.Now(),
+		ETag:        hex.EncodeToString(sum[:16]),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.blobs == nil {
+		s.blobs = make(map[string]memoryBlob)
+	}
+	s.blobs[key] = memoryBlob{contents: b, info: info}
+
+	return nil
+}
+
+// Get returns the blob stored as key.
+func (s *MemoryStore) Get(ctx context.Context, key string) (*Blob, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b, ok := s.blobs[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return &Blob{Info: b.info, Body: io.NopCloser(bytes.NewReader(b.contents))}, nil
+}
+
+// Delete removes the blob stored as key.
+func (s *MemoryStore) Delete(ctx context.Context, key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.blobs, key)
+	return nil
+}
+
+// List describes the blobs whose keys start with prefix.
+func (s *MemoryStore) List(ctx context.Context, prefix string) ([]Info, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var infos []Info
+	for key, b := range s.blobs {
+		if strings.HasPrefix(key, prefix) {
+			infos = append(infos, b.info)
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos, nil
+}
+
+// SignedURL returns a URL for key signed by URLs.
+func (s *MemoryStore) SignedURL(key string, ttl time.Duration) (string, error) {
+	return signedURL(s.URLs, key, ttl)
+}
@@ -0,0 +1,434 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxPresignTTL is the longest S3 accepts a presigned URL to be valid.
+const maxPresignTTL = 7 * 24 * time.Hour
+
+// emptyPayloadHash is the SHA-256 hash of an empty request body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Config configures an S3Store.
+type S3Config struct {
+	// Endpoint is the URL of the S3 service, e.g. "https://s3.eu-west-1.amazonaws.com"
+	// or "http://localhost:9000" for MinIO.
+	Endpoint string
+
+	Bucket string
+
+	// Region is the region requests are signed for; MinIO accepts "us-east-1".
+	Region string
+
+	AccessKey string
+	SecretKey string
+}
+
+// S3Store keeps blobs in a bucket of an S3 compatible service, such as AWS S3 or
+// MinIO. Requests are signed with AWS Signature Version 4, and buckets are
+// addressed by path, which every S3 compatible service understands.
+type S3Store struct {
+	S3Config
+
+	// Client sends the requests; nil means http.DefaultClient.
+	Client *http.Client
+
+	endpoint *url.URL
+
+	// now returns the time requests are signed at; tests fix it.
+	now func() time.Time
+}
+
+// NewS3Store returns a store for the bucket described by cfg.
+func NewS3Store(cfg S3Config) (*S3Store, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("storage: the s3 store needs an endpoint and a bucket")
+	}
+
+	endpoint, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("storage: invalid s3 endpoint %q", cfg.Endpoint)
+	}
+
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+
+	return &S3Store{S3Config: cfg, endpoint: endpoint, now: time.Now}, nil
+}
+
+// objectURL returns the URL of key in the bucket; an empty key is the bucket.
+func (s *S3Store) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	u.Path = u.Path + "/" + s.Bucket
+	u.RawPath = s.endpoint.EscapedPath() + "/" + uriEncode(s.Bucket, false)
+	if key != "" {
+		u.Path += "/" + key
+		u.RawPath += "/" + uriEncode(key, true)
+	}
+	return &u
+}
+
+// Put stores contents as key.
+func (s *S3Store) Put(ctx context.Context, key string, contents io.Reader, contentType string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	// the payload is signed, so it is read before it is sent
+	b, err := io.ReadAll(contents)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key).String(), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	sum := sha256.Sum256(b)
+	resp, err := s.do(req, hex.EncodeToString(sum[:]))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	return nil
+}
+
+// Get returns the blob stored as key.
+func (s *S3Store) Get(ctx context.Context, key string) (*Blob, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(req, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	info := Info{
+		Key:         key,
+		Size:        resp.ContentLength,
+		ContentType: resp.Header.Get("Content-Type"),
+		ModTime:     modTime,
+		ETag:        strings.Trim(resp.Header.Get("ETag"), `"`),
+	}
+
+	return &Blob{Info: info, Body: resp.Body}, nil
+}
+
+// Delete removes the blob stored as key.
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(key).String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(req, emptyPayloadHash)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	return nil
+}
+
+// listResult is the response to ListObjectsV2.
+type listResult struct {
+	Contents []struct {
+		Key          string
+		LastModified time.Time
+		ETag         string
+		Size         int64
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List describes the blobs whose keys start with prefix, a page of results at a
+// time.
+func (s *S3Store) List(ctx context.Context, prefix string) ([]Info, error) {
+	var infos []Info
+	var token string
+
+	for {
+		u := s.objectURL("")
+		query := url.Values{}
+		query.Set("list-type", "2")
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u.RawQuery = query.Encode()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := s.do(req, emptyPayloadHash)
+		if err != nil {
+			return nil, err
+		}
+
+		var result listResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("storage: reading the s3 listing: %w", err)
+		}
+
+		for _, c := range result.Contents {
+			infos = append(infos, Info{
+				Key:     c.Key,
+				Size:    c.Size,
+				ModTime: c.LastModified,
+				ETag:    strings.Trim(c.ETag, `"`),
+			})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos, nil
+}
+
+// CreateBucket creates the bucket of the store, for setting up a development
+// environment. A bucket that is already there isn't an error.
+func (s *S3Store) CreateBucket(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL("").String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(req, emptyPayloadHash)
+	var s3Err *S3Error
+	if errors.As(err, &s3Err) && (s3Err.Code == "BucketAlreadyOwnedByYou" || s3Err.Code == "BucketAlreadyExists") {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	return nil
+}
+
+// SignedURL returns a presigned URL that fetches key straight from the bucket.
+// S3 refuses presigned URLs valid for more than a week.
+func (s *S3Store) SignedURL(key string, ttl time.Duration) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+
+	if ttl <= 0 || ttl > maxPresignTTL {
+		return "", fmt.Errorf("storage: presigned URLs must be valid for up to %s", maxPresignTTL)
+	}
+
+	return s.presign(http.MethodGet, s.objectURL(key), s.now(), ttl), nil
+}
+
+// S3Error is an error response from the S3 service.
+type S3Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("storage: s3 responded %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// do signs and sends req, whose body hashes to payloadHash. Responses other
+// than 2xx are returned as an error: ErrNotFound for missing keys, an *S3Error
+// otherwise.
+func (s *S3Store) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	s.sign(req, payloadHash, s.now())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	s3Err := &S3Error{StatusCode: resp.StatusCode}
+	_ = xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(s3Err)
+
+	if resp.StatusCode == http.StatusNotFound && (s3Err.Code == "" || s3Err.Code == "NoSuchKey") {
+		return nil, ErrNotFound
+	}
+
+	return nil, s3Err
+}
+
+// sign adds the Signature Version 4 headers to req, for a body that hashes to
+// payloadHash.
+func (s *S3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || lower == "range" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	signedHeaders, signature := s.signature(req.Method, req.URL, headers, payloadHash, now)
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, s.scope(now), signedHeaders, signature))
+}
+
+// presign returns u with the query parameters of a Signature Version 4
+// presigned URL that is valid for ttl from now.
+func (s *S3Store) presign(method string, u *url.URL, now time.Time, ttl time.Duration) string {
+	signed := *u
+	query := signed.Query()
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.AccessKey+"/"+s.scope(now))
+	query.Set("X-Amz-Date", now.UTC().Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(ttl.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	signed.RawQuery = canonicalQuery(query)
+
+	_, signature := s.signature(method, &signed, map[string]string{"host": u.Host}, "UNSIGNED-PAYLOAD", now)
+
+	signed.RawQuery += "&X-Amz-Signature=" + signature
+	return signed.String()
+}
+
+func (s *S3Store) scope(now time.Time) string {
+	return now.UTC().Format("20060102") + "/" + s.Region + "/s3/aws4_request"
+}
+
+// signature returns the signed header names and the signature of a request.
+func (s *S3Store) signature(method string, u *url.URL, headers map[string]string, payloadHash string, now time.Time) (string, string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		canonicalQuery(u.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.UTC().Format("20060102T150405Z"),
+		s.scope(now),
+		hex.EncodeToString(hashed[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), now.UTC().Format("20060102"))
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	return signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery returns query sorted and encoded the way Signature Version 4
+// wants.
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var parts []string
+	for _, name := range names {
+		values := append([]string{}, query[name]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, uriEncode(name, false)+"="+uriEncode(v, false))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything but unreserved characters, and slashes if
+// keepSlash, as Signature Version 4 wants.
+func uriEncode(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
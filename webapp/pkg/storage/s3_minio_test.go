@@ -0,0 +1,59 @@
+//go:build integration
+
+package storage
+
+import (
+	"context"
+	"github.com/ory/dockertest/v3"
+	"net/http"
+	"testing"
+)
+
+// TestS3Store_minio runs the store tests against a real MinIO server.
+func TestS3Store_minio(t *testing.T) {
+	pool, err := dockertest.NewPool("")
+	if err != nil {
+		t.Fatalf("could not connect to docker; is it running? %s", err)
+	}
+
+	resource, err := pool.RunWithOptions(&dockertest.RunOptions{
+		Repository: "minio/minio",
+		Tag:        "RELEASE.2024-06-13T22-53-53Z",
+		Cmd:        []string{"server", "/data"},
+		Env: []string{
+			"MINIO_ROOT_USER=minioadmin",
+			"MINIO_ROOT_PASSWORD=minioadmin",
+		},
+	})
+	if err != nil {
+		t.Fatalf("could not start minio: %s", err)
+	}
+	t.Cleanup(func() { _ = pool.Purge(resource) })
+
+	endpoint := "http://localhost:" + resource.GetPort("9000/tcp")
+	if err := pool.Retry(func() error {
+		resp, err := http.Get(endpoint + "/minio/health/live")
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}); err != nil {
+		t.Fatalf("could not connect to minio: %s", err)
+	}
+
+	store, err := NewS3Store(S3Config{
+		Endpoint:  endpoint,
+		Bucket:    "images",
+		AccessKey: "minioadmin",
+		SecretKey: "minioadmin",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.CreateBucket(context.Background()); err != nil {
+		t.Fatalf("could not create the bucket: %s", err)
+	}
+
+	testStore(t, store)
+}
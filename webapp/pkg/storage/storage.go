@@ -0,0 +1,194 @@
+// Package storage keeps the files users upload, such as profile pictures, as
+// blobs: named byte strings in a BlobStore. LocalStore keeps them in a directory,
+// which is enough for one instance; S3Store keeps them in an S3 compatible
+// bucket, which every instance can share; MemoryStore is for tests and demos.
+// Handler serves blobs over HTTP, whichever store they are in.
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned for a key that has no blob.
+	ErrNotFound = errors.New("storage: blob not found")
+
+	// ErrInvalidKey is returned for keys that aren't made of letters, digits,
+	// dots, dashes, underscores and slashes, or that could escape the store.
+	ErrInvalidKey = errors.New("storage: invalid key")
+
+	// ErrInvalidSignature is returned by URLSigner.Verify for URLs that weren't
+	// signed by it, or have expired.
+	ErrInvalidSignature = errors.New("storage: invalid or expired signature")
+)
+
+// Info describes a blob.
+type Info struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+
+	// ETag changes whenever the contents do. It isn't quoted.
+	ETag string
+}
+
+// Blob is a blob being read. Its Body must be closed.
+type Blob struct {
+	Info
+	Body io.ReadCloser
+}
+
+// BlobStore stores blobs by key. Keys may contain slashes, which some stores
+// treat as directories.
+type BlobStore interface {
+	// Put stores contents as key, replacing any blob that was there.
+	Put(ctx context.Context, key string, contents io.Reader, contentType string) error
+
+	// Get returns the blob stored as key, or ErrNotFound.
+	Get(ctx context.Context, key string) (*Blob, error)
+
+	// Delete removes the blob stored as key. Deleting a missing blob is not an
+	// error.
+	Delete(ctx context.Context, key string) error
+
+	// List describes every blob whose key starts with prefix, ordered by key.
+	List(ctx context.Context, prefix string) ([]Info, error)
+
+	// SignedURL returns a URL anyone can fetch the blob stored as key from until
+	// ttl has passed.
+	SignedURL(key string, ttl time.Duration) (string, error)
+}
+
+// Config selects and configures a BlobStore; see New.
+type Config struct {
+	// Kind is one of local, memory or s3.
+	Kind string
+
+	// Dir is where the local store keeps blobs.
+	Dir string
+
+	// URLs signs the URLs of the local and memory stores, which Handler serves.
+	URLs *URLSigner
+
+	// S3 configures the s3 store.
+	S3 S3Config
+}
+
+// New returns the store described by cfg.
+func New(cfg Config) (BlobStore, error) {
+	switch cfg.Kind {
+	case "local":
+		if cfg.Dir == "" {
+			return nil, errors.New("storage: the local store needs a directory")
+		}
+		return &LocalStore{Dir: cfg.Dir, URLs: cfg.URLs}, nil
+	case "memory":
+		return &MemoryStore{URLs: cfg.URLs}, nil
+	case "s3":
+		return NewS3Store(cfg.S3)
+	default:
+		return nil, fmt.Errorf("storage: unknown store %q; expected local, memory or s3", cfg.Kind)
+	}
+}
+
+// ValidKey reports whether key can be used with every store: it must be made of
+// letters, digits, dots, dashes, underscores and slashes, and have no empty,
+// "." or ".." parts.
+func ValidKey(key string) bool {
+	if key == "" || len(key) > 512 {
+		return false
+	}
+
+	for _, c := range key {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '-', c == '_', c == '/':
+		default:
+			return false
+		}
+	}
+
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+
+	return true
+}
+
+func checkKey(key string) error {
+	if !ValidKey(key) {
+		return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+	return nil
+}
+
+// URLSigner makes and checks the signed URLs of stores that Handler serves. A
+// signed URL names the key, when the URL expires, and an HMAC of both.
+type URLSigner struct {
+	// BaseURL is where Handler is mounted, e.g. "/images" or
+	// "https://example.com/images".
+	BaseURL string
+
+	// Secret is the HMAC key; anyone who has it can sign URLs.
+	Secret []byte
+}
+
+// Sign returns a URL for key that is valid until expires.
+func (s *URLSigner) Sign(key string, expires time.Time) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+
+	if len(s.Secret) == 0 {
+		return "", errors.New("storage: the URL signer has no secret")
+	}
+
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("signature", s.signature(key, expires.Unix()))
+
+	return strings.TrimSuffix(s.BaseURL, "/") + "/" + key + "?" + query.Encode(), nil
+}
+
+// Verify checks that query is that of a URL for key signed by s that hasn't
+// expired.
+func (s *URLSigner) Verify(key string, query url.Values, now time.Time) error {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || len(s.Secret) == 0 {
+		return ErrInvalidSignature
+	}
+
+	expected := s.signature(key, expires)
+	if !hmac.Equal([]byte(query.Get("signature")), []byte(expected)) || now.Unix() > expires {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+func (s *URLSigner) signature(key string, expires int64) string {
+	mac := hmac.New(sha256.New, s.Secret)
+	fmt.Fprintf(mac, "%s\n%d", key, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedURL is SignedURL for the stores Handler serves.
+func signedURL(signer *URLSigner, key string, ttl time.Duration) (string, error) {
+	if signer == nil {
+		return "", errors.New("storage: the store has no URL signer")
+	}
+	return signer.Sign(key, time.Now().Add(ttl))
+}
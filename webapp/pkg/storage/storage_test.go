@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStore checks that store behaves as every BlobStore must.
+func testStore(t *testing.T, store BlobStore) {
+	t.Helper()
+	ctx := context.Background()
+
+	if _, err := store.Get(ctx, "missing.png"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for a missing blob, got %v", err)
+	}
+
+	if err := store.Put(ctx, "../escape.png", strings.NewReader("x"), "image/png"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("expected ErrInvalidKey for a key leaving the store, got %v", err)
+	}
+
+	blobs := map[string]string{
+		"a/one.png":   "first",
+		"a/two.png":   "second",
+		"b/three.jpg": "third",
+	}
+	for key, contents := range blobs {
+		if err := store.Put(ctx, key, strings.NewReader(contents), "image/png"); err != nil {
+			t.Fatalf("Put(%s) returned an error: %s", key, err)
+		}
+	}
+
+	blob, err := store.Get(ctx, "a/one.png")
+	if err != nil {
+		t.Fatalf("Get() returned an error: %s", err)
+	}
+	contents, _ := io.ReadAll(blob.Body)
+	_ = blob.Body.Close()
+	if string(contents) != "first" || blob.Size != 5 || blob.ContentType != "image/png" || blob.ETag == "" {
+		t.Errorf("unexpected blob %+v with contents %q", blob.Info, contents)
+	}
+
+	if err := store.Put(ctx, "a/one.png", strings.NewReader("replaced"), "image/png"); err != nil {
+		t.Fatalf("Put() over a blob returned an error: %s", err)
+	}
+	replaced, err := store.Get(ctx, "a/one.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, _ = io.ReadAll(replaced.Body)
+	_ = replaced.Body.Close()
+	if string(contents) != "replaced" || replaced.ETag == blob.ETag {
+		t.Errorf("expected the blob to be replaced with a new ETag, got %q and %+v", contents, replaced.Info)
+	}
+
+	infos, err := store.List(ctx, "a/")
+	if err != nil {
+		t.Fatalf("List() returned an error: %s", err)
+	}
+	if len(infos) != 2 || infos[0].Key != "a/one.png" || infos[1].Key != "a/two.png" || infos[1].Size != 6 {
+		t.Errorf("unexpected listing of a/: %+v", infos)
+	}
+
+	all, _ := store.List(ctx, "")
+	if len(all) != 3 {
+		t.Errorf("expected 3 blobs, got %+v", all)
+	}
+
+	if err := store.Delete(ctx, "a/two.png"); err != nil {
+		t.Errorf("Delete() returned an error: %s", err)
+	}
+	if err := store.Delete(ctx, "a/two.png"); err != nil {
+		t.Errorf("Delete() of a missing blob returned an error: %s", err)
+	}
+	if _, err := store.Get(ctx, "a/two.png"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound after Delete(), got %v", err)
+	}
+}
+
+func TestLocalStore(t *testing.T) {
+	dir := t.TempDir()
+	testStore(t, &LocalStore{Dir: dir})
+
+	if _, err := os.Stat(filepath.Join(dir, "b", "three.jpg")); err != nil {
+		t.Errorf("expected keys with slashes to be kept in subdirectories: %s", err)
+	}
+
+	// temporary files of unfinished writes aren't blobs
+	if err := os.WriteFile(filepath.Join(dir, tempPrefix+"123"), []byte("half"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	infos, _ := (&LocalStore{Dir: dir}).List(context.Background(), "")
+	for _, info := range infos {
+		if strings.Contains(info.Key, tempPrefix) {
+			t.Errorf("expected List() to skip temporary files, got %+v", info)
+		}
+	}
+
+	infos, err := (&LocalStore{Dir: filepath.Join(dir, "missing")}).List(context.Background(), "")
+	if err != nil || len(infos) != 0 {
+		t.Errorf("expected a missing directory to have no blobs, got %+v and %v", infos, err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, &MemoryStore{})
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      Config
+		expected string
+	}{
+		{"local", Config{Kind: "local", Dir: t.TempDir()}, "*storage.LocalStore"},
+		{"memory", Config{Kind: "memory"}, "*storage.MemoryStore"},
+		{"s3", Config{Kind: "s3", S3: S3Config{Endpoint: "http://localhost:9000", Bucket: "images"}}, "*storage.S3Store"},
+		{"local without a directory", Config{Kind: "local"}, ""},
+		{"s3 without a bucket", Config{Kind: "s3", S3: S3Config{Endpoint: "http://localhost:9000"}}, ""},
+		{"unknown", Config{Kind: "ftp"}, ""},
+	}
+
+	for _, e := range tests {
+		store, err := New(e.cfg)
+		if e.expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error", e.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", e.name, err)
+		} else if got := fmt.Sprintf("%T", store); got != e.expected {
+			t.Errorf("%s: expected %s, got %s", e.name, e.expected, got)
+		}
+	}
+}
+
+func TestValidKey(t *testing.T) {
+	tests := []struct {
+		key      string
+		expected bool
+	}{
+		{"face.png", true},
+		{"users/1/face_64.jpg", true},
+		{"", false},
+		{"../face.png", false},
+		{"a/../../face.png", false},
+		{"/face.png", false},
+		{"a//face.png", false},
+		{"face.png/", false},
+		{`a\face.png`, false},
+		{"face png", false},
+		{"fäce.png", false},
+		{strings.Repeat("a", 513), false},
+	}
+
+	for _, e := range tests {
+		if got := ValidKey(e.key); got != e.expected {
+			t.Errorf("ValidKey(%q): expected %v, got %v", e.key, e.expected, got)
+		}
+	}
+}
+
+func TestURLSigner(t *testing.T) {
+	signer := &URLSigner{BaseURL: "/images/", Secret: []byte("secret")}
+	now := time.Unix(1_700_000_000, 0)
+
+	signed, err := signer.Sign("a/face.png", now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/images/a/face.png" {
+		t.Errorf("unexpected signed URL %s", signed)
+	}
+
+	if err := signer.Verify("a/face.png", u.Query(), now); err != nil {
+		t.Errorf("expected the signed URL to verify, got %s", err)
+	}
+
+	tampered := u.Query()
+	tampered.Set("expires", "1800000000")
+
+	tests := []struct {
+		name  string
+		key   string
+		query url.Values
+		now   time.Time
+	}{
+		{"expired", "a/face.png", u.Query(), now.Add(2 * time.Minute)},
+		{"other key", "a/other.png", u.Query(), now},
+		{"extended expiry", "a/face.png", tampered, now},
+		{"unsigned", "a/face.png", url.Values{}, now},
+	}
+
+	for _, e := range tests {
+		if err := signer.Verify(e.key, e.query, e.now); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("%s: expected ErrInvalidSignature, got %v", e.name, err)
+		}
+	}
+
+	other := &URLSigner{BaseURL: "/images", Secret: []byte("other")}
+	if err := other.Verify("a/face.png", u.Query(), now); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected a URL signed with another secret to be refused, got %v", err)
+	}
+
+	if _, err := (&MemoryStore{}).SignedURL("face.png", time.Minute); err == nil {
+		t.Error("expected SignedURL() to fail for a store without a signer")
+	}
+	if _, err := (&MemoryStore{URLs: signer}).SignedURL("face.png", time.Minute); err != nil {
+		t.Errorf("SignedURL() returned an error: %s", err)
+	}
+}
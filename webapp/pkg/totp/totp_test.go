@@ -0,0 +1,95 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the SHA-1 test vectors from RFC 6238 appendix B, truncated to 6 digits
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	tests := []struct {
+		unix     int64
+		expected string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, e := range tests {
+		code, err := Code(rfcSecret, Step(time.Unix(e.unix, 0)))
+		if err != nil {
+			t.Fatalf("Code() returned an error: %s", err)
+		}
+
+		if code != e.expected {
+			t.Errorf("at %d: expected %s, but got %s", e.unix, e.expected, code)
+		}
+	}
+
+	if _, err := Code("not base32!", 1); err == nil {
+		t.Error("expected an error for an invalid secret")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+
+	tests := []struct {
+		name     string
+		code     string
+		skew     int
+		expected bool
+	}{
+		{"current", "050471", 0, true},
+		{"with spaces", "050 471", 0, true},
+		{"previous period within skew", "081804", 1, true},
+		{"previous period without skew", "081804", 0, false},
+		{"wrong", "123456", 1, false},
+		{"too short", "05047", 1, false},
+	}
+
+	for _, e := range tests {
+		if _, ok := Validate(rfcSecret, e.code, now, e.skew); ok != e.expected {
+			t.Errorf("%s: expected %t, but got %t", e.name, e.expected, ok)
+		}
+	}
+
+	step, _ := Validate(rfcSecret, "081804", now, 1)
+	if step != Step(now)-1 {
+		t.Errorf("expected the step of the matching code, %d, but got %d", Step(now)-1, step)
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("GenerateSecret() returned an error: %s", err)
+	}
+
+	if len(secret) != 32 {
+		t.Errorf("expected a 32 character secret, but got %q", secret)
+	}
+
+	code, _ := Code(secret, Step(time.Now()))
+	if _, ok := Validate(secret, code, time.Now(), 1); !ok {
+		t.Error("expected a code for a generated secret to validate")
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri := ProvisioningURI("Webapp", "admin@example.com", "JBSWY3DPEHPK3PXP")
+
+	for _, expected := range []string{"otpauth://totp/Webapp:admin@example.com?", "secret=JBSWY3DPEHPK3PXP", "issuer=Webapp", "digits=6", "period=30"} {
+		if !strings.Contains(uri, expected) {
+			t.Errorf("expected %s to contain %s", uri, expected)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+// Package twofactor manages optional two-factor authentication with an
+// authenticator app (TOTP). A user enrolls by scanning the provisioning URI and
+// confirming a code, and is then given single-use recovery codes for when the
+// app is lost. Only hashes of the recovery codes are stored.
+package twofactor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"github.com/spacesedan/testing-course/webapp/pkg/data"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository"
+	"github.com/spacesedan/testing-course/webapp/pkg/securetoken"
+	"github.com/spacesedan/testing-course/webapp/pkg/totp"
+	"strings"
+	"time"
+)
+
+// DefaultRecoveryCodes is how many recovery codes are issued when
+// Service.RecoveryCodes is zero.
+const DefaultRecoveryCodes = 10
+
+var (
+	// ErrInvalidCode is returned for a wrong, reused or expired code.
+	ErrInvalidCode = errors.New("the code is not valid")
+
+	// ErrAlreadyEnabled is returned when enrolling a user who already has
+	// two-factor authentication turned on.
+	ErrAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+
+	// ErrNotEnrolled is returned when confirming or checking a code for a user who
+	// has not started enrolling.
+	ErrNotEnrolled = errors.New("two-factor authentication is not set up")
+)
+
+// Service enrolls users in two-factor authentication and checks their codes.
+type Service struct {
+	DB repository.DataBaseRepo
+
+	// Issuer names the account in authenticator apps.
+	Issuer string
+
+	// Skew is how many periods a code may be early or late, to allow for clock
+	// drift; 1 is usual.
+	Skew int
+
+	// RecoveryCodes is how many recovery codes to issue; zero means
+	// DefaultRecoveryCodes.
+	RecoveryCodes int
+}
+
+// Enrollment is what a user needs to add their account to an authenticator app.
+type Enrollment struct {
+	Secret string `json:"secret"`
+
+	// URI is the otpauth:// URI, usually shown as a QR code.
+	URI string `json:"uri"`
+}
+
+// Enroll starts enrolling user with a new secret. Two-factor authentication stays
+// off until Confirm is called with a code generated from it.
+func (s *Service) Enroll(ctx context.Context, user *data.User) (Enrollment, error) {
+	if user.TOTPEnabled() {
+		return Enrollment{}, ErrAlreadyEnabled
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return Enrollment{}, err
+	}
+
+	err = s.DB.SetTOTPSecret(ctx, user.ID, secret)
+	if err != nil {
+		return Enrollment{}, err
+	}
+
+	return Enrollment{
+		Secret: secret,
+		URI:    totp.ProvisioningURI(s.Issuer, user.Email, secret),
+	}, nil
+}
+
+// Confirm turns on two-factor authentication once the user proves, with a code,
+// that their app has the secret from Enroll. It returns the recovery codes,
+// which are shown to the user once and never again.
+func (s *Service) Confirm(ctx context.Context, userID int, code string) ([]string, error) {
+	var codes []string
+
+	err := s.DB.WithTx(ctx, func(repo repository.DataBaseRepo) error {
+		user, err := repo.GetUser(ctx, userID)
+		if err != nil {
+			return err
+		}
+
+		if user.TOTPEnabled() {
+			return ErrAlreadyEnabled
+		}
+
+		if user.TOTPSecret == "" {
+			return ErrNotEnrolled
+		}
+
+		err = s.checkTOTP(ctx, repo, user, code)
+		if err != nil {
+			return err
+		}
+
+		var hashes []string
+		codes, hashes, err = s.newRecoveryCodes()
+		if err != nil {
+			return err
+		}
+
+		return repo.EnableTOTP(ctx, userID, hashes)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// Verify checks a code from the user's authenticator app, or one of their
+// recovery codes, which is then used up. An app code is only accepted once.
+func (s *Service) Verify(ctx context.Context, user *data.User, code string) error {
+	if !user.TOTPEnabled() {
+		return ErrNotEnrolled
+	}
+
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) == totp.Digits && strings.Trim(code, "0123456789") == "" {
+		return s.checkTOTP(ctx, s.DB, user, code)
+	}
+
+	err := s.DB.UseRecoveryCode(ctx, user.ID, hashRecoveryCode(code))
+	if errors.Is(err, repository.ErrNotFound) {
+		return ErrInvalidCode
+	}
+
+	return err
+}
+
+// Disable turns off two-factor authentication, once the user has given a valid
+// code.
+func (s *Service) Disable(ctx context.Context, user *data.User, code string) error {
+	err := s.Verify(ctx, user, code)
+	if err != nil {
+		return err
+	}
+
+	return s.DB.DisableTOTP(ctx, user.ID)
+}
+
+// checkTOTP validates an app code and records its time step, so it can't be used
+// again.
+func (s *Service) checkTOTP(ctx context.Context, repo repository.DataBaseRepo, user *data.User, code string) error {
+	step, ok := totp.Validate(user.TOTPSecret, code, time.Now(), s.Skew)
+	if !ok {
+		return ErrInvalidCode
+	}
+
+	err := repo.UseTOTPStep(ctx, user.ID, step)
+	if errors.Is(err, repository.ErrConflict) {
+		return ErrInvalidCode
+	}
+
+	return err
+}
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newRecoveryCodes returns new recovery codes, formatted like abcd-efgh, and
+// their hashes.
+func (s *Service) newRecoveryCodes() ([]string, []string, error) {
+	n := s.RecoveryCodes
+	if n <= 0 {
+		n = DefaultRecoveryCodes
+	}
+
+	codes := make([]string, n)
+	hashes := make([]string, n)
+
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(recoveryEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes a recovery code, ignoring case and dashes so it can be
+// typed loosely.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return securetoken.Hash(code)
+}
@@ -0,0 +1,149 @@
+package twofactor
+
+import (
+	"context"
+	"errors"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository/dbrepo"
+	"github.com/spacesedan/testing-course/webapp/pkg/repository/dbrepo/dbrepotest"
+	"github.com/spacesedan/testing-course/webapp/pkg/totp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newService(t *testing.T) (*Service, *dbrepo.MemoryDBRepo) {
+	t.Helper()
+
+	repo := dbrepotest.NewSeeded(t)
+
+	return &Service{DB: repo, Issuer: "Webapp", Skew: 1}, repo
+}
+
+// codeAt returns the app code for secret, offset periods from now.
+func codeAt(t *testing.T, secret string, offset int64) string {
+	t.Helper()
+
+	code, err := totp.Code(secret, totp.Step(time.Now())+offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return code
+}
+
+// enroll enrolls the admin user and returns their secret and recovery codes.
+func enroll(t *testing.T, s *Service, repo *dbrepo.MemoryDBRepo) (string, []string) {
+	t.Helper()
+	ctx := context.Background()
+
+	user, _ := repo.GetUser(ctx, 1)
+	enrollment, err := s.Enroll(ctx, user)
+	if err != nil {
+		t.Fatalf("Enroll() returned an error: %s", err)
+	}
+
+	codes, err := s.Confirm(ctx, 1, codeAt(t, enrollment.Secret, -1))
+	if err != nil {
+		t.Fatalf("Confirm() returned an error: %s", err)
+	}
+
+	return enrollment.Secret, codes
+}
+
+func TestService_Enroll(t *testing.T) {
+	ctx := context.Background()
+	s, repo := newService(t)
+
+	if _, err := s.Confirm(ctx, 1, "123456"); !errors.Is(err, ErrNotEnrolled) {
+		t.Errorf("expected ErrNotEnrolled before enrolling, got %v", err)
+	}
+
+	user, _ := repo.GetUser(ctx, 1)
+	enrollment, err := s.Enroll(ctx, user)
+	if err != nil {
+		t.Fatalf("Enroll() returned an error: %s", err)
+	}
+
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/Webapp:admin@example.com?") || !strings.Contains(enrollment.URI, enrollment.Secret) {
+		t.Errorf("unexpected provisioning URI %s", enrollment.URI)
+	}
+
+	user, _ = repo.GetUser(ctx, 1)
+	if user.TOTPEnabled() {
+		t.Error("two-factor authentication should stay off until confirmed")
+	}
+
+	if _, err := s.Confirm(ctx, 1, "000000"); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("expected ErrInvalidCode for a wrong code, got %v", err)
+	}
+
+	codes, err := s.Confirm(ctx, 1, codeAt(t, enrollment.Secret, 0))
+	if err != nil {
+		t.Fatalf("Confirm() returned an error: %s", err)
+	}
+
+	if len(codes) != DefaultRecoveryCodes || len(codes[0]) != 9 {
+		t.Errorf("expected %d recovery codes like abcd-efgh, but got %v", DefaultRecoveryCodes, codes)
+	}
+
+	user, _ = repo.GetUser(ctx, 1)
+	if !user.TOTPEnabled() {
+		t.Error("expected two-factor authentication to be enabled")
+	}
+
+	if _, err := s.Enroll(ctx, user); !errors.Is(err, ErrAlreadyEnabled) {
+		t.Errorf("expected ErrAlreadyEnabled when enrolling again, got %v", err)
+	}
+}
+
+func TestService_Verify(t *testing.T) {
+	ctx := context.Background()
+	s, repo := newService(t)
+	secret, recovery := enroll(t, s, repo)
+	user, _ := repo.GetUser(ctx, 1)
+
+	tests := []struct {
+		name        string
+		code        string
+		expectedErr error
+	}{
+		{"current code", codeAt(t, secret, 0), nil},
+		{"replayed code", codeAt(t, secret, 0), ErrInvalidCode},
+		{"earlier code", codeAt(t, secret, -1), ErrInvalidCode},
+		{"wrong code", "000000", ErrInvalidCode},
+		{"recovery code", strings.ToUpper(recovery[0]), nil},
+		{"recovery code without dash", strings.ReplaceAll(recovery[1], "-", ""), nil},
+		{"used recovery code", recovery[0], ErrInvalidCode},
+		{"made up recovery code", "abcd-efgh", ErrInvalidCode},
+	}
+
+	for _, e := range tests {
+		if err := s.Verify(ctx, user, e.code); !errors.Is(err, e.expectedErr) {
+			t.Errorf("%s: expected %v, but got %v", e.name, e.expectedErr, err)
+		}
+	}
+}
+
+func TestService_Disable(t *testing.T) {
+	ctx := context.Background()
+	s, repo := newService(t)
+	_, recovery := enroll(t, s, repo)
+	user, _ := repo.GetUser(ctx, 1)
+
+	if err := s.Disable(ctx, user, "000000"); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("expected ErrInvalidCode, got %v", err)
+	}
+
+	if err := s.Disable(ctx, user, recovery[0]); err != nil {
+		t.Fatalf("Disable() returned an error: %s", err)
+	}
+
+	user, _ = repo.GetUser(ctx, 1)
+	if user.TOTPEnabled() || user.TOTPSecret != "" {
+		t.Error("expected two-factor authentication to be turned off")
+	}
+
+	if err := s.Verify(ctx, user, recovery[1]); !errors.Is(err, ErrNotEnrolled) {
+		t.Errorf("expected ErrNotEnrolled after disabling, got %v", err)
+	}
+}
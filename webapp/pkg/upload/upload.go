@@ -0,0 +1,250 @@
+// Package upload stores images uploaded by users. Whatever the client says about
+// a file is ignored: each file is stored under a new random key, with the
+// extension of the image type its contents turn out to be, and anything that
+// isn't a JPEG, PNG, GIF or WebP image is refused.
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/spacesedan/testing-course/webapp/pkg/storage"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// The limits used when Limits leaves them zero.
+const (
+	DefaultMaxFileSize  = 5 << 20
+	DefaultMaxTotalSize = 10 << 20
+)
+
+// formOverhead is how much larger than its files a multipart form may be, for
+// the headers and boundaries around them.
+const formOverhead = 64 << 10
+
+// sniffLength is how much of a file http.DetectContentType looks at.
+const sniffLength = 512
+
+// Types maps the content types that may be uploaded to the extension files of
+// that type are stored with.
+var Types = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+var (
+	// ErrNoFile is returned by SaveForm for a form without files.
+	ErrNoFile = errors.New("no file was uploaded")
+
+	// ErrEmpty is returned for an empty file.
+	ErrEmpty = errors.New("the uploaded file is empty")
+
+	// ErrNotImage is returned for a file that isn't one of Types.
+	ErrNotImage = errors.New("the uploaded file is not a JPEG, PNG, GIF or WebP image")
+
+	// ErrFileTooLarge is returned for a file larger than Limits.MaxFileSize.
+	ErrFileTooLarge = errors.New("the uploaded file is too large")
+
+	// ErrTooLarge is returned by SaveForm when the files together are larger
+	// than Limits.MaxTotalSize.
+	ErrTooLarge = errors.New("the upload is too large")
+)
+
+// Limits are how large uploads may be, in bytes.
+type Limits struct {
+	// MaxFileSize is the largest a single file may be; zero means
+	// DefaultMaxFileSize.
+	MaxFileSize int64
+
+	// MaxTotalSize is the largest all the files of a form may be together; zero
+	// means DefaultMaxTotalSize.
+	MaxTotalSize int64
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxFileSize <= 0 {
+		l.MaxFileSize = DefaultMaxFileSize
+	}
+	if l.MaxTotalSize <= 0 {
+		l.MaxTotalSize = DefaultMaxTotalSize
+	}
+	return l
+}
+
+// File is an uploaded file that was stored.
+type File struct {
+	// Key is the key the file is stored under.
+	Key string
+
+	// OriginalName is the base name the client gave the file, for display only;
+	// it is empty for files that weren't uploaded with a name.
+	OriginalName string
+
+	ContentType string
+	Size        int64
+}
+
+// Save stores the image read from src in store, under a new key. It returns
+// ErrEmpty, ErrNotImage or ErrFileTooLarge if src isn't an image of at most
+// maxSize bytes, or zero for DefaultMaxFileSize; nothing is stored then.
+func Save(ctx context.Context, store storage.BlobStore, src io.Reader, maxSize int64) (*File, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxFileSize
+	}
+
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	if n == 0 {
+		return nil, ErrEmpty
+	}
+
+	contentType := http.DetectContentType(head)
+	ext, ok := Types[contentType]
+	if !ok {
+		return nil, ErrNotImage
+	}
+
+	// read one byte more than allowed, to tell a file of exactly maxSize bytes
+	// from a larger one
+	var contents bytes.Buffer
+	contents.Write(head)
+	_, err = contents.ReadFrom(io.LimitReader(src, maxSize-int64(n)+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(contents.Len()) > maxSize {
+		return nil, fmt.Errorf("%w: files may be at most %s", ErrFileTooLarge, FormatSize(maxSize))
+	}
+
+	key, err := NewKey(ext)
+	if err != nil {
+		return nil, err
+	}
+
+	size := int64(contents.Len())
+	err = store.Put(ctx, key, &contents, contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{Key: key, ContentType: contentType, Size: size}, nil
+}
+
+// SaveForm stores every file of the multipart form of r in store, as Save does.
+// If any file is refused, or they are too large together, none are kept.
+func SaveForm(r *http.Request, store storage.BlobStore, limits Limits) ([]*File, error) {
+	limits = limits.withDefaults()
+	tooLarge := fmt.Errorf("%w: files may be at most %s together", ErrTooLarge, FormatSize(limits.MaxTotalSize))
+
+	maxBody := limits.MaxTotalSize + formOverhead
+	if r.ContentLength > maxBody {
+		return nil, tooLarge
+	}
+	r.Body = http.MaxBytesReader(nil, r.Body, maxBody)
+
+	err := r.ParseMultipartForm(limits.MaxFileSize)
+	if err != nil {
+		return nil, fmt.Errorf("reading the upload: %w", err)
+	}
+
+	// store the files in the order of their fields, not of the map
+	fields := make([]string, 0, len(r.MultipartForm.File))
+	for field := range r.MultipartForm.File {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	var files []*File
+	var total int64
+	for _, field := range fields {
+		for _, hdr := range r.MultipartForm.File[field] {
+			if hdr.Size > limits.MaxFileSize {
+				err = fmt.Errorf("%w: files may be at most %s", ErrFileTooLarge, FormatSize(limits.MaxFileSize))
+			} else if total += hdr.Size; total > limits.MaxTotalSize {
+				err = tooLarge
+			}
+
+			var file *File
+			if err == nil {
+				file, err = saveFormFile(r.Context(), store, hdr, limits.MaxFileSize)
+			}
+			if err != nil {
+				Remove(r.Context(), store, files)
+				return nil, err
+			}
+
+			file.OriginalName = baseName(hdr.Filename)
+			files = append(files, file)
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, ErrNoFile
+	}
+
+	return files, nil
+}
+
+func saveFormFile(ctx context.Context, store storage.BlobStore, hdr *multipart.FileHeader, maxSize int64) (*File, error) {
+	in, err := hdr.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	return Save(ctx, store, in, maxSize)
+}
+
+// Remove deletes files that were stored in store.
+func Remove(ctx context.Context, store storage.BlobStore, files []*File) {
+	for _, f := range files {
+		_ = store.Delete(ctx, f.Key)
+	}
+}
+
+// NewKey returns a new random name to store a file with extension ext under.
+func NewKey(ext string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b) + ext, nil
+}
+
+// FormatSize returns n bytes in the largest whole unit, like "5 MB", or in bytes
+// if there is none.
+func FormatSize(n int64) string {
+	switch {
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return fmt.Sprintf("%d MB", n>>20)
+	case n >= 1<<10 && n%(1<<10) == 0:
+		return fmt.Sprintf("%d KB", n>>10)
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+// baseName returns the last element of a client's file name, which may be a path
+// with either kind of separator.
+func baseName(name string) string {
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	if name == "." || name == "/" {
+		return ""
+	}
+	return name
+}
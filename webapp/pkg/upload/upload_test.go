@@ -0,0 +1,111 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/spacesedan/testing-course/webapp/pkg/storage"
+	"image"
+	"image/png"
+	"io"
+	"path"
+	"testing"
+)
+
+func pngImage(t *testing.T) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestSave(t *testing.T) {
+	store := &storage.MemoryStore{}
+	ctx := context.Background()
+	picture := pngImage(t)
+
+	file, err := Save(ctx, store, bytes.NewReader(picture), int64(len(picture)))
+	if err != nil {
+		t.Fatalf("Save() of an image of exactly the limit returned an error: %s", err)
+	}
+
+	if file.ContentType != "image/png" || path.Ext(file.Key) != ".png" || file.Size != int64(len(picture)) {
+		t.Errorf("unexpected file %+v", file)
+	}
+
+	blob, err := store.Get(ctx, file.Key)
+	if err != nil {
+		t.Fatalf("expected the image to be stored as %s, got %v", file.Key, err)
+	}
+	stored, _ := io.ReadAll(blob.Body)
+	if !bytes.Equal(stored, picture) || blob.ContentType != "image/png" {
+		t.Errorf("unexpected blob %+v", blob.Info)
+	}
+
+	again, _ := Save(ctx, store, bytes.NewReader(picture), 0)
+	if again == nil || again.Key == file.Key {
+		t.Errorf("expected every upload to get a new key, got %+v", again)
+	}
+
+	tests := []struct {
+		name     string
+		contents []byte
+		maxSize  int64
+		expected error
+	}{
+		{"empty", nil, 0, ErrEmpty},
+		{"html", []byte("<html><script>alert(1)</script></html>"), 0, ErrNotImage},
+		{"svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`), 0, ErrNotImage},
+		{"one byte over", picture, int64(len(picture) - 1), ErrFileTooLarge},
+	}
+
+	for _, e := range tests {
+		store := &storage.MemoryStore{}
+		if _, err := Save(ctx, store, bytes.NewReader(e.contents), e.maxSize); !errors.Is(err, e.expected) {
+			t.Errorf("%s: expected %v, but got %v", e.name, e.expected, err)
+		}
+
+		if infos, _ := store.List(ctx, ""); len(infos) != 0 {
+			t.Errorf("%s: expected nothing to be left behind, but found %d blobs", e.name, len(infos))
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		n        int64
+		expected string
+	}{
+		{5 << 20, "5 MB"},
+		{512 << 10, "512 KB"},
+		{1000, "1000 bytes"},
+	}
+
+	for _, e := range tests {
+		if s := FormatSize(e.n); s != e.expected {
+			t.Errorf("FormatSize(%d): expected %q, but got %q", e.n, e.expected, s)
+		}
+	}
+}
+
+func TestBaseName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"me.jpg", "me.jpg"},
+		{"../../etc/passwd", "passwd"},
+		{`C:\Users\jack\me.jpg`, "me.jpg"},
+		{"", ""},
+		{"/", ""},
+	}
+
+	for _, e := range tests {
+		if base := baseName(e.name); base != e.expected {
+			t.Errorf("baseName(%q): expected %q, but got %q", e.name, e.expected, base)
+		}
+	}
+}
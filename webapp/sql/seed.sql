@@ -0,0 +1,11 @@
+--
+-- Development data. Apply the migrations first, then load this with:
+--
+--   go run ./cmd/migrate seed
+--
+-- The admin user's password is "secret".
+--
+
+INSERT INTO users (first_name, last_name, email, password, is_admin, created_at, updated_at, email_verified_at)
+VALUES ('Admin', 'User', 'admin@example.com', '$2a$14$ajq8Q7fbtFRQvXpdCq7Jcuy.Rx1h/L4J60Otx.gyNLbAYctGMJ9tK', 1, '2022-08-19 00:00:00', '2022-08-19 00:00:00', '2022-08-19 00:00:00')
+ON CONFLICT DO NOTHING;